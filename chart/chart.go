@@ -0,0 +1,175 @@
+package chart
+
+import (
+	"atc/models"
+	"image/color"
+	"math"
+	"strconv"
+)
+
+// package chart draws the performance management chart: daily TSS as bars against the right
+// axis, and CTL, ATL and TSB as lines against the left. it's drawn in go, so the page doesn't
+// need a javascript charting library. the layout is worked out once and drawn on a canvas,
+// which is either svg (for the page) or png (for downloading).
+
+// the size of the chart, in pixels
+const (
+	Width  = 800
+	Height = 360
+
+	marginLeft   = 48
+	marginRight  = 48
+	marginTop    = 36
+	marginBottom = 32
+
+	// at most this many dates along the bottom
+	maxDateLabels = 8
+)
+
+var (
+	colorBackground = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	colorAxis       = color.RGBA{0x44, 0x44, 0x44, 0xff}
+	colorGrid       = color.RGBA{0xe4, 0xe4, 0xe4, 0xff}
+	colorTSS        = color.RGBA{0xc8, 0xc8, 0xc8, 0xff}
+	colorCTL        = color.RGBA{0x1f, 0x77, 0xb4, 0xff} // fitness
+	colorATL        = color.RGBA{0xd6, 0x27, 0x28, 0xff} // fatigue
+	colorTSB        = color.RGBA{0xf2, 0xa9, 0x00, 0xff} // form
+)
+
+// anchor is which end of a piece of text its x is.
+type anchor int
+
+const (
+	anchorStart anchor = iota
+	anchorMiddle
+	anchorEnd
+)
+
+// point is a position on the canvas, in pixels from the top left.
+type point struct {
+	X, Y float64
+}
+
+// canvas is something the chart can be drawn on. Text is positioned by its baseline.
+type canvas interface {
+	Rect(x, y, w, h float64, c color.RGBA)
+	Line(points []point, c color.RGBA, width float64)
+	Text(x, y float64, s string, c color.RGBA, a anchor)
+}
+
+// plot lays the chart out on c.
+func plot(c canvas, title string, pmc models.PMC) {
+	left, right := float64(marginLeft), float64(Width-marginRight)
+	top, bottom := float64(marginTop), float64(Height-marginBottom)
+
+	c.Rect(0, 0, Width, Height, colorBackground)
+	c.Text(left, 20, title, colorAxis, anchorStart)
+
+	legend := []struct {
+		name  string
+		color color.RGBA
+	}{{"TSS", colorTSS}, {"CTL", colorCTL}, {"ATL", colorATL}, {"TSB", colorTSB}}
+	for i, l := range legend {
+		x := right - float64(len(legend)-i)*56
+		c.Rect(x, 11, 10, 10, l.color)
+		c.Text(x+14, 20, l.name, colorAxis, anchorStart)
+	}
+
+	// load and form share the left axis (form goes negative), tss has the right one to itself
+	lo, hi, maxTSS := 0.0, 1.0, 1.0
+	for _, day := range pmc {
+		lo = math.Min(lo, math.Min(day.TSB, math.Min(day.CTL, day.ATL)))
+		hi = math.Max(hi, math.Max(day.TSB, math.Max(day.CTL, day.ATL)))
+		maxTSS = math.Max(maxTSS, float64(day.TSS))
+	}
+	loadTicks := ticks(lo, hi)
+	lo, hi = loadTicks[0], loadTicks[len(loadTicks)-1]
+	tssTicks := ticks(0, maxTSS)
+	maxTSS = tssTicks[len(tssTicks)-1]
+
+	loadY := func(v float64) float64 { return bottom - (v-lo)/(hi-lo)*(bottom-top) }
+	tssY := func(v float64) float64 { return bottom - v/maxTSS*(bottom-top) }
+
+	for _, v := range loadTicks {
+		y := loadY(v)
+		c.Line([]point{{left, y}, {right, y}}, colorGrid, 1)
+		c.Text(left-6, y+4, formatTick(v), colorAxis, anchorEnd)
+	}
+	for _, v := range tssTicks {
+		c.Text(right+6, tssY(v)+4, formatTick(v), colorAxis, anchorStart)
+	}
+
+	if len(pmc) > 0 {
+		slot := (right - left) / float64(len(pmc))
+		dayX := func(i int) float64 { return left + (float64(i)+0.5)*slot }
+		barWidth := math.Max(1, slot*0.7)
+
+		for i, day := range pmc {
+			if day.TSS > 0 {
+				y := tssY(float64(day.TSS))
+				c.Rect(dayX(i)-barWidth/2, y, barWidth, bottom-y, colorTSS)
+			}
+		}
+
+		if lo < 0 {
+			c.Line([]point{{left, loadY(0)}, {right, loadY(0)}}, colorAxis, 1)
+		}
+
+		lines := []struct {
+			value func(d models.PMCDay) float64
+			color color.RGBA
+		}{
+			{func(d models.PMCDay) float64 { return d.TSB }, colorTSB},
+			{func(d models.PMCDay) float64 { return d.ATL }, colorATL},
+			{func(d models.PMCDay) float64 { return d.CTL }, colorCTL},
+		}
+		for _, l := range lines {
+			points := make([]point, len(pmc))
+			for i, day := range pmc {
+				points[i] = point{dayX(i), loadY(l.value(day))}
+			}
+			c.Line(points, l.color, 2)
+		}
+
+		every := (len(pmc) + maxDateLabels - 1) / maxDateLabels
+		for i := 0; i < len(pmc); i += every {
+			c.Text(dayX(i), bottom+16, pmc[i].Date.Format("01-02"), colorAxis, anchorMiddle)
+		}
+	}
+
+	c.Line([]point{{left, top}, {left, bottom}, {right, bottom}, {right, top}}, colorAxis, 1)
+}
+
+// ticks returns round numbers from at or below lo to at or above hi, about six of them.
+func ticks(lo, hi float64) []float64 {
+	// nobody's load is fractional enough to need ticks in between
+	step := math.Max(1, niceStep((hi-lo)/5))
+
+	var values []float64
+	for v := math.Floor(lo/step) * step; ; v += step {
+		values = append(values, v)
+		if v >= hi {
+			break
+		}
+	}
+	return values
+}
+
+// niceStep rounds a step up to 1, 2 or 5 times a power of ten.
+func niceStep(raw float64) float64 {
+	if raw <= 0 {
+		return 1
+	}
+	magnitude := math.Pow(10, math.Floor(math.Log10(raw)))
+	for _, m := range []float64{1, 2, 5, 10} {
+		if raw <= m*magnitude {
+			return m * magnitude
+		}
+	}
+	return 10 * magnitude
+}
+
+// formatTick prints an axis value, which is always a round number.
+func formatTick(v float64) string {
+	return strconv.FormatFloat(math.Round(v), 'f', -1, 64)
+}
@@ -0,0 +1,78 @@
+package chart_test
+
+import (
+	"atc/chart"
+	"atc/models"
+	"bytes"
+	"encoding/xml"
+	"image/png"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testPMC is a fortnight of training with a big day in the middle
+func testPMC() models.PMC {
+	start := time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)
+	var activities []models.Activity
+	for i := 0; i < 14; i++ {
+		tss := 60
+		if i == 7 {
+			tss = 250
+		}
+		activities = append(activities, models.Activity{StartDate: start.AddDate(0, 0, i).Add(7 * time.Hour), TSS: tss})
+	}
+	return models.NewPMC(activities, start, start.AddDate(0, 0, 20), time.UTC)
+}
+
+func TestWriteSVG(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, chart.WriteSVG(&buf, "Bike <& Run>", testPMC()))
+
+	svg := buf.String()
+	assert.True(t, strings.HasPrefix(svg, `<svg xmlns="http://www.w3.org/2000/svg"`))
+	assert.Contains(t, svg, "<title>Bike &lt;&amp; Run&gt;</title>")
+
+	// a line each for ctl, atl and tsb (plus the grid and the frame), and a bar for each day
+	// with any tss
+	assert.Contains(t, svg, `stroke="#1f77b4"`)
+	assert.Contains(t, svg, `stroke="#d62728"`)
+	assert.Contains(t, svg, `stroke="#f2a900"`)
+	assert.Equal(t, 14, strings.Count(svg, `fill="#c8c8c8"`)-1) // minus the legend
+	assert.Contains(t, svg, ">08-01</text>")
+	assert.Contains(t, svg, ">250</text>")
+
+	// and it's well formed
+	decoder := xml.NewDecoder(&buf)
+	for {
+		if _, err := decoder.Token(); err != nil {
+			assert.Equal(t, "EOF", err.Error())
+			break
+		}
+	}
+}
+
+func TestWritePNG(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, chart.WritePNG(&buf, "Combined", testPMC()))
+
+	img, err := png.Decode(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, chart.Width, img.Bounds().Dx())
+	assert.Equal(t, chart.Height, img.Bounds().Dy())
+
+	// somewhere in there is the ctl line
+	found := false
+	for x := 0; x < chart.Width && !found; x++ {
+		for y := 0; y < chart.Height && !found; y++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			found = r>>8 == 0x1f && g>>8 == 0x77 && b>>8 == 0xb4
+		}
+	}
+	assert.True(t, found)
+
+	// nothing to chart is an empty chart, not an error
+	assert.NoError(t, chart.WritePNG(&buf, "Swim", nil))
+}
@@ -0,0 +1,127 @@
+package chart
+
+import (
+	"atc/models"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"strings"
+)
+
+// there are no fonts in the standard library, so the png has its own: 3x5 pixel capitals and
+// digits, drawn at twice the size. it's enough for labels and dates.
+
+const (
+	glyphWidth   = 3
+	glyphHeight  = 5
+	glyphScale   = 2
+	glyphAdvance = (glyphWidth + 1) * glyphScale
+)
+
+// glyphs are drawn top to bottom, '#' for on
+var glyphs = map[rune][glyphHeight]string{
+	'0': {"###", "#.#", "#.#", "#.#", "###"},
+	'1': {".#.", "##.", ".#.", ".#.", "###"},
+	'2': {"###", "..#", "###", "#..", "###"},
+	'3': {"###", "..#", ".##", "..#", "###"},
+	'4': {"#.#", "#.#", "###", "..#", "..#"},
+	'5': {"###", "#..", "###", "..#", "###"},
+	'6': {"###", "#..", "###", "#.#", "###"},
+	'7': {"###", "..#", ".#.", ".#.", ".#."},
+	'8': {"###", "#.#", "###", "#.#", "###"},
+	'9': {"###", "#.#", "###", "..#", "###"},
+	'-': {"...", "...", "###", "...", "..."},
+	'.': {"...", "...", "...", "...", ".#."},
+	'+': {"...", ".#.", "###", ".#.", "..."},
+	'A': {".#.", "#.#", "###", "#.#", "#.#"},
+	'B': {"##.", "#.#", "##.", "#.#", "##."},
+	'C': {".##", "#..", "#..", "#..", ".##"},
+	'D': {"##.", "#.#", "#.#", "#.#", "##."},
+	'E': {"###", "#..", "##.", "#..", "###"},
+	'F': {"###", "#..", "##.", "#..", "#.."},
+	'G': {".##", "#..", "#.#", "#.#", ".##"},
+	'H': {"#.#", "#.#", "###", "#.#", "#.#"},
+	'I': {"###", ".#.", ".#.", ".#.", "###"},
+	'J': {"..#", "..#", "..#", "#.#", ".#."},
+	'K': {"#.#", "#.#", "##.", "#.#", "#.#"},
+	'L': {"#..", "#..", "#..", "#..", "###"},
+	'M': {"#.#", "###", "###", "#.#", "#.#"},
+	'N': {"##.", "#.#", "#.#", "#.#", "#.#"},
+	'O': {".#.", "#.#", "#.#", "#.#", ".#."},
+	'P': {"##.", "#.#", "##.", "#..", "#.."},
+	'Q': {".#.", "#.#", "#.#", "##.", ".##"},
+	'R': {"##.", "#.#", "##.", "#.#", "#.#"},
+	'S': {".##", "#..", ".#.", "..#", "##."},
+	'T': {"###", ".#.", ".#.", ".#.", ".#."},
+	'U': {"#.#", "#.#", "#.#", "#.#", "###"},
+	'V': {"#.#", "#.#", "#.#", "#.#", ".#."},
+	'W': {"#.#", "#.#", "###", "###", "#.#"},
+	'X': {"#.#", "#.#", ".#.", "#.#", "#.#"},
+	'Y': {"#.#", "#.#", ".#.", ".#.", ".#."},
+	'Z': {"###", "..#", ".#.", "#..", "###"},
+}
+
+// pngCanvas draws the chart on an image.
+type pngCanvas struct {
+	img *image.RGBA
+}
+
+func (p *pngCanvas) Rect(x, y, w, h float64, c color.RGBA) {
+	r := image.Rect(int(math.Round(x)), int(math.Round(y)), int(math.Round(x+w)), int(math.Round(y+h)))
+	draw.Draw(p.img, r, &image.Uniform{c}, image.Point{}, draw.Src)
+}
+
+// Line steps along each segment a pixel at a time, drawing a square of the line's width.
+func (p *pngCanvas) Line(points []point, c color.RGBA, width float64) {
+	for i := 1; i < len(points); i++ {
+		from, to := points[i-1], points[i]
+		steps := math.Max(math.Abs(to.X-from.X), math.Abs(to.Y-from.Y))
+		for s := 0.0; s <= steps; s++ {
+			t := 0.0
+			if steps > 0 {
+				t = s / steps
+			}
+			x := from.X + (to.X-from.X)*t
+			y := from.Y + (to.Y-from.Y)*t
+			p.Rect(x-width/2, y-width/2, width, width, c)
+		}
+	}
+}
+
+func (p *pngCanvas) Text(x, y float64, text string, c color.RGBA, a anchor) {
+	text = strings.ToUpper(text)
+
+	width := float64(len([]rune(text))*glyphAdvance - glyphScale)
+	switch a {
+	case anchorMiddle:
+		x -= width / 2
+	case anchorEnd:
+		x -= width
+	}
+	top := y - glyphHeight*glyphScale
+
+	for i, r := range []rune(text) {
+		glyph, ok := glyphs[r]
+		if !ok {
+			continue
+		}
+		left := x + float64(i*glyphAdvance)
+		for row, line := range glyph {
+			for col, on := range line {
+				if on == '#' {
+					p.Rect(left+float64(col*glyphScale), top+float64(row*glyphScale), glyphScale, glyphScale, c)
+				}
+			}
+		}
+	}
+}
+
+// WritePNG draws the chart for pmc as a png image.
+func WritePNG(w io.Writer, title string, pmc models.PMC) error {
+	c := pngCanvas{img: image.NewRGBA(image.Rect(0, 0, Width, Height))}
+	plot(&c, title, pmc)
+	return png.Encode(w, c.img)
+}
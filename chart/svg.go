@@ -0,0 +1,48 @@
+package chart
+
+import (
+	"atc/models"
+	"bytes"
+	"fmt"
+	"html"
+	"image/color"
+	"io"
+	"strings"
+)
+
+// svgCanvas draws the chart as svg elements.
+type svgCanvas struct {
+	buf bytes.Buffer
+}
+
+func (s *svgCanvas) Rect(x, y, w, h float64, c color.RGBA) {
+	fmt.Fprintf(&s.buf, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"/>`, x, y, w, h, hex(c))
+}
+
+func (s *svgCanvas) Line(points []point, c color.RGBA, width float64) {
+	coords := make([]string, len(points))
+	for i, p := range points {
+		coords[i] = fmt.Sprintf("%.1f,%.1f", p.X, p.Y)
+	}
+	fmt.Fprintf(&s.buf, `<polyline points="%s" fill="none" stroke="%s" stroke-width="%.0f" stroke-linejoin="round"/>`, strings.Join(coords, " "), hex(c), width)
+}
+
+func (s *svgCanvas) Text(x, y float64, text string, c color.RGBA, a anchor) {
+	anchors := map[anchor]string{anchorStart: "start", anchorMiddle: "middle", anchorEnd: "end"}
+	fmt.Fprintf(&s.buf, `<text x="%.1f" y="%.1f" fill="%s" font-family="sans-serif" font-size="11" text-anchor="%s">%s</text>`, x, y, hex(c), anchors[a], html.EscapeString(text))
+}
+
+// WriteSVG draws the chart for pmc as an svg document, which can also go straight into a page.
+func WriteSVG(w io.Writer, title string, pmc models.PMC) error {
+	var c svgCanvas
+	plot(&c, title, pmc)
+
+	_, err := fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" role="img"><title>%s</title>%s</svg>`,
+		Width, Height, Width, Height, html.EscapeString(title), c.buf.String())
+	return err
+}
+
+// hex is a color the way svg wants it.
+func hex(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
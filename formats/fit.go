@@ -0,0 +1,513 @@
+package formats
+
+import (
+	"atc/models"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// FIT is garmin's binary activity format (everybody else's devices write it too). a file is a
+// header, a stream of records, and a crc. records are either definitions, which say what the
+// fields of a message are and how big, or data, which is a message laid out the way the last
+// definition for its local type said. we only decode the handful of messages and fields we
+// need; everything else is skipped over using its definition.
+//
+// the spec is in the FIT SDK: https://developer.garmin.com/fit/protocol/
+
+// ErrNotFIT is returned for files that aren't FIT files, or are damaged.
+var ErrNotFIT = errors.New("not a FIT file")
+
+// fitEpoch is the FIT epoch (1989-12-31 00:00:00 UTC) in unix seconds.
+const fitEpoch = 631065600
+
+// global message numbers
+const (
+	fitMesgSession = 18
+	fitMesgLap     = 19
+	fitMesgRecord  = 20
+)
+
+// field numbers. session and lap share the first few.
+const (
+	fitFieldTimestamp = 253
+
+	fitSessionStartTime        = 2
+	fitSessionSport            = 5
+	fitSessionSubSport         = 6
+	fitSessionTotalElapsedTime = 7
+	fitSessionTotalTimerTime   = 8
+	fitSessionTotalDistance    = 9
+	fitSessionTotalCalories    = 11
+	fitSessionAvgHeartRate     = 16
+	fitSessionMaxHeartRate     = 17
+	fitSessionTotalAscent      = 22
+	fitSessionNormalizedPower  = 34
+
+	fitLapStartTime        = 2
+	fitLapTotalElapsedTime = 7
+	fitLapTotalTimerTime   = 8
+	fitLapTotalDistance    = 9
+	fitLapAvgHeartRate     = 15
+	fitLapAvgPower         = 19
+
+	fitRecordPositionLat      = 0
+	fitRecordPositionLong     = 1
+	fitRecordAltitude         = 2
+	fitRecordHeartRate        = 3
+	fitRecordCadence          = 4
+	fitRecordDistance         = 5
+	fitRecordSpeed            = 6
+	fitRecordPower            = 7
+	fitRecordEnhancedSpeed    = 73
+	fitRecordEnhancedAltitude = 78
+)
+
+// fitSports maps FIT's sport enum onto our activity types
+var fitSports = map[int64]string{
+	1: "Run",
+	2: "Ride",
+	5: "Swim",
+}
+
+// fitIndoorSubSports are the sub sports that mean nobody went anywhere: treadmill, indoor
+// cycling, and virtual activity (zwift and friends)
+var fitIndoorSubSports = map[int64]bool{
+	1:  true,
+	6:  true,
+	58: true,
+}
+
+// fitBaseTypes gives the size in bytes of each base type, by base type number (the low five
+// bits of the base type byte), and the value that means "no value" for the integer ones.
+var fitBaseTypes = map[byte]struct {
+	size    int
+	signed  bool
+	invalid uint64
+}{
+	0x00: {1, false, 0xFF},       // enum
+	0x01: {1, true, 0x7F},        // sint8
+	0x02: {1, false, 0xFF},       // uint8
+	0x03: {2, true, 0x7FFF},      // sint16
+	0x04: {2, false, 0xFFFF},     // uint16
+	0x05: {4, true, 0x7FFFFFFF},  // sint32
+	0x06: {4, false, 0xFFFFFFFF}, // uint32
+	0x0A: {1, false, 0x00},       // uint8z
+	0x0B: {2, false, 0x0000},     // uint16z
+	0x0C: {4, false, 0x00000000}, // uint32z
+	0x0D: {1, false, 0xFF},       // byte
+}
+
+type fitFieldDef struct {
+	num      byte
+	size     int
+	baseType byte
+}
+
+type fitDefinition struct {
+	global    uint16
+	bigEndian bool
+	fields    []fitFieldDef
+	devSize   int // developer fields, which we skip
+}
+
+// fitMessage is a decoded data message. only valid integer fields are in values.
+type fitMessage struct {
+	global uint16
+	values map[byte]int64
+}
+
+func (m fitMessage) get(field byte) (int64, bool) {
+	v, ok := m.values[field]
+	return v, ok
+}
+
+// scaled returns the field divided by its scale and less its offset, the way the FIT profile
+// stores fractional values.
+func (m fitMessage) scaled(field byte, scale float64, offset float64) (float64, bool) {
+	v, ok := m.values[field]
+	if !ok {
+		return 0, false
+	}
+	return float64(v)/scale - offset, true
+}
+
+func (m fitMessage) time(field byte) (time.Time, bool) {
+	v, ok := m.values[field]
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(v+fitEpoch, 0).UTC(), true
+}
+
+// ParseFIT reads a FIT activity file. A multisport file (a triathlon, say) has a session per
+// sport, and each one becomes an activity.
+func ParseFIT(r io.Reader) ([]models.StravaActivity, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < 12 {
+		return nil, ErrNotFIT
+	}
+	headerSize := int(data[0])
+	if headerSize < 12 || len(data) < headerSize || string(data[8:12]) != ".FIT" {
+		return nil, ErrNotFIT
+	}
+
+	end := headerSize + int(binary.LittleEndian.Uint32(data[4:8]))
+	if end+2 > len(data) {
+		return nil, fmt.Errorf("%w: truncated", ErrNotFIT)
+	}
+	if fitCRC(data[:end]) != binary.LittleEndian.Uint16(data[end:end+2]) {
+		return nil, fmt.Errorf("%w: bad crc", ErrNotFIT)
+	}
+
+	messages, err := decodeFITRecords(data[headerSize:end])
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions, laps, records []fitMessage
+	for _, m := range messages {
+		switch m.global {
+		case fitMesgSession:
+			sessions = append(sessions, m)
+		case fitMesgLap:
+			laps = append(laps, m)
+		case fitMesgRecord:
+			records = append(records, m)
+		}
+	}
+
+	if len(sessions) == 0 {
+		return nil, fmt.Errorf("%w: no sessions", ErrNotFIT)
+	}
+
+	var activities []models.StravaActivity
+	for _, session := range sessions {
+		activity, err := fitActivity(session, laps, records)
+		if errors.Is(err, ErrUnsupportedSport) && len(sessions) > 1 {
+			// transitions, mostly
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		activities = append(activities, activity)
+	}
+
+	return activities, nil
+}
+
+// decodeFITRecords decodes the records between the header and the crc.
+func decodeFITRecords(data []byte) ([]fitMessage, error) {
+	var (
+		definitions   [16]*fitDefinition
+		messages      []fitMessage
+		lastTimestamp int64
+	)
+
+	truncated := fmt.Errorf("%w: truncated record", ErrNotFIT)
+
+	for pos := 0; pos < len(data); {
+		header := data[pos]
+		pos++
+
+		// compressed timestamp header: a data message with the low five bits of the
+		// timestamp in the header
+		if header&0x80 != 0 {
+			local := (header >> 5) & 0x03
+			offset := int64(header & 0x1F)
+
+			timestamp := lastTimestamp&^0x1F + offset
+			if offset < lastTimestamp&0x1F {
+				timestamp += 0x20
+			}
+
+			m, n, err := decodeFITData(definitions[local], data[pos:])
+			if err != nil {
+				return nil, err
+			}
+			pos += n
+
+			m.values[fitFieldTimestamp] = timestamp
+			lastTimestamp = timestamp
+			messages = append(messages, m)
+			continue
+		}
+
+		local := header & 0x0F
+
+		// definition message
+		if header&0x40 != 0 {
+			if pos+5 > len(data) {
+				return nil, truncated
+			}
+
+			def := &fitDefinition{bigEndian: data[pos+1] == 1}
+			if def.bigEndian {
+				def.global = binary.BigEndian.Uint16(data[pos+2 : pos+4])
+			} else {
+				def.global = binary.LittleEndian.Uint16(data[pos+2 : pos+4])
+			}
+			count := int(data[pos+4])
+			pos += 5
+
+			if pos+count*3 > len(data) {
+				return nil, truncated
+			}
+			for i := 0; i < count; i++ {
+				def.fields = append(def.fields, fitFieldDef{
+					num:      data[pos],
+					size:     int(data[pos+1]),
+					baseType: data[pos+2],
+				})
+				pos += 3
+			}
+
+			if header&0x20 != 0 {
+				if pos >= len(data) {
+					return nil, truncated
+				}
+				devCount := int(data[pos])
+				pos++
+				if pos+devCount*3 > len(data) {
+					return nil, truncated
+				}
+				for i := 0; i < devCount; i++ {
+					def.devSize += int(data[pos+1])
+					pos += 3
+				}
+			}
+
+			definitions[local] = def
+			continue
+		}
+
+		// data message
+		m, n, err := decodeFITData(definitions[local], data[pos:])
+		if err != nil {
+			return nil, err
+		}
+		pos += n
+
+		if ts, ok := m.values[fitFieldTimestamp]; ok {
+			lastTimestamp = ts
+		}
+		messages = append(messages, m)
+	}
+
+	return messages, nil
+}
+
+// decodeFITData decodes one data message laid out according to def, and returns it with the
+// number of bytes it took up.
+func decodeFITData(def *fitDefinition, data []byte) (fitMessage, int, error) {
+	if def == nil {
+		return fitMessage{}, 0, fmt.Errorf("%w: data before its definition", ErrNotFIT)
+	}
+
+	m := fitMessage{global: def.global, values: make(map[byte]int64)}
+
+	pos := 0
+	for _, f := range def.fields {
+		if pos+f.size > len(data) {
+			return m, 0, fmt.Errorf("%w: truncated record", ErrNotFIT)
+		}
+
+		if v, ok := decodeFITValue(data[pos:pos+f.size], f.baseType, def.bigEndian); ok {
+			m.values[f.num] = v
+		}
+		pos += f.size
+	}
+
+	pos += def.devSize
+	if pos > len(data) {
+		return m, 0, fmt.Errorf("%w: truncated record", ErrNotFIT)
+	}
+
+	return m, pos, nil
+}
+
+// decodeFITValue decodes a single integer field. Arrays, strings, floats and invalid values
+// all come back not ok.
+func decodeFITValue(b []byte, baseType byte, bigEndian bool) (int64, bool) {
+	bt, ok := fitBaseTypes[baseType&0x1F]
+	if !ok || bt.size != len(b) {
+		return 0, false
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	if bigEndian {
+		order = binary.BigEndian
+	}
+
+	var raw uint64
+	switch bt.size {
+	case 1:
+		raw = uint64(b[0])
+	case 2:
+		raw = uint64(order.Uint16(b))
+	case 4:
+		raw = uint64(order.Uint32(b))
+	}
+
+	if raw == bt.invalid {
+		return 0, false
+	}
+
+	if bt.signed {
+		shift := 64 - 8*bt.size
+		return int64(raw<<shift) >> shift, true
+	}
+	return int64(raw), true
+}
+
+// fitActivity builds an activity out of a session and the laps and records that belong to it.
+func fitActivity(session fitMessage, laps []fitMessage, records []fitMessage) (models.StravaActivity, error) {
+	sport, _ := session.get(fitSessionSport)
+	activityType, ok := fitSports[sport]
+	if !ok {
+		return models.StravaActivity{}, fmt.Errorf("%w: FIT sport %d", ErrUnsupportedSport, sport)
+	}
+
+	start, ok := session.time(fitSessionStartTime)
+	if !ok {
+		return models.StravaActivity{}, fmt.Errorf("%w: session without a start time", ErrNotFIT)
+	}
+
+	elapsed, _ := session.scaled(fitSessionTotalElapsedTime, 1000, 0)
+	timer, ok := session.scaled(fitSessionTotalTimerTime, 1000, 0)
+	if !ok {
+		timer = elapsed
+	}
+	end := start.Add(time.Duration(elapsed) * time.Second)
+
+	subSport, _ := session.get(fitSessionSubSport)
+	trainer := fitIndoorSubSports[subSport]
+
+	sa := models.StravaActivity{
+		Id:          ImportedID(start),
+		Name:        activityName(activityType, trainer),
+		Type:        activityType,
+		StartDate:   start,
+		ElapsedTime: int(math.Round(elapsed)),
+		MovingTime:  int(math.Round(timer)),
+		Trainer:     trainer,
+		Source:      SourceFIT,
+	}
+
+	sa.Distance, _ = session.scaled(fitSessionTotalDistance, 100, 0)
+	sa.TotalElevationGain, _ = session.scaled(fitSessionTotalAscent, 1, 0)
+	sa.AverageHeartRate, _ = session.scaled(fitSessionAvgHeartRate, 1, 0)
+	sa.MaxHeartRate, _ = session.scaled(fitSessionMaxHeartRate, 1, 0)
+	if calories, ok := session.get(fitSessionTotalCalories); ok {
+		sa.Calories = int(calories)
+	}
+
+	for _, lap := range laps {
+		lapStart, ok := lap.time(fitLapStartTime)
+		if !ok || lapStart.Before(start) || lapStart.After(end) {
+			continue
+		}
+
+		l := models.Lap{StartDate: lapStart}
+		lapElapsed, _ := lap.scaled(fitLapTotalElapsedTime, 1000, 0)
+		lapTimer, _ := lap.scaled(fitLapTotalTimerTime, 1000, 0)
+		l.ElapsedTime = int(math.Round(lapElapsed))
+		l.MovingTime = int(math.Round(lapTimer))
+		l.Distance, _ = lap.scaled(fitLapTotalDistance, 100, 0)
+		l.AverageHeartRate, _ = lap.scaled(fitLapAvgHeartRate, 1, 0)
+		l.AverageWatts, _ = lap.scaled(fitLapAvgPower, 1, 0)
+
+		sa.Laps = append(sa.Laps, l)
+	}
+
+	sa.Streams = buildStreams(start, end, fitPoints(records))
+	sa.StartLatLng = startLatLng(sa.Streams)
+
+	// a power meter's normalized power is as good as strava's weighted average watts
+	if sa.Streams != nil && sa.Streams.HasPower() {
+		sa.DeviceWatts = true
+		if np, ok := session.scaled(fitSessionNormalizedPower, 1, 0); ok {
+			sa.WeightedAverageWatts = np
+		}
+	}
+
+	return sa, nil
+}
+
+// fitPoints turns records into track points.
+func fitPoints(records []fitMessage) []trackPoint {
+	var points []trackPoint
+
+	for _, record := range records {
+		ts, ok := record.time(fitFieldTimestamp)
+		if !ok {
+			continue
+		}
+
+		p := trackPoint{Time: ts}
+
+		// the enhanced fields, if there are any, win
+		value := func(field byte, fallback byte, scale float64, offset float64) *float64 {
+			if v, ok := record.scaled(field, scale, offset); ok {
+				return &v
+			}
+			if fallback == 0 {
+				return nil
+			}
+			if v, ok := record.scaled(fallback, scale, offset); ok {
+				return &v
+			}
+			return nil
+		}
+
+		p.HeartRate = value(fitRecordHeartRate, 0, 1, 0)
+		p.Watts = value(fitRecordPower, 0, 1, 0)
+		p.Cadence = value(fitRecordCadence, 0, 1, 0)
+		p.Distance = value(fitRecordDistance, 0, 100, 0)
+		p.Velocity = value(fitRecordEnhancedSpeed, fitRecordSpeed, 1000, 0)
+		p.Altitude = value(fitRecordEnhancedAltitude, fitRecordAltitude, 5, 500)
+
+		lat, okLat := record.get(fitRecordPositionLat)
+		lng, okLng := record.get(fitRecordPositionLong)
+		if okLat && okLng {
+			p.LatLng = []float64{semicirclesToDegrees(lat), semicirclesToDegrees(lng)}
+		}
+
+		points = append(points, p)
+	}
+
+	return points
+}
+
+func semicirclesToDegrees(semicircles int64) float64 {
+	return float64(semicircles) * 180 / math.Pow(2, 31)
+}
+
+// fitCRCTable is the nibble table from the FIT SDK's crc
+var fitCRCTable = [16]uint16{
+	0x0000, 0xCC01, 0xD801, 0x1400, 0xF001, 0x3C00, 0x2800, 0xE401,
+	0xA001, 0x6C00, 0x7800, 0xB401, 0x5000, 0x9C01, 0x8801, 0x4400,
+}
+
+// fitCRC is the crc FIT files end with.
+func fitCRC(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		tmp := fitCRCTable[crc&0xF]
+		crc = (crc >> 4) & 0x0FFF
+		crc = crc ^ tmp ^ fitCRCTable[b&0xF]
+
+		tmp = fitCRCTable[crc&0xF]
+		crc = (crc >> 4) & 0x0FFF
+		crc = crc ^ tmp ^ fitCRCTable[(b>>4)&0xF]
+	}
+	return crc
+}
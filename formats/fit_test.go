@@ -0,0 +1,187 @@
+package formats_test
+
+import (
+	"atc/formats"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fitField is a field in a test definition: number, size and base type
+type fitField struct {
+	num      byte
+	size     byte
+	baseType byte
+}
+
+// fitBuilder writes just enough FIT to test the decoder with
+type fitBuilder struct {
+	records bytes.Buffer
+	order   binary.ByteOrder
+}
+
+func (b *fitBuilder) define(local byte, global uint16, fields ...fitField) {
+	b.records.WriteByte(0x40 | local)
+	b.records.WriteByte(0)
+	if b.order == binary.BigEndian {
+		b.records.WriteByte(1)
+	} else {
+		b.records.WriteByte(0)
+	}
+	g := make([]byte, 2)
+	b.order.PutUint16(g, global)
+	b.records.Write(g)
+	b.records.WriteByte(byte(len(fields)))
+	for _, f := range fields {
+		b.records.Write([]byte{f.num, f.size, f.baseType})
+	}
+}
+
+// data writes a data message with the given header and values, which have to match the
+// definition's sizes
+func (b *fitBuilder) data(header byte, values ...interface{}) {
+	b.records.WriteByte(header)
+	for _, v := range values {
+		binary.Write(&b.records, b.order, v)
+	}
+}
+
+func (b *fitBuilder) bytes() []byte {
+	header := make([]byte, 12)
+	header[0] = 12
+	header[1] = 0x20
+	binary.LittleEndian.PutUint16(header[2:4], 2100)
+	binary.LittleEndian.PutUint32(header[4:8], uint32(b.records.Len()))
+	copy(header[8:12], ".FIT")
+
+	file := append(header, b.records.Bytes()...)
+	crc := make([]byte, 2)
+	binary.LittleEndian.PutUint16(crc, fitCRC(file))
+	return append(file, crc...)
+}
+
+// same crc as the decoder, written out the slow way
+func fitCRC(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+func fitTime(t time.Time) uint32 {
+	return uint32(t.Unix() - 631065600)
+}
+
+func TestParseFIT(t *testing.T) {
+	start := time.Date(2024, 8, 1, 6, 0, 0, 0, time.UTC)
+
+	b := &fitBuilder{order: binary.LittleEndian}
+
+	// records: timestamp, heart rate, power, enhanced speed, enhanced altitude
+	b.define(0, 20,
+		fitField{253, 4, 0x86}, fitField{3, 1, 0x02}, fitField{7, 2, 0x84},
+		fitField{73, 4, 0x86}, fitField{78, 4, 0x86})
+	for i := 0; i < 10; i++ {
+		hr := uint8(140 + i)
+		if i == 4 {
+			// the strap dropped out
+			hr = 0xFF
+		}
+		b.data(0x00, fitTime(start.Add(time.Duration(i)*time.Second)), hr, uint16(200), uint32(10000), uint32((100+500)*5))
+	}
+
+	// a record with a compressed timestamp, one second after the last
+	b.define(1, 20, fitField{3, 1, 0x02}, fitField{7, 2, 0x84})
+	offset := byte((fitTime(start) + 10) & 0x1F)
+	b.data(0x80|1<<5|offset, uint8(150), uint16(210))
+
+	// a lap, in big endian for the fun of it
+	b.order = binary.BigEndian
+	b.define(2, 19,
+		fitField{2, 4, 0x86}, fitField{7, 4, 0x86}, fitField{8, 4, 0x86},
+		fitField{9, 4, 0x86}, fitField{15, 1, 0x02}, fitField{19, 2, 0x84})
+	b.data(0x02, fitTime(start), uint32(10000), uint32(10000), uint32(10000), uint8(145), uint16(201))
+	b.order = binary.LittleEndian
+
+	// the session: an indoor ride (sub sport 6)
+	b.define(3, 18,
+		fitField{2, 4, 0x86}, fitField{5, 1, 0x00}, fitField{6, 1, 0x00},
+		fitField{7, 4, 0x86}, fitField{8, 4, 0x86}, fitField{9, 4, 0x86},
+		fitField{11, 2, 0x84}, fitField{16, 1, 0x02}, fitField{17, 1, 0x02}, fitField{34, 2, 0x84})
+	b.data(0x03, fitTime(start), uint8(2), uint8(6), uint32(10000), uint32(10000), uint32(10000),
+		uint16(120), uint8(145), uint8(150), uint16(205))
+
+	activities, err := formats.Parse("ride.FIT", bytes.NewReader(b.bytes()))
+	assert.NoError(t, err)
+	if !assert.Len(t, activities, 1) {
+		return
+	}
+
+	a := activities[0]
+	assert.Equal(t, formats.ImportedID(start), a.Id)
+	assert.Equal(t, "Ride", a.Type)
+	assert.Equal(t, "Indoor Ride", a.Name)
+	assert.Equal(t, formats.SourceFIT, a.Source)
+	assert.True(t, a.Trainer)
+	assert.True(t, start.Equal(a.StartDate))
+	assert.Equal(t, 10, a.ElapsedTime)
+	assert.Equal(t, 10, a.MovingTime)
+	assert.InDelta(t, 100, a.Distance, 0.001)
+	assert.Equal(t, 120, a.Calories)
+	assert.InDelta(t, 145, a.AverageHeartRate, 0.001)
+	assert.True(t, a.DeviceWatts)
+	assert.InDelta(t, 205, a.WeightedAverageWatts, 0.001)
+
+	if assert.Len(t, a.Laps, 1) {
+		assert.InDelta(t, 201, a.Laps[0].AverageWatts, 0.001)
+		assert.Equal(t, 10, a.Laps[0].ElapsedTime)
+	}
+
+	// streams line up, and gaps are filled with the last value
+	if assert.NotNil(t, a.Streams) {
+		s := a.Streams
+		assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, s.Time)
+		assert.Len(t, s.HeartRate, 11)
+		assert.Equal(t, 143.0, s.HeartRate[4])
+		assert.Equal(t, 150.0, s.HeartRate[10])
+		assert.Equal(t, 210.0, s.Watts[10])
+		assert.InDelta(t, 10, s.Velocity[0], 0.001)
+		assert.InDelta(t, 100, s.Altitude[0], 0.001)
+		assert.Nil(t, s.Cadence)
+		assert.True(t, s.HasPower())
+	}
+}
+
+func TestParseFITErrors(t *testing.T) {
+	start := time.Date(2024, 8, 1, 6, 0, 0, 0, time.UTC)
+
+	// not a fit file at all
+	_, err := formats.ParseFIT(bytes.NewReader([]byte("<gpx></gpx>")))
+	assert.True(t, errors.Is(err, formats.ErrNotFIT))
+
+	// a walk
+	b := &fitBuilder{order: binary.LittleEndian}
+	b.define(0, 18, fitField{2, 4, 0x86}, fitField{5, 1, 0x00}, fitField{7, 4, 0x86})
+	b.data(0x00, fitTime(start), uint8(11), uint32(600000))
+	file := b.bytes()
+
+	_, err = formats.ParseFIT(bytes.NewReader(file))
+	assert.True(t, errors.Is(err, formats.ErrUnsupportedSport))
+
+	// the same walk, damaged
+	file[len(file)-3] ^= 0xFF
+	_, err = formats.ParseFIT(bytes.NewReader(file))
+	assert.True(t, errors.Is(err, formats.ErrNotFIT))
+}
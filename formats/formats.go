@@ -0,0 +1,232 @@
+package formats
+
+import (
+	"atc/models"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// package formats reads (and writes) activity files, for workouts that never made it to
+// strava. whatever the format, an activity comes out as the same StravaActivity (with
+// Streams) the strava source produces, so it's stored, scored and charted the same way.
+
+// ErrUnsupportedSport is returned for files of a sport we don't score (ATC is for triathlon).
+var ErrUnsupportedSport = errors.New("unsupported sport")
+
+// sources recorded on imported activities
+const (
+	SourceFIT = "fit"
+	SourceGPX = "gpx"
+	SourceTCX = "tcx"
+)
+
+// ImportedID returns the id for an activity imported from a file. strava ids are positive,
+// so imports get negative ones (minus the start time in unix seconds) to stay out of their
+// way. two files that start in the same second are the same activity anyway.
+func ImportedID(start time.Time) int64 {
+	return -start.Unix()
+}
+
+// Parse reads an activity file, working out the format from its name.
+func Parse(filename string, r io.Reader) ([]models.StravaActivity, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".fit":
+		return ParseFIT(r)
+	case ".gpx":
+		return ParseGPX(r)
+	case ".tcx":
+		return ParseTCX(r)
+	}
+	return nil, fmt.Errorf("don't know how to read %s", filename)
+}
+
+// activityName makes up a name for an imported activity, since files don't have one.
+func activityName(activityType string, trainer bool) string {
+	if trainer {
+		return "Indoor " + activityType
+	}
+	return activityType
+}
+
+// sportTypes maps the names files give sports onto our activity types. gpx doesn't say what
+// to call them, so there's a bit of everything here.
+var sportTypes = map[string]string{
+	"run":      "Run",
+	"running":  "Run",
+	"ride":     "Ride",
+	"biking":   "Ride",
+	"cycling":  "Ride",
+	"swim":     "Swim",
+	"swimming": "Swim",
+}
+
+// activityType works out which of our activity types a file's sport is.
+func activityType(sport string) (string, error) {
+	t, ok := sportTypes[strings.ToLower(strings.TrimSpace(sport))]
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrUnsupportedSport, sport)
+	}
+	return t, nil
+}
+
+// trackPoint is one sample from a file, whatever the format. nil means the sample didn't
+// have that value.
+type trackPoint struct {
+	Time      time.Time
+	HeartRate *float64
+	Watts     *float64
+	Cadence   *float64
+	Distance  *float64
+	Velocity  *float64
+	Altitude  *float64
+	LatLng    []float64
+}
+
+// buildStreams turns the points between start and end into streams. Points don't always
+// have every value (the strap drops out, gps takes a while), so gaps are filled with the last
+// value we had; a stream is only kept if some point had it. It returns nil if there weren't
+// any points.
+func buildStreams(start time.Time, end time.Time, points []trackPoint) *models.Streams {
+	s := &models.Streams{}
+
+	channels := []struct {
+		value  func(p trackPoint) *float64
+		stream *[]float64
+	}{
+		{func(p trackPoint) *float64 { return p.HeartRate }, &s.HeartRate},
+		{func(p trackPoint) *float64 { return p.Watts }, &s.Watts},
+		{func(p trackPoint) *float64 { return p.Cadence }, &s.Cadence},
+		{func(p trackPoint) *float64 { return p.Distance }, &s.Distance},
+		{func(p trackPoint) *float64 { return p.Velocity }, &s.Velocity},
+		{func(p trackPoint) *float64 { return p.Altitude }, &s.Altitude},
+	}
+	seen := make([]bool, len(channels))
+	last := make([]float64, len(channels))
+
+	var position []float64
+	for _, p := range points {
+		if p.Time.Before(start) || p.Time.After(end) {
+			continue
+		}
+
+		s.Time = append(s.Time, int(p.Time.Sub(start).Seconds()))
+
+		for i, c := range channels {
+			if v := c.value(p); v != nil {
+				seen[i] = true
+				last[i] = *v
+			}
+			*c.stream = append(*c.stream, last[i])
+		}
+
+		// before the first fix there's no last position to repeat, so fill in the first one
+		// once we have it
+		if p.LatLng != nil {
+			if position == nil {
+				for i := range s.LatLng {
+					s.LatLng[i] = p.LatLng
+				}
+			}
+			position = p.LatLng
+		}
+		s.LatLng = append(s.LatLng, position)
+	}
+
+	if len(s.Time) == 0 {
+		return nil
+	}
+
+	for i, c := range channels {
+		if !seen[i] {
+			*c.stream = nil
+		}
+	}
+	if position == nil {
+		s.LatLng = nil
+	}
+
+	return s
+}
+
+// exportPoints turns an activity's streams back into track points, for writing files.
+func exportPoints(sa models.StravaActivity) []trackPoint {
+	s := sa.Streams
+	if s == nil {
+		return nil
+	}
+
+	// streams that don't line up with time are no use to anybody
+	value := func(stream []float64, i int) *float64 {
+		if len(stream) != len(s.Time) {
+			return nil
+		}
+		return float(stream[i])
+	}
+
+	points := make([]trackPoint, len(s.Time))
+	for i, t := range s.Time {
+		points[i] = trackPoint{
+			Time:      sa.StartDate.UTC().Add(time.Duration(t) * time.Second),
+			HeartRate: value(s.HeartRate, i),
+			Watts:     value(s.Watts, i),
+			Cadence:   value(s.Cadence, i),
+			Distance:  value(s.Distance, i),
+			Velocity:  value(s.Velocity, i),
+			Altitude:  value(s.Altitude, i),
+		}
+		if len(s.LatLng) == len(s.Time) && len(s.LatLng[i]) == 2 {
+			points[i].LatLng = s.LatLng[i]
+		}
+	}
+
+	return points
+}
+
+// elevationGain adds up the climbing in an altitude stream.
+func elevationGain(altitude []float64) float64 {
+	gain := 0.0
+	for i := 1; i < len(altitude); i++ {
+		if climb := altitude[i] - altitude[i-1]; climb > 0 {
+			gain += climb
+		}
+	}
+	return gain
+}
+
+// averageAndMax returns the mean and largest of values, leaving out zeroes (which are a
+// sensor that wasn't reading, not a heart that stopped).
+func averageAndMax(values []float64) (float64, float64) {
+	var sum, max float64
+	n := 0
+	for _, v := range values {
+		if v <= 0 {
+			continue
+		}
+		sum += v
+		n++
+		if v > max {
+			max = v
+		}
+	}
+	if n == 0 {
+		return 0, 0
+	}
+	return sum / float64(n), max
+}
+
+// startLatLng returns the first position in the streams, or nil.
+func startLatLng(s *models.Streams) []float64 {
+	if s == nil || len(s.LatLng) == 0 {
+		return nil
+	}
+	return s.LatLng[0]
+}
+
+// float returns a pointer to v, for trackPoints.
+func float(v float64) *float64 {
+	return &v
+}
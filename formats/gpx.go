@@ -0,0 +1,279 @@
+package formats
+
+import (
+	"atc/models"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// GPX is a track: a list of timestamped positions. everything else (heart rate, cadence) is
+// in garmin's TrackPointExtension, and power is a bare <power> extension, which is what
+// strava writes. there's no distance or speed, so those are worked out from the positions.
+//
+// the schema is at https://www.topografix.com/GPX/1/1/gpx.xsd
+
+// ErrNoTrack is returned when writing a GPX file for an activity without gps, since every
+// point in a GPX file has to have a position.
+var ErrNoTrack = errors.New("activity has no gps track")
+
+var (
+	// ErrNoTimestamps is returned for GPX tracks with points that don't say when they were
+	// recorded, like routes exported from a planner.
+	ErrNoTimestamps = errors.New("track points have no timestamps (is this a route rather than a recording?)")
+
+	// ErrTimestampOrder is returned for GPX tracks whose points go back in time.
+	ErrTimestampOrder = errors.New("track points are not in time order")
+)
+
+const (
+	gpxNamespace      = "http://www.topografix.com/GPX/1/1"
+	gpxTPXNamespace   = "http://www.garmin.com/xmlschemas/TrackPointExtension/v1"
+	gpxCreator        = "ATC"
+	earthRadiusMeters = 6371000
+)
+
+// gpxTypes is what we call our disciplines in GPX, which is what garmin calls them
+var gpxTypes = map[models.Discipline]string{
+	models.DisciplineRun:  "running",
+	models.DisciplineBike: "cycling",
+	models.DisciplineSwim: "swimming",
+}
+
+type gpx struct {
+	XMLName xml.Name   `xml:"gpx"`
+	Tracks  []gpxTrack `xml:"trk"`
+}
+
+type gpxTrack struct {
+	Name     string       `xml:"name,omitempty"`
+	Type     string       `xml:"type,omitempty"`
+	Segments []gpxSegment `xml:"trkseg"`
+}
+
+type gpxSegment struct {
+	Points []gpxPoint `xml:"trkpt"`
+}
+
+type gpxPoint struct {
+	Lat        float64        `xml:"lat,attr"`
+	Lon        float64        `xml:"lon,attr"`
+	Elevation  *float64       `xml:"ele,omitempty"`
+	Time       time.Time      `xml:"time"`
+	Extensions *gpxExtensions `xml:"extensions,omitempty"`
+}
+
+// gpxExtensions is how extensions are read. the decoder drops the gpxtpx: prefix, but the
+// encoder can't put it back, so writing them needs gpxExtensionsOut.
+type gpxExtensions struct {
+	Power *float64 `xml:"power"`
+	TPX   *struct {
+		HeartRate *float64 `xml:"hr"`
+		Cadence   *float64 `xml:"cad"`
+	} `xml:"TrackPointExtension"`
+}
+
+type gpxExtensionsOut struct {
+	Power *float64   `xml:"power,omitempty"`
+	TPX   *gpxTPXOut `xml:"gpxtpx:TrackPointExtension,omitempty"`
+}
+
+type gpxTPXOut struct {
+	HeartRate *float64 `xml:"gpxtpx:hr,omitempty"`
+	Cadence   *float64 `xml:"gpxtpx:cad,omitempty"`
+}
+
+// gpxPointOut is gpxPoint, for writing
+type gpxPointOut struct {
+	Lat        float64           `xml:"lat,attr"`
+	Lon        float64           `xml:"lon,attr"`
+	Elevation  *float64          `xml:"ele,omitempty"`
+	Time       time.Time         `xml:"time"`
+	Extensions *gpxExtensionsOut `xml:"extensions,omitempty"`
+}
+
+type gpxOut struct {
+	XMLName  xml.Name      `xml:"gpx"`
+	Xmlns    string        `xml:"xmlns,attr"`
+	XmlnsTPX string        `xml:"xmlns:gpxtpx,attr"`
+	Version  string        `xml:"version,attr"`
+	Creator  string        `xml:"creator,attr"`
+	Time     time.Time     `xml:"metadata>time"`
+	Name     string        `xml:"trk>name,omitempty"`
+	Type     string        `xml:"trk>type,omitempty"`
+	Points   []gpxPointOut `xml:"trk>trkseg>trkpt"`
+}
+
+// ParseGPX reads a GPX file. Every track in it becomes an activity. GPX has no sport of its
+// own, so tracks without a type we know are rejected.
+func ParseGPX(r io.Reader) ([]models.StravaActivity, error) {
+	var g gpx
+	if err := xml.NewDecoder(r).Decode(&g); err != nil {
+		return nil, fmt.Errorf("not a GPX file: %w", err)
+	}
+
+	if len(g.Tracks) == 0 {
+		return nil, fmt.Errorf("no tracks in GPX file")
+	}
+
+	var activities []models.StravaActivity
+	for _, track := range g.Tracks {
+		activity, err := gpxActivityFrom(track)
+		if err != nil {
+			return nil, err
+		}
+		activities = append(activities, activity)
+	}
+
+	return activities, nil
+}
+
+func gpxActivityFrom(track gpxTrack) (models.StravaActivity, error) {
+	activityType, err := activityType(track.Type)
+	if err != nil {
+		return models.StravaActivity{}, err
+	}
+
+	var points []trackPoint
+	for _, segment := range track.Segments {
+		for _, pt := range segment.Points {
+			p := trackPoint{
+				Time:     pt.Time.UTC(),
+				Altitude: pt.Elevation,
+				LatLng:   []float64{pt.Lat, pt.Lon},
+			}
+			if pt.Extensions != nil {
+				p.Watts = pt.Extensions.Power
+				if pt.Extensions.TPX != nil {
+					p.HeartRate = pt.Extensions.TPX.HeartRate
+					p.Cadence = pt.Extensions.TPX.Cadence
+				}
+			}
+			points = append(points, p)
+		}
+	}
+
+	if len(points) == 0 {
+		return models.StravaActivity{}, fmt.Errorf("GPX track %q has no points", track.Name)
+	}
+
+	// <time> is optional, and routes drawn in a planner don't have it. without it there's no
+	// telling when (or how fast) anything happened.
+	for i := range points {
+		if points[i].Time.IsZero() {
+			return models.StravaActivity{}, fmt.Errorf("GPX track %q: %w", track.Name, ErrNoTimestamps)
+		}
+		if i > 0 && points[i].Time.Before(points[i-1].Time) {
+			return models.StravaActivity{}, fmt.Errorf("GPX track %q: %w", track.Name, ErrTimestampOrder)
+		}
+	}
+
+	// distance and speed aren't in the file, but they fall out of the positions
+	distance := 0.0
+	for i := range points {
+		if i > 0 {
+			step := haversine(points[i-1].LatLng, points[i].LatLng)
+			distance += step
+			if dt := points[i].Time.Sub(points[i-1].Time).Seconds(); dt > 0 {
+				points[i].Velocity = float(step / dt)
+			}
+		}
+		points[i].Distance = float(distance)
+	}
+
+	start := points[0].Time
+	end := points[len(points)-1].Time
+
+	name := track.Name
+	if name == "" {
+		name = activityName(activityType, false)
+	}
+
+	sa := models.StravaActivity{
+		Id:          ImportedID(start),
+		Name:        name,
+		Type:        activityType,
+		StartDate:   start,
+		ElapsedTime: int(math.Round(end.Sub(start).Seconds())),
+		Distance:    distance,
+		Source:      SourceGPX,
+	}
+	// there's no telling when the clock was stopped
+	sa.MovingTime = sa.ElapsedTime
+
+	sa.Streams = buildStreams(start, end, points)
+	sa.StartLatLng = startLatLng(sa.Streams)
+	sa.TotalElevationGain = elevationGain(sa.Streams.Altitude)
+	sa.DeviceWatts = sa.Streams.HasPower()
+	if sa.Streams.HasHeartRate() {
+		sa.AverageHeartRate, sa.MaxHeartRate = averageAndMax(sa.Streams.HeartRate)
+	}
+
+	return sa, nil
+}
+
+// WriteGPX writes an activity out as GPX. Only activities with a gps track can be written,
+// for anything else there's TCX.
+func WriteGPX(w io.Writer, sa models.StravaActivity) error {
+	if sa.Streams == nil || len(sa.Streams.LatLng) == 0 || len(sa.Streams.LatLng) != len(sa.Streams.Time) {
+		return ErrNoTrack
+	}
+
+	g := gpxOut{
+		Xmlns:    gpxNamespace,
+		XmlnsTPX: gpxTPXNamespace,
+		Version:  "1.1",
+		Creator:  gpxCreator,
+		Time:     sa.StartDate.UTC(),
+		Name:     sa.Name,
+		Type:     gpxTypes[sa.Discipline],
+	}
+
+	for _, p := range exportPoints(sa) {
+		pt := gpxPointOut{
+			Lat:       p.LatLng[0],
+			Lon:       p.LatLng[1],
+			Elevation: p.Altitude,
+			Time:      p.Time,
+		}
+
+		ext := &gpxExtensionsOut{Power: p.Watts}
+		if p.HeartRate != nil || p.Cadence != nil {
+			ext.TPX = &gpxTPXOut{}
+			if p.HeartRate != nil {
+				ext.TPX.HeartRate = float(math.Round(*p.HeartRate))
+			}
+			if p.Cadence != nil {
+				ext.TPX.Cadence = float(math.Round(*p.Cadence))
+			}
+		}
+		if ext.Power != nil || ext.TPX != nil {
+			pt.Extensions = ext
+		}
+
+		g.Points = append(g.Points, pt)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(g)
+}
+
+// haversine is the distance in meters between two [lat, lng] positions.
+func haversine(a []float64, b []float64) float64 {
+	toRadians := func(d float64) float64 { return d * math.Pi / 180 }
+
+	dLat := toRadians(b[0] - a[0])
+	dLng := toRadians(b[1] - a[1])
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(a[0]))*math.Cos(toRadians(b[0]))*math.Sin(dLng/2)*math.Sin(dLng/2)
+
+	return 2 * earthRadiusMeters * math.Asin(math.Sqrt(h))
+}
@@ -0,0 +1,119 @@
+package formats_test
+
+import (
+	"atc/formats"
+	"atc/models"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// a few seconds of a ride, as strava exports it
+const testGPX = `<?xml version="1.0" encoding="UTF-8"?>
+<gpx creator="StravaGPX" version="1.1" xmlns="http://www.topografix.com/GPX/1/1" xmlns:gpxtpx="http://www.garmin.com/xmlschemas/TrackPointExtension/v1">
+ <metadata><time>2024-08-01T06:00:00Z</time></metadata>
+ <trk>
+  <name>Morning Ride</name>
+  <type>cycling</type>
+  <trkseg>
+   <trkpt lat="45.5000000" lon="-122.6000000">
+    <ele>10.0</ele>
+    <time>2024-08-01T06:00:00Z</time>
+    <extensions>
+     <power>200</power>
+     <gpxtpx:TrackPointExtension><gpxtpx:hr>120</gpxtpx:hr><gpxtpx:cad>85</gpxtpx:cad></gpxtpx:TrackPointExtension>
+    </extensions>
+   </trkpt>
+   <trkpt lat="45.5001000" lon="-122.6000000">
+    <ele>11.0</ele>
+    <time>2024-08-01T06:00:01Z</time>
+    <extensions>
+     <power>220</power>
+     <gpxtpx:TrackPointExtension><gpxtpx:hr>124</gpxtpx:hr></gpxtpx:TrackPointExtension>
+    </extensions>
+   </trkpt>
+   <trkpt lat="45.5002000" lon="-122.6000000">
+    <ele>10.5</ele>
+    <time>2024-08-01T06:00:02Z</time>
+   </trkpt>
+  </trkseg>
+ </trk>
+</gpx>`
+
+func TestParseGPX(t *testing.T) {
+	activities, err := formats.Parse("ride.gpx", strings.NewReader(testGPX))
+	assert.NoError(t, err)
+	if !assert.Len(t, activities, 1) {
+		return
+	}
+
+	a := activities[0]
+	start := time.Date(2024, 8, 1, 6, 0, 0, 0, time.UTC)
+	assert.Equal(t, formats.ImportedID(start), a.Id)
+	assert.Equal(t, "Ride", a.Type)
+	assert.Equal(t, "Morning Ride", a.Name)
+	assert.Equal(t, formats.SourceGPX, a.Source)
+	assert.Equal(t, 2, a.ElapsedTime)
+	assert.Equal(t, 1.0, a.TotalElevationGain)
+	assert.InDelta(t, 122.67, a.AverageHeartRate, 0.01)
+	assert.Equal(t, 124.0, a.MaxHeartRate)
+	assert.True(t, a.DeviceWatts)
+
+	// 0.0001 degrees of latitude is about 11 meters
+	assert.InDelta(t, 22.2, a.Distance, 0.1)
+
+	if assert.NotNil(t, a.Streams) {
+		assert.Equal(t, []int{0, 1, 2}, a.Streams.Time)
+		assert.Equal(t, []float64{120, 124, 124}, a.Streams.HeartRate)
+		assert.Equal(t, []float64{200, 220, 220}, a.Streams.Watts)
+		assert.Equal(t, []float64{85, 85, 85}, a.Streams.Cadence)
+		assert.InDelta(t, 11.1, a.Streams.Velocity[1], 0.1)
+		assert.Len(t, a.Streams.LatLng, 3)
+	}
+
+	// a walk
+	_, err = formats.ParseGPX(strings.NewReader(strings.Replace(testGPX, "cycling", "walking", 1)))
+	assert.True(t, errors.Is(err, formats.ErrUnsupportedSport))
+
+	// a route from a planner has no times at all, and it isn't an activity
+	route := strings.NewReplacer("<time>2024-08-01T06:00:00Z</time>", "", "<time>2024-08-01T06:00:01Z</time>", "", "<time>2024-08-01T06:00:02Z</time>", "").Replace(testGPX)
+	_, err = formats.ParseGPX(strings.NewReader(route))
+	assert.ErrorIs(t, err, formats.ErrNoTimestamps)
+
+	// and nor is one that goes back in time
+	backwards := strings.Replace(testGPX, "06:00:02Z", "05:59:59Z", 1)
+	_, err = formats.ParseGPX(strings.NewReader(backwards))
+	assert.ErrorIs(t, err, formats.ErrTimestampOrder)
+}
+
+func TestWriteGPX(t *testing.T) {
+	activities, err := formats.ParseGPX(strings.NewReader(testGPX))
+	assert.NoError(t, err)
+	ride := activities[0]
+	models.DefaultSportMap().Map(&ride)
+
+	var buf bytes.Buffer
+	assert.NoError(t, formats.WriteGPX(&buf, ride))
+	assert.Contains(t, buf.String(), "<type>cycling</type>")
+	assert.Contains(t, buf.String(), "<gpxtpx:hr>124</gpxtpx:hr>")
+	assert.Contains(t, buf.String(), "<power>220</power>")
+
+	again, err := formats.ParseGPX(&buf)
+	assert.NoError(t, err)
+	if assert.Len(t, again, 1) {
+		assert.Equal(t, ride.Id, again[0].Id)
+		assert.Equal(t, ride.Name, again[0].Name)
+		assert.Equal(t, ride.Streams.HeartRate, again[0].Streams.HeartRate)
+		assert.Equal(t, ride.Streams.Watts, again[0].Streams.Watts)
+		assert.Equal(t, ride.Streams.LatLng, again[0].Streams.LatLng)
+		assert.InDelta(t, ride.Distance, again[0].Distance, 0.001)
+	}
+
+	// a trainer ride has nowhere to put its points
+	trainer := models.StravaActivity{Type: "Ride", StartDate: ride.StartDate, Streams: &models.Streams{Time: []int{0}, Watts: []float64{200}}}
+	assert.True(t, errors.Is(formats.WriteGPX(&buf, trainer), formats.ErrNoTrack))
+}
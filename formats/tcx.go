@@ -0,0 +1,327 @@
+package formats
+
+import (
+	"atc/models"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// TCX is garmin's older xml format (training center). an activity is a list of laps, and each
+// lap has a track of trackpoints. power and speed are in the ActivityExtension namespace.
+// there's no swimming in TCX (a swim is "Other"), so swims don't survive a round trip.
+//
+// the schema is at https://www8.garmin.com/xmlschemas/TrainingCenterDatabasev2.xsd
+
+const (
+	tcxNamespace          = "http://www.garmin.com/xmlschemas/TrainingCenterDatabase/v2"
+	tcxExtensionNamespace = "http://www.garmin.com/xmlschemas/ActivityExtension/v2"
+)
+
+// tcxSports is what TCX calls our disciplines
+var tcxSports = map[models.Discipline]string{
+	models.DisciplineRun:  "Running",
+	models.DisciplineBike: "Biking",
+	models.DisciplineSwim: "Other",
+}
+
+type tcxDatabase struct {
+	XMLName    xml.Name      `xml:"TrainingCenterDatabase"`
+	Xmlns      string        `xml:"xmlns,attr,omitempty"`
+	Activities []tcxActivity `xml:"Activities>Activity"`
+}
+
+type tcxActivity struct {
+	Sport string    `xml:"Sport,attr"`
+	Id    time.Time `xml:"Id"`
+	Laps  []tcxLap  `xml:"Lap"`
+	Notes string    `xml:"Notes,omitempty"`
+}
+
+type tcxLap struct {
+	StartTime        time.Time       `xml:"StartTime,attr"`
+	TotalTimeSeconds float64         `xml:"TotalTimeSeconds"`
+	DistanceMeters   float64         `xml:"DistanceMeters"`
+	Calories         int             `xml:"Calories"`
+	AverageHeartRate *tcxValue       `xml:"AverageHeartRateBpm,omitempty"`
+	MaxHeartRate     *tcxValue       `xml:"MaximumHeartRateBpm,omitempty"`
+	Intensity        string          `xml:"Intensity"`
+	TriggerMethod    string          `xml:"TriggerMethod"`
+	Track            []tcxTrackpoint `xml:"Track>Trackpoint"`
+	Extensions       *tcxExtensions  `xml:"Extensions,omitempty"`
+}
+
+type tcxValue struct {
+	Value float64 `xml:"Value"`
+}
+
+type tcxTrackpoint struct {
+	Time       time.Time      `xml:"Time"`
+	Position   *tcxPosition   `xml:"Position,omitempty"`
+	Altitude   *float64       `xml:"AltitudeMeters,omitempty"`
+	Distance   *float64       `xml:"DistanceMeters,omitempty"`
+	HeartRate  *tcxValue      `xml:"HeartRateBpm,omitempty"`
+	Cadence    *float64       `xml:"Cadence,omitempty"`
+	Extensions *tcxExtensions `xml:"Extensions,omitempty"`
+}
+
+type tcxPosition struct {
+	Latitude  float64 `xml:"LatitudeDegrees"`
+	Longitude float64 `xml:"LongitudeDegrees"`
+}
+
+type tcxExtensions struct {
+	TPX *tcxTPX `xml:"TPX,omitempty"`
+	LX  *tcxLX  `xml:"LX,omitempty"`
+}
+
+// tcxTPX is the trackpoint extension
+type tcxTPX struct {
+	Xmlns      string   `xml:"xmlns,attr,omitempty"`
+	Speed      *float64 `xml:"Speed,omitempty"`
+	Watts      *float64 `xml:"Watts,omitempty"`
+	RunCadence *float64 `xml:"RunCadence,omitempty"`
+}
+
+// tcxLX is the lap extension
+type tcxLX struct {
+	Xmlns    string   `xml:"xmlns,attr,omitempty"`
+	AvgWatts *float64 `xml:"AvgWatts,omitempty"`
+}
+
+// ParseTCX reads a TCX file. Every activity in it becomes one of ours.
+func ParseTCX(r io.Reader) ([]models.StravaActivity, error) {
+	var db tcxDatabase
+	if err := xml.NewDecoder(r).Decode(&db); err != nil {
+		return nil, fmt.Errorf("not a TCX file: %w", err)
+	}
+
+	if len(db.Activities) == 0 {
+		return nil, fmt.Errorf("no activities in TCX file")
+	}
+
+	var activities []models.StravaActivity
+	for _, a := range db.Activities {
+		activity, err := tcxActivityFrom(a)
+		if err != nil {
+			return nil, err
+		}
+		activities = append(activities, activity)
+	}
+
+	return activities, nil
+}
+
+func tcxActivityFrom(a tcxActivity) (models.StravaActivity, error) {
+	activityType, err := activityType(a.Sport)
+	if err != nil {
+		return models.StravaActivity{}, err
+	}
+
+	if len(a.Laps) == 0 {
+		return models.StravaActivity{}, fmt.Errorf("TCX activity %s has no laps", a.Id)
+	}
+
+	start := a.Laps[0].StartTime.UTC()
+	if !a.Id.IsZero() {
+		start = a.Id.UTC()
+	}
+
+	name := strings.TrimSpace(a.Notes)
+	if name == "" {
+		name = activityName(activityType, false)
+	}
+
+	sa := models.StravaActivity{
+		Id:        ImportedID(start),
+		Name:      name,
+		Type:      activityType,
+		StartDate: start,
+		Source:    SourceTCX,
+	}
+
+	var (
+		points    []trackPoint
+		end       = start
+		hrSeconds float64
+	)
+	for _, lap := range a.Laps {
+		l := models.Lap{
+			StartDate:   lap.StartTime.UTC(),
+			ElapsedTime: int(math.Round(lap.TotalTimeSeconds)),
+			MovingTime:  int(math.Round(lap.TotalTimeSeconds)),
+			Distance:    lap.DistanceMeters,
+		}
+		if lap.AverageHeartRate != nil {
+			l.AverageHeartRate = lap.AverageHeartRate.Value
+			hrSeconds += lap.TotalTimeSeconds
+			sa.AverageHeartRate += lap.AverageHeartRate.Value * lap.TotalTimeSeconds
+		}
+		if lap.MaxHeartRate != nil {
+			sa.MaxHeartRate = math.Max(sa.MaxHeartRate, lap.MaxHeartRate.Value)
+		}
+		if lap.Extensions != nil && lap.Extensions.LX != nil && lap.Extensions.LX.AvgWatts != nil {
+			l.AverageWatts = *lap.Extensions.LX.AvgWatts
+		}
+		sa.Laps = append(sa.Laps, l)
+
+		sa.Distance += lap.DistanceMeters
+		sa.MovingTime += l.MovingTime
+		sa.Calories += lap.Calories
+
+		if lapEnd := l.StartDate.Add(time.Duration(lap.TotalTimeSeconds * float64(time.Second))); lapEnd.After(end) {
+			end = lapEnd
+		}
+
+		for _, tp := range lap.Track {
+			p := trackPoint{
+				Time:     tp.Time.UTC(),
+				Altitude: tp.Altitude,
+				Distance: tp.Distance,
+				Cadence:  tp.Cadence,
+			}
+			if tp.HeartRate != nil {
+				p.HeartRate = float(tp.HeartRate.Value)
+			}
+			if tp.Position != nil {
+				p.LatLng = []float64{tp.Position.Latitude, tp.Position.Longitude}
+			}
+			if tp.Extensions != nil && tp.Extensions.TPX != nil {
+				p.Velocity = tp.Extensions.TPX.Speed
+				p.Watts = tp.Extensions.TPX.Watts
+				if tp.Extensions.TPX.RunCadence != nil {
+					p.Cadence = tp.Extensions.TPX.RunCadence
+				}
+			}
+			if p.Time.After(end) {
+				end = p.Time
+			}
+			points = append(points, p)
+		}
+	}
+
+	if hrSeconds > 0 {
+		sa.AverageHeartRate /= hrSeconds
+	}
+
+	// laps only add up the time the clock was running
+	sa.ElapsedTime = int(math.Round(end.Sub(start).Seconds()))
+
+	sa.Streams = buildStreams(start, end, points)
+	sa.StartLatLng = startLatLng(sa.Streams)
+	if sa.Streams != nil {
+		sa.TotalElevationGain = elevationGain(sa.Streams.Altitude)
+		sa.DeviceWatts = sa.Streams.HasPower()
+		if sa.AverageHeartRate == 0 && sa.Streams.HasHeartRate() {
+			sa.AverageHeartRate, sa.MaxHeartRate = averageAndMax(sa.Streams.HeartRate)
+		}
+	}
+
+	return sa, nil
+}
+
+// WriteTCX writes an activity out as TCX, with its streams as trackpoints if it has them. The
+// sport comes from sa.Discipline, so it should have been through a SportMap.
+func WriteTCX(w io.Writer, sa models.StravaActivity) error {
+	sport, ok := tcxSports[sa.Discipline]
+	if !ok {
+		sport = "Other"
+	}
+
+	activity := tcxActivity{
+		Sport: sport,
+		Id:    sa.StartDate.UTC(),
+		Notes: sa.Name,
+	}
+
+	laps := sa.Laps
+	if len(laps) == 0 {
+		// the whole thing is one lap
+		laps = []models.Lap{{
+			StartDate:        sa.StartDate,
+			ElapsedTime:      sa.ElapsedTime,
+			MovingTime:       sa.MovingTime,
+			Distance:         sa.Distance,
+			AverageHeartRate: sa.AverageHeartRate,
+		}}
+	}
+
+	points := exportPoints(sa)
+
+	for i, l := range laps {
+		lap := tcxLap{
+			StartTime:        l.StartDate.UTC(),
+			TotalTimeSeconds: float64(l.MovingTime),
+			DistanceMeters:   l.Distance,
+			Intensity:        "Active",
+			TriggerMethod:    "Manual",
+		}
+		if len(laps) == 1 {
+			lap.Calories = sa.Calories
+			if sa.MaxHeartRate > 0 {
+				lap.MaxHeartRate = &tcxValue{math.Round(sa.MaxHeartRate)}
+			}
+		}
+		if l.AverageHeartRate > 0 {
+			lap.AverageHeartRate = &tcxValue{math.Round(l.AverageHeartRate)}
+		}
+		if l.AverageWatts > 0 {
+			lap.Extensions = &tcxExtensions{LX: &tcxLX{Xmlns: tcxExtensionNamespace, AvgWatts: float(l.AverageWatts)}}
+		}
+
+		// a lap gets the points from its start to the next lap's
+		lapEnd := time.Time{}
+		if i+1 < len(laps) {
+			lapEnd = laps[i+1].StartDate
+		}
+		for _, p := range points {
+			if (i > 0 && p.Time.Before(l.StartDate)) || (!lapEnd.IsZero() && !p.Time.Before(lapEnd)) {
+				continue
+			}
+			lap.Track = append(lap.Track, tcxTrackpointFrom(p, sa.Discipline))
+		}
+
+		activity.Laps = append(activity.Laps, lap)
+	}
+
+	db := tcxDatabase{Xmlns: tcxNamespace, Activities: []tcxActivity{activity}}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(db)
+}
+
+func tcxTrackpointFrom(p trackPoint, discipline models.Discipline) tcxTrackpoint {
+	tp := tcxTrackpoint{
+		Time:     p.Time,
+		Altitude: p.Altitude,
+		Distance: p.Distance,
+	}
+	if p.LatLng != nil {
+		tp.Position = &tcxPosition{Latitude: p.LatLng[0], Longitude: p.LatLng[1]}
+	}
+	if p.HeartRate != nil {
+		tp.HeartRate = &tcxValue{math.Round(*p.HeartRate)}
+	}
+
+	ext := &tcxTPX{Xmlns: tcxExtensionNamespace, Speed: p.Velocity, Watts: p.Watts}
+	if p.Cadence != nil {
+		// runs keep cadence in the extension, everything else in the trackpoint
+		if discipline == models.DisciplineRun {
+			ext.RunCadence = float(math.Round(*p.Cadence))
+		} else {
+			tp.Cadence = float(math.Round(*p.Cadence))
+		}
+	}
+	if ext.Speed != nil || ext.Watts != nil || ext.RunCadence != nil {
+		tp.Extensions = &tcxExtensions{TPX: ext}
+	}
+
+	return tp
+}
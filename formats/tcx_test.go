@@ -0,0 +1,168 @@
+package formats_test
+
+import (
+	"atc/formats"
+	"atc/models"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// a couple of laps of a run, the way an old forerunner writes them
+const testTCX = `<?xml version="1.0" encoding="UTF-8"?>
+<TrainingCenterDatabase xmlns="http://www.garmin.com/xmlschemas/TrainingCenterDatabase/v2" xmlns:ns3="http://www.garmin.com/xmlschemas/ActivityExtension/v2">
+  <Activities>
+    <Activity Sport="Running">
+      <Id>2024-08-01T06:00:00Z</Id>
+      <Lap StartTime="2024-08-01T06:00:00Z">
+        <TotalTimeSeconds>2</TotalTimeSeconds>
+        <DistanceMeters>6</DistanceMeters>
+        <Calories>1</Calories>
+        <AverageHeartRateBpm><Value>140</Value></AverageHeartRateBpm>
+        <MaximumHeartRateBpm><Value>141</Value></MaximumHeartRateBpm>
+        <Intensity>Active</Intensity>
+        <TriggerMethod>Distance</TriggerMethod>
+        <Track>
+          <Trackpoint>
+            <Time>2024-08-01T06:00:00Z</Time>
+            <Position><LatitudeDegrees>45.5</LatitudeDegrees><LongitudeDegrees>-122.6</LongitudeDegrees></Position>
+            <AltitudeMeters>10</AltitudeMeters>
+            <DistanceMeters>0</DistanceMeters>
+            <HeartRateBpm><Value>139</Value></HeartRateBpm>
+            <Extensions><ns3:TPX><ns3:Speed>3</ns3:Speed><ns3:RunCadence>88</ns3:RunCadence></ns3:TPX></Extensions>
+          </Trackpoint>
+          <Trackpoint>
+            <Time>2024-08-01T06:00:02Z</Time>
+            <AltitudeMeters>12</AltitudeMeters>
+            <DistanceMeters>6</DistanceMeters>
+            <HeartRateBpm><Value>141</Value></HeartRateBpm>
+            <Extensions><ns3:TPX><ns3:Speed>3</ns3:Speed></ns3:TPX></Extensions>
+          </Trackpoint>
+        </Track>
+      </Lap>
+      <Lap StartTime="2024-08-01T06:00:02Z">
+        <TotalTimeSeconds>2</TotalTimeSeconds>
+        <DistanceMeters>6</DistanceMeters>
+        <Calories>1</Calories>
+        <AverageHeartRateBpm><Value>150</Value></AverageHeartRateBpm>
+        <MaximumHeartRateBpm><Value>152</Value></MaximumHeartRateBpm>
+        <Intensity>Active</Intensity>
+        <TriggerMethod>Distance</TriggerMethod>
+        <Track>
+          <Trackpoint>
+            <Time>2024-08-01T06:00:04Z</Time>
+            <Position><LatitudeDegrees>45.5001</LatitudeDegrees><LongitudeDegrees>-122.6</LongitudeDegrees></Position>
+            <AltitudeMeters>11</AltitudeMeters>
+            <DistanceMeters>12</DistanceMeters>
+            <HeartRateBpm><Value>152</Value></HeartRateBpm>
+          </Trackpoint>
+        </Track>
+      </Lap>
+      <Notes>Track Tuesday</Notes>
+    </Activity>
+  </Activities>
+</TrainingCenterDatabase>`
+
+func TestParseTCX(t *testing.T) {
+	activities, err := formats.Parse("run.tcx", strings.NewReader(testTCX))
+	assert.NoError(t, err)
+	if !assert.Len(t, activities, 1) {
+		return
+	}
+
+	a := activities[0]
+	start := time.Date(2024, 8, 1, 6, 0, 0, 0, time.UTC)
+	assert.Equal(t, formats.ImportedID(start), a.Id)
+	assert.Equal(t, "Run", a.Type)
+	assert.Equal(t, "Track Tuesday", a.Name)
+	assert.Equal(t, formats.SourceTCX, a.Source)
+	assert.Equal(t, 4, a.ElapsedTime)
+	assert.Equal(t, 4, a.MovingTime)
+	assert.Equal(t, 12.0, a.Distance)
+	assert.Equal(t, 2, a.Calories)
+	assert.InDelta(t, 145, a.AverageHeartRate, 0.001)
+	assert.Equal(t, 152.0, a.MaxHeartRate)
+	assert.Equal(t, 2.0, a.TotalElevationGain)
+	assert.Equal(t, []float64{45.5, -122.6}, a.StartLatLng)
+	assert.Len(t, a.Laps, 2)
+
+	if assert.NotNil(t, a.Streams) {
+		assert.Equal(t, []int{0, 2, 4}, a.Streams.Time)
+		assert.Equal(t, []float64{139, 141, 152}, a.Streams.HeartRate)
+		assert.Equal(t, []float64{3, 3, 3}, a.Streams.Velocity)
+		assert.Equal(t, []float64{88, 88, 88}, a.Streams.Cadence)
+		// no fix on the second point, so it stays where it was
+		assert.Equal(t, [][]float64{{45.5, -122.6}, {45.5, -122.6}, {45.5001, -122.6}}, a.Streams.LatLng)
+		assert.Nil(t, a.Streams.Watts)
+	}
+
+	// swims are Other in TCX, which we can't tell from yoga
+	_, err = formats.ParseTCX(strings.NewReader(strings.Replace(testTCX, "Running", "Other", 1)))
+	assert.True(t, errors.Is(err, formats.ErrUnsupportedSport))
+}
+
+func TestWriteTCX(t *testing.T) {
+	start := time.Date(2024, 8, 1, 6, 0, 0, 0, time.UTC)
+
+	// a ride from strava, streams and all
+	ride := models.StravaActivity{
+		Id:               99,
+		Name:             "Hill Repeats",
+		Type:             "Ride",
+		Discipline:       models.DisciplineBike,
+		StartDate:        start,
+		ElapsedTime:      2,
+		MovingTime:       2,
+		Distance:         20,
+		Calories:         3,
+		AverageHeartRate: 130,
+		MaxHeartRate:     135,
+		Source:           "strava",
+		Streams: &models.Streams{
+			Time:      []int{0, 1, 2},
+			HeartRate: []float64{125, 130, 135},
+			Watts:     []float64{200, 250, 300},
+			Cadence:   []float64{85, 90, 95},
+			Distance:  []float64{0, 10, 20},
+			LatLng:    [][]float64{{45.5, -122.6}, {45.5001, -122.6}, {45.5002, -122.6}},
+		},
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, formats.WriteTCX(&buf, ride))
+	assert.Contains(t, buf.String(), `Sport="Biking"`)
+	assert.Contains(t, buf.String(), "<Watts>250</Watts>")
+
+	// and it comes back the same
+	activities, err := formats.ParseTCX(&buf)
+	assert.NoError(t, err)
+	if assert.Len(t, activities, 1) {
+		a := activities[0]
+		assert.Equal(t, "Ride", a.Type)
+		assert.Equal(t, "Hill Repeats", a.Name)
+		assert.True(t, start.Equal(a.StartDate))
+		assert.Equal(t, 20.0, a.Distance)
+		assert.Equal(t, 3, a.Calories)
+		assert.Equal(t, ride.Streams.Time, a.Streams.Time)
+		assert.Equal(t, ride.Streams.HeartRate, a.Streams.HeartRate)
+		assert.Equal(t, ride.Streams.Watts, a.Streams.Watts)
+		assert.Equal(t, ride.Streams.Cadence, a.Streams.Cadence)
+		assert.Equal(t, ride.Streams.LatLng, a.Streams.LatLng)
+		assert.True(t, a.DeviceWatts)
+	}
+
+	// no streams is still a file, just a short one
+	buf.Reset()
+	ride.Streams = nil
+	assert.NoError(t, formats.WriteTCX(&buf, ride))
+	activities, err = formats.ParseTCX(&buf)
+	assert.NoError(t, err)
+	if assert.Len(t, activities, 1) {
+		assert.Nil(t, activities[0].Streams)
+		assert.InDelta(t, 130, activities[0].AverageHeartRate, 0.001)
+	}
+}
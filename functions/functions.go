@@ -1,3 +1,30 @@
 package functions
 
 // package base for various functions used in calculations
+//
+// this is the one place the training load formulas live. everything in here works on plain
+// numbers and slices (no activities, no streams, no strava) so that it can be read, tested,
+// and argued about without dragging the rest of the app along. models and planning call in
+// here; nothing in here calls out.
+//
+// units, unless a function says otherwise:
+//   - durations are in seconds
+//   - heart rate is in bpm, power in watts
+//   - pace is handled as speed, in meters per second, so that "bigger is harder" holds for
+//     every metric. PaceToSpeed and SpeedToPace convert at the edges.
+
+// PaceToSpeed converts a pace (seconds per `meters`, e.g. 270 seconds per 1000m) to meters per second.
+func PaceToSpeed(seconds float64, meters float64) float64 {
+	if seconds <= 0 {
+		return 0
+	}
+	return meters / seconds
+}
+
+// SpeedToPace converts meters per second to a pace (seconds per `meters`).
+func SpeedToPace(speed float64, meters float64) float64 {
+	if speed <= 0 {
+		return 0
+	}
+	return meters / speed
+}
@@ -1,8 +1,132 @@
 package functions
 
+import (
+	"time"
+)
+
 // package with functions and structures used for creating/storing thresholds
 
+// Metric is the kind of measurement a threshold is expressed in.
+type Metric string
+
+const (
+	MetricHR    Metric = "hr"    // lactate threshold heart rate, bpm
+	MetricPace  Metric = "pace"  // threshold pace, stored as speed in m/s
+	MetricPower Metric = "power" // functional threshold power, watts
+)
+
+// sports, as far as the formulas are concerned
+const (
+	SportSwim = "swim"
+	SportBike = "bike"
+	SportRun  = "run"
+)
+
 // public structs
 
+// Threshold is an athlete's threshold for one sport and metric, from a given date onwards.
+// It's the denominator of every intensity factor.
 type Threshold struct {
+	Sport         string    `json:"sport"`
+	Metric        Metric    `json:"metric"`
+	Value         float64   `json:"value"`
+	EffectiveDate time.Time `json:"effective_date"`
+}
+
+// NewThreshold constructs a Threshold.
+func NewThreshold(sport string, metric Metric, value float64, effectiveDate time.Time) Threshold {
+	return Threshold{
+		Sport:         sport,
+		Metric:        metric,
+		Value:         value,
+		EffectiveDate: effectiveDate,
+	}
+}
+
+// Valid returns true if the threshold can be used to score anything.
+func (t Threshold) Valid() bool {
+	return t.Value > 0
+}
+
+// IntensityFactor returns value (normalized power, graded speed, heart rate...) as a
+// fraction of the threshold.
+func (t Threshold) IntensityFactor(value float64) float64 {
+	return IntensityFactor(value, t.Value)
+}
+
+// TSS scores `seconds` at the (normalized) value against the threshold, and returns the
+// rounded TSS and the intensity factor. Swim pace uses the cubic formula, everything else
+// the square.
+func (t Threshold) TSS(seconds int, value float64) (int, float64) {
+	if !t.Valid() {
+		return 0, 0
+	}
+
+	IF := t.IntensityFactor(value)
+
+	if t.Sport == SportSwim && t.Metric == MetricPace {
+		return roundTSS(SwimTSS(float64(seconds), IF)), IF
+	}
+
+	return roundTSS(TSS(float64(seconds), IF)), IF
+}
+
+// zeroTime is the effective date of thresholds that are built on the fly and don't have one
+var zeroTime time.Time
+
+//
+// estimating thresholds from hard efforts
+//
+
+// the usual field tests, and the fudge factors that turn them into thresholds:
+//   - 20 minutes all out on the bike: ftp is 95% of average power, lthr 95% of average hr
+//   - 30 minutes all out running solo: threshold pace is the average pace, and lthr is the
+//     average hr over the last 20 minutes
+//
+// an athlete doesn't have to do a formal test for these to be useful; a race or a hard
+// workout that contains the same effort tells us the same thing.
+const (
+	TwentyMinutes = 20 * 60
+	ThirtyMinutes = 30 * 60
+
+	// TwentyMinuteFactor scales a 20 minute best effort (power, hr, or speed) to threshold
+	TwentyMinuteFactor = 0.95
+)
+
+// BestAverage returns the highest average over any `window` consecutive samples of series
+// (sampled once per second), and the index that window starts at. If the series is shorter
+// than the window there is no best average and start is -1.
+func BestAverage(series []float64, window int) (float64, int) {
+	if window <= 0 || len(series) < window {
+		return 0, -1
+	}
+
+	var sum float64
+	for _, v := range series[:window] {
+		sum += v
+	}
+
+	best, start := sum, 0
+	for i := window; i < len(series); i++ {
+		sum += series[i] - series[i-window]
+		if sum > best {
+			best, start = sum, i-window+1
+		}
+	}
+
+	return best / float64(window), start
+}
+
+// Average returns the mean of series.
+func Average(series []float64) float64 {
+	if len(series) == 0 {
+		return 0
+	}
+
+	var sum float64
+	for _, v := range series {
+		sum += v
+	}
+
+	return sum / float64(len(series))
 }
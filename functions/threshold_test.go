@@ -0,0 +1,73 @@
+package functions_test
+
+import (
+	"atc/functions"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewThreshold(t *testing.T) {
+	effective := time.Date(2024, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	threshold := functions.NewThreshold(functions.SportBike, functions.MetricPower, 250, effective)
+
+	assert.Equal(t, functions.SportBike, threshold.Sport)
+	assert.Equal(t, functions.MetricPower, threshold.Metric)
+	assert.Equal(t, 250.0, threshold.Value)
+	assert.Equal(t, effective, threshold.EffectiveDate)
+	assert.True(t, threshold.Valid())
+
+	assert.False(t, functions.NewThreshold(functions.SportRun, functions.MetricHR, 0, effective).Valid())
+}
+
+func TestThresholdTSS(t *testing.T) {
+	hr := functions.NewThreshold(functions.SportRun, functions.MetricHR, 160, time.Time{})
+	tss, IF := hr.TSS(3600, 144)
+	assert.Equal(t, 81, tss)
+	assert.InDelta(t, 0.9, IF, 1e-9)
+
+	// the same intensity in the pool is cubed, not squared
+	swim := functions.NewThreshold(functions.SportSwim, functions.MetricPace, 1, time.Time{})
+	tss, IF = swim.TSS(3600, 0.9)
+	assert.Equal(t, 73, tss)
+	assert.InDelta(t, 0.9, IF, 1e-9)
+
+	// an invalid threshold scores nothing
+	tss, IF = functions.Threshold{}.TSS(3600, 144)
+	assert.Equal(t, 0, tss)
+	assert.Equal(t, 0.0, IF)
+}
+
+func TestPaceToSpeed(t *testing.T) {
+	// 4:00/km is 4.17 m/s
+	assert.InDelta(t, 1000.0/240, functions.PaceToSpeed(240, 1000), 1e-9)
+	assert.InDelta(t, 240, functions.SpeedToPace(1000.0/240, 1000), 1e-9)
+
+	assert.Equal(t, 0.0, functions.PaceToSpeed(0, 1000))
+	assert.Equal(t, 0.0, functions.SpeedToPace(0, 1000))
+}
+
+func TestBestAverage(t *testing.T) {
+	// ten minutes easy, twenty minutes hard, ten minutes easy
+	series := make([]float64, 40*60)
+	for i := range series {
+		series[i] = 150
+		if i >= 600 && i < 1800 {
+			series[i] = 280
+		}
+	}
+
+	best, start := functions.BestAverage(series, functions.TwentyMinutes)
+	assert.InDelta(t, 280, best, 1e-9)
+	assert.Equal(t, 600, start)
+
+	// too short to have a best twenty minutes
+	best, start = functions.BestAverage(series[:60], functions.TwentyMinutes)
+	assert.Equal(t, 0.0, best)
+	assert.Equal(t, -1, start)
+
+	assert.InDelta(t, 215, functions.Average([]float64{150, 280}), 1e-9)
+	assert.Equal(t, 0.0, functions.Average(nil))
+}
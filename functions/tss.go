@@ -1,5 +1,9 @@
 package functions
 
+import (
+	"math"
+)
+
 // includes functions for tss, ctl, and atl calculations
 
 // tss is the training stress score, a measure of the overall training load of a workout
@@ -14,3 +18,285 @@ package functions
 // atl (sometimes called "fatigue") is acute training load, or the rolling average of tss over 7 days.
 
 // tsb (sometimes called "form") is training stress balance, or the difference between ctl and atl.
+
+const (
+	// CTLDays is the time constant (in days) for chronic training load
+	CTLDays = 42
+
+	// ATLDays is the time constant (in days) for acute training load
+	ATLDays = 7
+
+	// NormalizationWindow is the rolling average window, in seconds, for normalized power
+	// and normalized graded pace
+	NormalizationWindow = 30
+)
+
+//
+// intensity and tss
+//
+
+// IntensityFactor returns value as a fraction of threshold.
+func IntensityFactor(value float64, threshold float64) float64 {
+	if threshold <= 0 {
+		return 0
+	}
+	return value / threshold
+}
+
+// TSS is the general formula: hours × IF² × 100. For power this is the same thing as
+// (sec × NP × IF) / (FTP × 3600) × 100, it just doesn't look like it.
+func TSS(seconds float64, IF float64) float64 {
+	return seconds / 3600 * IF * IF * 100
+}
+
+// SwimTSS is the swim formula: hours × IF³ × 100. Water resistance rises with roughly the
+// cube of speed, so swimming a little faster than threshold costs a lot more.
+func SwimTSS(seconds float64, IF float64) float64 {
+	return seconds / 3600 * math.Pow(IF, 3) * 100
+}
+
+// IntensityFactorForTSS inverts TSS: the steady intensity that would produce tss in seconds.
+func IntensityFactorForTSS(tss float64, seconds float64) float64 {
+	if seconds <= 0 || tss <= 0 {
+		return 0
+	}
+	return math.Sqrt(tss / (seconds / 3600 * 100))
+}
+
+func roundTSS(tss float64) int {
+	return int(math.Round(tss))
+}
+
+//
+// heart rate
+//
+
+// HrTSS calculates hrTSS from average heart rate over moving time. This under-counts anything
+// with intervals in it; use ZoneHrTSS when there's a heart rate stream.
+func HrTSS(movingTime int, avgHR float64, thresholdHR float64) (int, float64) {
+	IF := IntensityFactor(avgHR, thresholdHR)
+	return roundTSS(TSS(float64(movingTime), IF)), IF
+}
+
+// ZoneHrTSS calculates hrTSS by integrating time-in-zone, given the number of seconds spent
+// at each heart rate. The intensity factor returned is the equivalent steady-state IF, i.e.
+// the one that would produce the same hrTSS over the same time.
+func ZoneHrTSS(timeAtHeartRate map[int]float64, thresholdHR float64) (int, float64) {
+	if thresholdHR <= 0 {
+		return 0, 0
+	}
+
+	var hrTSS, seconds float64
+	for hr, dt := range timeAtHeartRate {
+		hrTSS += TSS(dt, IntensityFactor(float64(hr), thresholdHR))
+		seconds += dt
+	}
+
+	if seconds == 0 {
+		return 0, 0
+	}
+
+	return roundTSS(hrTSS), IntensityFactorForTSS(hrTSS, seconds)
+}
+
+// TRIMP (training impulse, "trimps" or "ttss") attempts to quantify the training load of a
+// workout incorporating both the duration and intensity of the workout.
+func TRIMP(durationMinutes float64, avgHR float64, thresholdHR float64) float64 {
+	IF := IntensityFactor(avgHR, thresholdHR)
+	return durationMinutes * IF * math.Pow(IF, 2)
+}
+
+//
+// power
+//
+
+// NormalizedPower is the power you could have held steadily for the same physiological cost:
+// the fourth root of the mean of the fourth power of the 30 second rolling average. watts must
+// be sampled once per second. Anything shorter than the rolling window returns zero.
+func NormalizedPower(watts []float64) float64 {
+	return rollingFourthPowerMean(watts, NormalizationWindow)
+}
+
+// PowerTSS calculates TSS from normalized power: (sec × NP × IF) / (FTP × 3600) × 100.
+func PowerTSS(seconds int, normalizedPower float64, ftp float64) (int, float64) {
+	return NewThreshold(SportBike, MetricPower, ftp, zeroTime).TSS(seconds, normalizedPower)
+}
+
+//
+// pace
+//
+
+// maxGrade is the steepest slope minetti measured. beyond it the polynomial goes sideways.
+const maxGrade = 0.45
+
+// MinettiCost is the energy cost of running at the given grade (as a fraction), in joules
+// per kg per meter:
+//
+//	C(i) = 155.4i^5 - 30.4i^4 - 43.3i^3 + 46.3i^2 + 19.5i + 3.6
+func MinettiCost(grade float64) float64 {
+	i := math.Max(-maxGrade, math.Min(maxGrade, grade))
+	return 155.4*math.Pow(i, 5) - 30.4*math.Pow(i, 4) - 43.3*math.Pow(i, 3) + 46.3*i*i + 19.5*i + 3.6
+}
+
+// GradeFactor is the multiple of flat-ground effort that running at the given grade costs.
+// Multiply a speed by it to get the flat-ground speed of equal effort.
+func GradeFactor(grade float64) float64 {
+	return MinettiCost(grade) / MinettiCost(0)
+}
+
+// NormalizedGradedSpeed is normalized graded pace ("ngp"), as a speed: grade adjusted speed
+// normalized the same way as power. gradedSpeeds must be sampled once per second.
+func NormalizedGradedSpeed(gradedSpeeds []float64) float64 {
+	return rollingFourthPowerMean(gradedSpeeds, NormalizationWindow)
+}
+
+// AverageGradedSpeed estimates graded speed from an activity summary. We assume the course
+// climbs and descends the same amount (it's usually a loop or an out-and-back), so half the
+// distance is run uphill at the average climbing grade and half downhill at the same grade.
+func AverageGradedSpeed(distance float64, movingTime int, elevationGain float64) float64 {
+	if distance <= 0 || movingTime <= 0 {
+		return 0
+	}
+
+	speed := distance / float64(movingTime)
+	grade := elevationGain / (distance / 2)
+
+	return speed * (GradeFactor(grade) + GradeFactor(-grade)) / 2
+}
+
+// PaceTSS calculates rTSS from a graded speed against threshold speed (both in m/s).
+func PaceTSS(seconds int, speed float64, thresholdSpeed float64) (int, float64) {
+	return NewThreshold(SportRun, MetricPace, thresholdSpeed, zeroTime).TSS(seconds, speed)
+}
+
+// SwimPaceTSS calculates sTSS from distance and moving time against threshold speed (m/s).
+func SwimPaceTSS(distance float64, movingTime int, thresholdSpeed float64) (int, float64) {
+	if distance <= 0 || movingTime <= 0 {
+		return 0, 0
+	}
+	return NewThreshold(SportSwim, MetricPace, thresholdSpeed, zeroTime).TSS(movingTime, distance/float64(movingTime))
+}
+
+//
+// training load
+//
+
+// NextLoad advances an exponentially weighted training load by one day:
+// load_today = load_yesterday + (tss_today - load_yesterday) / days
+func NextLoad(previous float64, tss float64, days int) float64 {
+	if days <= 0 {
+		return previous
+	}
+	return previous + (tss-previous)/float64(days)
+}
+
+// Load runs NextLoad over a series of daily TSS (rest days included, as zeros) starting
+// from zero, and returns the load at the end of the last day.
+func Load(dailyTSS []float64, days int) float64 {
+	var load float64
+	for _, tss := range dailyTSS {
+		load = NextLoad(load, tss, days)
+	}
+	return load
+}
+
+// CTL is chronic training load ("fitness") at the end of a series of daily TSS.
+func CTL(dailyTSS []float64) float64 {
+	return Load(dailyTSS, CTLDays)
+}
+
+// ATL is acute training load ("fatigue") at the end of a series of daily TSS.
+func ATL(dailyTSS []float64) float64 {
+	return Load(dailyTSS, ATLDays)
+}
+
+// TSB is training stress balance ("form"). Trainingpeaks uses yesterday's ctl and atl for
+// today's tsb, i.e. how you show up to today's workout, so that's what callers should pass.
+func TSB(ctl float64, atl float64) float64 {
+	return ctl - atl
+}
+
+// RampRate is the change in CTL per week between two points `days` apart. Somewhere around
+// 5-8 a week is sustainable; much more than that is how people get hurt.
+func RampRate(fromCTL float64, toCTL float64, days int) float64 {
+	if days <= 0 {
+		return 0
+	}
+	return (toCTL - fromCTL) / float64(days) * 7
+}
+
+// WeeklyTSS is the TSS for a week, spread evenly over it, that takes CTL from fromCTL to
+// toCTL. Holding CTL where it is takes 7 times CTL.
+func WeeklyTSS(fromCTL float64, toCTL float64) float64 {
+	kept := math.Pow(1-1/float64(CTLDays), 7)
+	return math.Max(0, (toCTL-fromCTL*kept)/(1-kept)*7)
+}
+
+// CTLAfterWeek is what CTL is after a week of weeklyTSS, spread evenly over it.
+func CTLAfterWeek(fromCTL float64, weeklyTSS float64) float64 {
+	ctl := fromCTL
+	for day := 0; day < 7; day++ {
+		ctl = NextLoad(ctl, weeklyTSS/7, CTLDays)
+	}
+	return ctl
+}
+
+// performance is a guess at what fitness is worth, and the guesses are here so there's one
+// place to argue with them:
+//   - riegel: the time for a distance goes up with the distance to the 1.06, so the speed you
+//     can hold drops off (slowly) with how long you hold it. threshold is the speed you can
+//     hold for an hour.
+//   - threshold speed goes up with CTL to the FitnessExponent, so doubling CTL is worth about
+//     ten percent. it's a SWAG, and it's only meant to hold for CTLs in the same ballpark.
+
+const (
+	// RiegelExponent is how much longer a longer race takes
+	RiegelExponent = 1.06
+
+	// FitnessExponent is how much faster more CTL makes you
+	FitnessExponent = 0.15
+)
+
+// SustainableIntensity is the IF that can be held for `seconds`: 1 for an hour, more for
+// less, less for more.
+func SustainableIntensity(seconds float64) float64 {
+	if seconds <= 0 {
+		return 0
+	}
+	return math.Pow(seconds/3600, 1/RiegelExponent-1)
+}
+
+// RequiredCTL is the CTL it takes to bring threshold speed (or power) from current up to
+// target, for an athlete whose CTL is currentCTL now.
+func RequiredCTL(currentCTL float64, current float64, target float64) float64 {
+	if currentCTL <= 0 || current <= 0 {
+		return 0
+	}
+	return currentCTL * math.Pow(target/current, 1/FitnessExponent)
+}
+
+//
+// helpers
+//
+
+// rollingFourthPowerMean is the normalization shared by normalized power and normalized graded
+// pace: take the rolling average over window samples, raise each to the fourth power, average
+// those, and take the fourth root.
+func rollingFourthPowerMean(series []float64, window int) float64 {
+	if window <= 0 || len(series) < window {
+		return 0
+	}
+
+	var rolling, sum float64
+	for i, v := range series {
+		rolling += v
+		if i >= window {
+			rolling -= series[i-window]
+		}
+		if i >= window-1 {
+			sum += math.Pow(math.Max(rolling, 0)/float64(window), 4)
+		}
+	}
+
+	return math.Pow(sum/float64(len(series)-window+1), 0.25)
+}
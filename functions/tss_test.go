@@ -0,0 +1,185 @@
+package functions_test
+
+import (
+	"atc/functions"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIntensityFactor(t *testing.T) {
+	assert.InDelta(t, 0.8, functions.IntensityFactor(128, 160), 1e-9)
+
+	// no threshold is not a divide by zero
+	assert.Equal(t, 0.0, functions.IntensityFactor(128, 0))
+}
+
+func TestTSS(t *testing.T) {
+	// an hour at threshold is 100, half an hour is 50
+	assert.InDelta(t, 100, functions.TSS(3600, 1), 1e-9)
+	assert.InDelta(t, 50, functions.TSS(1800, 1), 1e-9)
+
+	// the readme's long run: 90 minutes at IF .7
+	assert.InDelta(t, 73.5, functions.TSS(5400, 0.7), 1e-9)
+
+	// and back again
+	assert.InDelta(t, 0.7, functions.IntensityFactorForTSS(73.5, 5400), 1e-9)
+}
+
+func TestHrTSS(t *testing.T) {
+	tss, IF := functions.HrTSS(3600, 144, 160)
+	assert.Equal(t, 81, tss)
+	assert.InDelta(t, 0.9, IF, 1e-9)
+
+	// half an hour at 176 and half an hour at 104 averages 140 but costs more than 140
+	tss, IF = functions.ZoneHrTSS(map[int]float64{176: 1800, 104: 1800}, 160)
+	assert.Equal(t, 82, tss)
+	assert.Greater(t, IF, 140.0/160)
+
+	tss, IF = functions.ZoneHrTSS(map[int]float64{}, 160)
+	assert.Equal(t, 0, tss)
+	assert.Equal(t, 0.0, IF)
+}
+
+func TestTRIMP(t *testing.T) {
+	assert.InDelta(t, 60, functions.TRIMP(60, 160, 160), 1e-9)
+	assert.InDelta(t, 60*0.512, functions.TRIMP(60, 128, 160), 1e-9)
+}
+
+func TestNormalizedPower(t *testing.T) {
+	steady := make([]float64, 3600)
+	intervals := make([]float64, 3600)
+	for i := range steady {
+		steady[i] = 200
+		intervals[i] = 100
+		if (i/300)%2 == 0 {
+			intervals[i] = 300
+		}
+	}
+
+	assert.InDelta(t, 200, functions.NormalizedPower(steady), 1e-9)
+	assert.Greater(t, functions.NormalizedPower(intervals), 240.0)
+
+	// shorter than the rolling window
+	assert.Equal(t, 0.0, functions.NormalizedPower(steady[:10]))
+}
+
+func TestPowerTSS(t *testing.T) {
+	// an hour at ftp is 100 tss
+	tss, IF := functions.PowerTSS(3600, 250, 250)
+	assert.Equal(t, 100, tss)
+	assert.InDelta(t, 1.0, IF, 1e-9)
+
+	// two hours at 0.75 is 112.5
+	tss, IF = functions.PowerTSS(7200, 187.5, 250)
+	assert.Equal(t, 113, tss)
+	assert.InDelta(t, 0.75, IF, 1e-9)
+
+	// no ftp, no tss
+	tss, _ = functions.PowerTSS(3600, 250, 0)
+	assert.Equal(t, 0, tss)
+}
+
+func TestGradeFactor(t *testing.T) {
+	assert.InDelta(t, 1.0, functions.GradeFactor(0), 1e-9)
+
+	// uphill is harder, gentle downhill is easier, and steep downhill is harder again
+	assert.Greater(t, functions.GradeFactor(0.05), 1.2)
+	assert.Less(t, functions.GradeFactor(-0.05), 1.0)
+	assert.Greater(t, functions.GradeFactor(-0.45), functions.GradeFactor(-0.1))
+
+	// a flat course is just average speed
+	assert.InDelta(t, 4.0, functions.AverageGradedSpeed(14400, 3600, 0), 1e-9)
+	assert.Greater(t, functions.AverageGradedSpeed(14400, 3600, 200), 4.0)
+	assert.Equal(t, 0.0, functions.AverageGradedSpeed(0, 3600, 0))
+}
+
+func TestPaceTSS(t *testing.T) {
+	threshold := functions.PaceToSpeed(270, 1000)
+
+	// an hour at threshold pace is 100 tss
+	tss, IF := functions.PaceTSS(3600, threshold, threshold)
+	assert.Equal(t, 100, tss)
+	assert.InDelta(t, 1.0, IF, 1e-9)
+
+	tss, _ = functions.PaceTSS(3600, threshold, 0)
+	assert.Equal(t, 0, tss)
+}
+
+func TestSwimPaceTSS(t *testing.T) {
+	threshold := functions.PaceToSpeed(100, 100)
+
+	// an hour at threshold pace (1:40/100m, 3600m) is 100 tss
+	tss, IF := functions.SwimPaceTSS(3600, 3600, threshold)
+	assert.Equal(t, 100, tss)
+	assert.InDelta(t, 1.0, IF, 1e-9)
+
+	// swimming 10% slower than threshold costs about 27% less, not 19%
+	tss, IF = functions.SwimPaceTSS(3600, 3960, threshold)
+	assert.InDelta(t, 1/1.1, IF, 1e-9)
+	assert.Equal(t, 83, tss)
+
+	tss, _ = functions.SwimPaceTSS(0, 3600, threshold)
+	assert.Equal(t, 0, tss)
+}
+
+func TestLoad(t *testing.T) {
+	// one big day then six weeks of nothing
+	daily := make([]float64, 43)
+	daily[0] = 420
+
+	assert.InDelta(t, 10, functions.NextLoad(0, 420, 42), 1e-9)
+	assert.InDelta(t, 60, functions.NextLoad(0, 420, 7), 1e-9)
+
+	ctl := functions.CTL(daily)
+	atl := functions.ATL(daily)
+	assert.Less(t, ctl, 10.0)
+	assert.Less(t, atl, ctl)
+	assert.Greater(t, functions.TSB(ctl, atl), 0.0)
+
+	// a steady 50 a day converges on 50
+	steady := make([]float64, 365)
+	for i := range steady {
+		steady[i] = 50
+	}
+	assert.InDelta(t, 50, functions.CTL(steady), 0.01)
+	assert.InDelta(t, 50, functions.ATL(steady), 0.01)
+}
+
+func TestRampRate(t *testing.T) {
+	assert.InDelta(t, 5, functions.RampRate(40, 45, 7), 1e-9)
+	assert.InDelta(t, 2.5, functions.RampRate(40, 50, 28), 1e-9)
+	assert.Equal(t, 0.0, functions.RampRate(40, 50, 0))
+}
+
+func TestWeeklyTSS(t *testing.T) {
+	// holding steady is 7 times ctl
+	assert.InDelta(t, 350, functions.WeeklyTSS(50, 50), 1e-9)
+	assert.InDelta(t, 50, functions.CTLAfterWeek(50, 350), 1e-9)
+
+	// and they agree with each other going up
+	assert.InDelta(t, 45, functions.CTLAfterWeek(40, functions.WeeklyTSS(40, 45)), 1e-9)
+
+	// a week off
+	assert.Equal(t, 0.0, functions.WeeklyTSS(50, 10))
+	assert.Less(t, functions.CTLAfterWeek(50, 0), 50.0)
+}
+
+func TestSustainableIntensity(t *testing.T) {
+	// an hour is threshold, by definition
+	assert.InDelta(t, 1, functions.SustainableIntensity(3600), 1e-9)
+	assert.Greater(t, functions.SustainableIntensity(1200), 1.0)
+	assert.Less(t, functions.SustainableIntensity(4*3600), 1.0)
+	assert.Equal(t, 0.0, functions.SustainableIntensity(0))
+}
+
+func TestRequiredCTL(t *testing.T) {
+	// no faster, no fitter
+	assert.InDelta(t, 50, functions.RequiredCTL(50, 4, 4), 1e-9)
+
+	// doubling ctl is worth about ten percent
+	assert.InDelta(t, 100, functions.RequiredCTL(50, 4, 4*math.Pow(2, functions.FitnessExponent)), 1e-9)
+
+	assert.Equal(t, 0.0, functions.RequiredCTL(0, 4, 5))
+}
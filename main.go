@@ -4,6 +4,9 @@ import (
 	"atc/service"
 	"os"
 	"path/filepath"
+
+	// the container doesn't ship a zoneinfo database, so bake one into the binary
+	_ "time/tzdata"
 )
 
 func main() {
@@ -1,29 +1,51 @@
 package models
 
 import (
-	"math"
+	"atc/functions"
 	"time"
 )
 
 // Activity is a simplified version of StravaActivity for internal use.
 type Activity struct {
-	Id                 int64     `json:"id"`
-	Name               string    `json:"name"`
-	Distance           float64   `json:"distance"`             // in meters
-	MovingTime         int       `json:"moving_time"`          // in seconds
-	ElapsedTime        int       `json:"elapsed_time"`         // in seconds
-	TotalElevationGain float64   `json:"total_elevation_gain"` // in meters
-	Type               string    `json:"type"`
-	StartDate          time.Time `json:"start_date"`
-	Calories           int       `json:"calories"`
-	TSS                int       `json:"tss"`               // Rounded TSS
-	Trimps             float64   `json:"trimps"`            // TRIMPS
-	IntensityFactor    float64   `json:"intensity_factor"`  // IF
-	AverageHeartRate   float64   `json:"average_heartrate"` // in bpm
-	MaxHeartRate       float64   `json:"max_heartrate"`     // in bpm
+	Id                 int64      `json:"id"`
+	Name               string     `json:"name"`
+	Distance           float64    `json:"distance"`             // in meters
+	MovingTime         int        `json:"moving_time"`          // in seconds
+	ElapsedTime        int        `json:"elapsed_time"`         // in seconds
+	TotalElevationGain float64    `json:"total_elevation_gain"` // in meters
+	Type               string     `json:"type"`
+	SportType          string     `json:"sport_type"` // strava's name for it, e.g. VirtualRide
+	Discipline         Discipline `json:"discipline"`
+	StartDate          time.Time  `json:"start_date"`
+	Calories           int        `json:"calories"`
+	TSS                int        `json:"tss"`               // Rounded TSS
+	Trimps             float64    `json:"trimps"`            // TRIMPS
+	IntensityFactor    float64    `json:"intensity_factor"`  // IF
+	Method             TSSMethod  `json:"method"`            // which data the TSS was calculated from
+	AverageHeartRate   float64    `json:"average_heartrate"` // in bpm
+	MaxHeartRate       float64    `json:"max_heartrate"`     // in bpm
+	NormalizedPower    float64    `json:"normalized_power"`  // in watts, zero without a power meter
+	GradedPace         float64    `json:"graded_pace"`       // normalized graded pace, in m/s
+	OpenWater          bool       `json:"open_water"`        // swims only
+	Source             string     `json:"source"`            // where it came from: strava, or the kind of file it was imported from
+
+	// scored, but not counted in CTL (an e-bike ride, or a sport we don't know what to do with)
+	ExcludedFromCTL bool `json:"excluded_from_ctl"`
 }
 
-// StravaActivity represents the detailed activity data returned by the Strava API.
+// TSSMethod records which kind of data an activity's TSS was calculated from.
+// These line up with the threshold metric the activity was scored against.
+type TSSMethod string
+
+const (
+	TSSMethodPower = TSSMethod(functions.MetricPower) // normalized power against FTP
+	TSSMethodPace  = TSSMethod(functions.MetricPace)  // (graded) pace against threshold pace
+	TSSMethodHR    = TSSMethod(functions.MetricHR)    // heart rate against threshold heart rate
+)
+
+// StravaActivity represents the detailed activity data returned by the Strava API. It's
+// named for where activities first came from, but it's what every activity source hands
+// us, and Source says which one it was.
 type StravaActivity struct {
 	Id                 int64     `json:"id"`
 	Name               string    `json:"name"`
@@ -32,10 +54,48 @@ type StravaActivity struct {
 	ElapsedTime        int       `json:"elapsed_time"`         // in seconds
 	TotalElevationGain float64   `json:"total_elevation_gain"` // in meters
 	Type               string    `json:"type"`
+	SportType          string    `json:"sport_type"` // strava's more specific type, e.g. VirtualRide
 	StartDate          time.Time `json:"start_date"`
 	Calories           int       `json:"calories"`
 	AverageHeartRate   float64   `json:"average_heartrate"` // in bpm
 	MaxHeartRate       float64   `json:"max_heartrate"`     // in bpm
+
+	// strava's weighted average watts is their take on normalized power. it's only
+	// trustworthy when device_watts is true, otherwise strava made it up.
+	DeviceWatts          bool    `json:"device_watts"`
+	WeightedAverageWatts float64 `json:"weighted_average_watts"`
+
+	// indoors (treadmill, trainer). without a footpod a treadmill run has no distance, and
+	// with one it has a distance but no grade worth believing, so it's scored on the flat.
+	Trainer bool `json:"trainer"`
+
+	// [lat, lng], empty for activities without gps (like pool swims)
+	StartLatLng []float64 `json:"start_latlng"`
+
+	// the time zone it started in, e.g. America/Los_Angeles, if the source says
+	TimeZone string `json:"timezone,omitempty"`
+
+	// ours, not strava's: what SportMap.Map made of SportType
+	Discipline Discipline `json:"discipline"`
+
+	// where the activity came from, e.g. "strava"
+	Source string `json:"source"`
+
+	// laps, for sources that give them to us with the activity
+	Laps []Lap `json:"laps,omitempty"`
+
+	// these come from a separate endpoint and may be nil
+	Streams *Streams `json:"-"`
+}
+
+// Lap is one lap (or split, or length) of an activity.
+type Lap struct {
+	StartDate        time.Time `json:"start_date"`
+	ElapsedTime      int       `json:"elapsed_time"`      // in seconds
+	MovingTime       int       `json:"moving_time"`       // in seconds
+	Distance         float64   `json:"distance"`          // in meters
+	AverageHeartRate float64   `json:"average_heartrate"` // in bpm
+	AverageWatts     float64   `json:"average_watts"`     // in watts
 }
 
 // NewStravaActivity constructs a StravaActivity (presumably from json data)
@@ -55,15 +115,39 @@ func NewStravaActivity(id int64, name string, distance float64, mt int, et int,
 	}
 }
 
-// NewActivity creates a new Activity from a StravaActivity and calculates TSS.
-func NewActivity(sa StravaActivity, thresholdHR float64) Activity {
+// NewUnscoredActivity creates an Activity for a sport we don't score. It has no TSS and
+// doesn't count toward CTL, but it's there for anybody wondering where their yoga went.
+func NewUnscoredActivity(sa StravaActivity) Activity {
+	return Activity{
+		Id:                 sa.Id,
+		Name:               sa.Name,
+		Distance:           sa.Distance,
+		MovingTime:         sa.MovingTime,
+		ElapsedTime:        sa.ElapsedTime,
+		TotalElevationGain: sa.TotalElevationGain,
+		Type:               sa.Type,
+		SportType:          sa.SportType,
+		Discipline:         sa.Discipline,
+		StartDate:          sa.StartDate,
+		Calories:           sa.Calories,
+		AverageHeartRate:   sa.AverageHeartRate,
+		MaxHeartRate:       sa.MaxHeartRate,
+		Source:             sa.Source,
+		ExcludedFromCTL:    true,
+	}
+}
 
-	// calculate our normalized values for fitness
-	hrTSS := calculateHrTSS(sa.MovingTime, sa.AverageHeartRate, thresholdHR)
-	intensityFactor := calculateIntensityFactor(sa.AverageHeartRate, thresholdHR)
-	trimps := CalculateTRIMPS(float64(sa.MovingTime)/60, sa.AverageHeartRate, thresholdHR)
+// NewActivity creates a new Activity from a StravaActivity and calculates TSS using the
+// thresholds for the activity's sport that were in effect when it started. Power is preferred
+// whenever we have both a power meter and an FTP to compare it to, then pace (if there's a
+// threshold pace and the activity actually went somewhere), and heart rate only when neither
+// is available.
+func NewActivity(sa StravaActivity, th SportThresholds) Activity {
+	// score against the thresholds the athlete had on the day, not the ones they have now,
+	// otherwise every re-test rewrites history
+	th = th.On(sa.StartDate)
 
-	return Activity{
+	activity := Activity{
 		// these values are ganked from the strava object
 		Id:                 sa.Id,
 		Name:               sa.Name,
@@ -72,62 +156,106 @@ func NewActivity(sa StravaActivity, thresholdHR float64) Activity {
 		ElapsedTime:        sa.ElapsedTime,
 		TotalElevationGain: sa.TotalElevationGain,
 		Type:               sa.Type,
+		SportType:          sa.SportType,
+		Discipline:         sa.Discipline,
 		StartDate:          sa.StartDate,
 		Calories:           sa.Calories,
 		MaxHeartRate:       sa.MaxHeartRate,
 		AverageHeartRate:   sa.AverageHeartRate,
+		OpenWater:          sa.IsOpenWater(),
+		Source:             sa.Source,
 
 		// these are our values
-		Trimps:          trimps, // 🦐
-		TSS:             hrTSS,
-		IntensityFactor: intensityFactor,
+		Trimps: functions.TRIMP(float64(sa.MovingTime)/60, sa.AverageHeartRate, th.ThresholdHR), // 🦐
 	}
-}
 
-func calculateIntensityFactor(averageHeartRate float64, thresholdHR float64) float64 {
-	return averageHeartRate / thresholdHR
-}
+	// work out which threshold (and which normalized value) to score against
+	var threshold functions.Threshold
+	var value float64
+	seconds := sa.MovingTime
 
-// calculateHrTSS calculates TSS based on heart rate data.
-func calculateHrTSS(movingTime int, avgHR float64, thresholdHR float64) int {
-	// Convert moving time from seconds to hours
-	durationHours := float64(movingTime) / 3600.0
+	power := th.PowerThreshold()
+	swimPace := th.SwimPaceThreshold(activity.OpenWater)
+	runPace := th.RunPaceThreshold()
 
-	// Calculate IF
-	IF := calculateIntensityFactor(avgHR, thresholdHR)
+	switch {
+	case power.Valid() && sa.Streams.HasPower():
+		threshold = power
+		value, seconds = CalculateNormalizedPower(sa.Streams)
+		activity.NormalizedPower = value
 
-	// Calculate hrTSS (this is suspicious but also the number seems accurate so)
-	hrTSS := durationHours * IF * IF * 100
+	case power.Valid() && sa.DeviceWatts && sa.WeightedAverageWatts > 0:
+		// no stream, but strava's summary is close enough to normalized power
+		threshold = power
+		value = sa.WeightedAverageWatts
+		activity.NormalizedPower = value
 
-	return int(math.Round(hrTSS))
-}
+	case swimPace.Valid() && sa.Distance > 0 && sa.MovingTime > 0:
+		threshold = swimPace
+		value = sa.Distance / float64(sa.MovingTime)
 
-// training impulse ("trimps" or "ttss") attempts to quantify the training load of a workout incorporating
-// both the duration and intensity of the workout.
-func CalculateTRIMPS(durationMinutes float64, avgHR float64, thresholdHR float64) float64 {
-	// Calculate IF
-	IF := calculateIntensityFactor(avgHR, thresholdHR)
+	case runPace.Valid() && sa.Streams.HasPace():
+		threshold = runPace
+		if sa.Trainer {
+			value, seconds = CalculateNormalizedPace(sa.Streams)
+		} else {
+			value, seconds = CalculateNormalizedGradedPace(sa.Streams)
+		}
+		activity.GradedPace = value
+
+	case runPace.Valid() && sa.Distance > 0:
+		// no usable speed stream, so work out graded pace from the summary
+		threshold = runPace
+		climbed := sa.TotalElevationGain
+		if sa.Trainer {
+			climbed = 0
+		}
+		value = functions.AverageGradedSpeed(sa.Distance, sa.MovingTime, climbed)
+		activity.GradedPace = value
 
-	trimps := durationMinutes * IF * math.Pow(IF, 2)
+	case sa.Streams.HasHeartRate():
+		// if we have a heart rate stream, that beats the average every time (especially for intervals)
+		activity.TSS, activity.IntensityFactor = CalculateStreamHrTSS(sa.Streams, th.ThresholdHR)
+		activity.Method = TSSMethodHR
+		return activity
 
-	return trimps
+	default:
+		threshold = th.HRThreshold(sa.Discipline.Sport())
+		value = sa.AverageHeartRate
+	}
+
+	activity.TSS, activity.IntensityFactor = threshold.TSS(seconds, value)
+	activity.Method = TSSMethod(threshold.Metric)
+
+	return activity
 }
 
-// calculateCTL calculates the Chronic Training Load (CTL) based on TSS values.
+// CalculateCTL calculates the training load of the supplied activities as of today (UTC),
+// with a time constant of `days`. Activities are bucketed by calendar day and rest days
+// decay the load, so pass 42 for CTL and 7 for ATL. If you want the whole series, or want
+// to bucket days in the athlete's time zone, use NewPMC instead.
 func CalculateCTL(activities []Activity, days int) float64 {
-	decayFactor := 2.0 / float64(days+1)
-	var ctl float64
-
-	// Issue #11
-	// https://github.com/janearc/atc/issues/11
-	for i, activity := range activities {
-		if i == 0 {
-			ctl = float64(activity.TSS)
-		} else {
-			ctl = ctl*(1-decayFactor) + float64(activity.TSS)*decayFactor
+	if len(activities) == 0 || days <= 0 {
+		return 0
+	}
+
+	daily := DailyTSS(activities, time.UTC)
+
+	var first time.Time
+	for day := range daily {
+		if first.IsZero() || day.Before(first) {
+			first = day
 		}
 	}
-	return ctl
+
+	today := StartOfDay(time.Now(), time.UTC)
+
+	var series []float64
+	for day := first; !day.After(today); day = day.AddDate(0, 0, 1) {
+		series = append(series, float64(daily[day]))
+	}
+
+	return functions.Load(series, days)
 }
 
 // calculcate duration calculates the duration of activities in hours.
@@ -141,11 +269,11 @@ func CalculateDurationHrs(activities []Activity) float64 {
 
 // TODO: CalculateVolumeKms(activities []Activity) float64
 
-// FilterActivitiesByType filters the activities by supplied type, e.g., Swim, Ride, Run
-func FilterActivitiesByType(activities []Activity, activityType string) []Activity {
+// FilterActivitiesByType filters the activities by discipline, e.g., Swim, Bike, Run
+func FilterActivitiesByType(activities []Activity, discipline Discipline) []Activity {
 	var filtered []Activity
 	for _, activity := range activities {
-		if activity.Type == activityType {
+		if activity.Discipline == discipline {
 			filtered = append(filtered, activity)
 		}
 	}
@@ -12,7 +12,7 @@ import (
 )
 
 func TestNewActivity(t *testing.T) {
-	// func NewActivity(sa StravaActivity, thresholdHR float64) Activity {
+	// func NewActivity(sa StravaActivity, th SportThresholds) Activity {
 	startTime := "2024-09-05"
 	layout := "2006-01-02"
 
@@ -62,7 +62,7 @@ func TestNewActivity(t *testing.T) {
 	// just determine whether the constructor shit the bed
 	assert.NotNil(t, fake)
 
-	activity := models.NewActivity(fake, 145)
+	activity := models.NewActivity(fake, models.SportThresholds{ThresholdHR: 145})
 
 	assert.NotNil(t, activity)
 
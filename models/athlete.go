@@ -1,5 +1,10 @@
 package models
 
+import (
+	"sort"
+	"time"
+)
+
 // Athlete defines the base structure for an athlete.
 type Athlete struct {
 	Id         string     `json:"id"`         // Unique identifier for the athlete
@@ -9,18 +14,42 @@ type Athlete struct {
 	Sex        string     // not sure if this is strictly required but strava's gonna tell us anyways
 	Activities []Activity `json:"activities"`
 	Thresholds Thresholds
+
+	// where their days start and end, e.g. America/Los_Angeles. strava says with every
+	// activity, and it's empty until one has (in which case config.yml's is used).
+	TimeZone string `json:"timezone"`
+}
+
+// SportThresholds holds the threshold values for a single sport. not every value
+// makes sense for every sport (nobody has a power meter in the pool), and zero
+// means "we don't know."
+//
+// athletes re-test every couple of months, so thresholds change over time. the values
+// at the top level apply from the beginning of time; each entry in History applies from
+// its EffectiveFrom date until the next one, and any value it leaves at zero carries over
+// from before. use On to get the values that applied on a given day.
+type SportThresholds struct {
+	EffectiveFrom time.Time `yaml:"effective_from"` // zero for the base values
+
+	ThresholdHR float64 `yaml:"threshold_hr"` // lactate threshold heart rate, in bpm
+	FTP         float64 `yaml:"ftp"`          // functional threshold power, in watts
+
+	// threshold pace, in seconds per kilometer (run)
+	ThresholdPace float64 `yaml:"threshold_pace"`
+
+	// functional threshold swim pace, in seconds per 100 meters (swim). open water gets its
+	// own because nobody swims a straight line without a black line to follow; if it isn't
+	// set, the pool pace is used.
+	ThresholdSwimPace          float64 `yaml:"threshold_pace_100m"`
+	OpenWaterThresholdSwimPace float64 `yaml:"open_water_threshold_pace_100m"`
+
+	History []SportThresholds `yaml:"history"`
 }
 
 type Thresholds struct {
-	Run struct {
-		ThresholdHR float64 `yaml:"threshold_hr"`
-	} `yaml:"run"`
-	Swim struct {
-		ThresholdHR float64 `yaml:"threshold_hr"`
-	} `yaml:"swim"`
-	Bike struct {
-		ThresholdHR float64 `yaml:"threshold_hr"`
-	} `yaml:"bike"`
+	Run  SportThresholds `yaml:"run"`
+	Swim SportThresholds `yaml:"swim"`
+	Bike SportThresholds `yaml:"bike"`
 }
 
 // NewAthlete creates a new athlete with the provided details.
@@ -29,15 +58,7 @@ func NewAthlete(id, firstName, lastName string, sex string, thresholds *Threshol
 	// doesn't seem to want to give us this data. so we're going to
 	// hack this together from service config
 
-	runThreshold := thresholds.Run.ThresholdHR
-	swimThreshold := thresholds.Swim.ThresholdHR
-	bikeThreshold := thresholds.Bike.ThresholdHR
-
-	t := Thresholds{}
-
-	t.Run.ThresholdHR = runThreshold
-	t.Swim.ThresholdHR = swimThreshold
-	t.Bike.ThresholdHR = bikeThreshold
+	t := *thresholds
 
 	return &Athlete{
 		Id:        id,
@@ -55,13 +76,99 @@ func (a *Athlete) FullName() string {
 }
 
 func (a *Athlete) GetRunThreshold() float64 {
-	return a.Thresholds.Run.ThresholdHR
+	return a.Thresholds.Run.On(time.Now()).ThresholdHR
 }
 
 func (a *Athlete) GetSwimThreshold() float64 {
-	return a.Thresholds.Swim.ThresholdHR
+	return a.Thresholds.Swim.On(time.Now()).ThresholdHR
 }
 
 func (a *Athlete) GetBikeThreshold() float64 {
-	return a.Thresholds.Bike.ThresholdHR
+	return a.Thresholds.Bike.On(time.Now()).ThresholdHR
+}
+
+func (a *Athlete) GetBikeFTP() float64 {
+	return a.Thresholds.Bike.On(time.Now()).FTP
+}
+
+// On returns the thresholds for every sport as they were on date.
+func (t Thresholds) On(date time.Time) Thresholds {
+	return Thresholds{
+		Run:  t.Run.On(date),
+		Swim: t.Swim.On(date),
+		Bike: t.Bike.On(date),
+	}
+}
+
+// On returns the threshold values that applied on date, with the history flattened away.
+// EffectiveFrom is set to the date of the most recent change that was applied.
+func (th SportThresholds) On(date time.Time) SportThresholds {
+	current := th
+	current.History = nil
+
+	for _, change := range th.sortedHistory() {
+		if change.EffectiveFrom.After(date) {
+			break
+		}
+		current = current.apply(change)
+	}
+
+	return current
+}
+
+// Timeline returns the flattened thresholds at the start of each period, oldest first,
+// beginning with the base values.
+func (th SportThresholds) Timeline() []SportThresholds {
+	current := th
+	current.History = nil
+
+	timeline := []SportThresholds{current}
+	for _, change := range th.sortedHistory() {
+		current = current.apply(change)
+		timeline = append(timeline, current)
+	}
+
+	return timeline
+}
+
+// AddChange records a new threshold (from a re-test, say) in the history.
+func (th *SportThresholds) AddChange(change SportThresholds) {
+	change.History = nil
+	th.History = append(th.History, change)
+	th.History = th.sortedHistory()
+}
+
+// sortedHistory returns the history oldest first without touching the original.
+func (th SportThresholds) sortedHistory() []SportThresholds {
+	history := make([]SportThresholds, len(th.History))
+	copy(history, th.History)
+
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].EffectiveFrom.Before(history[j].EffectiveFrom)
+	})
+
+	return history
+}
+
+// apply overlays the non-zero values of change onto th.
+func (th SportThresholds) apply(change SportThresholds) SportThresholds {
+	th.EffectiveFrom = change.EffectiveFrom
+
+	if change.ThresholdHR > 0 {
+		th.ThresholdHR = change.ThresholdHR
+	}
+	if change.FTP > 0 {
+		th.FTP = change.FTP
+	}
+	if change.ThresholdPace > 0 {
+		th.ThresholdPace = change.ThresholdPace
+	}
+	if change.ThresholdSwimPace > 0 {
+		th.ThresholdSwimPace = change.ThresholdSwimPace
+	}
+	if change.OpenWaterThresholdSwimPace > 0 {
+		th.OpenWaterThresholdSwimPace = change.OpenWaterThresholdSwimPace
+	}
+
+	return th
 }
@@ -0,0 +1,59 @@
+package models_test
+
+import (
+	"atc/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSportThresholdsOn(t *testing.T) {
+	date := func(m time.Month, d int) time.Time {
+		return time.Date(2024, m, d, 0, 0, 0, 0, time.UTC)
+	}
+
+	bike := models.SportThresholds{ThresholdHR: 160, FTP: 220}
+
+	// out of order on purpose
+	bike.AddChange(models.SportThresholds{EffectiveFrom: date(time.May, 1), FTP: 240})
+	bike.AddChange(models.SportThresholds{EffectiveFrom: date(time.March, 1), FTP: 230, ThresholdHR: 162})
+
+	// before the first test
+	early := bike.On(date(time.January, 1))
+	assert.Equal(t, 220.0, early.FTP)
+	assert.Equal(t, 160.0, early.ThresholdHR)
+	assert.True(t, early.EffectiveFrom.IsZero())
+	assert.Nil(t, early.History)
+
+	// the day of the first test
+	march := bike.On(date(time.March, 1))
+	assert.Equal(t, 230.0, march.FTP)
+	assert.Equal(t, 162.0, march.ThresholdHR)
+	assert.Equal(t, date(time.March, 1), march.EffectiveFrom)
+
+	// the second test only changed ftp, so hr carries over
+	june := bike.On(date(time.June, 1))
+	assert.Equal(t, 240.0, june.FTP)
+	assert.Equal(t, 162.0, june.ThresholdHR)
+
+	timeline := bike.Timeline()
+	assert.Len(t, timeline, 3)
+	assert.Equal(t, 220.0, timeline[0].FTP)
+	assert.Equal(t, 230.0, timeline[1].FTP)
+	assert.Equal(t, 240.0, timeline[2].FTP)
+}
+
+func TestNewActivityUsesHistoricalThreshold(t *testing.T) {
+	bike := models.SportThresholds{FTP: 200}
+	bike.AddChange(models.SportThresholds{EffectiveFrom: time.Date(2024, time.June, 1, 0, 0, 0, 0, time.UTC), FTP: 250})
+
+	sa := models.StravaActivity{Type: "Ride", Discipline: models.DisciplineBike, MovingTime: 3600, DeviceWatts: true, WeightedAverageWatts: 200}
+
+	// a threshold ride in april is still a threshold ride after the ftp goes up in june
+	sa.StartDate = time.Date(2024, time.April, 1, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, 100, models.NewActivity(sa, bike).TSS)
+
+	sa.StartDate = time.Date(2024, time.July, 1, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, 64, models.NewActivity(sa, bike).TSS)
+}
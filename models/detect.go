@@ -0,0 +1,208 @@
+package models
+
+import (
+	"atc/functions"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// strava doesn't know anybody's thresholds, and athletes don't re-test as often as they
+// should. so we look through recent streams for efforts that could only have happened if the
+// athlete's thresholds have gone up, and propose new ones. proposals are never applied on
+// their own: a human has to look at them and say yes.
+
+// MinThresholdChange is how much better (as a fraction) a detected threshold has to be than
+// the current one before we bother anybody about it.
+const MinThresholdChange = 0.01
+
+// ThresholdProposal is a suggested new threshold, and the effort that suggested it.
+type ThresholdProposal struct {
+	Id           string           `json:"id"`
+	Sport        string           `json:"sport"`
+	Metric       functions.Metric `json:"metric"`
+	Current      float64          `json:"current"`  // bpm, watts, or seconds per km
+	Proposed     float64          `json:"proposed"` // same units as Current
+	ActivityId   int64            `json:"activity_id"`
+	ActivityDate time.Time        `json:"activity_date"`
+	Effort       string           `json:"effort"` // what we saw, e.g. "best 20 minutes of power"
+}
+
+// candidate is a detected threshold before we've decided whether it's worth proposing.
+// score is the value with "bigger is better" semantics (speed rather than pace).
+type candidate struct {
+	proposal ThresholdProposal
+	score    float64
+}
+
+// DetectThresholds scans the streams of the supplied activities for best efforts and returns
+// a proposal for every sport and metric where the best effort beats the current threshold.
+// Activities without streams, and efforts older than the current threshold, are ignored.
+func DetectThresholds(activities []StravaActivity, thresholds Thresholds) []ThresholdProposal {
+	now := time.Now()
+	best := make(map[string]candidate)
+
+	for _, sa := range activities {
+		if sa.Streams == nil {
+			continue
+		}
+
+		sport := sa.Discipline.Sport()
+		current := thresholds.Sport(sport)
+		if current == nil {
+			continue
+		}
+
+		// a re-test after this activity already supersedes it
+		th := current.On(now)
+		if sa.StartDate.Before(th.EffectiveFrom) {
+			continue
+		}
+
+		for _, c := range effortsFor(sa, sport) {
+			key := c.proposal.Sport + "/" + string(c.proposal.Metric)
+			if existing, ok := best[key]; !ok || c.score > existing.score {
+				best[key] = c
+			}
+		}
+	}
+
+	var proposals []ThresholdProposal
+	for _, c := range best {
+		p := c.proposal
+		th := thresholds.Sport(p.Sport).On(now)
+
+		var current, currentScore float64
+		switch p.Metric {
+		case functions.MetricHR:
+			current = th.ThresholdHR
+			currentScore = current
+		case functions.MetricPower:
+			current = th.FTP
+			currentScore = current
+		case functions.MetricPace:
+			current = th.ThresholdPace
+			currentScore = functions.PaceToSpeed(current, 1000)
+		}
+
+		if currentScore > 0 && c.score < currentScore*(1+MinThresholdChange) {
+			continue
+		}
+
+		p.Current = current
+		proposals = append(proposals, p)
+	}
+
+	sort.Slice(proposals, func(i, j int) bool {
+		return proposals[i].Id < proposals[j].Id
+	})
+
+	return proposals
+}
+
+// effortsFor returns every threshold estimate we can get out of a single activity.
+func effortsFor(sa StravaActivity, sport string) []candidate {
+	s := sa.Streams
+
+	newCandidate := func(metric functions.Metric, value float64, score float64, effort string) candidate {
+		return candidate{
+			proposal: ThresholdProposal{
+				Id:           fmt.Sprintf("%s-%s-%d", sport, metric, sa.Id),
+				Sport:        sport,
+				Metric:       metric,
+				Proposed:     value,
+				ActivityId:   sa.Id,
+				ActivityDate: sa.StartDate,
+				Effort:       effort,
+			},
+			score: score,
+		}
+	}
+
+	var candidates []candidate
+
+	if s.HasHeartRate() && (sport == functions.SportBike || sport == functions.SportRun) {
+		hr, start := functions.BestAverage(s.perSecond(s.HeartRate), functions.TwentyMinutes)
+		if start >= 0 {
+			lthr := hr * functions.TwentyMinuteFactor
+			candidates = append(candidates, newCandidate(functions.MetricHR, lthr, lthr, "best 20 minutes of heart rate"))
+		}
+	}
+
+	if sport == functions.SportBike && s.HasPower() {
+		watts, start := functions.BestAverage(s.perSecond(s.Watts), functions.TwentyMinutes)
+		if start >= 0 {
+			ftp := watts * functions.TwentyMinuteFactor
+			candidates = append(candidates, newCandidate(functions.MetricPower, ftp, ftp, "best 20 minutes of power"))
+		}
+	}
+
+	if sport == functions.SportRun && s.HasPace() {
+		speeds := s.perSecond(s.Velocity)
+
+		speed, start := functions.BestAverage(speeds, functions.TwentyMinutes)
+		if start >= 0 {
+			threshold := speed * functions.TwentyMinuteFactor
+			candidates = append(candidates, newCandidate(functions.MetricPace, functions.SpeedToPace(threshold, 1000), threshold, "best 20 minutes of pace"))
+		}
+
+		// the 30 minute test: the pace is the pace, and lthr is the last 20 minutes of hr
+		speed, start = functions.BestAverage(speeds, functions.ThirtyMinutes)
+		if start >= 0 {
+			candidates = append(candidates, newCandidate(functions.MetricPace, functions.SpeedToPace(speed, 1000), speed, "best 30 minutes of pace"))
+
+			if s.HasHeartRate() {
+				hr := s.perSecond(s.HeartRate)
+				end := start + functions.ThirtyMinutes
+				lthr := functions.Average(hr[end-functions.TwentyMinutes : end])
+				candidates = append(candidates, newCandidate(functions.MetricHR, lthr, lthr, "last 20 minutes of the best 30 minutes of pace"))
+			}
+		}
+	}
+
+	return candidates
+}
+
+// Sport returns the thresholds for sport, or nil if we don't keep thresholds for it.
+func (t *Thresholds) Sport(sport string) *SportThresholds {
+	switch sport {
+	case functions.SportSwim:
+		return &t.Swim
+	case functions.SportBike:
+		return &t.Bike
+	case functions.SportRun:
+		return &t.Run
+	}
+	return nil
+}
+
+// Apply adopts the proposal: the proposed value becomes a new entry in the sport's threshold
+// history, effective from the start of the day of the effort that produced it. That's the
+// day in loc, the athlete's time zone, so the effort and the rest of that day are scored
+// against the new value.
+func (p ThresholdProposal) Apply(t *Thresholds, loc *time.Location) error {
+	th := t.Sport(p.Sport)
+	if th == nil {
+		return fmt.Errorf("no thresholds for sport %s", p.Sport)
+	}
+
+	if loc == nil {
+		loc = time.UTC
+	}
+	change := SportThresholds{EffectiveFrom: StartOfDay(p.ActivityDate, loc)}
+
+	switch p.Metric {
+	case functions.MetricHR:
+		change.ThresholdHR = p.Proposed
+	case functions.MetricPower:
+		change.FTP = p.Proposed
+	case functions.MetricPace:
+		change.ThresholdPace = p.Proposed
+	default:
+		return fmt.Errorf("unknown threshold metric %s", p.Metric)
+	}
+
+	th.AddChange(change)
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package models_test
+
+import (
+	"atc/functions"
+	"atc/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeTest builds 40 minutes of one-second samples: 10 easy, then `hard` minutes of effort,
+// then easy again
+func fakeTest(hard int, easy func(s *models.Streams), effort func(s *models.Streams)) *models.Streams {
+	s := &models.Streams{}
+	for i := 0; i <= 40*60; i++ {
+		s.Time = append(s.Time, i)
+		s.Moving = append(s.Moving, true)
+		if i > 600 && i <= 600+hard*60 {
+			effort(s)
+		} else {
+			easy(s)
+		}
+	}
+	return s
+}
+
+func TestDetectThresholds(t *testing.T) {
+	var thresholds models.Thresholds
+	thresholds.Bike.FTP = 250
+	thresholds.Bike.ThresholdHR = 160
+	thresholds.Run.ThresholdPace = 270 // 4:30/km
+	thresholds.Run.ThresholdHR = 170
+
+	// a 20 minute test at 280w and 172bpm
+	ride := models.StravaActivity{Id: 1, Type: "Ride", Discipline: models.DisciplineBike, StartDate: time.Now().AddDate(0, 0, -3)}
+	ride.Streams = fakeTest(20, func(s *models.Streams) {
+		s.Watts = append(s.Watts, 150)
+		s.HeartRate = append(s.HeartRate, 130)
+	}, func(s *models.Streams) {
+		s.Watts = append(s.Watts, 280)
+		s.HeartRate = append(s.HeartRate, 172)
+	})
+
+	// a 30 minute run test at 4:00/km, hr 171
+	run := models.StravaActivity{Id: 2, Type: "Run", Discipline: models.DisciplineRun, StartDate: time.Now().AddDate(0, 0, -2)}
+	run.Streams = fakeTest(30, func(s *models.Streams) {
+		s.Velocity = append(s.Velocity, 3)
+		s.HeartRate = append(s.HeartRate, 140)
+	}, func(s *models.Streams) {
+		s.Velocity = append(s.Velocity, 1000.0/240)
+		s.HeartRate = append(s.HeartRate, 171)
+	})
+
+	// and one without streams, which can't tell us anything
+	nothing := models.StravaActivity{Id: 3, Type: "Ride", Discipline: models.DisciplineBike, StartDate: time.Now()}
+
+	proposals := models.DetectThresholds([]models.StravaActivity{ride, run, nothing}, thresholds)
+
+	byId := make(map[string]models.ThresholdProposal)
+	for _, p := range proposals {
+		byId[p.Id] = p
+	}
+
+	// 95% of 280w beats 250w
+	ftp, ok := byId["bike-power-1"]
+	assert.True(t, ok)
+	assert.InDelta(t, 266, ftp.Proposed, 0.01)
+	assert.Equal(t, 250.0, ftp.Current)
+	assert.Equal(t, int64(1), ftp.ActivityId)
+
+	// 95% of 172 is 163.4
+	lthr, ok := byId["bike-hr-1"]
+	assert.True(t, ok)
+	assert.InDelta(t, 163.4, lthr.Proposed, 0.01)
+
+	// the 30 minute pace wins over 95% of the 20 minute pace
+	pace, ok := byId["run-pace-2"]
+	assert.True(t, ok)
+	assert.InDelta(t, 240, pace.Proposed, 0.01)
+	assert.Equal(t, "best 30 minutes of pace", pace.Effort)
+
+	// 171 is less than 1% over 170, so no run hr proposal
+	_, ok = byId["run-hr-2"]
+	assert.False(t, ok)
+
+	// nothing gets applied until somebody says so
+	assert.Equal(t, 250.0, thresholds.Bike.On(time.Now()).FTP)
+
+	assert.Nil(t, ftp.Apply(&thresholds, time.UTC))
+	assert.InDelta(t, 266, thresholds.Bike.On(time.Now()).FTP, 0.01)
+	assert.Equal(t, 250.0, thresholds.Bike.On(time.Now().AddDate(0, 0, -7)).FTP)
+
+	// and once it has been, the same ride doesn't propose it again
+	proposals = models.DetectThresholds([]models.StravaActivity{ride}, thresholds)
+	for _, p := range proposals {
+		assert.NotEqual(t, functions.MetricPower, p.Metric)
+	}
+}
+
+func TestApplyTimeZone(t *testing.T) {
+	la, err := time.LoadLocation("America/Los_Angeles")
+	assert.Nil(t, err)
+
+	// a test at 7pm in los angeles, which is already tomorrow in UTC
+	test := time.Date(2024, 8, 1, 19, 0, 0, 0, la)
+	morning := time.Date(2024, 8, 1, 7, 0, 0, 0, la)
+	p := models.ThresholdProposal{Sport: "bike", Metric: functions.MetricPower, Proposed: 266, ActivityDate: test}
+
+	var thresholds models.Thresholds
+	thresholds.Bike.FTP = 250
+	assert.Nil(t, p.Apply(&thresholds, la))
+
+	// the test itself, and the rest of that day, are scored against the new threshold
+	assert.Equal(t, 266.0, thresholds.Bike.On(test).FTP)
+	assert.Equal(t, 266.0, thresholds.Bike.On(morning).FTP)
+	assert.Equal(t, 250.0, thresholds.Bike.On(morning.AddDate(0, 0, -1)).FTP)
+}
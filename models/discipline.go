@@ -0,0 +1,73 @@
+package models
+
+import (
+	"atc/functions"
+	"fmt"
+	"strings"
+)
+
+// strava says "Ride", the thresholds say "Bike", and the formulas say "bike". a Discipline is
+// what we call a sport everywhere past the point an activity comes in: strava's types are
+// translated once, by a SportMap, and nothing downstream has to know what strava calls things.
+
+// Discipline is one of the sports we train for (or a bucket for the ones we don't).
+type Discipline string
+
+const (
+	DisciplineSwim     Discipline = "Swim"
+	DisciplineBike     Discipline = "Bike"
+	DisciplineRun      Discipline = "Run"
+	DisciplineStrength Discipline = "Strength" // counts as training, but there's no TSS for it
+	DisciplineOther    Discipline = "Other"    // everything we haven't been told about
+)
+
+// Disciplines is every discipline, in the order they're shown.
+var Disciplines = []Discipline{DisciplineSwim, DisciplineBike, DisciplineRun, DisciplineStrength, DisciplineOther}
+
+// Valid returns true if d is one of ours.
+func (d Discipline) Valid() bool {
+	for _, discipline := range Disciplines {
+		if d == discipline {
+			return true
+		}
+	}
+	return false
+}
+
+// Scored returns true for the disciplines we have thresholds for, and so can calculate TSS.
+func (d Discipline) Scored() bool {
+	return d.Sport() != ""
+}
+
+// Sport returns the sport the formulas care about, or "" if they don't.
+func (d Discipline) Sport() string {
+	switch d {
+	case DisciplineSwim:
+		return functions.SportSwim
+	case DisciplineBike:
+		return functions.SportBike
+	case DisciplineRun:
+		return functions.SportRun
+	}
+	return ""
+}
+
+// For picks the thresholds that apply to a discipline. The bool is false for disciplines we
+// don't score.
+func (t Thresholds) For(d Discipline) (SportThresholds, bool) {
+	th := t.Sport(d.Sport())
+	if th == nil {
+		return SportThresholds{}, false
+	}
+	return *th, true
+}
+
+// ParseDiscipline reads a discipline from a url or a form, where nobody gets the case right.
+func ParseDiscipline(s string) (Discipline, error) {
+	for _, d := range Disciplines {
+		if strings.EqualFold(s, string(d)) {
+			return d, nil
+		}
+	}
+	return "", fmt.Errorf("unknown discipline %q", s)
+}
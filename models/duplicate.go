@@ -0,0 +1,48 @@
+package models
+
+import (
+	"math"
+	"time"
+)
+
+// the same workout can reach us twice: a watch that syncs to strava and also gets its file
+// emailed to a coach, say. two activities are the same one if they started at (about) the
+// same time and went on for (about) as long. the type isn't compared, because different
+// sources don't always agree on what to call things.
+
+const (
+	// DuplicateStartTolerance is how far apart two starts can be and still be the same activity.
+	// devices and strava round start times differently, and a file export can be a few
+	// seconds off the original.
+	DuplicateStartTolerance = 2 * time.Minute
+
+	// DuplicateDurationTolerance is how different (as a fraction) two elapsed times can be.
+	DuplicateDurationTolerance = 0.05
+)
+
+// IsDuplicate returns true if a and b look like the same activity.
+func IsDuplicate(a StravaActivity, b StravaActivity) bool {
+	start := a.StartDate.Sub(b.StartDate)
+	if start < 0 {
+		start = -start
+	}
+	if start > DuplicateStartTolerance {
+		return false
+	}
+
+	longer := math.Max(float64(a.ElapsedTime), float64(b.ElapsedTime))
+	// anything short enough for the tolerance to be under a minute gets a minute
+	tolerance := math.Max(longer*DuplicateDurationTolerance, 60)
+
+	return math.Abs(float64(a.ElapsedTime-b.ElapsedTime)) <= tolerance
+}
+
+// FindDuplicate returns the first of activities that's a duplicate of sa, or nil.
+func FindDuplicate(sa StravaActivity, activities []StravaActivity) *StravaActivity {
+	for i := range activities {
+		if activities[i].Id != sa.Id && IsDuplicate(sa, activities[i]) {
+			return &activities[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package models_test
+
+import (
+	"atc/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsDuplicate(t *testing.T) {
+	start := time.Date(2024, 8, 1, 7, 0, 0, 0, time.UTC)
+	strava := models.StravaActivity{Id: 1, Type: "Ride", StartDate: start, ElapsedTime: 3600}
+
+	// the same ride from the head unit, a few seconds off and called something else
+	fit := models.StravaActivity{Id: -1, Type: "VirtualRide", StartDate: start.Add(5 * time.Second), ElapsedTime: 3590}
+	assert.True(t, models.IsDuplicate(strava, fit))
+	assert.True(t, models.IsDuplicate(fit, strava))
+
+	// the ride after it
+	later := models.StravaActivity{Id: -2, Type: "Ride", StartDate: start.Add(2 * time.Hour), ElapsedTime: 3600}
+	assert.False(t, models.IsDuplicate(strava, later))
+
+	// same start, very different length: a warmup recorded on its own, say
+	warmup := models.StravaActivity{Id: -3, Type: "Ride", StartDate: start, ElapsedTime: 900}
+	assert.False(t, models.IsDuplicate(strava, warmup))
+
+	// short things get a minute of slack
+	short := models.StravaActivity{StartDate: start, ElapsedTime: 300}
+	assert.True(t, models.IsDuplicate(short, models.StravaActivity{StartDate: start, ElapsedTime: 350}))
+
+	found := models.FindDuplicate(fit, []models.StravaActivity{later, strava})
+	assert.NotNil(t, found)
+	assert.Equal(t, int64(1), found.Id)
+	assert.Nil(t, models.FindDuplicate(warmup, []models.StravaActivity{later, strava}))
+}
@@ -0,0 +1,83 @@
+package models
+
+import (
+	"atc/functions"
+)
+
+// running tss ("rtss") is the pace equivalent of power tss. raw pace lies on hills, so we
+// use normalized graded pace ("ngp"): every sample's speed is adjusted to the flat-ground
+// speed of equal metabolic cost, then normalized the same way normalized power is. the
+// formulas are in functions; this is just the part that knows about streams.
+
+// HasPace returns true if there is a usable speed stream with some actual movement in it
+// (a treadmill without a footpod records a velocity stream full of zeros).
+func (s *Streams) HasPace() bool {
+	if s == nil || len(s.Velocity) == 0 || len(s.Velocity) != len(s.Time) {
+		return false
+	}
+	for _, v := range s.Velocity {
+		if v > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// grades returns the gradient (as a fraction) for every sample, preferring strava's smoothed
+// grade stream and falling back to working it out from altitude and distance.
+func (s *Streams) grades() []float64 {
+	grades := make([]float64, len(s.Time))
+
+	if len(s.GradeSmooth) == len(s.Time) {
+		for i, g := range s.GradeSmooth {
+			grades[i] = g / 100
+		}
+		return grades
+	}
+
+	if len(s.Altitude) == len(s.Time) && len(s.Distance) == len(s.Time) {
+		for i := 1; i < len(s.Time); i++ {
+			run := s.Distance[i] - s.Distance[i-1]
+			if run > 0 {
+				grades[i] = (s.Altitude[i] - s.Altitude[i-1]) / run
+			}
+		}
+	}
+
+	return grades
+}
+
+// CalculateNormalizedGradedPace returns normalized graded pace as a speed in meters per
+// second, and the number of seconds it was computed over.
+func CalculateNormalizedGradedPace(s *Streams) (float64, int) {
+	if !s.HasPace() {
+		return 0, 0
+	}
+	return s.normalizedPace(s.grades())
+}
+
+// CalculateNormalizedPace is CalculateNormalizedGradedPace on the flat, for treadmill runs: a
+// footpod gets the distance right, but any grade the watch recorded has nothing to do with the
+// belt.
+func CalculateNormalizedPace(s *Streams) (float64, int) {
+	if !s.HasPace() {
+		return 0, 0
+	}
+	return s.normalizedPace(make([]float64, len(s.Time)))
+}
+
+// normalizedPace adjusts every sample's speed for its grade and normalizes the result.
+func (s *Streams) normalizedPace(grades []float64) (float64, int) {
+	adjusted := make([]float64, len(s.Velocity))
+	for i, v := range s.Velocity {
+		adjusted[i] = v * functions.GradeFactor(grades[i])
+	}
+
+	speeds := s.perSecond(adjusted)
+	ngp := functions.NormalizedGradedSpeed(speeds)
+	if ngp == 0 {
+		return 0, 0
+	}
+
+	return ngp, len(speeds)
+}
@@ -0,0 +1,86 @@
+package models_test
+
+import (
+	"atc/models"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRunStreams builds an hour of one-second samples at the given speed (m/s) and grade (%)
+func fakeRunStreams(speed float64, grade func(i int) float64) *models.Streams {
+	s := &models.Streams{}
+	for i := 0; i <= 3600; i++ {
+		s.Time = append(s.Time, i)
+		s.Velocity = append(s.Velocity, speed)
+		s.GradeSmooth = append(s.GradeSmooth, grade(i))
+		s.HeartRate = append(s.HeartRate, 150)
+		s.Moving = append(s.Moving, true)
+	}
+	return s
+}
+
+func TestCalculateNormalizedGradedPace(t *testing.T) {
+	// 4:00/km on the flat is 4:00/km
+	flat := fakeRunStreams(1000.0/240, func(i int) float64 { return 0 })
+	ngp, seconds := models.CalculateNormalizedGradedPace(flat)
+	assert.InDelta(t, 1000.0/240, ngp, 0.001)
+	assert.Equal(t, 3600, seconds)
+
+	// the same speed uphill is worth a lot more
+	hilly := fakeRunStreams(1000.0/240, func(i int) float64 { return 5 })
+	ngp, _ = models.CalculateNormalizedGradedPace(hilly)
+	assert.Greater(t, ngp, 1000.0/240*1.2)
+
+	// a treadmill without a footpod records zeros
+	treadmill := fakeRunStreams(0, func(i int) float64 { return 0 })
+	assert.False(t, treadmill.HasPace())
+	ngp, seconds = models.CalculateNormalizedGradedPace(treadmill)
+	assert.Equal(t, 0.0, ngp)
+	assert.Equal(t, 0, seconds)
+}
+
+func TestNewActivityPace(t *testing.T) {
+	th := models.SportThresholds{ThresholdHR: 160, ThresholdPace: 240}
+
+	sa := models.StravaActivity{Id: 1, Type: "Run", Discipline: models.DisciplineRun, Distance: 15000, MovingTime: 3600, AverageHeartRate: 150}
+	sa.Streams = fakeRunStreams(1000.0/240, func(i int) float64 { return 0 })
+
+	activity := models.NewActivity(sa, th)
+	assert.Equal(t, models.TSSMethodPace, activity.Method)
+	assert.Equal(t, 100, activity.TSS)
+
+	// a flat summary with no streams is scored from average pace
+	sa.Streams = nil
+	activity = models.NewActivity(sa, th)
+	assert.Equal(t, models.TSSMethodPace, activity.Method)
+	assert.Equal(t, 100, activity.TSS)
+
+	// a treadmill run with a footpod is scored from pace, on the flat, whatever grade the
+	// watch thought it was on
+	sa.Trainer = true
+	sa.Streams = fakeRunStreams(1000.0/240, func(i int) float64 { return 5 })
+	activity = models.NewActivity(sa, th)
+	assert.Equal(t, models.TSSMethodPace, activity.Method)
+	assert.Equal(t, 100, activity.TSS)
+
+	sa.Streams = nil
+	sa.TotalElevationGain = 300
+	activity = models.NewActivity(sa, th)
+	assert.Equal(t, models.TSSMethodPace, activity.Method)
+	assert.Equal(t, 100, activity.TSS)
+
+	// outdoors, the same climb counts
+	sa.Trainer = false
+	activity = models.NewActivity(sa, th)
+	assert.Greater(t, activity.TSS, 100)
+
+	// a treadmill run without a footpod has no pace, so it falls back to heart rate
+	sa.Trainer = true
+	sa.TotalElevationGain = 0
+	sa.Distance = 0
+	sa.Streams = fakeRunStreams(0, func(i int) float64 { return 0 })
+	activity = models.NewActivity(sa, th)
+	assert.Equal(t, models.TSSMethodHR, activity.Method)
+	assert.Equal(t, 88, activity.TSS)
+}
@@ -0,0 +1,151 @@
+package models
+
+import (
+	"atc/functions"
+	"time"
+)
+
+// the performance management chart ("pmc") is the daily series of ctl, atl, and tsb.
+// it's the thing trainingpeaks draws, and it's the thing we compare ourselves against,
+// so the rules here follow theirs:
+//
+//   - tss is bucketed by calendar day in the athlete's time zone
+//   - days with no activities are rest days with a tss of zero (they still decay ctl/atl)
+//   - ctl_today = ctl_yesterday + (tss_today - ctl_yesterday) / 42
+//   - atl_today = atl_yesterday + (tss_today - atl_yesterday) / 7
+//   - tsb_today = ctl_yesterday - atl_yesterday (form is how you show up to today's workout)
+
+const (
+	// CTLDays is the time constant (in days) for chronic training load ("fitness")
+	CTLDays = functions.CTLDays
+
+	// ATLDays is the time constant (in days) for acute training load ("fatigue")
+	ATLDays = functions.ATLDays
+)
+
+// PMCDay is a single calendar day of the performance management chart.
+type PMCDay struct {
+	Date time.Time `json:"date"` // midnight, in the athlete's time zone
+	TSS  int       `json:"tss"`  // sum of TSS for all activities on this day
+	CTL  float64   `json:"ctl"`  // chronic training load at the end of the day
+	ATL  float64   `json:"atl"`  // acute training load at the end of the day
+	TSB  float64   `json:"tsb"`  // training stress balance going into the day
+}
+
+// PMC is a contiguous, ordered series of PMCDays with no gaps.
+type PMC []PMCDay
+
+// NewPMC buckets the TSS of the supplied activities by day in loc and computes CTL, ATL,
+// and TSB for every day from `from` through `to` inclusive. Load is seeded at zero on
+// `from`, so callers should pass in a good deal more history than they intend to display
+// (three or four times CTLDays is plenty). If from is zero, the series starts on the day
+// of the earliest activity. Activities outside the window are ignored.
+func NewPMC(activities []Activity, from time.Time, to time.Time, loc *time.Location) PMC {
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	daily := DailyTSS(activities, loc)
+
+	if from.IsZero() {
+		for day := range daily {
+			if from.IsZero() || day.Before(from) {
+				from = day
+			}
+		}
+	}
+
+	// nothing to chart
+	if from.IsZero() {
+		return PMC{}
+	}
+
+	start := StartOfDay(from, loc)
+	end := StartOfDay(to, loc)
+
+	var pmc PMC
+	var ctl, atl float64
+
+	// AddDate rather than Add(24h) so that we don't fall off the day across dst changes
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		tss := daily[day]
+
+		tsb := functions.TSB(ctl, atl)
+		ctl = functions.NextLoad(ctl, float64(tss), CTLDays)
+		atl = functions.NextLoad(atl, float64(tss), ATLDays)
+
+		pmc = append(pmc, PMCDay{
+			Date: day,
+			TSS:  tss,
+			CTL:  ctl,
+			ATL:  atl,
+			TSB:  tsb,
+		})
+	}
+
+	return pmc
+}
+
+// DailyTSS sums activity TSS by calendar day in loc. The map is keyed by midnight of each day.
+// Activities excluded from CTL are left out.
+func DailyTSS(activities []Activity, loc *time.Location) map[time.Time]int {
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	daily := make(map[time.Time]int)
+	for _, activity := range activities {
+		if activity.ExcludedFromCTL {
+			continue
+		}
+		daily[StartOfDay(activity.StartDate, loc)] += activity.TSS
+	}
+
+	return daily
+}
+
+// StartOfDay returns midnight of the calendar day t falls on in loc.
+func StartOfDay(t time.Time, loc *time.Location) time.Time {
+	local := t.In(loc)
+	return time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+}
+
+// Latest returns the last day in the series, or an empty PMCDay if there isn't one.
+func (p PMC) Latest() PMCDay {
+	if len(p) == 0 {
+		return PMCDay{}
+	}
+	return p[len(p)-1]
+}
+
+// On returns the PMCDay for the calendar day containing t.
+func (p PMC) On(t time.Time) (PMCDay, bool) {
+	if len(p) == 0 {
+		return PMCDay{}, false
+	}
+
+	day := StartOfDay(t, p[0].Date.Location())
+	for _, d := range p {
+		if d.Date.Equal(day) {
+			return d, true
+		}
+	}
+
+	return PMCDay{}, false
+}
+
+// Since returns the tail of the series starting on the calendar day containing t.
+func (p PMC) Since(t time.Time) PMC {
+	if len(p) == 0 {
+		return p
+	}
+
+	day := StartOfDay(t, p[0].Date.Location())
+	for i, d := range p {
+		if !d.Date.Before(day) {
+			return p[i:]
+		}
+	}
+
+	return PMC{}
+}
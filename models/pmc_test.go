@@ -0,0 +1,73 @@
+package models_test
+
+import (
+	"atc/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPMC(t *testing.T) {
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	assert.Nil(t, err)
+
+	day := func(d, h int) time.Time {
+		return time.Date(2024, time.September, d, h, 0, 0, 0, loc)
+	}
+
+	activities := []models.Activity{
+		// two workouts on tuesday the 3rd
+		{TSS: 60, StartDate: day(3, 6)},
+		{TSS: 40, StartDate: day(3, 18)},
+
+		// this is 10pm on the 5th local time, which is the 6th in UTC. it belongs to the 5th.
+		{TSS: 50, StartDate: day(5, 22).UTC()},
+	}
+
+	pmc := models.NewPMC(activities, day(1, 0), day(7, 12), loc)
+
+	// the 1st through the 7th, inclusive, with rest days filled in
+	assert.Len(t, pmc, 7)
+	assert.Equal(t, day(1, 0), pmc[0].Date)
+	assert.Equal(t, day(7, 0), pmc.Latest().Date)
+
+	tuesday, ok := pmc.On(day(3, 12))
+	assert.True(t, ok)
+	assert.Equal(t, 100, tuesday.TSS)
+
+	thursday, ok := pmc.On(day(5, 0))
+	assert.True(t, ok)
+	assert.Equal(t, 50, thursday.TSS)
+
+	friday, ok := pmc.On(day(6, 0))
+	assert.True(t, ok)
+	assert.Equal(t, 0, friday.TSS)
+
+	// walk the series by hand using the trainingpeaks formulas
+	var ctl, atl float64
+	for _, d := range pmc {
+		tsb := ctl - atl
+		ctl = ctl + (float64(d.TSS)-ctl)/42
+		atl = atl + (float64(d.TSS)-atl)/7
+
+		assert.InDelta(t, ctl, d.CTL, 1e-9, "ctl on %s", d.Date)
+		assert.InDelta(t, atl, d.ATL, 1e-9, "atl on %s", d.Date)
+		assert.InDelta(t, tsb, d.TSB, 1e-9, "tsb on %s", d.Date)
+	}
+
+	// rest days should decay load
+	saturday := pmc.Latest()
+	assert.Less(t, saturday.CTL, thursday.CTL)
+	assert.Less(t, saturday.ATL, thursday.ATL)
+
+	// the tail of the series
+	assert.Len(t, pmc.Since(day(6, 8)), 2)
+}
+
+func TestNewPMCEmpty(t *testing.T) {
+	pmc := models.NewPMC(nil, time.Time{}, time.Now(), time.UTC)
+
+	assert.Len(t, pmc, 0)
+	assert.Equal(t, models.PMCDay{}, pmc.Latest())
+}
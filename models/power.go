@@ -0,0 +1,38 @@
+package models
+
+import (
+	"atc/functions"
+)
+
+// HasPower returns true if there is a usable power stream.
+func (s *Streams) HasPower() bool {
+	return s != nil && len(s.Watts) > 0 && len(s.Watts) == len(s.Time)
+}
+
+// perSecond expands a stream to one value per recorded second, holding each sample for
+// the duration it represents. pauses are dropped, not filled.
+func (s *Streams) perSecond(values []float64) []float64 {
+	var expanded []float64
+	for i, dt := range s.sampleDurations() {
+		for j := 0; j < int(dt); j++ {
+			expanded = append(expanded, values[i])
+		}
+	}
+	return expanded
+}
+
+// CalculateNormalizedPower returns normalized power from the power stream and the number of
+// seconds it was computed over. Activities shorter than the rolling window don't have one.
+func CalculateNormalizedPower(s *Streams) (float64, int) {
+	if !s.HasPower() {
+		return 0, 0
+	}
+
+	watts := s.perSecond(s.Watts)
+	np := functions.NormalizedPower(watts)
+	if np == 0 {
+		return 0, 0
+	}
+
+	return np, len(watts)
+}
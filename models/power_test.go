@@ -0,0 +1,66 @@
+package models_test
+
+import (
+	"atc/models"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakePowerStreams builds an hour of one-second samples with watts(i) as the power
+func fakePowerStreams(watts func(i int) float64) *models.Streams {
+	s := &models.Streams{}
+	for i := 0; i <= 3600; i++ {
+		s.Time = append(s.Time, i)
+		s.Watts = append(s.Watts, watts(i))
+		s.HeartRate = append(s.HeartRate, 150)
+		s.Moving = append(s.Moving, true)
+	}
+	return s
+}
+
+func TestCalculateNormalizedPower(t *testing.T) {
+	steady := fakePowerStreams(func(i int) float64 { return 200 })
+	np, seconds := models.CalculateNormalizedPower(steady)
+	assert.InDelta(t, 200, np, 0.001)
+	assert.Equal(t, 3600, seconds)
+
+	// 5 minutes at 300w, 5 minutes at 100w averages 200w but costs a lot more than that
+	intervals := fakePowerStreams(func(i int) float64 {
+		if (i/300)%2 == 0 {
+			return 300
+		}
+		return 100
+	})
+	np, _ = models.CalculateNormalizedPower(intervals)
+	assert.Greater(t, np, 240.0)
+
+	// no power meter, no normalized power
+	np, seconds = models.CalculateNormalizedPower(&models.Streams{})
+	assert.Equal(t, 0.0, np)
+	assert.Equal(t, 0, seconds)
+}
+
+func TestNewActivityPower(t *testing.T) {
+	sa := models.StravaActivity{Id: 1, Type: "Ride", Discipline: models.DisciplineBike, MovingTime: 3600, AverageHeartRate: 150}
+	sa.Streams = fakePowerStreams(func(i int) float64 { return 200 })
+
+	// with an ftp, power wins over heart rate
+	activity := models.NewActivity(sa, models.SportThresholds{ThresholdHR: 160, FTP: 200})
+	assert.Equal(t, models.TSSMethodPower, activity.Method)
+	assert.Equal(t, 100, activity.TSS)
+	assert.InDelta(t, 200, activity.NormalizedPower, 0.001)
+
+	// without one we fall back to heart rate
+	activity = models.NewActivity(sa, models.SportThresholds{ThresholdHR: 160})
+	assert.Equal(t, models.TSSMethodHR, activity.Method)
+	assert.Equal(t, 88, activity.TSS)
+
+	// strava's summary watts are used when there's no stream
+	sa.Streams = nil
+	sa.DeviceWatts = true
+	sa.WeightedAverageWatts = 200
+	activity = models.NewActivity(sa, models.SportThresholds{ThresholdHR: 160, FTP: 200})
+	assert.Equal(t, models.TSSMethodPower, activity.Method)
+	assert.Equal(t, 100, activity.TSS)
+}
@@ -0,0 +1,89 @@
+package models
+
+import "fmt"
+
+// strava has dozens of sport types (VirtualRide, GravelRide, TrailRun, ...) and we score
+// three disciplines: Swim, Bike and Run. a SportMap says which discipline each of strava's is,
+// which decides which thresholds it's scored against, and whether it counts toward CTL.
+// anything that isn't in the map is Other: kept, but not scored, so somebody can notice and
+// add it.
+
+// SportMapping is what we make of one strava sport type.
+type SportMapping struct {
+	// Discipline is what it's scored as: Swim, Bike, Run, Strength or Other
+	Discipline Discipline `yaml:"discipline"`
+
+	// CTL is whether its TSS counts toward CTL. It does unless this says otherwise.
+	CTL *bool `yaml:"ctl"`
+}
+
+// CountsTowardCTL returns true if activities of this sport go into the PMC.
+func (m SportMapping) CountsTowardCTL() bool {
+	return m.CTL == nil || *m.CTL
+}
+
+// SportMap maps strava sport types onto ours.
+type SportMap map[string]SportMapping
+
+// DefaultSportMap is the mapping used for any sport type config.yml doesn't mention.
+func DefaultSportMap() SportMap {
+	no := false
+	return SportMap{
+		"Swim": {Discipline: DisciplineSwim},
+
+		"Ride":             {Discipline: DisciplineBike},
+		"VirtualRide":      {Discipline: DisciplineBike},
+		"GravelRide":       {Discipline: DisciplineBike},
+		"MountainBikeRide": {Discipline: DisciplineBike},
+		"Handcycle":        {Discipline: DisciplineBike},
+		"Velomobile":       {Discipline: DisciplineBike},
+
+		// the motor does an unknowable amount of the work
+		"EBikeRide":         {Discipline: DisciplineBike, CTL: &no},
+		"EMountainBikeRide": {Discipline: DisciplineBike, CTL: &no},
+
+		"Run":        {Discipline: DisciplineRun},
+		"TrailRun":   {Discipline: DisciplineRun},
+		"VirtualRun": {Discipline: DisciplineRun},
+
+		"WeightTraining": {Discipline: DisciplineStrength},
+		"Crossfit":       {Discipline: DisciplineStrength},
+	}
+}
+
+// Merge returns the default map with m's entries added (and replacing the defaults).
+func (m SportMap) Merge() SportMap {
+	merged := DefaultSportMap()
+	for sportType, mapping := range m {
+		merged[sportType] = mapping
+	}
+	return merged
+}
+
+// Validate checks every sport maps onto a discipline we know.
+func (m SportMap) Validate() error {
+	for sportType, mapping := range m {
+		if !mapping.Discipline.Valid() {
+			return fmt.Errorf("sport %s maps to %q, which isn't Swim, Bike, Run, Strength or Other", sportType, mapping.Discipline)
+		}
+	}
+	return nil
+}
+
+// Map works out what sa is. sa.SportType is filled in from sa.Type if it's empty (older
+// activities and files only have a type), and sa.Discipline is set to the discipline the
+// sport maps onto. The bool is false for sports that aren't mapped, which are Other.
+func (m SportMap) Map(sa *StravaActivity) (SportMapping, bool) {
+	if sa.SportType == "" {
+		sa.SportType = sa.Type
+	}
+
+	mapping, ok := m[sa.SportType]
+	if !ok {
+		sa.Discipline = DisciplineOther
+		return SportMapping{Discipline: DisciplineOther}, false
+	}
+
+	sa.Discipline = mapping.Discipline
+	return mapping, true
+}
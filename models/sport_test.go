@@ -0,0 +1,97 @@
+package models_test
+
+import (
+	"atc/models"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSportMap(t *testing.T) {
+	no := false
+	sports := models.SportMap{
+		"Rowing":    {Discipline: models.DisciplineBike},
+		"EBikeRide": {Discipline: models.DisciplineBike, CTL: &no},
+		"TrailRun":  {Discipline: models.DisciplineRun, CTL: &no},
+	}.Merge()
+	assert.NoError(t, sports.Validate())
+
+	// zwift is a ride, and strava's names are left alone
+	zwift := models.StravaActivity{Type: "VirtualRide", SportType: "VirtualRide"}
+	m, ok := sports.Map(&zwift)
+	assert.True(t, ok)
+	assert.True(t, m.CountsTowardCTL())
+	assert.Equal(t, models.DisciplineBike, zwift.Discipline)
+	assert.Equal(t, "VirtualRide", zwift.Type)
+	assert.Equal(t, "VirtualRide", zwift.SportType)
+
+	// config wins over the defaults
+	trail := models.StravaActivity{Type: "Run", SportType: "TrailRun"}
+	m, ok = sports.Map(&trail)
+	assert.True(t, ok)
+	assert.False(t, m.CountsTowardCTL())
+
+	// and adds to them
+	_, ok = sports.Map(&models.StravaActivity{SportType: "Rowing"})
+	assert.True(t, ok)
+
+	// files (and activities from before sport types) only have a type
+	file := models.StravaActivity{Type: "Swim"}
+	_, ok = sports.Map(&file)
+	assert.True(t, ok)
+	assert.Equal(t, "Swim", file.SportType)
+	assert.Equal(t, models.DisciplineSwim, file.Discipline)
+
+	// lifting is training, but there's no TSS for it
+	lifting := models.StravaActivity{Type: "WeightTraining", SportType: "WeightTraining"}
+	_, ok = sports.Map(&lifting)
+	assert.True(t, ok)
+	assert.Equal(t, models.DisciplineStrength, lifting.Discipline)
+	assert.False(t, lifting.Discipline.Scored())
+
+	// nobody said what yoga is
+	yoga := models.StravaActivity{Type: "Yoga", SportType: "Yoga"}
+	_, ok = sports.Map(&yoga)
+	assert.False(t, ok)
+	assert.Equal(t, models.DisciplineOther, yoga.Discipline)
+
+	// "Ride" is strava's word, not ours
+	assert.Error(t, models.SportMap{"Rowing": {Discipline: "Ride"}}.Validate())
+	assert.NoError(t, models.SportMap{"Yoga": {Discipline: models.DisciplineOther}}.Validate())
+}
+
+func TestDiscipline(t *testing.T) {
+	thresholds := models.Thresholds{
+		Run:  models.SportThresholds{ThresholdHR: 170},
+		Bike: models.SportThresholds{FTP: 250},
+	}
+
+	th, ok := thresholds.For(models.DisciplineBike)
+	assert.True(t, ok)
+	assert.Equal(t, 250.0, th.FTP)
+
+	th, ok = thresholds.For(models.DisciplineRun)
+	assert.True(t, ok)
+	assert.Equal(t, 170.0, th.ThresholdHR)
+
+	_, ok = thresholds.For(models.DisciplineStrength)
+	assert.False(t, ok)
+	_, ok = thresholds.For(models.DisciplineOther)
+	assert.False(t, ok)
+
+	assert.True(t, models.DisciplineSwim.Valid())
+	assert.False(t, models.Discipline("Ride").Valid())
+}
+
+func TestExcludedFromCTL(t *testing.T) {
+	day := time.Date(2024, 8, 1, 7, 0, 0, 0, time.UTC)
+	activities := []models.Activity{
+		{StartDate: day, TSS: 50},
+		{StartDate: day, TSS: 80, ExcludedFromCTL: true},
+		models.NewUnscoredActivity(models.StravaActivity{StartDate: day, Type: "Yoga"}),
+	}
+
+	daily := models.DailyTSS(activities, time.UTC)
+	assert.Equal(t, 50, daily[day.Truncate(24*time.Hour)])
+}
@@ -0,0 +1,82 @@
+package models
+
+import (
+	"atc/functions"
+	"math"
+)
+
+// Streams holds the per-sample data recorded during an activity. Every slice is indexed the
+// same way (sample i of each stream was recorded at Time[i]), but any of them may be empty if
+// the device didn't record that channel.
+type Streams struct {
+	Time      []int     `json:"time"`            // seconds since the start of the activity
+	HeartRate []float64 `json:"heartrate"`       // in bpm
+	Moving    []bool    `json:"moving"`          // strava's idea of whether we were moving
+	Velocity  []float64 `json:"velocity_smooth"` // in meters per second
+	Watts     []float64 `json:"watts"`           // in watts
+	Cadence   []float64 `json:"cadence"`         // rpm (or steps per minute, per foot)
+	Altitude  []float64 `json:"altitude"`        // in meters
+
+	Distance    []float64 `json:"distance"`     // meters since the start of the activity
+	GradeSmooth []float64 `json:"grade_smooth"` // in percent
+
+	LatLng [][]float64 `json:"latlng"` // [lat, lng] in degrees, for activities with gps
+}
+
+// maxSampleGap is the longest gap between two samples we'll count as continuous recording.
+// anything longer is a pause (or a dropout) and we don't want to score it.
+const maxSampleGap = 30
+
+// HasHeartRate returns true if there is a usable heart rate stream.
+func (s *Streams) HasHeartRate() bool {
+	return s != nil && len(s.HeartRate) > 0 && len(s.HeartRate) == len(s.Time)
+}
+
+// sampleDurations returns the number of seconds each sample represents, zeroing out samples
+// recorded while stopped and samples that follow a pause.
+func (s *Streams) sampleDurations() []float64 {
+	durations := make([]float64, len(s.Time))
+
+	for i := 1; i < len(s.Time); i++ {
+		dt := s.Time[i] - s.Time[i-1]
+		if dt <= 0 || dt > maxSampleGap {
+			continue
+		}
+		if len(s.Moving) == len(s.Time) && !s.Moving[i] {
+			continue
+		}
+		durations[i] = float64(dt)
+	}
+
+	return durations
+}
+
+// TimeAtHeartRate returns the number of moving seconds spent at each (rounded) heart rate.
+// this is time-in-zone with one-bpm-wide zones, which is about as fine as a strap can measure.
+func (s *Streams) TimeAtHeartRate() map[int]float64 {
+	zones := make(map[int]float64)
+	if !s.HasHeartRate() {
+		return zones
+	}
+
+	for i, dt := range s.sampleDurations() {
+		hr := s.HeartRate[i]
+		if dt == 0 || hr <= 0 {
+			// zero hr is a dropout, not a very relaxed athlete
+			continue
+		}
+		zones[int(math.Round(hr))] += dt
+	}
+
+	return zones
+}
+
+// CalculateStreamHrTSS calculates hrTSS by integrating time-in-zone over the heart rate
+// stream rather than multiplying average intensity by duration. the intensity factor
+// returned is the equivalent steady-state IF.
+func CalculateStreamHrTSS(s *Streams, thresholdHR float64) (int, float64) {
+	if !s.HasHeartRate() {
+		return 0, 0
+	}
+	return functions.ZoneHrTSS(s.TimeAtHeartRate(), thresholdHR)
+}
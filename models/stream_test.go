@@ -0,0 +1,53 @@
+package models_test
+
+import (
+	"atc/models"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeStreams builds an hour of one-second samples with hr(i) as the heart rate
+func fakeStreams(hr func(i int) float64) *models.Streams {
+	s := &models.Streams{}
+	for i := 0; i <= 3600; i++ {
+		s.Time = append(s.Time, i)
+		s.HeartRate = append(s.HeartRate, hr(i))
+		s.Moving = append(s.Moving, true)
+	}
+	return s
+}
+
+func TestCalculateStreamHrTSS(t *testing.T) {
+	// an hour at threshold is 100 tss, no matter how you slice it
+	steady := fakeStreams(func(i int) float64 { return 160 })
+	tss, IF := models.CalculateStreamHrTSS(steady, 160)
+	assert.Equal(t, 100, tss)
+	assert.InDelta(t, 1.0, IF, 0.001)
+
+	// alternating 5 minutes hard / 5 minutes easy averages out to 140 bpm. the average
+	// would call that 77 tss, but the hard bits cost more than the easy bits give back.
+	intervals := fakeStreams(func(i int) float64 {
+		if (i/300)%2 == 0 {
+			return 176
+		}
+		return 104
+	})
+	tss, IF = models.CalculateStreamHrTSS(intervals, 160)
+	assert.Equal(t, 82, tss)
+	assert.Greater(t, IF, 140.0/160.0)
+
+	// stopped time doesn't count
+	for i := range steady.Moving {
+		if i > 1800 {
+			steady.Moving[i] = false
+		}
+	}
+	tss, _ = models.CalculateStreamHrTSS(steady, 160)
+	assert.Equal(t, 50, tss)
+
+	// no stream, no score
+	tss, IF = models.CalculateStreamHrTSS(nil, 160)
+	assert.Equal(t, 0, tss)
+	assert.Equal(t, 0.0, IF)
+}
@@ -0,0 +1,11 @@
+package models
+
+// swims are scored against functional threshold pace per 100m rather than heart rate,
+// which is hard to measure underwater and which most swimmers don't bother with. the
+// (cubic) formula is in functions.SwimTSS.
+
+// IsOpenWater returns true for swims that recorded a gps position. strava calls both pool and
+// open water swims "Swim", but only one of them happens under the sky.
+func (sa StravaActivity) IsOpenWater() bool {
+	return sa.Discipline == DisciplineSwim && len(sa.StartLatLng) == 2
+}
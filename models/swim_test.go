@@ -0,0 +1,29 @@
+package models_test
+
+import (
+	"atc/models"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewActivitySwim(t *testing.T) {
+	th := models.SportThresholds{ThresholdHR: 144, ThresholdSwimPace: 100, OpenWaterThresholdSwimPace: 120}
+
+	pool := models.StravaActivity{Id: 1, Type: "Swim", Discipline: models.DisciplineSwim, Distance: 3600, MovingTime: 3600, AverageHeartRate: 130}
+	activity := models.NewActivity(pool, th)
+	assert.False(t, activity.OpenWater)
+	assert.Equal(t, models.TSSMethodPace, activity.Method)
+	assert.Equal(t, 100, activity.TSS)
+
+	// the same pace in a lake is a bigger deal against the (slower) open water threshold
+	lake := pool
+	lake.StartLatLng = []float64{47.6, -122.3}
+	activity = models.NewActivity(lake, th)
+	assert.True(t, activity.OpenWater)
+	assert.InDelta(t, 1.2, activity.IntensityFactor, 0.001)
+
+	// without a threshold pace we're back to heart rate
+	activity = models.NewActivity(pool, models.SportThresholds{ThresholdHR: 144})
+	assert.Equal(t, models.TSSMethodHR, activity.Method)
+}
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"atc/functions"
+)
+
+// the config (and strava, eventually) hands us thresholds in the units athletes think in:
+// bpm, watts, minutes per km, minutes per 100m. these turn them into functions.Threshold,
+// which is what the formulas want.
+
+// HRThreshold returns the threshold heart rate for sport.
+func (th SportThresholds) HRThreshold(sport string) functions.Threshold {
+	return functions.NewThreshold(sport, functions.MetricHR, th.ThresholdHR, th.EffectiveFrom)
+}
+
+// PowerThreshold returns functional threshold power. Only bikes have power meters (as far as
+// we're concerned).
+func (th SportThresholds) PowerThreshold() functions.Threshold {
+	return functions.NewThreshold(functions.SportBike, functions.MetricPower, th.FTP, th.EffectiveFrom)
+}
+
+// RunPaceThreshold returns threshold pace as a speed.
+func (th SportThresholds) RunPaceThreshold() functions.Threshold {
+	speed := functions.PaceToSpeed(th.ThresholdPace, 1000)
+	return functions.NewThreshold(functions.SportRun, functions.MetricPace, speed, th.EffectiveFrom)
+}
+
+// SwimPaceThreshold returns functional threshold swim pace as a speed. Open water uses its
+// own threshold if there is one, and the pool threshold if there isn't.
+func (th SportThresholds) SwimPaceThreshold(openWater bool) functions.Threshold {
+	pace := th.ThresholdSwimPace
+	if openWater && th.OpenWaterThresholdSwimPace > 0 {
+		pace = th.OpenWaterThresholdSwimPace
+	}
+	speed := functions.PaceToSpeed(pace, 100)
+	return functions.NewThreshold(functions.SportSwim, functions.MetricPace, speed, th.EffectiveFrom)
+}
@@ -0,0 +1,157 @@
+package planning
+
+import (
+	"atc/functions"
+	"atc/models"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// a goal is a date and something to be able to do by then: either a performance (12km in an
+// hour) or, for when a performance doesn't say much (a hilly bike course), the CTL to have.
+// a performance is turned into a CTL by working out the threshold it needs and scaling the
+// athlete's CTL by how far that is from the threshold they've got (see functions.RequiredCTL).
+// after that it's arithmetic: the gap between the CTL they have and the CTL they need, and
+// whether it can be closed by the event without ramping faster than MaxRamp a week.
+
+// DefaultMaxRamp is the fastest CTL is planned to go up, per week, if config.yml doesn't say.
+const DefaultMaxRamp = 6.0
+
+var (
+	// ErrNoFitness is returned for performance goals when there's no CTL to scale from.
+	ErrNoFitness = errors.New("no training to plan from")
+
+	// ErrNoThreshold is returned for performance goals when there's no threshold to scale from.
+	ErrNoThreshold = errors.New("no threshold pace to plan from")
+)
+
+// Goal is something an athlete wants to be able to do by EventDate.
+type Goal struct {
+	Id         string            `json:"id"`
+	Name       string            `json:"name"`
+	EventDate  time.Time         `json:"event_date"`
+	Discipline models.Discipline `json:"discipline"`
+
+	// a performance: Distance (meters) in Duration (seconds)
+	Distance float64 `json:"distance,omitempty"`
+	Duration int     `json:"duration,omitempty"`
+
+	// or the CTL to have, which is used as is
+	TargetCTL float64 `json:"target_ctl,omitempty"`
+}
+
+// Validate returns an error if the goal isn't something we can plan for.
+func (g Goal) Validate() error {
+	if !g.Discipline.Scored() {
+		return fmt.Errorf("%q isn't a sport we score", g.Discipline)
+	}
+	if g.EventDate.IsZero() {
+		return errors.New("a goal needs a date")
+	}
+	if g.TargetCTL > 0 {
+		return nil
+	}
+	if g.Distance <= 0 || g.Duration <= 0 {
+		return errors.New("a goal needs a distance and a time, or a target CTL")
+	}
+	// speed on a bike is down to the course and the wind as much as the legs
+	if g.Discipline == models.DisciplineBike {
+		return errors.New("bike goals need a target CTL")
+	}
+	return nil
+}
+
+// RequiredThreshold is the threshold speed (m/s) it takes to do the goal's distance in its
+// time, or zero for a goal that's a target CTL.
+func (g Goal) RequiredThreshold() float64 {
+	if g.TargetCTL > 0 || g.Duration <= 0 {
+		return 0
+	}
+	speed := g.Distance / float64(g.Duration)
+	return speed / functions.SustainableIntensity(float64(g.Duration))
+}
+
+// RequiredCTL is the CTL the goal needs, for an athlete at currentCTL with thresholds th.
+func (g Goal) RequiredCTL(currentCTL float64, th models.SportThresholds) (float64, error) {
+	if err := g.Validate(); err != nil {
+		return 0, err
+	}
+	if g.TargetCTL > 0 {
+		return g.TargetCTL, nil
+	}
+
+	var threshold functions.Threshold
+	switch g.Discipline {
+	case models.DisciplineRun:
+		threshold = th.RunPaceThreshold()
+	case models.DisciplineSwim:
+		threshold = th.SwimPaceThreshold(false)
+	}
+	if !threshold.Valid() {
+		return 0, ErrNoThreshold
+	}
+	if currentCTL <= 0 {
+		return 0, ErrNoFitness
+	}
+
+	return functions.RequiredCTL(currentCTL, threshold.Value, g.RequiredThreshold()), nil
+}
+
+// Assessment is how an athlete stands against a goal.
+type Assessment struct {
+	Goal        Goal    `json:"goal"`
+	CurrentCTL  float64 `json:"current_ctl"`
+	RequiredCTL float64 `json:"required_ctl"`
+
+	// days until the event, and the CTL a week it takes to get to RequiredCTL by then
+	Days       int     `json:"days"`
+	WeeklyRamp float64 `json:"weekly_ramp"`
+
+	// whether WeeklyRamp is within MaxRamp, and the soonest RequiredCTL can be had at MaxRamp
+	MaxRamp    float64   `json:"max_ramp"`
+	Achievable bool      `json:"achievable"`
+	Ready      time.Time `json:"ready"`
+}
+
+// Assess works out what it takes to get from currentCTL to the goal, starting now, without
+// going up more than maxRamp CTL a week.
+func Assess(g Goal, currentCTL float64, th models.SportThresholds, maxRamp float64, now time.Time) (Assessment, error) {
+	if maxRamp <= 0 {
+		maxRamp = DefaultMaxRamp
+	}
+
+	required, err := g.RequiredCTL(currentCTL, th)
+	if err != nil {
+		return Assessment{}, err
+	}
+
+	a := Assessment{
+		Goal:        g,
+		CurrentCTL:  currentCTL,
+		RequiredCTL: required,
+		Days:        daysUntil(g.EventDate, now),
+		MaxRamp:     maxRamp,
+		Ready:       now,
+	}
+
+	gap := required - currentCTL
+	if gap <= 0 {
+		// already there, and it's a matter of staying there
+		a.Achievable = a.Days >= 0
+		return a, nil
+	}
+
+	a.WeeklyRamp = functions.RampRate(currentCTL, required, a.Days)
+	a.Achievable = a.Days > 0 && a.WeeklyRamp <= maxRamp
+	a.Ready = now.AddDate(0, 0, int(math.Ceil(gap/maxRamp*7)))
+
+	return a, nil
+}
+
+// daysUntil is how many days away date is. Days aren't all 24 hours long (daylight saving
+// time), so it's rounded to the nearest.
+func daysUntil(date time.Time, now time.Time) int {
+	return int(math.Round(date.Sub(now).Hours() / 24))
+}
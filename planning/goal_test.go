@@ -0,0 +1,93 @@
+package planning_test
+
+import (
+	"atc/functions"
+	"atc/models"
+	"atc/planning"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var now = time.Date(2024, 9, 1, 8, 0, 0, 0, time.UTC)
+
+func TestGoalValidate(t *testing.T) {
+	event := now.AddDate(0, 3, 0)
+
+	assert.NoError(t, planning.Goal{Discipline: models.DisciplineRun, EventDate: event, Distance: 10000, Duration: 3000}.Validate())
+	assert.NoError(t, planning.Goal{Discipline: models.DisciplineBike, EventDate: event, TargetCTL: 70}.Validate())
+
+	// nothing to aim for
+	assert.Error(t, planning.Goal{Discipline: models.DisciplineRun, EventDate: event}.Validate())
+	// no date
+	assert.Error(t, planning.Goal{Discipline: models.DisciplineRun, TargetCTL: 70}.Validate())
+	// bikes go as fast as the course lets them
+	assert.Error(t, planning.Goal{Discipline: models.DisciplineBike, EventDate: event, Distance: 40000, Duration: 3600}.Validate())
+	// no tss for the gym
+	assert.Error(t, planning.Goal{Discipline: models.DisciplineStrength, EventDate: event, TargetCTL: 20}.Validate())
+}
+
+func TestRequiredCTL(t *testing.T) {
+	th := models.SportThresholds{ThresholdPace: 360} // 10km an hour
+
+	// an hour at threshold pace is the athlete as they are
+	same := planning.Goal{Discipline: models.DisciplineRun, EventDate: now, Distance: 10000, Duration: 3600}
+	ctl, err := same.RequiredCTL(50, th)
+	assert.NoError(t, err)
+	assert.InDelta(t, 50, ctl, 1e-6)
+
+	// the readme's 12km in an hour
+	faster := planning.Goal{Discipline: models.DisciplineRun, EventDate: now, Distance: 12000, Duration: 3600}
+	ctl, err = faster.RequiredCTL(50, th)
+	assert.NoError(t, err)
+	assert.InDelta(t, 50*math.Pow(1.2, 1/functions.FitnessExponent), ctl, 1e-6)
+
+	// a target ctl is taken at its word
+	target := planning.Goal{Discipline: models.DisciplineRun, EventDate: now, TargetCTL: 65}
+	ctl, err = target.RequiredCTL(0, models.SportThresholds{})
+	assert.NoError(t, err)
+	assert.Equal(t, 65.0, ctl)
+
+	_, err = faster.RequiredCTL(0, th)
+	assert.ErrorIs(t, err, planning.ErrNoFitness)
+	_, err = faster.RequiredCTL(50, models.SportThresholds{})
+	assert.ErrorIs(t, err, planning.ErrNoThreshold)
+}
+
+func TestAssess(t *testing.T) {
+	// 40 to 70 in 10 weeks is 3 a week
+	goal := planning.Goal{Discipline: models.DisciplineBike, EventDate: now.AddDate(0, 0, 70), TargetCTL: 70}
+	a, err := planning.Assess(goal, 40, models.SportThresholds{}, 6, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 70, a.Days)
+	assert.InDelta(t, 3, a.WeeklyRamp, 1e-9)
+	assert.True(t, a.Achievable)
+	assert.Equal(t, now.AddDate(0, 0, 35), a.Ready)
+
+	// in 3 weeks it's 10 a week, which is too much
+	goal.EventDate = now.AddDate(0, 0, 21)
+	a, err = planning.Assess(goal, 40, models.SportThresholds{}, 6, now)
+	assert.NoError(t, err)
+	assert.InDelta(t, 10, a.WeeklyRamp, 1e-9)
+	assert.False(t, a.Achievable)
+	assert.Equal(t, now.AddDate(0, 0, 35), a.Ready)
+
+	// already there
+	a, err = planning.Assess(goal, 80, models.SportThresholds{}, 6, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 0.0, a.WeeklyRamp)
+	assert.True(t, a.Achievable)
+
+	// too late
+	goal.EventDate = now.AddDate(0, 0, -7)
+	a, err = planning.Assess(goal, 40, models.SportThresholds{}, 6, now)
+	assert.NoError(t, err)
+	assert.False(t, a.Achievable)
+
+	// no max ramp is the default one
+	a, err = planning.Assess(goal, 40, models.SportThresholds{}, 0, now)
+	assert.NoError(t, err)
+	assert.Equal(t, planning.DefaultMaxRamp, a.MaxRamp)
+}
@@ -0,0 +1,199 @@
+package planning
+
+import (
+	"atc/functions"
+	"atc/models"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// a plan is the weeks between now and a goal, with a TSS budget for each discipline in each
+// of them. the goal's discipline builds toward the CTL the goal needs; the others hold the CTL
+// they started with, because the goal isn't about them. building is held back two ways:
+//   - CTL goes up no more than MaxRamp a week, as with Assess
+//   - a week's TSS is no more than MaxIncrease percent over the last week that wasn't a
+//     recovery week (the "10% rule")
+// and every RecoveryEvery'th week is a recovery week, at RecoveryLoad percent of the week
+// before it, for every discipline. how a week's budget is split into sessions (a long run at
+// IF 0.7, intervals at 0.85, and whatever's left over) is up to the athlete, for now.
+
+// the defaults, for anything config.yml doesn't say
+const (
+	DefaultMaxIncrease   = 10.0
+	DefaultRecoveryEvery = 4
+	DefaultRecoveryLoad  = 60.0
+)
+
+// ErrTooLate is returned when there are no weeks left to plan.
+var ErrTooLate = errors.New("the goal has been and gone")
+
+// Settings are how hard a plan is allowed to push.
+type Settings struct {
+	// the fastest CTL goes up, per week. 5-8 is sustainable, more than that is how people
+	// get hurt.
+	MaxRamp float64 `yaml:"max_ramp" json:"max_ramp"`
+
+	// the most a week's TSS goes up over the last one, in percent
+	MaxIncrease float64 `yaml:"max_increase" json:"max_increase"`
+
+	// every this many weeks is a recovery week (3 or 4, usually), at RecoveryLoad percent
+	// of the week before
+	RecoveryEvery int     `yaml:"recovery_every" json:"recovery_every"`
+	RecoveryLoad  float64 `yaml:"recovery_load" json:"recovery_load"`
+}
+
+// WithDefaults fills in anything that isn't set.
+func (s Settings) WithDefaults() Settings {
+	if s.MaxRamp == 0 {
+		s.MaxRamp = DefaultMaxRamp
+	}
+	if s.MaxIncrease == 0 {
+		s.MaxIncrease = DefaultMaxIncrease
+	}
+	if s.RecoveryEvery == 0 {
+		s.RecoveryEvery = DefaultRecoveryEvery
+	}
+	if s.RecoveryLoad == 0 {
+		s.RecoveryLoad = DefaultRecoveryLoad
+	}
+	return s
+}
+
+// Validate returns an error if a plan can't be made with these settings.
+func (s Settings) Validate() error {
+	switch {
+	case s.MaxRamp <= 0:
+		return fmt.Errorf("max_ramp should be more than zero, not %g", s.MaxRamp)
+	case s.MaxIncrease <= 0:
+		return fmt.Errorf("max_increase should be more than zero, not %g", s.MaxIncrease)
+	case s.RecoveryEvery < 2:
+		return fmt.Errorf("recovery_every should be 2 or more, not %d", s.RecoveryEvery)
+	case s.RecoveryLoad <= 0 || s.RecoveryLoad > 100:
+		return fmt.Errorf("recovery_load should be a percentage, not %g", s.RecoveryLoad)
+	}
+	return nil
+}
+
+// Week is one week of a plan. TSS is the budget for the week, and CTL is where that leaves
+// each discipline at the end of it, if the week goes to plan.
+type Week struct {
+	Start    time.Time                     `json:"start"`
+	Recovery bool                          `json:"recovery"`
+	TSS      map[models.Discipline]int     `json:"tss"`
+	Total    int                           `json:"total"`
+	CTL      map[models.Discipline]float64 `json:"ctl"`
+}
+
+// Plan is a goal, and the weeks between now and then.
+type Plan struct {
+	Goal        Goal     `json:"goal"`
+	Settings    Settings `json:"settings"`
+	RequiredCTL float64  `json:"required_ctl"`
+
+	// the most CTL the goal's discipline gets to, and whether that's enough. when the last
+	// week is a recovery week it's a taper, so the peak comes before the end.
+	CTL        float64 `json:"ctl"`
+	Achievable bool    `json:"achievable"`
+
+	Weeks []Week `json:"weeks"`
+}
+
+// NewPlan plans the weeks from now until the goal, for an athlete whose scored disciplines are
+// at currentCTL and whose thresholds for the goal's discipline are th.
+func NewPlan(g Goal, currentCTL map[models.Discipline]float64, th models.SportThresholds, settings Settings, now time.Time) (Plan, error) {
+	settings = settings.WithDefaults()
+	if err := settings.Validate(); err != nil {
+		return Plan{}, err
+	}
+
+	required, err := g.RequiredCTL(currentCTL[g.Discipline], th)
+	if err != nil {
+		return Plan{}, err
+	}
+
+	days := daysUntil(g.EventDate, now)
+	if days <= 0 {
+		return Plan{}, ErrTooLate
+	}
+	weeks := (days + 6) / 7
+
+	plan := Plan{Goal: g, Settings: settings, RequiredCTL: required}
+
+	// where each discipline is, and the last week that wasn't a recovery week. the athlete
+	// has been doing about 7 times their CTL a week, or it wouldn't be their CTL.
+	ctl := make(map[models.Discipline]float64)
+	lastBuild := make(map[models.Discipline]float64)
+	for _, d := range models.Disciplines {
+		if d.Scored() {
+			ctl[d] = currentCTL[d]
+			lastBuild[d] = functions.WeeklyTSS(ctl[d], ctl[d])
+		}
+	}
+
+	for i := 1; i <= weeks; i++ {
+		week := Week{
+			Start:    now.AddDate(0, 0, 7*(i-1)),
+			Recovery: i%settings.RecoveryEvery == 0,
+			TSS:      make(map[models.Discipline]int),
+			CTL:      make(map[models.Discipline]float64),
+		}
+
+		for d := range ctl {
+			var tss float64
+			switch {
+			case week.Recovery:
+				tss = lastBuild[d] * settings.RecoveryLoad / 100
+			case d == g.Discipline:
+				tss = buildTSS(ctl[d], required, lastBuild[d], buildWeeksLeft(i, weeks, settings.RecoveryEvery), settings)
+				lastBuild[d] = tss
+			default:
+				// back to where it started, after a recovery week
+				tss = buildTSS(ctl[d], currentCTL[d], lastBuild[d], 1, settings)
+				lastBuild[d] = tss
+			}
+
+			// the budget is what's planned, so the projection goes from what's planned
+			week.TSS[d] = int(math.Round(tss))
+			week.Total += week.TSS[d]
+			ctl[d] = functions.CTLAfterWeek(ctl[d], float64(week.TSS[d]))
+			week.CTL[d] = ctl[d]
+
+			if d == g.Discipline {
+				plan.CTL = math.Max(plan.CTL, ctl[d])
+			}
+		}
+
+		plan.Weeks = append(plan.Weeks, week)
+	}
+
+	plan.Achievable = math.Round(plan.CTL) >= math.Round(required)
+
+	return plan, nil
+}
+
+// buildTSS is the goal discipline's budget for a build week: enough to close the gap between
+// ctl and required over the build weeks left, as long as that's no more than MaxRamp and no
+// more than MaxIncrease over lastBuild. Somebody who isn't doing any yet has nothing to go
+// up ten percent from, so they only have MaxRamp to hold them back.
+func buildTSS(ctl float64, required float64, lastBuild float64, weeksLeft int, settings Settings) float64 {
+	ramp := math.Min(math.Max(required-ctl, 0)/float64(weeksLeft), settings.MaxRamp)
+	tss := functions.WeeklyTSS(ctl, ctl+ramp)
+
+	if lastBuild > 0 {
+		tss = math.Min(tss, lastBuild*(1+settings.MaxIncrease/100))
+	}
+	return tss
+}
+
+// buildWeeksLeft is how many of weeks week..last aren't recovery weeks.
+func buildWeeksLeft(week int, last int, recoveryEvery int) int {
+	left := 0
+	for i := week; i <= last; i++ {
+		if i%recoveryEvery != 0 {
+			left++
+		}
+	}
+	return left
+}
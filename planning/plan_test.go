@@ -0,0 +1,90 @@
+package planning_test
+
+import (
+	"atc/models"
+	"atc/planning"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSettings(t *testing.T) {
+	s := planning.Settings{MaxRamp: 5}.WithDefaults()
+	assert.Equal(t, 5.0, s.MaxRamp)
+	assert.Equal(t, planning.DefaultMaxIncrease, s.MaxIncrease)
+	assert.Equal(t, planning.DefaultRecoveryEvery, s.RecoveryEvery)
+	assert.Equal(t, planning.DefaultRecoveryLoad, s.RecoveryLoad)
+	assert.NoError(t, s.Validate())
+
+	s.RecoveryEvery = 1
+	assert.Error(t, s.Validate())
+	s.RecoveryEvery, s.RecoveryLoad = 3, 120
+	assert.Error(t, s.Validate())
+}
+
+func TestNewPlan(t *testing.T) {
+	ctl := map[models.Discipline]float64{models.DisciplineSwim: 10, models.DisciplineBike: 40, models.DisciplineRun: 30}
+	settings := planning.Settings{MaxRamp: 6, MaxIncrease: 10, RecoveryEvery: 4, RecoveryLoad: 60}
+
+	// twelve weeks to get the bike from 40 to 55
+	goal := planning.Goal{Discipline: models.DisciplineBike, EventDate: now.AddDate(0, 0, 84), TargetCTL: 55}
+	plan, err := planning.NewPlan(goal, ctl, models.SportThresholds{}, settings, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 55.0, plan.RequiredCTL)
+	assert.Len(t, plan.Weeks, 12)
+	assert.Equal(t, now, plan.Weeks[0].Start)
+	assert.Equal(t, now.AddDate(0, 0, 77), plan.Weeks[11].Start)
+	assert.True(t, plan.Achievable)
+	assert.InDelta(t, 55, plan.CTL, 1)
+
+	// 7 times ctl holds it where it is
+	lastBike, lastRun := 280.0, 210.0
+	assert.Equal(t, 70, plan.Weeks[0].TSS[models.DisciplineSwim])
+	assert.Equal(t, 210, plan.Weeks[0].TSS[models.DisciplineRun])
+
+	for i, week := range plan.Weeks {
+		bike, run := float64(week.TSS[models.DisciplineBike]), float64(week.TSS[models.DisciplineRun])
+		assert.Equal(t, week.TSS[models.DisciplineSwim]+week.TSS[models.DisciplineBike]+week.TSS[models.DisciplineRun], week.Total)
+
+		// every fourth week is a recovery week, for everything
+		assert.Equal(t, (i+1)%4 == 0, week.Recovery, "week %d", i+1)
+		if week.Recovery {
+			assert.InDelta(t, lastBike*0.6, bike, 1, "week %d", i+1)
+			assert.InDelta(t, lastRun*0.6, run, 1, "week %d", i+1)
+			continue
+		}
+
+		// the 10% rule
+		assert.LessOrEqual(t, bike, lastBike*1.1+0.5, "week %d", i+1)
+		assert.LessOrEqual(t, run, lastRun*1.1+0.5, "week %d", i+1)
+		lastBike, lastRun = bike, run
+
+		// the other sports hold (give or take the recovery weeks)
+		assert.InDelta(t, 30, week.CTL[models.DisciplineRun], 2.5, "week %d", i+1)
+	}
+
+	// too far in too little time: the 10% rule won't have it
+	goal.EventDate, goal.TargetCTL = now.AddDate(0, 0, 21), 80
+	plan, err = planning.NewPlan(goal, ctl, models.SportThresholds{}, settings, now)
+	assert.NoError(t, err)
+	assert.Len(t, plan.Weeks, 3)
+	assert.False(t, plan.Achievable)
+	assert.Less(t, plan.CTL, 50.0)
+
+	// the first week of the rest of your life has nothing to go ten percent up from
+	plan, err = planning.NewPlan(goal, map[models.Discipline]float64{}, models.SportThresholds{}, settings, now)
+	assert.NoError(t, err)
+	assert.Greater(t, plan.Weeks[0].TSS[models.DisciplineBike], 0)
+	assert.InDelta(t, 6, plan.Weeks[0].CTL[models.DisciplineBike], 0.5)
+
+	// already fit enough, so it's holding all the way
+	goal.TargetCTL = 30
+	plan, err = planning.NewPlan(goal, ctl, models.SportThresholds{}, settings, now)
+	assert.NoError(t, err)
+	assert.True(t, plan.Achievable)
+	assert.Equal(t, 280, plan.Weeks[0].TSS[models.DisciplineBike])
+
+	goal.EventDate = now.AddDate(0, 0, -1)
+	_, err = planning.NewPlan(goal, ctl, models.SportThresholds{}, settings, now)
+	assert.ErrorIs(t, err, planning.ErrTooLate)
+}
@@ -0,0 +1,576 @@
+package service
+
+import (
+	"atc/models"
+	"atc/planning"
+	"atc/store"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// the json api is the same data as the html pages, for scripts and web/app.js, so nobody has
+// to scrape a table. it's versioned in the path: v1 responses can gain fields, but a field
+// that changes meaning or goes away means a v2. it only reads the store, so it's as fresh as
+// the last sync (the webhook, a login, or somebody looking at /activities).
+//
+// every endpoint takes the same query parameters:
+//
+//	from=2024-07-01  first day to include, in the athlete's time zone. defaults to six weeks ago
+//	to=2024-08-11    last day to include. defaults to today, and no more than apiMaxYears after from
+//	sport=Bike       only this discipline (Swim, Bike, Run, Strength or Other). can be repeated
+//
+// and errors come back as {"error": "...", "status": 400}.
+
+const (
+	apiPrefix     = "/api/v1/"
+	apiDateFormat = "2006-01-02"
+
+	// apiMaxYears is the longest span from and to can cover. every day in it is a row in the
+	// pmc, so without a limit from=0001-01-01 is a very long response.
+	apiMaxYears = 5
+)
+
+// apiError is the body of every error response.
+type apiError struct {
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+}
+
+// apiAthlete is who's logged in.
+type apiAthlete struct {
+	Id        string `json:"id"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	TimeZone  string `json:"timezone"`
+}
+
+// apiActivity is a scored activity. It's models.Activity as it was when v1 was published, so
+// that a field added to (or renamed in) the store doesn't change the api along with it.
+type apiActivity struct {
+	Id                 int64             `json:"id"`
+	Name               string            `json:"name"`
+	Distance           float64           `json:"distance"`             // in meters
+	MovingTime         int               `json:"moving_time"`          // in seconds
+	ElapsedTime        int               `json:"elapsed_time"`         // in seconds
+	TotalElevationGain float64           `json:"total_elevation_gain"` // in meters
+	Type               string            `json:"type"`
+	SportType          string            `json:"sport_type"`
+	Discipline         models.Discipline `json:"discipline"`
+	StartDate          time.Time         `json:"start_date"`
+	Calories           int               `json:"calories"`
+	TSS                int               `json:"tss"`
+	Trimps             float64           `json:"trimps"`
+	IntensityFactor    float64           `json:"intensity_factor"`
+	Method             string            `json:"method"`            // power, pace or hr
+	AverageHeartRate   float64           `json:"average_heartrate"` // in bpm
+	MaxHeartRate       float64           `json:"max_heartrate"`     // in bpm
+	NormalizedPower    float64           `json:"normalized_power"`  // in watts
+	GradedPace         float64           `json:"graded_pace"`       // in m/s
+	OpenWater          bool              `json:"open_water"`
+	ExcludedFromCTL    bool              `json:"excluded_from_ctl"`
+	Source             string            `json:"source"` // strava, fit, tcx or gpx
+}
+
+// apiActivities is a list of scored activities, oldest first.
+type apiActivities struct {
+	From       string        `json:"from"`
+	To         string        `json:"to"`
+	Activities []apiActivity `json:"activities"`
+}
+
+// apiPMCDay is one day of a PMC.
+type apiPMCDay struct {
+	Date time.Time `json:"date"` // midnight, in the athlete's time zone
+	TSS  int       `json:"tss"`
+	CTL  float64   `json:"ctl"`
+	ATL  float64   `json:"atl"`
+	TSB  float64   `json:"tsb"`
+}
+
+// apiPMC is a daily PMC for each discipline that's scored.
+type apiPMC struct {
+	From   string                            `json:"from"`
+	To     string                            `json:"to"`
+	Series map[models.Discipline][]apiPMCDay `json:"series"`
+}
+
+// apiThresholdValues is models.SportThresholds without the history, which has no json tags
+// of its own (it's stored as is).
+type apiThresholdValues struct {
+	EffectiveFrom              time.Time `json:"effective_from"` // zero for the values from the beginning of time
+	ThresholdHR                float64   `json:"threshold_hr"`
+	FTP                        float64   `json:"ftp"`
+	ThresholdPace              float64   `json:"threshold_pace"`
+	ThresholdSwimPace          float64   `json:"threshold_pace_100m"`
+	OpenWaterThresholdSwimPace float64   `json:"open_water_threshold_pace_100m"`
+}
+
+// apiDisciplineThresholds is what applies today, and every change that led up to it.
+type apiDisciplineThresholds struct {
+	Current apiThresholdValues   `json:"current"`
+	History []apiThresholdValues `json:"history"`
+}
+
+// apiProposal is a threshold change waiting on somebody to confirm it.
+type apiProposal struct {
+	Id           string    `json:"id"`
+	Sport        string    `json:"sport"`
+	Metric       string    `json:"metric"`   // power, pace or hr
+	Current      float64   `json:"current"`  // bpm, watts, or seconds per km
+	Proposed     float64   `json:"proposed"` // same units as Current
+	ActivityId   int64     `json:"activity_id"`
+	ActivityDate time.Time `json:"activity_date"`
+	Effort       string    `json:"effort"`
+}
+
+// apiThresholds is every scored discipline's thresholds, and changes waiting on somebody to
+// confirm them.
+type apiThresholds struct {
+	Thresholds map[models.Discipline]apiDisciplineThresholds `json:"thresholds"`
+	Proposals  []apiProposal                                 `json:"proposals"`
+}
+
+// apiGoalDetail is a goal as the athlete set it.
+type apiGoalDetail struct {
+	Id         string            `json:"id"`
+	Name       string            `json:"name"`
+	EventDate  time.Time         `json:"event_date"`
+	Discipline models.Discipline `json:"discipline"`
+	Distance   float64           `json:"distance,omitempty"`   // in meters, with Duration
+	Duration   int               `json:"duration,omitempty"`   // in seconds
+	TargetCTL  float64           `json:"target_ctl,omitempty"` // instead of a distance and duration
+}
+
+// apiGoal is a goal and how the athlete stands against it, or why that couldn't be worked out.
+type apiGoal struct {
+	Goal        apiGoalDetail `json:"goal"`
+	CurrentCTL  float64       `json:"current_ctl"`
+	RequiredCTL float64       `json:"required_ctl"`
+	Days        int           `json:"days"`        // until the event
+	WeeklyRamp  float64       `json:"weekly_ramp"` // CTL a week it takes to get to RequiredCTL
+	MaxRamp     float64       `json:"max_ramp"`
+	Achievable  bool          `json:"achievable"` // WeeklyRamp is within MaxRamp
+	Ready       time.Time     `json:"ready"`      // the soonest RequiredCTL can be had at MaxRamp
+	Error       string        `json:"error,omitempty"`
+}
+
+// apiGoals is the athlete's goals, soonest first.
+type apiGoals struct {
+	MaxRamp float64   `json:"max_ramp"`
+	Goals   []apiGoal `json:"goals"`
+}
+
+// apiPlanSettings is how a plan was allowed to ramp up.
+type apiPlanSettings struct {
+	MaxRamp       float64 `json:"max_ramp"`       // CTL a week
+	MaxIncrease   float64 `json:"max_increase"`   // percent of the week before
+	RecoveryEvery int     `json:"recovery_every"` // weeks
+	RecoveryLoad  float64 `json:"recovery_load"`  // percent of the week before
+}
+
+// apiWeek is one week of a plan.
+type apiWeek struct {
+	Start    time.Time                     `json:"start"`
+	Recovery bool                          `json:"recovery"`
+	TSS      map[models.Discipline]int     `json:"tss"`
+	Total    int                           `json:"total"`
+	CTL      map[models.Discipline]float64 `json:"ctl"` // at the end of the week
+}
+
+// apiPlan is a goal, and the weeks between now and then.
+type apiPlan struct {
+	Goal        apiGoalDetail   `json:"goal"`
+	Settings    apiPlanSettings `json:"settings"`
+	RequiredCTL float64         `json:"required_ctl"`
+	CTL         float64         `json:"ctl"` // the most the goal's discipline gets to
+	Achievable  bool            `json:"achievable"`
+	Weeks       []apiWeek       `json:"weeks"`
+}
+
+// apiQuery is the query parameters every endpoint takes.
+type apiQuery struct {
+	From        time.Time // midnight, in the athlete's time zone
+	To          time.Time // midnight of the last day
+	Disciplines map[models.Discipline]bool
+	Location    *time.Location // the athlete's time zone, which the days are in
+}
+
+// Includes returns true if the query is for d (every discipline is, if it didn't say).
+func (q apiQuery) Includes(d models.Discipline) bool {
+	return len(q.Disciplines) == 0 || q.Disciplines[d]
+}
+
+// parseAPIQuery reads the query parameters, filling in the defaults. Dates are days in loc.
+func (s *Service) parseAPIQuery(r *http.Request, loc *time.Location) (apiQuery, error) {
+	query := r.URL.Query()
+	today := models.StartOfDay(time.Now(), loc)
+
+	q := apiQuery{
+		From:     today.AddDate(0, 0, -models.CTLDays),
+		To:       today,
+		Location: loc,
+	}
+
+	for _, param := range []struct {
+		name string
+		date *time.Time
+	}{{"from", &q.From}, {"to", &q.To}} {
+		value := query.Get(param.name)
+		if value == "" {
+			continue
+		}
+		date, err := time.ParseInLocation(apiDateFormat, value, loc)
+		if err != nil {
+			return q, fmt.Errorf("%s should be a date like 2024-08-01, not %q", param.name, value)
+		}
+		*param.date = date
+	}
+
+	if q.To.Before(q.From) {
+		return q, fmt.Errorf("from (%s) is after to (%s)", q.From.Format(apiDateFormat), q.To.Format(apiDateFormat))
+	}
+	if q.To.After(q.From.AddDate(apiMaxYears, 0, 0)) {
+		return q, fmt.Errorf("from (%s) and to (%s) are more than %d years apart", q.From.Format(apiDateFormat), q.To.Format(apiDateFormat), apiMaxYears)
+	}
+
+	disciplines, err := parseDisciplines(r)
+	if err != nil {
+		return q, err
+	}
+	q.Disciplines = disciplines
+
+	return q, nil
+}
+
+// parseDisciplines reads the sport parameters.
+func parseDisciplines(r *http.Request) (map[models.Discipline]bool, error) {
+	disciplines := make(map[models.Discipline]bool)
+	for _, value := range r.URL.Query()["sport"] {
+		d, err := models.ParseDiscipline(value)
+		if err != nil {
+			return nil, err
+		}
+		disciplines[d] = true
+	}
+	return disciplines, nil
+}
+
+// writeJSON sends v back with status.
+func (s *Service) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.Log.WithError(err).Error("error writing to socket")
+	}
+}
+
+// writeAPIError sends back an error the way every api response does.
+func (s *Service) writeAPIError(w http.ResponseWriter, status int, message string) {
+	s.writeJSON(w, status, apiError{Error: message, Status: status})
+}
+
+// apiHandle registers an api endpoint. Only GETs from somebody who's logged in get as far as
+// handle, everybody else gets an error (rather than the redirect to /auth the pages do).
+func (s *Service) apiHandle(path string, handle func(w http.ResponseWriter, r *http.Request, athleteID string, q apiQuery)) {
+	http.HandleFunc(apiPrefix+path, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			s.writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		athleteID, err := s.sessionAthlete(r)
+		if err != nil {
+			s.Log.Infof("[%s]: %v", r.URL.Path, err)
+			s.writeAPIError(w, http.StatusUnauthorized, "not logged in, see /auth")
+			return
+		}
+
+		q, err := s.parseAPIQuery(r, s.location(athleteID))
+		if err != nil {
+			s.writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		handle(w, r, athleteID, q)
+	})
+}
+
+// /api/v1/... is the json api
+func (s *Service) apiHandler() {
+	s.apiHandle("athlete", func(w http.ResponseWriter, r *http.Request, athleteID string, q apiQuery) {
+		athlete, err := s.Store.GetAthlete(athleteID)
+		if err != nil {
+			s.Log.WithError(err).Errorf("Failed to load athlete %s", athleteID)
+			s.writeAPIError(w, http.StatusInternalServerError, "failed to load athlete")
+			return
+		}
+
+		s.writeJSON(w, http.StatusOK, apiAthlete{
+			Id:        athlete.Id,
+			FirstName: athlete.FirstName,
+			LastName:  athlete.LastName,
+			TimeZone:  q.Location.String(),
+		})
+	})
+
+	s.apiHandle("activities", func(w http.ResponseWriter, r *http.Request, athleteID string, q apiQuery) {
+		activities, err := s.Store.ListActivities(athleteID, q.From, q.To.AddDate(0, 0, 1))
+		if err != nil {
+			s.Log.WithError(err).Error("Failed to load activities")
+			s.writeAPIError(w, http.StatusInternalServerError, "failed to load activities")
+			return
+		}
+
+		response := apiActivities{
+			From:       q.From.Format(apiDateFormat),
+			To:         q.To.Format(apiDateFormat),
+			Activities: []apiActivity{},
+		}
+		for _, activity := range activities {
+			if q.Includes(activity.Discipline) {
+				response.Activities = append(response.Activities, newAPIActivity(activity))
+			}
+		}
+
+		s.writeJSON(w, http.StatusOK, response)
+	})
+
+	s.apiHandle("pmc", func(w http.ResponseWriter, r *http.Request, athleteID string, q apiQuery) {
+		for d := range q.Disciplines {
+			if !d.Scored() {
+				s.writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("%s isn't scored, so it has no PMC", d))
+				return
+			}
+		}
+
+		// load starts at zero, so it needs seeding with history from before the first day
+		seed := q.From.AddDate(0, 0, -s.Config.Strava.HistoryDays)
+		activities, err := s.Store.ListActivities(athleteID, seed, q.To.AddDate(0, 0, 1))
+		if err != nil {
+			s.Log.WithError(err).Error("Failed to load activities")
+			s.writeAPIError(w, http.StatusInternalServerError, "failed to load activities")
+			return
+		}
+
+		response := apiPMC{
+			From:   q.From.Format(apiDateFormat),
+			To:     q.To.Format(apiDateFormat),
+			Series: make(map[models.Discipline][]apiPMCDay),
+		}
+		for _, d := range models.Disciplines {
+			if d.Scored() && q.Includes(d) {
+				pmc := models.NewPMC(models.FilterActivitiesByType(activities, d), seed, q.To, q.Location)
+				response.Series[d] = newAPIPMC(pmc.Since(q.From))
+			}
+		}
+
+		s.writeJSON(w, http.StatusOK, response)
+	})
+
+	s.apiHandle("thresholds", func(w http.ResponseWriter, r *http.Request, athleteID string, q apiQuery) {
+		thresholds := s.thresholds(athleteID)
+
+		response := apiThresholds{
+			Thresholds: make(map[models.Discipline]apiDisciplineThresholds),
+			Proposals:  []apiProposal{},
+		}
+		for _, d := range models.Disciplines {
+			th, ok := thresholds.For(d)
+			if !ok || !q.Includes(d) {
+				continue
+			}
+
+			dt := apiDisciplineThresholds{
+				Current: newAPIThresholdValues(th.On(time.Now())),
+				History: []apiThresholdValues{newAPIThresholdValues(th)},
+			}
+			for _, change := range th.History {
+				dt.History = append(dt.History, newAPIThresholdValues(change))
+			}
+			response.Thresholds[d] = dt
+		}
+		proposals, err := s.pendingProposals(athleteID)
+		if err != nil {
+			s.Log.WithError(err).Errorf("Failed to load threshold proposals for athlete %s", athleteID)
+			s.writeAPIError(w, http.StatusInternalServerError, "failed to load threshold proposals")
+			return
+		}
+		for _, p := range proposals {
+			// proposals go by the formulas' name for the sport, which is ours in lower case
+			d, _ := models.ParseDiscipline(p.Sport)
+			if q.Includes(d) {
+				response.Proposals = append(response.Proposals, newAPIProposal(p))
+			}
+		}
+
+		s.writeJSON(w, http.StatusOK, response)
+	})
+
+	s.apiHandle("goals", func(w http.ResponseWriter, r *http.Request, athleteID string, q apiQuery) {
+		statuses, err := s.goalStatuses(athleteID)
+		if err != nil {
+			s.Log.WithError(err).Errorf("Failed to load goals for athlete %s", athleteID)
+			s.writeAPIError(w, http.StatusInternalServerError, "failed to load goals")
+			return
+		}
+
+		response := apiGoals{MaxRamp: s.Config.Planning.MaxRamp, Goals: []apiGoal{}}
+		for _, status := range statuses {
+			if !q.Includes(status.Goal.Discipline) {
+				continue
+			}
+			goal := newAPIGoal(status.Assessment)
+			if status.Err != nil {
+				goal.Error = status.Err.Error()
+			}
+			response.Goals = append(response.Goals, goal)
+		}
+
+		s.writeJSON(w, http.StatusOK, response)
+	})
+
+	// the plan for one goal, by id
+	s.apiHandle("plan", func(w http.ResponseWriter, r *http.Request, athleteID string, q apiQuery) {
+		id := r.URL.Query().Get("goal")
+
+		_, plan, err := s.goalPlan(athleteID, id)
+		switch {
+		case errors.Is(err, store.ErrNotFound):
+			s.writeAPIError(w, http.StatusNotFound, fmt.Sprintf("no such goal %q", id))
+		case unplannable(err):
+			s.writeAPIError(w, http.StatusUnprocessableEntity, err.Error())
+		case err != nil:
+			s.Log.WithError(err).Errorf("Failed to plan goal %s for athlete %s", id, athleteID)
+			s.writeAPIError(w, http.StatusInternalServerError, "failed to plan goal")
+		default:
+			s.writeJSON(w, http.StatusOK, newAPIPlan(plan))
+		}
+	})
+
+	// anything else under /api/v1/ is a 404, in json
+	http.HandleFunc(apiPrefix, func(w http.ResponseWriter, r *http.Request) {
+		s.writeAPIError(w, http.StatusNotFound, fmt.Sprintf("no such endpoint %s", r.URL.Path))
+	})
+
+	return
+}
+
+// newAPIThresholdValues copies th's values (but not its history).
+func newAPIThresholdValues(th models.SportThresholds) apiThresholdValues {
+	return apiThresholdValues{
+		EffectiveFrom:              th.EffectiveFrom,
+		ThresholdHR:                th.ThresholdHR,
+		FTP:                        th.FTP,
+		ThresholdPace:              th.ThresholdPace,
+		ThresholdSwimPace:          th.ThresholdSwimPace,
+		OpenWaterThresholdSwimPace: th.OpenWaterThresholdSwimPace,
+	}
+}
+
+// newAPIActivity copies a's fields into the v1 shape.
+func newAPIActivity(a models.Activity) apiActivity {
+	return apiActivity{
+		Id:                 a.Id,
+		Name:               a.Name,
+		Distance:           a.Distance,
+		MovingTime:         a.MovingTime,
+		ElapsedTime:        a.ElapsedTime,
+		TotalElevationGain: a.TotalElevationGain,
+		Type:               a.Type,
+		SportType:          a.SportType,
+		Discipline:         a.Discipline,
+		StartDate:          a.StartDate,
+		Calories:           a.Calories,
+		TSS:                a.TSS,
+		Trimps:             a.Trimps,
+		IntensityFactor:    a.IntensityFactor,
+		Method:             string(a.Method),
+		AverageHeartRate:   a.AverageHeartRate,
+		MaxHeartRate:       a.MaxHeartRate,
+		NormalizedPower:    a.NormalizedPower,
+		GradedPace:         a.GradedPace,
+		OpenWater:          a.OpenWater,
+		ExcludedFromCTL:    a.ExcludedFromCTL,
+		Source:             a.Source,
+	}
+}
+
+// newAPIPMC copies every day of pmc.
+func newAPIPMC(pmc models.PMC) []apiPMCDay {
+	days := make([]apiPMCDay, 0, len(pmc))
+	for _, day := range pmc {
+		days = append(days, apiPMCDay{Date: day.Date, TSS: day.TSS, CTL: day.CTL, ATL: day.ATL, TSB: day.TSB})
+	}
+	return days
+}
+
+// newAPIProposal copies p's fields.
+func newAPIProposal(p models.ThresholdProposal) apiProposal {
+	return apiProposal{
+		Id:           p.Id,
+		Sport:        p.Sport,
+		Metric:       string(p.Metric),
+		Current:      p.Current,
+		Proposed:     p.Proposed,
+		ActivityId:   p.ActivityId,
+		ActivityDate: p.ActivityDate,
+		Effort:       p.Effort,
+	}
+}
+
+// newAPIGoalDetail copies g's fields.
+func newAPIGoalDetail(g planning.Goal) apiGoalDetail {
+	return apiGoalDetail{
+		Id:         g.Id,
+		Name:       g.Name,
+		EventDate:  g.EventDate,
+		Discipline: g.Discipline,
+		Distance:   g.Distance,
+		Duration:   g.Duration,
+		TargetCTL:  g.TargetCTL,
+	}
+}
+
+// newAPIGoal copies a's fields. Error is up to the caller.
+func newAPIGoal(a planning.Assessment) apiGoal {
+	return apiGoal{
+		Goal:        newAPIGoalDetail(a.Goal),
+		CurrentCTL:  a.CurrentCTL,
+		RequiredCTL: a.RequiredCTL,
+		Days:        a.Days,
+		WeeklyRamp:  a.WeeklyRamp,
+		MaxRamp:     a.MaxRamp,
+		Achievable:  a.Achievable,
+		Ready:       a.Ready,
+	}
+}
+
+// newAPIPlan copies every week of p.
+func newAPIPlan(p planning.Plan) apiPlan {
+	plan := apiPlan{
+		Goal: newAPIGoalDetail(p.Goal),
+		Settings: apiPlanSettings{
+			MaxRamp:       p.Settings.MaxRamp,
+			MaxIncrease:   p.Settings.MaxIncrease,
+			RecoveryEvery: p.Settings.RecoveryEvery,
+			RecoveryLoad:  p.Settings.RecoveryLoad,
+		},
+		RequiredCTL: p.RequiredCTL,
+		CTL:         p.CTL,
+		Achievable:  p.Achievable,
+		Weeks:       make([]apiWeek, 0, len(p.Weeks)),
+	}
+	for _, week := range p.Weeks {
+		plan.Weeks = append(plan.Weeks, apiWeek{
+			Start:    week.Start,
+			Recovery: week.Recovery,
+			TSS:      week.TSS,
+			Total:    week.Total,
+			CTL:      week.CTL,
+		})
+	}
+	return plan
+}
@@ -0,0 +1,130 @@
+package service
+
+import (
+	"atc/chart"
+	"atc/models"
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// the performance management chart is on /activities, as svg, for whichever sports were asked
+// for (all of them unless somebody said otherwise). /chart is the same chart as a file to
+// download, png unless it's asked for as svg.
+
+// chartFormats are the formats /chart can draw
+var chartFormats = map[string]struct {
+	write       func(w io.Writer, title string, pmc models.PMC) error
+	contentType string
+}{
+	"png": {chart.WritePNG, "image/png"},
+	"svg": {chart.WriteSVG, "image/svg+xml"},
+}
+
+// chartPMC is the combined PMC of every activity q includes, seeded from seed, for the days q
+// asks for.
+func (s *Service) chartPMC(activities []models.Activity, seed time.Time, q apiQuery) models.PMC {
+	var included []models.Activity
+	for _, activity := range activities {
+		if q.Includes(activity.Discipline) {
+			included = append(included, activity)
+		}
+	}
+	return models.NewPMC(included, seed, q.To, q.Location).Since(q.From)
+}
+
+// chartTitle names the sports in the chart.
+func chartTitle(q apiQuery) string {
+	var names []string
+	for _, d := range models.Disciplines {
+		if q.Disciplines[d] {
+			names = append(names, string(d))
+		}
+	}
+	if len(names) == 0 {
+		return "Combined"
+	}
+	return strings.Join(names, " + ")
+}
+
+// newChartView draws the chart for /activities, with links to the other sports and the png.
+func newChartView(pmc models.PMC, q apiQuery) (chartView, error) {
+	var buf bytes.Buffer
+	if err := chart.WriteSVG(&buf, chartTitle(q), pmc); err != nil {
+		return chartView{}, err
+	}
+
+	query := url.Values{"format": {"png"}}
+	for d := range q.Disciplines {
+		query.Add("sport", string(d))
+	}
+
+	// the svg is ours, and chart escapes the only text in it
+	view := chartView{SVG: template.HTML(buf.String()), PNG: "/chart?" + query.Encode()}
+
+	options := []models.Discipline{"", models.DisciplineSwim, models.DisciplineBike, models.DisciplineRun}
+	for _, d := range options {
+		option := chartOption{Name: "Combined", URL: "/activities", Selected: len(q.Disciplines) == 0}
+		if d != "" {
+			option = chartOption{Name: string(d), URL: "/activities?sport=" + string(d), Selected: len(q.Disciplines) == 1 && q.Disciplines[d]}
+		}
+		view.Options = append(view.Options, option)
+	}
+
+	return view, nil
+}
+
+// /chart?sport=Bike&format=png downloads the chart
+func (s *Service) chartHandler() {
+	http.HandleFunc("/chart", func(w http.ResponseWriter, r *http.Request) {
+		athleteID, ok := s.athleteForRequest(w, r)
+		if !ok {
+			return
+		}
+
+		q, err := s.parseAPIQuery(r, s.location(athleteID))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "png"
+		}
+		f, ok := chartFormats[format]
+		if !ok {
+			http.Error(w, "Unknown format", http.StatusBadRequest)
+			return
+		}
+
+		// load starts at zero, so it needs seeding with history from before the first day
+		seed := q.From.AddDate(0, 0, -s.Config.Strava.HistoryDays)
+		activities, err := s.Store.ListActivities(athleteID, seed, q.To.AddDate(0, 0, 1))
+		if err != nil {
+			s.Log.WithError(err).Error("Failed to load activities")
+			http.Error(w, "Failed to load activities", http.StatusInternalServerError)
+			return
+		}
+
+		var buf bytes.Buffer
+		if err := f.write(&buf, chartTitle(q), s.chartPMC(activities, seed, q)); err != nil {
+			s.Log.WithError(err).Errorf("Failed to draw chart for athlete %s", athleteID)
+			http.Error(w, "Failed to draw chart", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", f.contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=pmc-%s-%s.%s", q.From.Format(apiDateFormat), q.To.Format(apiDateFormat), format))
+		if _, err := buf.WriteTo(w); err != nil {
+			s.Log.WithError(err).Error("error writing to socket")
+		}
+	})
+
+	return
+}
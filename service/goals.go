@@ -0,0 +1,311 @@
+package service
+
+import (
+	"atc/models"
+	"atc/planning"
+	"atc/store"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// goals are kept in the store with the athlete, and assessed (and planned for) whenever
+// somebody looks at them: against the CTL each sport has today, and the thresholds that apply
+// today, so they get closer (or further away) as the training goes.
+
+// goalStatus is a goal and how the athlete stands against it. Err is why that couldn't be
+// worked out, if it couldn't.
+type goalStatus struct {
+	planning.Assessment
+	Err error
+}
+
+// currentCTL is each scored discipline's CTL as of today, which is midnight where the athlete
+// is.
+func (s *Service) currentCTL(athleteID string, today time.Time) (map[models.Discipline]float64, error) {
+	after := today.AddDate(0, 0, -s.Config.Strava.HistoryDays)
+	activities, err := s.Store.ListActivities(athleteID, after, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	ctl := make(map[models.Discipline]float64)
+	for _, d := range models.Disciplines {
+		if d.Scored() {
+			ctl[d] = models.NewPMC(models.FilterActivitiesByType(activities, d), after, today, today.Location()).Latest().CTL
+		}
+	}
+	return ctl, nil
+}
+
+// goalStatuses assesses each of the athlete's goals, soonest first.
+func (s *Service) goalStatuses(athleteID string) ([]goalStatus, error) {
+	goals, err := s.Store.ListGoals(athleteID)
+	if err != nil {
+		return nil, err
+	}
+
+	today := models.StartOfDay(time.Now(), s.location(athleteID))
+	ctl, err := s.currentCTL(athleteID, today)
+	if err != nil {
+		return nil, err
+	}
+	thresholds := s.thresholds(athleteID).On(today)
+
+	var statuses []goalStatus
+	for _, goal := range goals {
+		th, _ := thresholds.For(goal.Discipline)
+		a, err := planning.Assess(goal, ctl[goal.Discipline], th, s.Config.Planning.MaxRamp, today)
+		if err != nil {
+			a = planning.Assessment{Goal: goal, CurrentCTL: ctl[goal.Discipline], MaxRamp: s.Config.Planning.MaxRamp}
+		}
+		statuses = append(statuses, goalStatus{a, err})
+	}
+
+	return statuses, nil
+}
+
+// addGoal stores a new goal alongside the athlete's others.
+func (s *Service) addGoal(athleteID string, goal planning.Goal) error {
+	if err := goal.Validate(); err != nil {
+		return err
+	}
+
+	s.goalLock.Lock()
+	defer s.goalLock.Unlock()
+
+	goals, err := s.Store.ListGoals(athleteID)
+	if err != nil {
+		return err
+	}
+
+	goal.Id = strconv.FormatInt(time.Now().UnixNano(), 10)
+	goals = append(goals, goal)
+	sort.SliceStable(goals, func(i, j int) bool {
+		return goals[i].EventDate.Before(goals[j].EventDate)
+	})
+
+	return s.Store.SaveGoals(athleteID, goals)
+}
+
+// deleteGoal removes one of the athlete's goals. It's store.ErrNotFound if there's no such goal.
+func (s *Service) deleteGoal(athleteID string, id string) error {
+	s.goalLock.Lock()
+	defer s.goalLock.Unlock()
+
+	goals, err := s.Store.ListGoals(athleteID)
+	if err != nil {
+		return err
+	}
+
+	for i, goal := range goals {
+		if goal.Id == id {
+			return s.Store.SaveGoals(athleteID, append(goals[:i], goals[i+1:]...))
+		}
+	}
+	return store.ErrNotFound
+}
+
+// goalPlan plans the weeks until one of the athlete's goals. The goal is returned even when
+// it can't be planned for (it's too late, or there's nothing to plan from), and it's
+// store.ErrNotFound if there's no such goal.
+func (s *Service) goalPlan(athleteID string, id string) (planning.Goal, planning.Plan, error) {
+	goals, err := s.Store.ListGoals(athleteID)
+	if err != nil {
+		return planning.Goal{}, planning.Plan{}, err
+	}
+
+	for _, goal := range goals {
+		if goal.Id != id {
+			continue
+		}
+
+		today := models.StartOfDay(time.Now(), s.location(athleteID))
+		ctl, err := s.currentCTL(athleteID, today)
+		if err != nil {
+			return goal, planning.Plan{}, err
+		}
+		th, _ := s.thresholds(athleteID).On(today).For(goal.Discipline)
+
+		plan, err := planning.NewPlan(goal, ctl, th, s.Config.Planning, today)
+		return goal, plan, err
+	}
+
+	return planning.Goal{}, planning.Plan{}, store.ErrNotFound
+}
+
+// unplannable returns true for the errors that mean a goal can't be planned for, as opposed to
+// something having gone wrong.
+func unplannable(err error) bool {
+	return errors.Is(err, planning.ErrTooLate) || errors.Is(err, planning.ErrNoFitness) || errors.Is(err, planning.ErrNoThreshold)
+}
+
+// parseGoal reads a goal from the form on /goals. Distances are in km, times are h:mm:ss
+// (or m:ss, or minutes), and the date is a day in loc.
+func (s *Service) parseGoal(r *http.Request, loc *time.Location) (planning.Goal, error) {
+	goal := planning.Goal{Name: strings.TrimSpace(r.FormValue("name"))}
+
+	d, err := models.ParseDiscipline(r.FormValue("discipline"))
+	if err != nil {
+		return goal, err
+	}
+	goal.Discipline = d
+
+	date := r.FormValue("date")
+	goal.EventDate, err = time.ParseInLocation(apiDateFormat, date, loc)
+	if err != nil {
+		return goal, fmt.Errorf("the date should be like 2024-08-01, not %q", date)
+	}
+
+	if v := strings.TrimSpace(r.FormValue("target_ctl")); v != "" {
+		goal.TargetCTL, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			return goal, fmt.Errorf("the target CTL should be a number, not %q", v)
+		}
+	}
+
+	if v := strings.TrimSpace(r.FormValue("distance")); v != "" {
+		km, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return goal, fmt.Errorf("the distance should be in km, not %q", v)
+		}
+		goal.Distance = km * 1000
+	}
+
+	if v := strings.TrimSpace(r.FormValue("time")); v != "" {
+		goal.Duration, err = parseClock(v)
+		if err != nil {
+			return goal, err
+		}
+	}
+
+	if goal.Name == "" {
+		goal.Name = fmt.Sprintf("%s on %s", goal.Discipline, goal.EventDate.Format(apiDateFormat))
+	}
+
+	return goal, goal.Validate()
+}
+
+// parseClock reads h:mm:ss, m:ss or plain minutes as seconds.
+func parseClock(v string) (int, error) {
+	parts := strings.Split(v, ":")
+	if len(parts) == 1 {
+		parts = append(parts, "0")
+	}
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("the time should be like 1:05:30, not %q", v)
+	}
+
+	seconds := 0
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("the time should be like 1:05:30, not %q", v)
+		}
+		seconds = seconds*60 + n
+	}
+	return seconds, nil
+}
+
+// /goals lists the athlete's goals and how they're getting on, and adds new ones
+func (s *Service) goalsHandler() {
+	http.HandleFunc("/goals", func(w http.ResponseWriter, r *http.Request) {
+		athleteID, ok := s.athleteForRequest(w, r)
+		if !ok {
+			return
+		}
+
+		status, message := http.StatusOK, ""
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			goal, err := s.parseGoal(r, s.location(athleteID))
+			if err == nil {
+				err = s.addGoal(athleteID, goal)
+				if err == nil {
+					s.Log.Infof("Added goal %q for athlete %s", goal.Name, athleteID)
+					http.Redirect(w, r, "/goals", http.StatusSeeOther)
+					return
+				}
+			}
+			s.Log.WithError(err).Warnf("Not adding goal for athlete %s", athleteID)
+			status, message = http.StatusBadRequest, fmt.Sprintf("Couldn't add that goal: %v", err)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		statuses, err := s.goalStatuses(athleteID)
+		if err != nil {
+			s.Log.WithError(err).Errorf("Failed to load goals for athlete %s", athleteID)
+			http.Error(w, "Failed to load goals", http.StatusInternalServerError)
+			return
+		}
+
+		if err := renderGoals(w, status, statuses, s.Config.Planning.MaxRamp, message); err != nil {
+			s.Log.WithError(err).Error("Failed to send page")
+		}
+	})
+
+	// the weeks between now and a goal
+	http.HandleFunc("/goals/plan", func(w http.ResponseWriter, r *http.Request) {
+		athleteID, ok := s.athleteForRequest(w, r)
+		if !ok {
+			return
+		}
+
+		id := r.URL.Query().Get("id")
+
+		goal, plan, err := s.goalPlan(athleteID, id)
+		switch {
+		case errors.Is(err, store.ErrNotFound):
+			http.Error(w, "No such goal", http.StatusNotFound)
+		case unplannable(err):
+			if err := renderPlan(w, http.StatusUnprocessableEntity, goal, nil, fmt.Sprintf("There's no plan for this one: %v.", err)); err != nil {
+				s.Log.WithError(err).Error("Failed to send page")
+			}
+		case err != nil:
+			s.Log.WithError(err).Errorf("Failed to plan goal %s for athlete %s", id, athleteID)
+			http.Error(w, "Failed to plan goal", http.StatusInternalServerError)
+		default:
+			if err := renderPlan(w, http.StatusOK, goal, &plan, ""); err != nil {
+				s.Log.WithError(err).Error("Failed to send page")
+			}
+		}
+	})
+
+	// give up on a goal (or it's been and gone)
+	http.HandleFunc("/goals/delete", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		athleteID, ok := s.athleteForRequest(w, r)
+		if !ok {
+			return
+		}
+
+		id := r.FormValue("id")
+
+		err := s.deleteGoal(athleteID, id)
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "No such goal", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			s.Log.WithError(err).Errorf("Failed to delete goal %s for athlete %s", id, athleteID)
+			http.Error(w, "Failed to delete goal", http.StatusInternalServerError)
+			return
+		}
+
+		http.Redirect(w, r, "/goals", http.StatusSeeOther)
+	})
+
+	return
+}
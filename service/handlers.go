@@ -2,6 +2,8 @@ package service
 
 import (
 	"atc/models"
+	"atc/source"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
@@ -20,55 +22,54 @@ func (s *Service) oauthRedirectHandler() {
 
 // this exists to respond to oauth callbacks and isn't interactive
 func (s *Service) oauthCallbackHandler() {
-	// Handle the callback from Strava and store the token in a cookie
+	// Handle the callback from Strava, keep the athlete's token, and give them a session
 	http.HandleFunc("/oauth/callback", func(w http.ResponseWriter, r *http.Request) {
-		s.Log.Infof("[%s]: Received callback from Strava with URL: %s", r.URL.Path, r.URL.String())
-
-		s.Backend.AuthGood()
+		s.Log.Infof("[%s]: Received callback from Strava", r.URL.Path)
 
 		code := r.URL.Query().Get("code")
 		if code == "" {
 			s.Log.Warn("No token found in callback")
 			http.Error(w, "No token found in callback", http.StatusBadRequest)
-		} else {
-			s.Log.Infof("Received token: %s", code)
-			e := s.Backend.ExchangeCodeForToken(code)
-			if e != nil {
-				s.Log.WithError(e).Error("Failed to exchange code for token")
-				http.Error(w, "Failed to exchange code for token", http.StatusInternalServerError)
-			}
+			return
+		}
+
+		token, err := s.Backend.ExchangeCodeForToken(code)
+		if err != nil {
+			s.Log.WithError(err).Error("Failed to exchange code for token")
+			http.Error(w, "Failed to exchange code for token", http.StatusInternalServerError)
+			return
+		}
+
+		if token.AthleteID == "" {
+			s.Log.Error("Strava didn't say who the token is for")
+			http.Error(w, "Failed to exchange code for token", http.StatusInternalServerError)
+			return
+		}
+
+		if err := s.Store.SaveToken(token); err != nil {
+			s.Log.WithError(err).Errorf("Failed to save token for athlete %s", token.AthleteID)
+			http.Error(w, "Failed to save token", http.StatusInternalServerError)
+			return
 		}
 
-		// TODO: where is this found?
-		// s.Backend.SetRefreshToken()
-
-		// Cookie the access token
-		http.SetCookie(w, &http.Cookie{
-			Name:       "strava_token",
-			Value:      s.Backend.GetAccessToken(),
-			Path:       "/",
-			Domain:     "",
-			Expires:    time.Now().Add(24 * time.Hour),
-			RawExpires: "",
-			MaxAge:     0,
-			Secure:     true,
-			HttpOnly:   true,
-			SameSite:   0,
-			Raw:        "",
-			Unparsed:   nil,
-		})
-
-		// Cookie the refresh token
-		http.SetCookie(w, &http.Cookie{
-			Name:     "strava_refresh_token",
-			Value:    s.Backend.GetRefreshToken(),
-			Path:     "/",
-			Expires:  time.Now().Add(30 * 24 * time.Hour), // Refresh token typically lasts longer
-			HttpOnly: true,
-			Secure:   true,
-		})
-
-		// Also need to set this in the transport object
+		athlete, err := s.Source.Athlete(r.Context(), token.AthleteID)
+		if err != nil {
+			s.Log.WithError(err).Error("Failed to fetch athlete profile")
+			http.Error(w, "Failed to fetch athlete profile", http.StatusInternalServerError)
+			return
+		}
+
+		if err := s.saveAthlete(athlete); err != nil {
+			s.Log.WithError(err).Errorf("Failed to save athlete %s", athlete.Id)
+			http.Error(w, "Failed to save athlete", http.StatusInternalServerError)
+			return
+		}
+
+		s.Sessions.Set(w, athlete.Id)
+		s.Log.Infof("Logged in %s (%s)", athlete.FullName(), athlete.Id)
+
+		// catch up on whatever's happened since we last saw them without holding up the page
+		go s.backgroundSync(athlete.Id)
 
 		http.Redirect(w, r, "/activities", http.StatusFound)
 	})
@@ -76,74 +77,143 @@ func (s *Service) oauthCallbackHandler() {
 	return
 }
 
+// /logout forgets the session. the token stays in the store so the athlete doesn't have to
+// re-authorize the app next time.
+func (s *Service) logoutHandler() {
+	http.HandleFunc("/logout", func(w http.ResponseWriter, r *http.Request) {
+		s.Sessions.Clear(w)
+		http.Redirect(w, r, "/about", http.StatusFound)
+	})
+
+	return
+}
+
+// athleteForRequest works out who the request is from. If there's nobody logged in (or it's
+// somebody we've never heard of) it sends them off to /auth and returns false, and the
+// handler should stop there.
+func (s *Service) athleteForRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+	athleteID, err := s.sessionAthlete(r)
+	if err != nil {
+		s.Log.Infof("[%s]: %v, passing to /auth", r.URL.Path, err)
+		http.Redirect(w, r, "/auth", http.StatusFound)
+		return "", false
+	}
+
+	return athleteID, true
+}
+
+// sessionAthlete returns the id of the athlete the request's session belongs to, as long as
+// we know who that is.
+func (s *Service) sessionAthlete(r *http.Request) (string, error) {
+	athleteID, err := s.Sessions.Get(r)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := s.Store.GetAthlete(athleteID); err != nil {
+		return "", fmt.Errorf("unknown athlete %s: %w", athleteID, err)
+	}
+
+	return athleteID, nil
+}
+
 // /activities is the endpoint that displays activities and data
 func (s *Service) activitiesHandler() {
-	// behind the scenes this is wrapping transport.FetchActivities
+	// behind the scenes this is syncing the activity source into the store
 
 	// Handle requests to fetch activities and display CTL
 	http.HandleFunc("/activities", func(w http.ResponseWriter, r *http.Request) {
-		if s.Backend.Authenticated() == false {
-			s.Log.Info("not authenticated, passing to /auth")
+		athleteID, ok := s.athleteForRequest(w, r)
+		if !ok {
+			return
+		}
+
+		// pull anything new down from the source. if that doesn't work we can still show what we have.
+		// pulling down new activities is quick, but the backfill after somebody logs in isn't,
+		// so if that's still going we just show what it's got so far
+		err := s.syncActivities(r.Context(), athleteID)
+		switch {
+		case errors.Is(err, source.ErrNotConnected):
+			s.Log.WithError(err).Warnf("Athlete %s needs to log in again, passing to /auth", athleteID)
 			http.Redirect(w, r, "/auth", http.StatusFound)
-		} else {
-			s.Log.Info("authenticated, attempting to fetch activities")
+			return
+		case errors.Is(err, errSyncInProgress):
+			s.Log.Infof("Sync for athlete %s already running, showing stored activities", athleteID)
+		case err != nil:
+			s.Log.WithError(err).Error("Failed to sync activities, showing stored activities")
 		}
 
-		// Fetch the last six weeks of Swim, Bike, and Run activities
-		s.Log.Info("Fetching activities...")
-		stravaActivities, err := s.Backend.FetchActivities()
+		// the chart is of whichever sports were asked for
+		disciplines, err := parseDisciplines(r)
 		if err != nil {
-			s.Log.WithError(err).Error("Failed to fetch activities")
-			// http.Error(w, "Failed to fetch activities", http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		s.Log.Infof("Fetched %d activities", len(stravaActivities))
+		// Load enough Swim, Bike, and Run history to seed CTL, even though we only display six weeks
+		now := time.Now()
+		after := now.AddDate(0, 0, -s.Config.Strava.HistoryDays)
+		sixWeeksAgo := now.AddDate(0, 0, -models.CTLDays)
 
-		if len(stravaActivities) == 0 {
+		activities, err := s.Store.ListActivities(athleteID, after, time.Time{})
+		if err != nil {
+			s.Log.WithError(err).Error("Failed to load activities")
+			http.Error(w, "Failed to load activities", http.StatusInternalServerError)
+			return
+		}
+
+		s.Log.Infof("Loaded %d activities", len(activities))
+
+		if len(activities) == 0 {
 			// send to both syslog and the browser to let them know what's happened
-			s.Log.Warn("No activities found")
-			_, perr := fmt.Fprintf(w, "No activities found")
+			message := "No activities found"
+			if s.isSyncing(athleteID) {
+				message = "Still fetching your activities from Strava, check back in a minute"
+			}
+			s.Log.Warn(message)
+			_, perr := fmt.Fprint(w, message)
 			if perr != nil {
 				s.Log.WithError(perr).Error("error writing to socket")
 			}
 			return
 		}
 
-		// Map Strava activities to native Activity struct and calculate TSS
-		var activities []models.Activity
-		for _, sa := range stravaActivities {
-			var thresholdHR float64
-
-			// Determine the correct threshold HR based on the activity type
-			switch sa.Type {
-			case "Run":
-				thresholdHR = s.Config.Athlete.Run.ThresholdHR
-			case "Ride":
-				thresholdHR = s.Config.Athlete.Bike.ThresholdHR
-			case "Swim":
-				thresholdHR = s.Config.Athlete.Swim.ThresholdHR
-			default:
-				s.Log.Warnf("Unexpected/unknown activity type: %s", sa.Type)
-				continue // Skip unwanted activity types
+		// Build the daily performance management chart for Swim, Bike, and Run separately,
+		// seeded from the start of the history window, in days where the athlete is
+		loc := s.location(athleteID)
+		swimPMC := models.NewPMC(models.FilterActivitiesByType(activities, models.DisciplineSwim), after, now, loc)
+		bikePMC := models.NewPMC(models.FilterActivitiesByType(activities, models.DisciplineBike), after, now, loc)
+		runPMC := models.NewPMC(models.FilterActivitiesByType(activities, models.DisciplineRun), after, now, loc)
+
+		// only the last six weeks go in the table
+		var recent []models.Activity
+		for _, activity := range activities {
+			if activity.StartDate.After(sixWeeksAgo) {
+				recent = append(recent, activity)
 			}
-
-			// this constructs our new native activity, which calculates
-			//   tss, trimps, and hrtss
-			// in the constructor (models/activity) so we don't have to.
-			activity := models.NewActivity(sa, thresholdHR)
-			activities = append(activities, activity)
 		}
 
-		s.Log.Infof("Mapped to %d activities", len(activities))
+		// sports nobody's told us how to score are in the table, but not in CTL. say so, so
+		// somebody can add them to the config rather than wonder where their zwift went
+		unmapped := make(map[string]int)
+		for _, activity := range activities {
+			if _, ok := s.Config.Sports[activity.SportType]; !ok && activity.SportType != "" {
+				unmapped[activity.SportType]++
+			}
+		}
 
-		// Calculate CTL for Swim, Bike, and Run separately using models.CalculateCTL
-		swimCTL := models.CalculateCTL(models.FilterActivitiesByType(activities, "Swim"), 42)
-		bikeCTL := models.CalculateCTL(models.FilterActivitiesByType(activities, "Ride"), 42)
-		runCTL := models.CalculateCTL(models.FilterActivitiesByType(activities, "Run"), 42)
+		q := apiQuery{From: models.StartOfDay(sixWeeksAgo, loc), To: models.StartOfDay(now, loc), Disciplines: disciplines, Location: loc}
+		chart, err := newChartView(s.chartPMC(activities, after, q), q)
+		if err != nil {
+			s.Log.WithError(err).Error("Failed to draw chart")
+			http.Error(w, "Failed to draw chart", http.StatusInternalServerError)
+			return
+		}
 
 		// ask renderer to display the activities in a table with CTL and IF
-		renderActivitiesTableWithCTL(w, activities, swimCTL, bikeCTL, runCTL)
+		if err := renderActivitiesTableWithCTL(w, recent, swimPMC.Latest(), bikePMC.Latest(), runPMC.Latest(), unmapped, chart); err != nil {
+			s.Log.WithError(err).Error("Failed to send page")
+		}
 	})
 
 	return
@@ -153,31 +223,12 @@ func (s *Service) activitiesHandler() {
 func (s *Service) aboutHandler() {
 	// handle the "about" request
 	http.HandleFunc("/about", func(w http.ResponseWriter, r *http.Request) {
-		html := fmt.Sprintf(`
-		<!DOCTYPE html>
-		<html lang="en">
-		<head>
-			<meta charset="UTF-8">
-			<meta name="viewport" content="width=device-width, initial-scale=1.0">
-			<title>Activity Dashboard</title>
-			<style>
-				/* TODO: */
-			</style>
-		</head>
-		<body>
-			<div class="container">
-				<h3>ATC</h3>
-				<p>ATC is a web application that helps athletes track their performance and progress in swimming, biking, and running.</p>
-				<p>author: Jane Arc</p>
-				<p>Build Version: %s</p>
-				<p>Build Date: %s</p>
-				<p>source: <a href="http://github.com/janearc/atc">http://github.com/janearc/atc</a></p>
-			</div>
-		</body>
-		</html>
-		`, s.Config.Build.Build, s.Config.Build.BuildDate)
-
-		w.Write([]byte(html))
+		// strava tells us the limits with every response, so these are zero until we've asked it something
+		budget := s.Backend.Budget()
+
+		if err := renderAbout(w, s.Config.Build.Build, s.Config.Build.BuildDate, budget); err != nil {
+			s.Log.WithError(err).Error("Failed to send page")
+		}
 	})
 
 	return
@@ -0,0 +1,214 @@
+package service
+
+import (
+	"atc/formats"
+	"atc/models"
+	"atc/store"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// not everything makes it to strava (some indoor trainers and head units never sync, coaches
+// email files around), so athletes can upload activity files on /import. imported activities
+// are stored and scored like synced ones, but anything that's already there (because it did
+// reach strava after all) is skipped rather than counted twice. going the other way, /export
+// writes any stored activity out as a file.
+
+// maxImportSize is the biggest upload we'll take. a long ride with every sensor is a few
+// megabytes of FIT.
+const maxImportSize = 32 << 20
+
+// importResult is what happened to each activity in an uploaded file.
+type importResult struct {
+	Imported   []models.StravaActivity
+	Duplicates []models.StravaActivity
+}
+
+// importActivities parses an activity file and stores and scores what's in it, skipping
+// anything we already have.
+func (s *Service) importActivities(athleteID string, filename string, r io.Reader) (importResult, error) {
+	var result importResult
+
+	activities, err := formats.Parse(filename, r)
+	if err != nil {
+		return result, err
+	}
+
+	thresholds := s.thresholds(athleteID)
+
+	for _, sa := range activities {
+		s.Config.Sports.Map(&sa)
+
+		duplicate, err := s.findDuplicate(athleteID, sa)
+		if err != nil {
+			return result, err
+		}
+		if duplicate != nil {
+			s.Log.Infof("Skipping imported activity %d for athlete %s, it's a duplicate of %d", sa.Id, athleteID, duplicate.Id)
+			result.Duplicates = append(result.Duplicates, sa)
+			continue
+		}
+
+		if err := s.Store.SaveStravaActivity(athleteID, sa); err != nil {
+			return result, fmt.Errorf("failed to save activity %d: %w", sa.Id, err)
+		}
+
+		if err := s.scoreActivity(athleteID, sa, thresholds); err != nil {
+			return result, err
+		}
+
+		result.Imported = append(result.Imported, sa)
+	}
+
+	s.Log.Infof("Imported %d activities (%d duplicates) from %s for athlete %s", len(result.Imported), len(result.Duplicates), filename, athleteID)
+
+	// files come with streams, so they can show off new thresholds too
+	s.proposeThresholds(athleteID, result.Imported)
+
+	return result, nil
+}
+
+// findDuplicate returns the stored activity that sa is a copy of, or nil. That's one with the
+// same id (the same file uploaded again) or one from around the same time that looks the same.
+func (s *Service) findDuplicate(athleteID string, sa models.StravaActivity) (*models.StravaActivity, error) {
+	nearby, err := s.Store.ListStravaActivities(athleteID,
+		sa.StartDate.Add(-models.DuplicateStartTolerance),
+		sa.StartDate.Add(models.DuplicateStartTolerance+time.Second))
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range nearby {
+		if nearby[i].Id == sa.Id {
+			return &nearby[i], nil
+		}
+	}
+
+	return models.FindDuplicate(sa, nearby), nil
+}
+
+// /import takes activity files
+func (s *Service) importHandler() {
+	http.HandleFunc("/import", func(w http.ResponseWriter, r *http.Request) {
+		athleteID, ok := s.athleteForRequest(w, r)
+		if !ok {
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			if err := renderImport(w, http.StatusOK, nil, ""); err != nil {
+				s.Log.WithError(err).Error("Failed to send page")
+			}
+			return
+		}
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			s.Log.WithError(err).Warn("No file in import")
+			http.Error(w, "No file uploaded", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+
+		result, err := s.importActivities(athleteID, header.Filename, file)
+		switch {
+		case errors.Is(err, formats.ErrUnsupportedSport):
+			s.Log.WithError(err).Warnf("Not importing %s for athlete %s", header.Filename, athleteID)
+			if err := renderImport(w, http.StatusUnprocessableEntity, nil, fmt.Sprintf("%s isn't a swim, bike, or run", header.Filename)); err != nil {
+				s.Log.WithError(err).Error("Failed to send page")
+			}
+			return
+		case err != nil:
+			s.Log.WithError(err).Errorf("Failed to import %s for athlete %s", header.Filename, athleteID)
+			if err := renderImport(w, http.StatusBadRequest, nil, fmt.Sprintf("Couldn't import %s: %v", header.Filename, err)); err != nil {
+				s.Log.WithError(err).Error("Failed to send page")
+			}
+			return
+		}
+
+		if err := renderImport(w, http.StatusOK, &result, ""); err != nil {
+			s.Log.WithError(err).Error("Failed to send page")
+		}
+	})
+
+	return
+}
+
+// exporters are the formats /export can write, by file extension
+var exporters = map[string]func(w io.Writer, sa models.StravaActivity) error{
+	"tcx": formats.WriteTCX,
+	"gpx": formats.WriteGPX,
+}
+
+// /export?id=...&format=tcx (or gpx) downloads a stored activity
+func (s *Service) exportHandler() {
+	http.HandleFunc("/export", func(w http.ResponseWriter, r *http.Request) {
+		athleteID, ok := s.athleteForRequest(w, r)
+		if !ok {
+			return
+		}
+
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Bad activity id", http.StatusBadRequest)
+			return
+		}
+
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "tcx"
+		}
+		export, ok := exporters[format]
+		if !ok {
+			http.Error(w, "Unknown format", http.StatusBadRequest)
+			return
+		}
+
+		sa, err := s.Store.GetStravaActivity(athleteID, id)
+		if errors.Is(err, store.ErrNotFound) {
+			http.Error(w, "No such activity", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			s.Log.WithError(err).Errorf("Failed to load activity %d for athlete %s", id, athleteID)
+			http.Error(w, "Failed to load activity", http.StatusInternalServerError)
+			return
+		}
+
+		// activities stored before disciplines were a thing don't have one
+		s.Config.Sports.Map(sa)
+
+		// write it out first, so errors can still be errors rather than half a file
+		var buf bytes.Buffer
+		err = export(&buf, *sa)
+		if errors.Is(err, formats.ErrNoTrack) {
+			http.Error(w, "This activity has no gps track, try TCX instead", http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			s.Log.WithError(err).Errorf("Failed to export activity %d as %s", id, format)
+			http.Error(w, "Failed to export activity", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/xml")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"activity-%d.%s\"", id, format))
+		if _, err := buf.WriteTo(w); err != nil {
+			s.Log.WithError(err).Error("error writing to socket")
+		}
+	})
+
+	return
+}
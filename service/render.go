@@ -2,55 +2,340 @@ package service
 
 import (
 	"atc/models"
+	"atc/planning"
+	"atc/transport"
+	"bytes"
+	"embed"
 	"fmt"
+	"html/template"
 	"net/http"
+	"sort"
 )
 
-// TODO: this could probably be broken into html renders and json renders per github #21
+// this file contains helper functions which render html for the web service. the html itself
+// is in templates/, which is built into the binary: layout.html is the page every page is
+// wrapped in, partials.html the pieces more than one page uses, and every other file is a
+// page. html/template escapes whatever ends up in them, so names from strava (or anybody's
+// FIT file) can go straight in.
 
-// this file contains helper functions which render html for the web service
+//go:embed templates/*.html
+var templateFS embed.FS
+
+// pages are the parsed templates, by file name
+var pages = parsePages("activities.html", "about.html", "thresholds.html", "import.html", "goals.html", "plan.html")
+
+// parsePages parses each page along with the layout and partials. A template that doesn't
+// parse is a bug, so it panics (at startup, rather than the first time somebody looks).
+func parsePages(names ...string) map[string]*template.Template {
+	parsed := make(map[string]*template.Template)
+	for _, name := range names {
+		parsed[name] = template.Must(template.ParseFS(templateFS, "templates/layout.html", "templates/partials.html", "templates/"+name))
+	}
+	return parsed
+}
+
+// renderPage writes out a page. It's rendered into a buffer first so that a template error
+// is an error page, not half a page. Either way, what went wrong is returned for the handler
+// to log.
+func renderPage(w http.ResponseWriter, status int, name string, data interface{}) error {
+	var buf bytes.Buffer
+	if err := pages[name].ExecuteTemplate(&buf, "layout", data); err != nil {
+		http.Error(w, "Failed to render page", http.StatusInternalServerError)
+		return fmt.Errorf("failed to render %s: %w", name, err)
+	}
 
-// renderActivitiesTableWithCTL generates an HTML table of activities with CTL and IF values
-// and writes it back to the http writer
-func renderActivitiesTableWithCTL(w http.ResponseWriter, activities []models.Activity, swimCTL, bikeCTL, runCTL float64) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if _, err := buf.WriteTo(w); err != nil {
+		return fmt.Errorf("error writing to socket: %w", err)
+	}
+	return nil
+}
+
+// activityRow is one row of the activity table
+type activityRow struct {
+	Date            string
+	Type            string
+	Name            string
+	Minutes         int
+	TSS             int
+	IntensityFactor float64
+	Trimps          float64
+	Method          models.TSSMethod
+	Source          string
+}
+
+func newActivityRow(activity models.Activity) activityRow {
+	activityType := string(activity.Discipline)
+	if activity.SportType != "" && activity.SportType != activityType {
+		activityType += " (" + activity.SportType + ")"
+	}
+	if activity.OpenWater {
+		activityType += " (open water)"
+	}
+	if activity.ExcludedFromCTL {
+		activityType += " *"
+	}
+
+	return activityRow{
+		Date:            activity.StartDate.Format("2006-01-02"),
+		Type:            activityType,
+		Name:            activity.Name,
+		Minutes:         activity.MovingTime / 60,
+		TSS:             activity.TSS,
+		IntensityFactor: activity.IntensityFactor,
+		Trimps:          activity.Trimps,
+		Method:          activity.Method,
+		Source:          activity.Source,
+	}
+}
+
+// pmcRow is one sport's load today
+type pmcRow struct {
+	Name string
+	models.PMCDay
+}
+
+// chartView is the pmc chart, and links to the other charts
+type chartView struct {
+	SVG     template.HTML
+	PNG     string // where to download it
+	Options []chartOption
+}
+
+// chartOption is a link to the chart for another sport (or all of them)
+type chartOption struct {
+	Name     string
+	URL      string
+	Selected bool
+}
+
+// renderActivitiesTableWithCTL generates an HTML table of activities with IF values and today's
+// CTL/ATL/TSB for each sport and the chart, and writes it back to the http writer
+func renderActivitiesTableWithCTL(w http.ResponseWriter, activities []models.Activity, swim, bike, run models.PMCDay, unmapped map[string]int, chart chartView) error {
+	type unmappedSport struct {
+		SportType string
+		Count     int
+	}
+
+	data := struct {
+		Activities []activityRow
+		Unmapped   []unmappedSport
+		PMC        []pmcRow
+		Chart      chartView
+	}{
+		PMC:   []pmcRow{{"Swim", swim}, {"Bike", bike}, {"Run", run}},
+		Chart: chart,
+	}
 
-	// Start the HTML document
-	fmt.Fprintf(w, "<html><head><title>Activity Data</title></head><body>")
-	fmt.Fprintf(w, "<h1>Activities (42 days)</h1>")
-
-	// TODO: this is getting kind of hacky and gross but it works for now.
-	fmt.Fprintf(w,
-		"<table border='1'>"+
-			"<tr>"+
-			"<th>Date</th>"+
-			"<th>Type</th>"+
-			"<th>Duration (min)</th>"+
-			"<th>TSS</th>"+
-			"<th>IF</th>"+
-			"<th>tTSS</th>"+
-			"</tr>")
-
-	// Populate the table with activity data
 	for _, activity := range activities {
-		durationMinutes := activity.MovingTime / 60
-		activityDate := activity.StartDate.Format("2006-01-02")
-		fmt.Fprintf(w, "<tr><td>%s</td><td>%s</td><td>%d</td><td>%d</td><td>%.2f</td><td>%.2f</td></tr>",
-			activityDate,
-			activity.Type,
-			durationMinutes,
-			activity.TSS,
-			activity.IntensityFactor,
-			activity.Trimps)
-	}
-
-	// Display the CTL for each sport
-	fmt.Fprintf(w, "</table>")
-	fmt.Fprintf(w, "<h2>Chronic Training Load (CTL)</h2>")
-	fmt.Fprintf(w, "<p>Swim CTL: %.2f</p>", swimCTL)
-	fmt.Fprintf(w, "<p>Bike CTL: %.2f</p>", bikeCTL)
-	fmt.Fprintf(w, "<p>Run CTL: %.2f</p>", runCTL)
-
-	// End the HTML document
-	fmt.Fprintf(w, "</body></html>")
+		data.Activities = append(data.Activities, newActivityRow(activity))
+	}
+
+	for sportType, count := range unmapped {
+		data.Unmapped = append(data.Unmapped, unmappedSport{sportType, count})
+	}
+	sort.Slice(data.Unmapped, func(i, j int) bool {
+		return data.Unmapped[i].SportType < data.Unmapped[j].SportType
+	})
+
+	return renderPage(w, http.StatusOK, "activities.html", data)
+}
+
+// renderAbout generates the about page
+func renderAbout(w http.ResponseWriter, build string, buildDate string, budget transport.Budget) error {
+	return renderPage(w, http.StatusOK, "about.html", struct {
+		Build     string
+		BuildDate string
+		Budget    transport.Budget
+	}{build, buildDate, budget})
+}
+
+// renderThresholds generates an HTML page with the athlete's thresholds (and how they've
+// changed) and any proposed changes waiting to be confirmed
+func renderThresholds(w http.ResponseWriter, thresholds models.Thresholds, proposals []models.ThresholdProposal) error {
+	type thresholdRow struct {
+		Sport string
+		From  string
+		models.SportThresholds
+	}
+
+	data := struct {
+		Thresholds []thresholdRow
+		Proposals  []models.ThresholdProposal
+	}{Proposals: proposals}
+
+	sports := []struct {
+		name       string
+		thresholds models.SportThresholds
+	}{
+		{"Swim", thresholds.Swim},
+		{"Bike", thresholds.Bike},
+		{"Run", thresholds.Run},
+	}
+
+	for _, sport := range sports {
+		for _, th := range sport.thresholds.Timeline() {
+			from := "always"
+			if !th.EffectiveFrom.IsZero() {
+				from = th.EffectiveFrom.Format("2006-01-02")
+			}
+			data.Thresholds = append(data.Thresholds, thresholdRow{sport.name, from, th})
+		}
+	}
+
+	return renderPage(w, http.StatusOK, "thresholds.html", data)
+}
+
+// renderImport shows the upload form, along with what happened to the last upload (if there
+// was one) and any error message.
+func renderImport(w http.ResponseWriter, status int, result *importResult, message string) error {
+	type importRow struct {
+		Date    string
+		Type    string
+		Name    string
+		Minutes float64
+		Status  string
+	}
+
+	data := struct {
+		Message string
+		Result  *importResult
+		Rows    []importRow
+	}{Message: message, Result: result}
+
+	if result != nil {
+		rows := []struct {
+			activities []models.StravaActivity
+			status     string
+		}{
+			{result.Imported, "imported"},
+			{result.Duplicates, "duplicate"},
+		}
+		for _, row := range rows {
+			for _, sa := range row.activities {
+				data.Rows = append(data.Rows, importRow{
+					Date:    sa.StartDate.Format("2006-01-02 15:04"),
+					Type:    sa.Type,
+					Name:    sa.Name,
+					Minutes: float64(sa.ElapsedTime) / 60,
+					Status:  row.status,
+				})
+			}
+		}
+	}
+
+	return renderPage(w, status, "import.html", data)
+}
+
+// renderGoals lists the athlete's goals and how they're getting on, along with the form to
+// add another and any error message from the last one.
+func renderGoals(w http.ResponseWriter, status int, goals []goalStatus, maxRamp float64, message string) error {
+	type goalRow struct {
+		Id          string
+		Name        string
+		Sport       models.Discipline
+		Date        string
+		Target      string
+		CurrentCTL  float64
+		RequiredCTL float64
+		WeeklyRamp  float64
+		Verdict     string
+	}
+
+	data := struct {
+		Message string
+		MaxRamp float64
+		Goals   []goalRow
+	}{Message: message, MaxRamp: maxRamp}
+
+	for _, g := range goals {
+		row := goalRow{
+			Id:          g.Goal.Id,
+			Name:        g.Goal.Name,
+			Sport:       g.Goal.Discipline,
+			Date:        g.Goal.EventDate.Format("2006-01-02"),
+			Target:      goalTarget(g.Goal),
+			CurrentCTL:  g.CurrentCTL,
+			RequiredCTL: g.RequiredCTL,
+			WeeklyRamp:  g.WeeklyRamp,
+		}
+
+		switch {
+		case g.Err != nil:
+			row.Verdict = g.Err.Error()
+		case g.Achievable:
+			row.Verdict = "on track"
+		case g.Days < 0:
+			row.Verdict = "been and gone"
+		default:
+			row.Verdict = fmt.Sprintf("too soon: at %.0f a week it's %s", g.MaxRamp, g.Ready.Format("2006-01-02"))
+		}
+
+		data.Goals = append(data.Goals, row)
+	}
+
+	return renderPage(w, status, "goals.html", data)
+}
+
+// renderPlan shows the weeks between now and a goal, or why there aren't any.
+func renderPlan(w http.ResponseWriter, status int, goal planning.Goal, plan *planning.Plan, message string) error {
+	type weekRow struct {
+		Week     int
+		Start    string
+		Recovery bool
+		TSS      []int
+		Total    int
+		CTL      float64
+	}
+
+	data := struct {
+		Message     string
+		Name        string
+		Sport       models.Discipline
+		Date        string
+		Target      string
+		Plan        *planning.Plan
+		Disciplines []models.Discipline
+		Weeks       []weekRow
+	}{
+		Message:     message,
+		Name:        goal.Name,
+		Sport:       goal.Discipline,
+		Date:        goal.EventDate.Format("2006-01-02"),
+		Target:      goalTarget(goal),
+		Plan:        plan,
+		Disciplines: []models.Discipline{models.DisciplineSwim, models.DisciplineBike, models.DisciplineRun},
+	}
+
+	if plan != nil {
+		for i, week := range plan.Weeks {
+			row := weekRow{
+				Week:     i + 1,
+				Start:    week.Start.Format("2006-01-02"),
+				Recovery: week.Recovery,
+				Total:    week.Total,
+				CTL:      week.CTL[goal.Discipline],
+			}
+			for _, d := range data.Disciplines {
+				row.TSS = append(row.TSS, week.TSS[d])
+			}
+			data.Weeks = append(data.Weeks, row)
+		}
+	}
+
+	return renderPage(w, status, "plan.html", data)
+}
+
+// goalTarget is what the goal is, in words.
+func goalTarget(goal planning.Goal) string {
+	if goal.TargetCTL > 0 {
+		return fmt.Sprintf("CTL %.0f", goal.TargetCTL)
+	}
+	return fmt.Sprintf("%.1f km in %s", goal.Distance/1000, formatClock(goal.Duration))
+}
+
+// formatClock prints seconds as h:mm:ss.
+func formatClock(seconds int) string {
+	return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
 }
@@ -1,21 +1,60 @@
 package service
 
 import (
+	"atc/session"
+	"atc/source"
+	"atc/store"
 	"atc/transport"
 	"fmt"
 	"github.com/janearc/sux/sux"
 	"github.com/sirupsen/logrus"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 // abstracting away the various backend-y type things the app uses
 
 type Service struct {
-	Web     WebService
+	Web WebService
+
+	// Backend is strava itself, which we only need for logging people in. activities come
+	// from Source.
 	Backend *transport.Transport
+	Source  source.ActivitySource
+	Store   store.Store
 	Config  *transport.Config
 	Log     *logrus.Logger
 	Sux     *sux.Sux
+
+	// the time zone from config.yml, used to bucket activities into calendar days for athletes
+	// whose own time zone we don't know yet (see location)
+	Location *time.Location
+
+	// who's logged in
+	Sessions *session.Manager
+
+	// what strava has to tell us when we subscribe to webhook events, and the subscription
+	// every event has to be for
+	WebhookVerifyToken    string
+	WebhookSubscriptionID int64
+
+	// one slot per webhook event being handled, see webhookHandler
+	webhookSlots chan struct{}
+
+	// stored athletes and their threshold proposals are read, changed and written back
+	// whole, so changes to them take turns
+	thresholdLock sync.Mutex
+
+	// athletes with a sync running
+	syncing  map[string]bool
+	syncLock sync.Mutex
+
+	// goals are read, changed and written back whole, so changes to them take turns
+	goalLock sync.Mutex
 }
 
 type WebService struct {
@@ -53,6 +92,56 @@ func NewService(configFileName string, versionFileName string, secretsFileName s
 		log.Fatalf("Failed to initialize transport: %v", err)
 	}
 
+	//
+	// set up sessions. without a key in secrets.yml everybody has to log in again
+	// whenever we restart.
+	//
+
+	secrets, err := transport.LoadSecrets(secretsFileName)
+	if err != nil {
+		log.Fatalf("Failed to load secrets: %v", err)
+	}
+
+	sessionKey := []byte(secrets.Session.Key)
+	if len(sessionKey) == 0 {
+		log.Warn("No session key in secrets, sessions will not survive a restart")
+		sessionKey, err = session.NewRandomKey()
+		if err != nil {
+			log.Fatalf("Failed to make a session key: %v", err)
+		}
+	}
+
+	//
+	// open the activity store
+	//
+
+	storePath := config.Store.Path
+	if !filepath.IsAbs(storePath) {
+		storePath = filepath.Join(os.Getenv("ATC_ROOT"), storePath)
+	}
+
+	activityStore, err := store.NewDiskStore(storePath)
+	if err != nil {
+		log.Fatalf("Failed to open activity store: %v", err)
+	}
+
+	// strava rotates refresh tokens when we refresh, so the new one has to be kept
+	backend.OnTokenRefresh(activityStore.SaveToken)
+	backend.LoadTokensWith(activityStore.GetToken)
+
+	//
+	// figure out which time zone "today" is in
+	//
+
+	location := time.UTC
+	if config.Athlete.TimeZone != "" {
+		location, err = time.LoadLocation(config.Athlete.TimeZone)
+		if err != nil {
+			log.WithError(err).Warnf("Unknown time zone %s, falling back to UTC", config.Athlete.TimeZone)
+			location = time.UTC
+		}
+	}
+
 	//
 	// create the sux facility
 	//
@@ -62,18 +151,37 @@ func NewService(configFileName string, versionFileName string, secretsFileName s
 		Config:  config,
 		Log:     log,
 		Backend: backend,
+		Source:  source.NewStrava(backend, activityStore),
+		Store:   activityStore,
 		Web: WebService{
 			// NOTE: this creates the http listener
 			Handle: instantiateWebService(),
 		},
-		Sux: thisSux,
+		Sux:      thisSux,
+		Location: location,
+		// strava sends people back to redirect_uri, so that's the scheme they're using
+		Sessions: session.NewManager(sessionKey, session.DefaultMaxAge, strings.HasPrefix(config.Server.RedirectURI, "https://")),
+
+		WebhookVerifyToken:    secrets.Strava.WebhookVerifyToken,
+		WebhookSubscriptionID: secrets.Strava.WebhookSubscriptionID,
+
+		syncing:      make(map[string]bool),
+		webhookSlots: make(chan struct{}, maxWebhookEvents),
 	}
 
 	// Set up the http request handlers ("endpoints")
 	s.oauthRedirectHandler()
 	s.oauthCallbackHandler()
+	s.logoutHandler()
 	s.activitiesHandler()
 	s.aboutHandler()
+	s.thresholdsHandler()
+	s.importHandler()
+	s.exportHandler()
+	s.webhookHandler()
+	s.apiHandler()
+	s.chartHandler()
+	s.goalsHandler()
 
 	// All you gotta do now is s.Start()
 	return s
@@ -1,29 +1,60 @@
 package service_test
 
 import (
+	"atc/chart"
+	"atc/formats"
+	"atc/models"
+	"atc/planning"
 	"atc/service"
+	"atc/source"
+	"atc/store"
+	"atc/transport"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
-func TestNewService(t *testing.T) {
-	// Call the constructor
-	// for testing
-	configFileName := "config/config.yml"
-	versionFileName := "config/version.yml"
-	secretsFileName := "config/secrets.yml"
+// handlers are registered on the default mux, so there can only be one service per test run
+var (
+	testService     *service.Service
+	testServiceOnce sync.Once
+)
+
+func newTestService() *service.Service {
+	testServiceOnce.Do(func() {
+		// for testing
+		configFileName := "config/config.yml"
+		versionFileName := "config/version.yml"
+		secretsFileName := "config/secrets.yml"
 
-	root := os.Getenv("ATC_ROOT")
+		root := os.Getenv("ATC_ROOT")
 
-	// concatenate the working directory with our relative filename
-	configFileName = filepath.Join(root, configFileName)
-	versionFileName = filepath.Join(root, versionFileName)
-	secretsFileName = filepath.Join(root, secretsFileName)
+		// concatenate the working directory with our relative filename
+		configFileName = filepath.Join(root, configFileName)
+		versionFileName = filepath.Join(root, versionFileName)
+		secretsFileName = filepath.Join(root, secretsFileName)
 
-	s := service.NewService(configFileName, versionFileName, secretsFileName)
+		testService = service.NewService(configFileName, versionFileName, secretsFileName)
+	})
+	return testService
+}
+
+func TestNewService(t *testing.T) {
+	// Call the constructor
+	s := newTestService()
 
 	// Verify that the service is not nil
 	assert.NotNil(t, s)
@@ -32,5 +63,657 @@ func TestNewService(t *testing.T) {
 	assert.NotNil(t, s.Config)
 	assert.NotNil(t, s.Log)
 	assert.NotNil(t, s.Backend)
+	assert.NotNil(t, s.Source)
+	assert.NotNil(t, s.Store)
 	assert.NotNil(t, s.Web.Handle)
 }
+
+// get makes a request to the service as athleteID (or nobody, if it's empty)
+func get(s *service.Service, path string, athleteID string) *httptest.ResponseRecorder {
+	return serve(s, httptest.NewRequest("GET", path, nil), athleteID)
+}
+
+// upload posts a file to the service as athleteID
+func upload(s *service.Service, path string, athleteID string, filename string, contents []byte) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", filename)
+	part.Write(contents)
+	form.Close()
+
+	r := httptest.NewRequest("POST", path, &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	return serve(s, r, athleteID)
+}
+
+func serve(s *service.Service, r *http.Request, athleteID string) *httptest.ResponseRecorder {
+	if athleteID != "" {
+		cookies := httptest.NewRecorder()
+		s.Sessions.Set(cookies, athleteID)
+		for _, c := range cookies.Result().Cookies() {
+			r.AddCookie(c)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, r)
+	return w
+}
+
+func TestActivitiesFromSource(t *testing.T) {
+	s := newTestService()
+
+	d, err := store.NewDiskStore(t.TempDir())
+	assert.NoError(t, err)
+	fake := source.NewFake()
+	s.Store, s.Source = d, fake
+
+	athlete := models.NewAthlete("123", "Jane", "Arc", "F", &s.Config.Athlete.Thresholds)
+	fake.AddAthlete(athlete)
+	assert.NoError(t, d.SaveAthlete(athlete))
+
+	yesterday := time.Now().AddDate(0, 0, -1)
+	fake.AddActivity("123", models.StravaActivity{Id: 1, Name: "Lunch Run", Type: "Run", StartDate: yesterday, MovingTime: 3600, AverageHeartRate: 150})
+	fake.AddActivity("123", models.StravaActivity{Id: 2, Name: "Morning Ride", Type: "Ride", StartDate: yesterday.Add(time.Hour), MovingTime: 3600, AverageHeartRate: 140})
+
+	// nobody logged in
+	w := get(s, "/activities", "")
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/auth", w.Header().Get("Location"))
+
+	// somebody logged in, and their activities are synced from the source into the store
+	w = get(s, "/activities", "123")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "<td>Run</td>")
+	assert.Contains(t, w.Body.String(), "<td>Bike (Ride)</td>")
+
+	stored, err := d.ListStravaActivities("123", time.Time{}, time.Time{})
+	assert.NoError(t, err)
+	assert.Len(t, stored, 2)
+	assert.Equal(t, "fake", stored[0].Source)
+
+	// the source gave up on them, so off they go to log in again
+	fake.Disconnect("123")
+	w = get(s, "/activities", "123")
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/auth", w.Header().Get("Location"))
+}
+
+func TestImport(t *testing.T) {
+	s := newTestService()
+
+	d, err := store.NewDiskStore(t.TempDir())
+	assert.NoError(t, err)
+	s.Store, s.Source = d, source.NewFake()
+
+	athlete := models.NewAthlete("123", "Jane", "Arc", "F", &s.Config.Athlete.Thresholds)
+	assert.NoError(t, d.SaveAthlete(athlete))
+
+	fit, err := os.ReadFile("testdata/trainer_ride.fit")
+	assert.NoError(t, err)
+
+	// an hour on the trainer that never made it to strava
+	w := upload(s, "/import", "123", "trainer_ride.fit", fit)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Imported 1, skipped 0")
+
+	start := time.Date(2024, 8, 1, 6, 0, 0, 0, time.UTC)
+	scored, err := d.ListActivities("123", time.Time{}, time.Time{})
+	assert.NoError(t, err)
+	if assert.Len(t, scored, 1) {
+		assert.Equal(t, formats.ImportedID(start), scored[0].Id)
+		assert.Equal(t, models.TSSMethodPower, scored[0].Method)
+		assert.Greater(t, scored[0].TSS, 0)
+		assert.Equal(t, formats.SourceFIT, scored[0].Source)
+	}
+
+	// and the api says where it came from
+	w = get(s, "/api/v1/activities?from=2024-07-31&to=2024-08-01", "123")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"source":"fit"`)
+
+	// the same file again is a duplicate
+	w = upload(s, "/import", "123", "trainer_ride.fit", fit)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Imported 0, skipped 1")
+
+	// and so is the file for a ride strava already has
+	assert.NoError(t, d.DeleteActivity("123", formats.ImportedID(start)))
+	assert.NoError(t, d.SaveStravaActivity("123", models.StravaActivity{Id: 42, Type: "Ride", StartDate: start.Add(3 * time.Second), ElapsedTime: 3590, MovingTime: 3590, Source: "strava"}))
+	w = upload(s, "/import", "123", "trainer_ride.fit", fit)
+	assert.Contains(t, w.Body.String(), "Imported 0, skipped 1")
+
+	// things we can't read
+	w = upload(s, "/import", "123", "notes.txt", []byte("intervals!"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// the strava ride can go back out as tcx, and comes back in as a duplicate of itself
+	w = get(s, "/export?id=42&format=tcx", "123")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "activity-42.tcx")
+	w = upload(s, "/import", "123", "activity-42.tcx", w.Body.Bytes())
+	assert.Contains(t, w.Body.String(), "Imported 0, skipped 1")
+
+	// but it was indoors, so there's no gpx
+	w = get(s, "/export?id=42&format=gpx", "123")
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	w = get(s, "/export?id=43", "123")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestWebhook(t *testing.T) {
+	s := newTestService()
+
+	d, err := store.NewDiskStore(t.TempDir())
+	assert.NoError(t, err)
+	fake := source.NewFake()
+	s.Store, s.Source = d, fake
+	s.WebhookVerifyToken = "sekrit"
+	s.WebhookSubscriptionID = 1
+
+	athlete := models.NewAthlete("123", "Jane", "Arc", "F", &s.Config.Athlete.Thresholds)
+	fake.AddAthlete(athlete)
+	assert.NoError(t, d.SaveAthlete(athlete))
+
+	// the subscription handshake
+	w := get(s, "/webhook?hub.mode=subscribe&hub.challenge=15f7d1a91c1f40f8a748fd134752feb3&hub.verify_token=sekrit", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"hub.challenge":"15f7d1a91c1f40f8a748fd134752feb3"}`, w.Body.String())
+
+	w = get(s, "/webhook?hub.mode=subscribe&hub.challenge=abc&hub.verify_token=guess", "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	post := func(event string) int {
+		w := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(w, httptest.NewRequest("POST", "/webhook", strings.NewReader(event)))
+		return w.Code
+	}
+
+	// a new activity turns up in the store without anybody loading a page
+	yesterday := time.Now().AddDate(0, 0, -1)
+	fake.AddActivity("123", models.StravaActivity{Id: 7, Name: "Lunch Run", Type: "Run", StartDate: yesterday, MovingTime: 3600, AverageHeartRate: 150})
+	assert.Equal(t, http.StatusOK, post(`{"object_type":"activity","object_id":7,"aspect_type":"create","owner_id":123,"subscription_id":1,"event_time":1516126040}`))
+	assert.Eventually(t, func() bool {
+		scored, err := d.ListActivities("123", time.Time{}, time.Time{})
+		return err == nil && len(scored) == 1 && scored[0].Id == 7
+	}, time.Second, 10*time.Millisecond)
+
+	// events for somebody else's subscription aren't for us
+	deleted := `{"object_type":"activity","object_id":7,"aspect_type":"delete","owner_id":123,"subscription_id":1,"event_time":1516126040}`
+	assert.Equal(t, http.StatusForbidden, post(strings.Replace(deleted, `"subscription_id":1`, `"subscription_id":2`, 1)))
+
+	// and anybody can say an activity was deleted, so it's only deleted once strava agrees
+	assert.Equal(t, http.StatusOK, post(deleted))
+	assert.Never(t, func() bool {
+		_, err := d.GetStravaActivity("123", 7)
+		return errors.Is(err, store.ErrNotFound)
+	}, 100*time.Millisecond, 10*time.Millisecond)
+
+	fake.RemoveActivity("123", 7)
+	assert.Equal(t, http.StatusOK, post(deleted))
+	assert.Eventually(t, func() bool {
+		_, err := d.GetStravaActivity("123", 7)
+		return errors.Is(err, store.ErrNotFound)
+	}, time.Second, 10*time.Millisecond)
+
+	// the same goes for the athlete revoking our access
+	deauthorized := `{"object_type":"athlete","object_id":123,"aspect_type":"update","owner_id":123,"subscription_id":1,"event_time":1516126040,"updates":{"authorized":"false"}}`
+	assert.NoError(t, d.SaveToken(&transport.Token{AthleteID: "123", AccessToken: "abc"}))
+	assert.Equal(t, http.StatusOK, post(deauthorized))
+	assert.Never(t, func() bool {
+		_, err := d.GetToken("123")
+		return errors.Is(err, store.ErrNotFound)
+	}, 100*time.Millisecond, 10*time.Millisecond)
+
+	fake.Disconnect("123")
+	assert.Equal(t, http.StatusOK, post(deauthorized))
+	assert.Eventually(t, func() bool {
+		_, err := d.GetToken("123")
+		return errors.Is(err, store.ErrNotFound)
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, http.StatusBadRequest, post(`not json`))
+}
+
+func TestSportTypes(t *testing.T) {
+	s := newTestService()
+
+	d, err := store.NewDiskStore(t.TempDir())
+	assert.NoError(t, err)
+	fake := source.NewFake()
+	s.Store, s.Source = d, fake
+
+	athlete := models.NewAthlete("123", "Jane", "Arc", "F", &s.Config.Athlete.Thresholds)
+	fake.AddAthlete(athlete)
+	assert.NoError(t, d.SaveAthlete(athlete))
+
+	yesterday := time.Now().AddDate(0, 0, -1)
+	fake.AddActivity("123", models.StravaActivity{Id: 1, Type: "VirtualRide", SportType: "VirtualRide", StartDate: yesterday, MovingTime: 3600, AverageHeartRate: 140})
+	fake.AddActivity("123", models.StravaActivity{Id: 2, Type: "EBikeRide", SportType: "EBikeRide", StartDate: yesterday.Add(2 * time.Hour), MovingTime: 3600, AverageHeartRate: 120})
+	fake.AddActivity("123", models.StravaActivity{Id: 3, Type: "Yoga", SportType: "Yoga", StartDate: yesterday.Add(4 * time.Hour), MovingTime: 3600})
+
+	w := get(s, "/activities", "123")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "<td>Bike (VirtualRide)</td>")
+	assert.Contains(t, w.Body.String(), "<td>Bike (EBikeRide) *</td>")
+	assert.Contains(t, w.Body.String(), "Yoga (1)")
+
+	// the zwift ride is scored as a ride, the e-bike ride is scored but doesn't count, and
+	// the yoga is kept without a score
+	scored, err := d.ListActivities("123", time.Time{}, time.Time{})
+	assert.NoError(t, err)
+	if assert.Len(t, scored, 3) {
+		assert.Equal(t, models.DisciplineBike, scored[0].Discipline)
+		assert.Equal(t, "VirtualRide", scored[0].Type)
+		assert.Greater(t, scored[0].TSS, 0)
+		assert.False(t, scored[0].ExcludedFromCTL)
+		assert.True(t, scored[1].ExcludedFromCTL)
+		assert.Equal(t, models.DisciplineOther, scored[2].Discipline)
+		assert.Equal(t, 0, scored[2].TSS)
+		assert.True(t, scored[2].ExcludedFromCTL)
+	}
+}
+
+func TestThresholdProposals(t *testing.T) {
+	s := newTestService()
+
+	root := t.TempDir()
+	d, err := store.NewDiskStore(root)
+	assert.NoError(t, err)
+	fake := source.NewFake()
+	s.Store, s.Source = d, fake
+
+	athlete := models.NewAthlete("123", "Jane", "Arc", "F", &s.Config.Athlete.Thresholds)
+	athlete.Thresholds.Bike.FTP = 200
+	fake.AddAthlete(athlete)
+	assert.NoError(t, d.SaveAthlete(athlete))
+
+	// 20 minutes at 300w, in the middle of an easy hour
+	ride := models.StravaActivity{Id: 7, Type: "Ride", StartDate: time.Now().AddDate(0, 0, -1), MovingTime: 3600}
+	ride.Streams = &models.Streams{}
+	for i := 0; i < 3600; i++ {
+		watts := 150.0
+		if i >= 1200 && i < 2400 {
+			watts = 300
+		}
+		ride.Streams.Time = append(ride.Streams.Time, i)
+		ride.Streams.Moving = append(ride.Streams.Moving, true)
+		ride.Streams.Watts = append(ride.Streams.Watts, watts)
+	}
+	fake.AddActivity("123", ride)
+
+	w := get(s, "/activities", "123")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// the proposal outlives a restart
+	s.Store, err = store.NewDiskStore(root)
+	assert.NoError(t, err)
+
+	var thresholds struct {
+		Thresholds map[models.Discipline]struct {
+			Current struct {
+				FTP float64 `json:"ftp"`
+			} `json:"current"`
+		} `json:"thresholds"`
+		Proposals []struct {
+			Id       string  `json:"id"`
+			Proposed float64 `json:"proposed"`
+		} `json:"proposals"`
+	}
+	w = get(s, "/api/v1/thresholds?sport=Bike", "123")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &thresholds))
+	if assert.Len(t, thresholds.Proposals, 1) {
+		assert.Equal(t, "bike-power-7", thresholds.Proposals[0].Id)
+		assert.InDelta(t, 285, thresholds.Proposals[0].Proposed, 0.01)
+	}
+
+	w = get(s, "/thresholds", "123")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "bike-power-7")
+
+	// confirming it adopts it, and it's gone
+	w = post(s, "/thresholds/confirm", "123", url.Values{"id": {"bike-power-7"}})
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	w = post(s, "/thresholds/confirm", "123", url.Values{"id": {"bike-power-7"}})
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	thresholds.Proposals = nil
+	w = get(s, "/api/v1/thresholds?sport=Bike", "123")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &thresholds))
+	assert.Empty(t, thresholds.Proposals)
+	assert.InDelta(t, 285, thresholds.Thresholds[models.DisciplineBike].Current.FTP, 0.01)
+}
+
+func TestTimeZones(t *testing.T) {
+	s := newTestService()
+
+	d, err := store.NewDiskStore(t.TempDir())
+	assert.NoError(t, err)
+	fake := source.NewFake()
+	s.Store, s.Source = d, fake
+
+	// the same moment is an evening run in los angeles, and a lunchtime one in tokyo the next day
+	start := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -2).Add(3 * time.Hour)
+	for id, zone := range map[string]string{"123": "America/Los_Angeles", "456": "Asia/Tokyo"} {
+		athlete := models.NewAthlete(id, "Jane", "Arc", "F", &s.Config.Athlete.Thresholds)
+		fake.AddAthlete(athlete)
+		assert.NoError(t, d.SaveAthlete(athlete))
+		fake.AddActivity(id, models.StravaActivity{Id: 1, Type: "Run", StartDate: start, MovingTime: 3600, AverageHeartRate: 150, TimeZone: zone})
+
+		w := get(s, "/activities", id)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		w = get(s, "/api/v1/athlete", id)
+		assert.Contains(t, w.Body.String(), `"timezone":"`+zone+`"`)
+	}
+
+	var pmc struct {
+		Series map[models.Discipline][]models.PMCDay `json:"series"`
+	}
+	query := "/api/v1/pmc?sport=Run&from=" + start.AddDate(0, 0, -1).Format("2006-01-02") + "&to=" + start.Format("2006-01-02")
+
+	w := get(s, query, "123")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &pmc))
+	if assert.Len(t, pmc.Series[models.DisciplineRun], 2) {
+		assert.Greater(t, pmc.Series[models.DisciplineRun][0].TSS, 0)
+		assert.Equal(t, 0, pmc.Series[models.DisciplineRun][1].TSS)
+	}
+
+	w = get(s, query, "456")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &pmc))
+	if assert.Len(t, pmc.Series[models.DisciplineRun], 2) {
+		assert.Equal(t, 0, pmc.Series[models.DisciplineRun][0].TSS)
+		assert.Greater(t, pmc.Series[models.DisciplineRun][1].TSS, 0)
+	}
+}
+
+func TestAPI(t *testing.T) {
+	s := newTestService()
+
+	d, err := store.NewDiskStore(t.TempDir())
+	assert.NoError(t, err)
+	s.Store, s.Source = d, source.NewFake()
+
+	athlete := models.NewAthlete("123", "Jane", "Arc", "F", &s.Config.Athlete.Thresholds)
+	assert.NoError(t, d.SaveAthlete(athlete))
+
+	day := time.Date(2024, 8, 1, 7, 0, 0, 0, s.Location)
+	assert.NoError(t, d.SaveActivity("123", models.Activity{Id: 1, Discipline: models.DisciplineRun, StartDate: day, TSS: 60}))
+	assert.NoError(t, d.SaveActivity("123", models.Activity{Id: 2, Discipline: models.DisciplineBike, StartDate: day.AddDate(0, 0, 1), TSS: 90}))
+	assert.NoError(t, d.SaveActivity("123", models.Activity{Id: 3, Discipline: models.DisciplineBike, StartDate: day.AddDate(0, 0, 3), TSS: 80}))
+
+	// nobody logged in gets an error, not a redirect
+	w := get(s, "/api/v1/activities", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.JSONEq(t, `{"error":"not logged in, see /auth","status":401}`, w.Body.String())
+
+	w = get(s, "/api/v1/athlete", "123")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), `"first_name":"Jane"`)
+
+	var activities struct {
+		From       string            `json:"from"`
+		To         string            `json:"to"`
+		Activities []models.Activity `json:"activities"`
+	}
+	w = get(s, "/api/v1/activities?from=2024-08-01&to=2024-08-02&sport=bike", "123")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &activities))
+	assert.Equal(t, "2024-08-01", activities.From)
+	if assert.Len(t, activities.Activities, 1) {
+		assert.Equal(t, int64(2), activities.Activities[0].Id)
+	}
+	// v1's field names don't follow the store's around
+	assert.Contains(t, w.Body.String(), `"tss":90,`)
+	assert.Contains(t, w.Body.String(), `"sport_type":"",`)
+	assert.Contains(t, w.Body.String(), `"excluded_from_ctl":false,`)
+	assert.Contains(t, w.Body.String(), `"source":""}`)
+
+	// the series starts on from, but the load doesn't
+	var pmc struct {
+		Series map[models.Discipline]models.PMC `json:"series"`
+	}
+	w = get(s, "/api/v1/pmc?from=2024-08-02&to=2024-08-04", "123")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &pmc))
+	assert.Len(t, pmc.Series, 3)
+	if assert.Len(t, pmc.Series[models.DisciplineRun], 3) {
+		assert.Equal(t, 0, pmc.Series[models.DisciplineRun][0].TSS)
+		assert.Greater(t, pmc.Series[models.DisciplineRun][0].CTL, 0.0)
+		assert.Equal(t, 90, pmc.Series[models.DisciplineBike][0].TSS)
+	}
+
+	// five years is as long as a query gets
+	w = get(s, "/api/v1/pmc?from=2019-08-01&to=2024-08-01", "123")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = get(s, "/api/v1/thresholds?sport=Run", "123")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"Run":{"current":{`)
+	assert.NotContains(t, w.Body.String(), `"Bike"`)
+
+	// and the errors
+	for path, code := range map[string]int{
+		"/api/v1/activities?from=yesterday":                http.StatusBadRequest,
+		"/api/v1/activities?from=2024-08-02&to=2024-08-01": http.StatusBadRequest,
+		"/api/v1/pmc?from=0001-01-01":                      http.StatusBadRequest,
+		"/api/v1/pmc?from=2019-08-01&to=2024-08-02":        http.StatusBadRequest,
+		"/api/v1/activities?sport=Ride":                    http.StatusBadRequest,
+		"/api/v1/pmc?sport=Strength":                       http.StatusBadRequest,
+		"/api/v1/nothing":                                  http.StatusNotFound,
+	} {
+		w = get(s, path, "123")
+		assert.Equal(t, code, w.Code, path)
+		assert.Contains(t, w.Body.String(), `"error":`, path)
+	}
+
+	w = serve(s, httptest.NewRequest("POST", "/api/v1/activities", nil), "123")
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestPages(t *testing.T) {
+	s := newTestService()
+
+	d, err := store.NewDiskStore(t.TempDir())
+	assert.NoError(t, err)
+	fake := source.NewFake()
+	s.Store, s.Source = d, fake
+
+	athlete := models.NewAthlete("123", "Jane", "Arc", "F", &s.Config.Athlete.Thresholds)
+	fake.AddAthlete(athlete)
+	assert.NoError(t, d.SaveAthlete(athlete))
+
+	// names come from strava (or whoever made the file), so they're escaped
+	yesterday := time.Now().AddDate(0, 0, -1)
+	assert.NoError(t, d.SaveActivity("123", models.Activity{Id: 1, Name: "Tempo <script>alert(1)</script>", Discipline: models.DisciplineRun, SportType: "Run", StartDate: yesterday, MovingTime: 3600, TSS: 70}))
+
+	w := get(s, "/activities", "123")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "<title>Activity Data</title>")
+	assert.Contains(t, w.Body.String(), "<td>Tempo &lt;script&gt;alert(1)&lt;/script&gt;</td>")
+	assert.NotContains(t, w.Body.String(), "<script>")
+	assert.Contains(t, w.Body.String(), "<td>70</td>")
+	assert.Contains(t, w.Body.String(), "Run CTL: ")
+
+	// with the chart, of everything unless it says otherwise
+	assert.Contains(t, w.Body.String(), `<svg xmlns="http://www.w3.org/2000/svg"`)
+	assert.Contains(t, w.Body.String(), "<title>Combined</title>")
+	assert.Contains(t, w.Body.String(), `<b>Combined</b> <a href="/activities?sport=Swim">Swim</a>`)
+	assert.Contains(t, w.Body.String(), `<a href="/chart?format=png">Download PNG</a>`)
+
+	w = get(s, "/activities?sport=run", "123")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "<title>Run</title>")
+	assert.Contains(t, w.Body.String(), "<b>Run</b>")
+	assert.Contains(t, w.Body.String(), `<a href="/chart?format=png&amp;sport=Run">Download PNG</a>`)
+
+	w = get(s, "/activities?sport=Ride", "123")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = get(s, "/chart?format=png&sport=Run", "123")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "attachment; filename=pmc-")
+	img, err := png.Decode(w.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, chart.Width, img.Bounds().Dx())
+
+	w = get(s, "/chart?format=svg", "123")
+	assert.Equal(t, "image/svg+xml", w.Header().Get("Content-Type"))
+
+	w = get(s, "/chart?format=gif", "123")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = get(s, "/about", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "<title>Activity Dashboard</title>")
+	assert.Contains(t, w.Body.String(), "Build Version: ")
+
+	w = get(s, "/thresholds", "123")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "<td>Bike</td><td>always</td>")
+	assert.Contains(t, w.Body.String(), "Nothing to see here.")
+}
+
+// post submits a form to the service as athleteID
+func post(s *service.Service, path string, athleteID string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return serve(s, r, athleteID)
+}
+
+func TestGoals(t *testing.T) {
+	s := newTestService()
+
+	d, err := store.NewDiskStore(t.TempDir())
+	assert.NoError(t, err)
+	s.Store, s.Source = d, source.NewFake()
+
+	athlete := models.NewAthlete("123", "Jane", "Arc", "F", &s.Config.Athlete.Thresholds)
+	assert.NoError(t, d.SaveAthlete(athlete))
+
+	// two months of an hour on the bike a day gets ctl into the thirties
+	today := models.StartOfDay(time.Now(), s.Location)
+	for i := 1; i <= 60; i++ {
+		assert.NoError(t, d.SaveActivity("123", models.Activity{Id: int64(i), Discipline: models.DisciplineBike, StartDate: today.AddDate(0, 0, -i).Add(7 * time.Hour), TSS: 50}))
+	}
+
+	w := get(s, "/goals", "123")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "No goals yet.")
+
+	// a bit more fitness with plenty of time, and a run with no running to go on
+	inTenWeeks := today.AddDate(0, 0, 70).Format("2006-01-02")
+	w = post(s, "/goals", "123", url.Values{"name": {"Gran Fondo"}, "discipline": {"bike"}, "date": {inTenWeeks}, "target_ctl": {"45"}})
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	w = post(s, "/goals", "123", url.Values{"discipline": {"Run"}, "date": {inTenWeeks}, "distance": {"10"}, "time": {"45:00"}})
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+
+	// a bike goal has to be a ctl, and nonsense is nonsense
+	for _, form := range []url.Values{
+		{"discipline": {"Bike"}, "date": {inTenWeeks}, "distance": {"40"}, "time": {"1:00:00"}},
+		{"discipline": {"Run"}, "date": {"soon"}, "target_ctl": {"40"}},
+		{"discipline": {"Run"}, "date": {inTenWeeks}, "distance": {"10"}, "time": {"fast"}},
+		{"discipline": {"Yoga"}, "date": {inTenWeeks}, "target_ctl": {"40"}},
+	} {
+		w = post(s, "/goals", "123", form)
+		assert.Equal(t, http.StatusBadRequest, w.Code, form.Encode())
+		assert.Contains(t, w.Body.String(), "Couldn&#39;t add that goal", form.Encode())
+	}
+
+	w = get(s, "/goals", "123")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "<td>Gran Fondo</td><td>Bike</td>")
+	assert.Contains(t, w.Body.String(), "<td>CTL 45</td>")
+	assert.Contains(t, w.Body.String(), "<td>on track</td>")
+	assert.Contains(t, w.Body.String(), "<td>10.0 km in 0:45:00</td>")
+	assert.Contains(t, w.Body.String(), "<td>no training to plan from</td>")
+
+	var goals struct {
+		MaxRamp float64 `json:"max_ramp"`
+		Goals   []struct {
+			Goal        planning.Goal `json:"goal"`
+			CurrentCTL  float64       `json:"current_ctl"`
+			RequiredCTL float64       `json:"required_ctl"`
+			WeeklyRamp  float64       `json:"weekly_ramp"`
+			Achievable  bool          `json:"achievable"`
+			Error       string        `json:"error"`
+		} `json:"goals"`
+	}
+	w = get(s, "/api/v1/goals?sport=Bike", "123")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &goals))
+	assert.Equal(t, s.Config.Planning.MaxRamp, goals.MaxRamp)
+	// the goal's fields are spelled out, not whatever planning.Goal happens to be
+	assert.Contains(t, w.Body.String(), `"goal":{"id":"`)
+	assert.Contains(t, w.Body.String(), `"event_date":"`)
+	if assert.Len(t, goals.Goals, 1) {
+		goal := goals.Goals[0]
+		assert.Equal(t, "Gran Fondo", goal.Goal.Name)
+		assert.Greater(t, goal.CurrentCTL, 30.0)
+		assert.Equal(t, 45.0, goal.RequiredCTL)
+		assert.Greater(t, goal.WeeklyRamp, 0.0)
+		assert.True(t, goal.Achievable)
+		assert.Empty(t, goal.Error)
+
+		// with a plan for each week until then
+		w = get(s, "/goals/plan?id="+goal.Goal.Id, "123")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "<h1>Gran Fondo</h1>")
+		assert.Contains(t, w.Body.String(), "<th>Swim TSS</th><th>Bike TSS</th><th>Run TSS</th>")
+		assert.Contains(t, w.Body.String(), "<td>recovery</td>")
+
+		var plan planning.Plan
+		w = get(s, "/api/v1/plan?goal="+goal.Goal.Id, "123")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &plan))
+		assert.Equal(t, "Gran Fondo", plan.Goal.Name)
+		assert.Len(t, plan.Weeks, 10)
+		assert.True(t, plan.Weeks[3].Recovery)
+		assert.Greater(t, plan.Weeks[0].TSS[models.DisciplineBike], 0)
+		assert.Equal(t, 0, plan.Weeks[0].TSS[models.DisciplineRun])
+		assert.Equal(t, 10.0, plan.Settings.MaxIncrease)
+		assert.True(t, plan.Achievable)
+
+		// the settings are spelled the same as in config.yml
+		var raw struct {
+			Settings map[string]interface{} `json:"settings"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &raw))
+		assert.Equal(t, map[string]interface{}{
+			"max_ramp":       6.0,
+			"max_increase":   10.0,
+			"recovery_every": 4.0,
+			"recovery_load":  60.0,
+		}, raw.Settings)
+
+		w = post(s, "/goals/delete", "123", url.Values{"id": {goal.Goal.Id}})
+		assert.Equal(t, http.StatusSeeOther, w.Code)
+		w = post(s, "/goals/delete", "123", url.Values{"id": {goal.Goal.Id}})
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	}
+
+	w = get(s, "/goals", "123")
+	assert.NotContains(t, w.Body.String(), "Gran Fondo")
+	assert.Contains(t, w.Body.String(), "Run on "+inTenWeeks)
+
+	// there's no running to plan a run from
+	w = get(s, "/api/v1/goals", "123")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &goals))
+	if assert.Len(t, goals.Goals, 1) {
+		w = get(s, "/goals/plan?id="+goals.Goals[0].Goal.Id, "123")
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		assert.Contains(t, w.Body.String(), "no training to plan from")
+
+		w = get(s, "/api/v1/plan?goal="+goals.Goals[0].Goal.Id, "123")
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	}
+
+	w = get(s, "/goals/plan?id=nope", "123")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = get(s, "/api/v1/plan?goal=nope", "123")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
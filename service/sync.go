@@ -0,0 +1,198 @@
+package service
+
+import (
+	"atc/models"
+	"atc/source"
+	"atc/transport"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// everything the activity source (strava, usually) gives us goes into the store, and pages
+// are rendered from the store. syncing is incremental: the first sync for an athlete
+// backfills strava.history_days of history, and after that we only ask the source for
+// activities newer than the newest one we already have.
+//
+// a backfill can take a lot of requests, so the one that happens when somebody logs in runs
+// in the background, where it waits its turn for strava's rate limits rather than use up the
+// budget page loads need. only one sync per athlete runs at a time.
+
+// errSyncInProgress is returned when somebody else is already syncing the athlete.
+var errSyncInProgress = errors.New("sync already in progress")
+
+// backgroundSync runs syncActivities at background priority.
+func (s *Service) backgroundSync(athleteID string) {
+	ctx := transport.WithPriority(context.Background(), transport.PriorityBackground)
+
+	err := s.syncActivities(ctx, athleteID)
+	if err != nil && !errors.Is(err, errSyncInProgress) {
+		s.Log.WithError(err).Errorf("Background sync for athlete %s failed", athleteID)
+	}
+}
+
+// isSyncing returns true if the athlete is being synced right now.
+func (s *Service) isSyncing(athleteID string) bool {
+	s.syncLock.Lock()
+	defer s.syncLock.Unlock()
+
+	return s.syncing[athleteID]
+}
+
+// syncActivities brings the store up to date with the activity source and scores anything
+// new. Requests to the source are made with ctx, which says how urgent they are.
+func (s *Service) syncActivities(ctx context.Context, athleteID string) error {
+	s.syncLock.Lock()
+	if s.syncing[athleteID] {
+		s.syncLock.Unlock()
+		return errSyncInProgress
+	}
+	s.syncing[athleteID] = true
+	s.syncLock.Unlock()
+
+	defer func() {
+		s.syncLock.Lock()
+		delete(s.syncing, athleteID)
+		s.syncLock.Unlock()
+	}()
+
+	latest, err := s.Store.LatestStartDate(athleteID, s.Source.Name())
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	after := now.AddDate(0, 0, -s.Config.Strava.HistoryDays)
+	if !latest.IsZero() {
+		after = latest
+	}
+
+	s.Log.Infof("Syncing activities for athlete %s since %s", athleteID, after)
+	stravaActivities, err := s.Source.Activities(ctx, athleteID, after, now)
+	if err != nil {
+		return err
+	}
+
+	thresholds := s.thresholds(athleteID)
+	sixWeeksAgo := now.AddDate(0, 0, -models.CTLDays)
+
+	var withStreams []models.StravaActivity
+	for _, sa := range stravaActivities {
+		s.Config.Sports.Map(&sa)
+		scored := sa.Discipline.Scored()
+
+		// streams cost us a request per activity. once we have them we have them, but on
+		// a backfill we only go get them for the activities we're actually going to display.
+		// older activities are scored from averages, and sports we don't score don't need them.
+		if scored && sa.StartDate.After(sixWeeksAgo) {
+			streams, err := s.Source.Streams(ctx, athleteID, sa.Id)
+			if stopSync(err) {
+				// activities are oldest first, so stopping here means the next sync picks up
+				// where this one left off, streams and all
+				s.Log.WithError(err).Warnf("Stopping sync for athlete %s at activity %d", athleteID, sa.Id)
+				s.proposeThresholds(athleteID, withStreams)
+				return err
+			}
+			if err != nil {
+				s.Log.WithError(err).Warnf("Failed to fetch streams for activity %d, using averages", sa.Id)
+			} else {
+				sa.Streams = streams
+				withStreams = append(withStreams, sa)
+			}
+		}
+
+		if err := s.saveActivity(athleteID, sa, thresholds); err != nil {
+			return err
+		}
+	}
+
+	s.Log.Infof("Synced %d activities for athlete %s", len(stravaActivities), athleteID)
+
+	// wherever the newest one was is where they are now
+	if len(stravaActivities) > 0 {
+		s.updateTimeZone(athleteID, stravaActivities[len(stravaActivities)-1].TimeZone)
+	}
+
+	// while we have the streams handy, see if anybody has outgrown their thresholds
+	s.proposeThresholds(athleteID, withStreams)
+
+	return nil
+}
+
+// saveActivity stores an activity from the source and scores it.
+func (s *Service) saveActivity(athleteID string, sa models.StravaActivity, thresholds models.Thresholds) error {
+	// if the athlete imported this one from a file before it reached the source, the
+	// source's copy replaces the import, so it isn't counted twice
+	duplicate, err := s.findDuplicate(athleteID, sa)
+	if err != nil {
+		return err
+	}
+	if duplicate != nil && duplicate.Id != sa.Id && duplicate.Source != "" && duplicate.Source != sa.Source {
+		s.Log.Infof("Activity %d replaces imported activity %d for athlete %s", sa.Id, duplicate.Id, athleteID)
+		if err := s.Store.DeleteActivity(athleteID, duplicate.Id); err != nil {
+			return fmt.Errorf("failed to remove duplicate activity %d: %w", duplicate.Id, err)
+		}
+	}
+
+	if err := s.Store.SaveStravaActivity(athleteID, sa); err != nil {
+		return fmt.Errorf("failed to save activity %d: %w", sa.Id, err)
+	}
+
+	return s.scoreActivity(athleteID, sa, thresholds)
+}
+
+// stopSync returns true for errors that mean there's no point asking the source for anything else
+// right now.
+func stopSync(err error) bool {
+	return errors.Is(err, source.ErrNotConnected) ||
+		errors.Is(err, transport.ErrRateLimited) ||
+		errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// scoreActivity calculates tss for a raw activity and saves the result. Sports we don't
+// score are saved too, without tss, so they can be pointed out.
+func (s *Service) scoreActivity(athleteID string, sa models.StravaActivity, thresholds models.Thresholds) error {
+	mapping, mapped := s.Config.Sports.Map(&sa)
+	th, ok := thresholds.For(sa.Discipline)
+
+	var activity models.Activity
+	if ok {
+		// this constructs our new native activity, which calculates
+		//   tss, trimps, and hrtss (or power/pace tss)
+		// in the constructor (models/activity) so we don't have to.
+		activity = models.NewActivity(sa, th)
+		activity.ExcludedFromCTL = !mapping.CountsTowardCTL()
+	} else {
+		if !mapped {
+			s.Log.Warnf("Unmapped sport type %s (activity %d), add it to sports in config.yml to score it", sa.SportType, sa.Id)
+		}
+		activity = models.NewUnscoredActivity(sa)
+	}
+
+	if err := s.Store.SaveActivity(athleteID, activity); err != nil {
+		return fmt.Errorf("failed to save scored activity %d: %w", sa.Id, err)
+	}
+
+	return nil
+}
+
+// rescoreActivities scores every stored activity again, e.g. after a threshold changes.
+func (s *Service) rescoreActivities(athleteID string) error {
+	stravaActivities, err := s.Store.ListStravaActivities(athleteID, time.Time{}, time.Time{})
+	if err != nil {
+		return err
+	}
+
+	thresholds := s.thresholds(athleteID)
+	for _, sa := range stravaActivities {
+		if err := s.scoreActivity(athleteID, sa, thresholds); err != nil {
+			return err
+		}
+	}
+
+	s.Log.Infof("Rescored %d activities for athlete %s", len(stravaActivities), athleteID)
+
+	return nil
+}
@@ -0,0 +1,252 @@
+package service
+
+import (
+	"atc/models"
+	"atc/store"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// thresholds start out in config.yml, but they change as the athlete gets fitter. changes
+// are proposed by models.DetectThresholds and only adopted once somebody confirms them on
+// the /thresholds page. every athlete has their own: config.yml is only where a new
+// athlete's thresholds start out.
+
+// thresholds returns a copy of the athlete's threshold history.
+func (s *Service) thresholds(athleteID string) models.Thresholds {
+	s.thresholdLock.Lock()
+	defer s.thresholdLock.Unlock()
+
+	athlete, err := s.Store.GetAthlete(athleteID)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			s.Log.WithError(err).Errorf("Failed to load athlete %s, using configured thresholds", athleteID)
+		}
+		return s.Config.Athlete.Thresholds
+	}
+
+	return athlete.Thresholds
+}
+
+// saveAthlete stores a freshly fetched profile. If we already know the athlete, the
+// thresholds they've built up since they first logged in (and their time zone) are kept.
+func (s *Service) saveAthlete(athlete *models.Athlete) error {
+	s.thresholdLock.Lock()
+	defer s.thresholdLock.Unlock()
+
+	existing, err := s.Store.GetAthlete(athlete.Id)
+	switch {
+	case err == nil:
+		athlete.Thresholds = existing.Thresholds
+		athlete.TimeZone = existing.TimeZone
+	case !errors.Is(err, store.ErrNotFound):
+		return err
+	}
+
+	return s.Store.SaveAthlete(athlete)
+}
+
+// proposeThresholds looks for best efforts in the supplied activities and saves any new
+// thresholds they suggest. Detection only ever sees activities as they're synced, so a
+// proposal that isn't saved isn't made again.
+func (s *Service) proposeThresholds(athleteID string, activities []models.StravaActivity) {
+	proposals := models.DetectThresholds(activities, s.thresholds(athleteID))
+	if len(proposals) == 0 {
+		return
+	}
+
+	s.thresholdLock.Lock()
+	defer s.thresholdLock.Unlock()
+
+	pending, err := s.Store.ListProposals(athleteID)
+	if err != nil {
+		s.Log.WithError(err).Errorf("Failed to load threshold proposals for athlete %s", athleteID)
+		return
+	}
+
+	// an activity that's synced again (it was edited) replaces its old proposals
+	byID := make(map[string]models.ThresholdProposal)
+	for _, p := range pending {
+		byID[p.Id] = p
+	}
+	for _, p := range proposals {
+		if _, ok := byID[p.Id]; !ok {
+			s.Log.Infof("Proposing %s %s threshold of %.0f (currently %.0f) from activity %d for athlete %s", p.Sport, p.Metric, p.Proposed, p.Current, p.ActivityId, athleteID)
+		}
+		byID[p.Id] = p
+	}
+
+	if err := s.saveProposals(athleteID, byID); err != nil {
+		s.Log.WithError(err).Errorf("Failed to save threshold proposals for athlete %s", athleteID)
+	}
+}
+
+// saveProposals stores the athlete's proposals, in id order. The caller has thresholdLock.
+func (s *Service) saveProposals(athleteID string, byID map[string]models.ThresholdProposal) error {
+	proposals := make([]models.ThresholdProposal, 0, len(byID))
+	for _, p := range byID {
+		proposals = append(proposals, p)
+	}
+
+	sort.Slice(proposals, func(i, j int) bool {
+		return proposals[i].Id < proposals[j].Id
+	})
+
+	return s.Store.SaveProposals(athleteID, proposals)
+}
+
+// pendingProposals returns the athlete's proposals still waiting on a decision.
+func (s *Service) pendingProposals(athleteID string) ([]models.ThresholdProposal, error) {
+	s.thresholdLock.Lock()
+	defer s.thresholdLock.Unlock()
+
+	return s.Store.ListProposals(athleteID)
+}
+
+// takeProposal removes one of the athlete's proposals and returns it, or store.ErrNotFound.
+// The caller has thresholdLock.
+func (s *Service) takeProposal(athleteID string, id string) (models.ThresholdProposal, error) {
+	pending, err := s.Store.ListProposals(athleteID)
+	if err != nil {
+		return models.ThresholdProposal{}, err
+	}
+
+	byID := make(map[string]models.ThresholdProposal)
+	for _, p := range pending {
+		byID[p.Id] = p
+	}
+
+	p, ok := byID[id]
+	if !ok {
+		return p, store.ErrNotFound
+	}
+	delete(byID, id)
+
+	return p, s.saveProposals(athleteID, byID)
+}
+
+// confirmProposal adopts one of the athlete's proposals and stores the new thresholds.
+func (s *Service) confirmProposal(athleteID string, id string) (models.ThresholdProposal, error) {
+	s.thresholdLock.Lock()
+	defer s.thresholdLock.Unlock()
+
+	athlete, err := s.Store.GetAthlete(athleteID)
+	if err != nil {
+		return models.ThresholdProposal{}, err
+	}
+
+	p, err := s.takeProposal(athleteID, id)
+	if err != nil {
+		return p, err
+	}
+
+	if err := p.Apply(&athlete.Thresholds, s.location(athleteID)); err != nil {
+		return p, err
+	}
+
+	if err := s.Store.SaveAthlete(athlete); err != nil {
+		return p, fmt.Errorf("failed to save thresholds: %w", err)
+	}
+
+	return p, nil
+}
+
+// dismissProposal throws one of the athlete's proposals away.
+func (s *Service) dismissProposal(athleteID string, id string) error {
+	s.thresholdLock.Lock()
+	defer s.thresholdLock.Unlock()
+
+	_, err := s.takeProposal(athleteID, id)
+	return err
+}
+
+// /thresholds shows the current thresholds and any proposed changes
+func (s *Service) thresholdsHandler() {
+	http.HandleFunc("/thresholds", func(w http.ResponseWriter, r *http.Request) {
+		athleteID, ok := s.athleteForRequest(w, r)
+		if !ok {
+			return
+		}
+
+		proposals, err := s.pendingProposals(athleteID)
+		if err != nil {
+			s.Log.WithError(err).Errorf("Failed to load threshold proposals for athlete %s", athleteID)
+			http.Error(w, "Failed to load threshold proposals", http.StatusInternalServerError)
+			return
+		}
+
+		if err := renderThresholds(w, s.thresholds(athleteID), proposals); err != nil {
+			s.Log.WithError(err).Error("Failed to send page")
+		}
+	})
+
+	// adopt a proposal. this changes how every activity from that day forward is scored.
+	http.HandleFunc("/thresholds/confirm", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		athleteID, ok := s.athleteForRequest(w, r)
+		if !ok {
+			return
+		}
+
+		id := r.FormValue("id")
+
+		p, err := s.confirmProposal(athleteID, id)
+		if errors.Is(err, store.ErrNotFound) {
+			s.Log.Warnf("No threshold proposal %s for athlete %s", id, athleteID)
+			http.Error(w, "No such threshold proposal", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			s.Log.WithError(err).Errorf("Failed to apply threshold proposal %s", id)
+			http.Error(w, "Failed to apply threshold proposal", http.StatusInternalServerError)
+			return
+		}
+
+		s.Log.Infof("Adopted %s %s threshold of %.0f from activity %d for athlete %s", p.Sport, p.Metric, p.Proposed, p.ActivityId, athleteID)
+
+		// stored scores from that day on were worked out with the old threshold
+		if err := s.rescoreActivities(athleteID); err != nil {
+			s.Log.WithError(err).Error("Failed to rescore activities after threshold change")
+		}
+
+		http.Redirect(w, r, "/thresholds", http.StatusSeeOther)
+	})
+
+	// throw a proposal away (it was a downhill, the strap was acting up, etc)
+	http.HandleFunc("/thresholds/dismiss", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		athleteID, ok := s.athleteForRequest(w, r)
+		if !ok {
+			return
+		}
+
+		id := r.FormValue("id")
+
+		err := s.dismissProposal(athleteID, id)
+		if errors.Is(err, store.ErrNotFound) {
+			s.Log.Warnf("No threshold proposal %s for athlete %s", id, athleteID)
+			http.Error(w, "No such threshold proposal", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			s.Log.WithError(err).Errorf("Failed to dismiss threshold proposal %s", id)
+			http.Error(w, "Failed to dismiss threshold proposal", http.StatusInternalServerError)
+			return
+		}
+
+		s.Log.Infof("Dismissed threshold proposal %s for athlete %s", id, athleteID)
+		http.Redirect(w, r, "/thresholds", http.StatusSeeOther)
+	})
+
+	return
+}
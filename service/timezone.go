@@ -0,0 +1,55 @@
+package service
+
+import (
+	"time"
+)
+
+// days (for the PMC, for "today", for dates people type in) start and end at midnight where
+// the athlete is, not where the server is or where config.yml says. every activity strava
+// sends us says which time zone it started in, so the athlete's is whichever their newest
+// activity was in. until there's been one, it's athlete.timezone from config.yml.
+
+// location returns the athlete's time zone.
+func (s *Service) location(athleteID string) *time.Location {
+	athlete, err := s.Store.GetAthlete(athleteID)
+	if err != nil || athlete.TimeZone == "" {
+		return s.Location
+	}
+
+	loc, err := time.LoadLocation(athlete.TimeZone)
+	if err != nil {
+		s.Log.WithError(err).Warnf("Unknown time zone %s for athlete %s, using %s", athlete.TimeZone, athleteID, s.Location)
+		return s.Location
+	}
+	return loc
+}
+
+// updateTimeZone records that the athlete is in the time zone named zone now.
+func (s *Service) updateTimeZone(athleteID string, zone string) {
+	if zone == "" {
+		return
+	}
+	if _, err := time.LoadLocation(zone); err != nil {
+		s.Log.WithError(err).Warnf("Unknown time zone %s for athlete %s, ignoring it", zone, athleteID)
+		return
+	}
+
+	s.thresholdLock.Lock()
+	defer s.thresholdLock.Unlock()
+
+	athlete, err := s.Store.GetAthlete(athleteID)
+	if err != nil {
+		s.Log.WithError(err).Errorf("Failed to load athlete %s to update their time zone", athleteID)
+		return
+	}
+	if athlete.TimeZone == zone {
+		return
+	}
+
+	athlete.TimeZone = zone
+	if err := s.Store.SaveAthlete(athlete); err != nil {
+		s.Log.WithError(err).Errorf("Failed to save time zone for athlete %s", athleteID)
+		return
+	}
+	s.Log.Infof("Athlete %s is in %s", athleteID, zone)
+}
@@ -0,0 +1,195 @@
+package service
+
+import (
+	"atc/models"
+	"atc/source"
+	"atc/transport"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// strava tells us about new activities as they happen, if we've subscribed to its webhook
+// events (see https://developers.strava.com/docs/webhooks/). subscribing is done once, by
+// hand, and strava checks the callback url is really ours by sending it a challenge with the
+// verify token we gave it. after that every event is a POST, which we have two seconds to
+// answer, so the work happens in the background.
+//
+// anybody can POST to /webhook, so an event is only a hint: it has to be for our
+// subscription, and before anything is thrown away the source is asked whether it's really
+// gone. new and updated activities are fetched from the source anyway.
+
+const (
+	// webhookTimeout is how long we give the fetches an event kicks off
+	webhookTimeout = 5 * time.Minute
+
+	// maxWebhookEvents is how many events are handled at once. past that strava is told to
+	// try again later, which it does.
+	maxWebhookEvents = 8
+)
+
+// webhookEvent is what strava POSTs to us.
+type webhookEvent struct {
+	ObjectType     string            `json:"object_type"` // "activity" or "athlete"
+	ObjectID       int64             `json:"object_id"`
+	AspectType     string            `json:"aspect_type"` // "create", "update" or "delete"
+	OwnerID        int64             `json:"owner_id"`
+	SubscriptionID int64             `json:"subscription_id"`
+	EventTime      int64             `json:"event_time"`
+	Updates        map[string]string `json:"updates"`
+}
+
+// handleWebhookEvent does whatever an event needs doing.
+func (s *Service) handleWebhookEvent(ctx context.Context, event webhookEvent) error {
+	athleteID := strconv.FormatInt(event.OwnerID, 10)
+
+	// strava only sends us events for athletes who've authorized us, but they may not have
+	// logged in since we started keeping athletes
+	if _, err := s.Store.GetAthlete(athleteID); err != nil {
+		return fmt.Errorf("event for unknown athlete %s: %w", athleteID, err)
+	}
+
+	switch {
+	case event.ObjectType == "athlete" && event.Updates["authorized"] == "false":
+		// they've revoked our access, so the token is no good to anybody. their
+		// activities stay, and they can log in again whenever they like.
+		_, err := s.Source.Athlete(ctx, athleteID)
+		switch {
+		case err == nil:
+			return fmt.Errorf("athlete %s is still connected, keeping their token", athleteID)
+		case !errors.Is(err, source.ErrNotConnected):
+			return fmt.Errorf("couldn't check athlete %s deauthorized us: %w", athleteID, err)
+		}
+		s.Log.Infof("Athlete %s deauthorized us", athleteID)
+		return s.Store.DeleteToken(athleteID)
+
+	case event.ObjectType != "activity":
+		return nil
+
+	case event.AspectType == "delete":
+		_, err := s.Source.Activity(ctx, athleteID, event.ObjectID)
+		switch {
+		case err == nil:
+			return fmt.Errorf("activity %d is still there, not deleting it", event.ObjectID)
+		case !errors.Is(err, source.ErrNotFound):
+			return fmt.Errorf("couldn't check activity %d was deleted: %w", event.ObjectID, err)
+		}
+		s.Log.Infof("Activity %d deleted for athlete %s", event.ObjectID, athleteID)
+		return s.Store.DeleteActivity(athleteID, event.ObjectID)
+
+	case event.AspectType == "create" || event.AspectType == "update":
+		return s.syncActivity(ctx, athleteID, event.ObjectID)
+	}
+
+	return nil
+}
+
+// syncActivity fetches a single activity from the source and stores and scores it.
+func (s *Service) syncActivity(ctx context.Context, athleteID string, id int64) error {
+	sa, err := s.Source.Activity(ctx, athleteID, id)
+	if err != nil {
+		return err
+	}
+
+	thresholds := s.thresholds(athleteID)
+	s.Config.Sports.Map(sa)
+	scored := sa.Discipline.Scored()
+
+	// an update is usually a new title, so keep the streams we've already got
+	if existing, err := s.Store.GetStravaActivity(athleteID, id); err == nil && existing.Streams != nil {
+		sa.Streams = existing.Streams
+	}
+
+	if scored && sa.Streams == nil && sa.StartDate.After(time.Now().AddDate(0, 0, -models.CTLDays)) {
+		streams, err := s.Source.Streams(ctx, athleteID, id)
+		if stopSync(err) {
+			return err
+		}
+		if err != nil {
+			s.Log.WithError(err).Warnf("Failed to fetch streams for activity %d, using averages", id)
+		} else {
+			sa.Streams = streams
+		}
+	}
+
+	if err := s.saveActivity(athleteID, *sa, thresholds); err != nil {
+		return err
+	}
+
+	s.Log.Infof("Synced activity %d for athlete %s", id, athleteID)
+
+	if sa.Streams != nil {
+		s.proposeThresholds(athleteID, []models.StravaActivity{*sa})
+	}
+
+	return nil
+}
+
+// /webhook is where strava sends events
+func (s *Service) webhookHandler() {
+	http.HandleFunc("/webhook", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			// subscription handshake: echo the challenge back if the verify token is ours
+			query := r.URL.Query()
+			if s.WebhookVerifyToken == "" || query.Get("hub.mode") != "subscribe" || query.Get("hub.verify_token") != s.WebhookVerifyToken {
+				s.Log.Warnf("[%s]: Refusing webhook subscription", r.URL.Path)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+
+			s.Log.Infof("[%s]: Webhook subscription verified", r.URL.Path)
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(map[string]string{"hub.challenge": query.Get("hub.challenge")}); err != nil {
+				s.Log.WithError(err).Error("error writing to socket")
+			}
+
+		case http.MethodPost:
+			var event webhookEvent
+			if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+				s.Log.WithError(err).Warnf("[%s]: Bad webhook event", r.URL.Path)
+				http.Error(w, "Bad event", http.StatusBadRequest)
+				return
+			}
+
+			if s.WebhookSubscriptionID == 0 || event.SubscriptionID != s.WebhookSubscriptionID {
+				s.Log.Warnf("[%s]: Refusing event for subscription %d", r.URL.Path, event.SubscriptionID)
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+
+			s.Log.Infof("[%s]: %s %s %d for athlete %d", r.URL.Path, event.AspectType, event.ObjectType, event.ObjectID, event.OwnerID)
+
+			select {
+			case s.webhookSlots <- struct{}{}:
+			default:
+				s.Log.Warnf("[%s]: Too many events at once, asking strava to try again", r.URL.Path)
+				http.Error(w, "Busy", http.StatusServiceUnavailable)
+				return
+			}
+
+			// strava wants an answer within two seconds, and retries if it doesn't get one
+			go func() {
+				defer func() { <-s.webhookSlots }()
+
+				ctx, cancel := context.WithTimeout(transport.WithPriority(context.Background(), transport.PriorityBackground), webhookTimeout)
+				defer cancel()
+
+				if err := s.handleWebhookEvent(ctx, event); err != nil && !errors.Is(err, context.Canceled) {
+					s.Log.WithError(err).Errorf("Failed to handle %s %s %d", event.AspectType, event.ObjectType, event.ObjectID)
+				}
+			}()
+
+			w.WriteHeader(http.StatusOK)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	return
+}
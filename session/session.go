@@ -0,0 +1,123 @@
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// package session works out who a request is from. the session cookie only says which
+// athlete you are (and is signed, so you can't say you're somebody else); strava tokens stay
+// on the server, keyed by athlete.
+
+// CookieName is the name of the session cookie.
+const CookieName = "atc_session"
+
+// DefaultMaxAge is how long a session lasts before you have to log in again.
+const DefaultMaxAge = 30 * 24 * time.Hour
+
+var (
+	// ErrNoSession is returned when the request has no session cookie.
+	ErrNoSession = errors.New("no session")
+
+	// ErrInvalidSession is returned when the session cookie is malformed, has been tampered
+	// with, or has expired.
+	ErrInvalidSession = errors.New("invalid session")
+)
+
+// Manager hands out and checks session cookies.
+type Manager struct {
+	key    []byte
+	maxAge time.Duration
+	secure bool
+}
+
+// NewManager creates a Manager that signs cookies with key. Anybody with the key can log in
+// as anybody, so it lives in secrets.yml. Secure cookies are only sent back over https, so
+// secure should be false when ATC is served over plain http (on localhost, say), or nobody
+// stays logged in.
+func NewManager(key []byte, maxAge time.Duration, secure bool) *Manager {
+	if maxAge <= 0 {
+		maxAge = DefaultMaxAge
+	}
+	return &Manager{key: key, maxAge: maxAge, secure: secure}
+}
+
+// NewRandomKey makes a key for when secrets.yml doesn't have one. Sessions signed with it
+// don't survive a restart.
+func NewRandomKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Set logs athleteID in by giving them a session cookie.
+func (m *Manager) Set(w http.ResponseWriter, athleteID string) {
+	expires := time.Now().Add(m.maxAge)
+	payload := fmt.Sprintf("%s.%d", athleteID, expires.Unix())
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    payload + "." + m.sign(payload),
+		Path:     "/",
+		Expires:  expires,
+		Secure:   m.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Get returns the athlete the request is from.
+func (m *Manager) Get(r *http.Request) (string, error) {
+	cookie, err := r.Cookie(CookieName)
+	if err != nil {
+		return "", ErrNoSession
+	}
+
+	// <athlete id>.<expiry>.<signature>
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 || parts[0] == "" {
+		return "", ErrInvalidSession
+	}
+
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(m.sign(payload))) {
+		return "", ErrInvalidSession
+	}
+
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().After(time.Unix(expires, 0)) {
+		return "", ErrInvalidSession
+	}
+
+	return parts[0], nil
+}
+
+// Clear logs the request out.
+func (m *Manager) Clear(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   m.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// sign returns the url-safe hmac of payload.
+func (m *Manager) sign(payload string) string {
+	mac := hmac.New(sha256.New, m.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
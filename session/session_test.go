@@ -0,0 +1,102 @@
+package session_test
+
+import (
+	"atc/session"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// requestWith hands back a request carrying whatever cookie the manager set
+func requestWith(m *session.Manager, athleteID string) *http.Request {
+	w := httptest.NewRecorder()
+	m.Set(w, athleteID)
+
+	r := httptest.NewRequest("GET", "/activities", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func TestSession(t *testing.T) {
+	m := session.NewManager([]byte("sekrit"), time.Hour, true)
+
+	athleteID, err := m.Get(requestWith(m, "12345"))
+	assert.NoError(t, err)
+	assert.Equal(t, "12345", athleteID)
+
+	// no cookie at all
+	_, err = m.Get(httptest.NewRequest("GET", "/activities", nil))
+	assert.ErrorIs(t, err, session.ErrNoSession)
+
+	// somebody else's key
+	other := session.NewManager([]byte("other"), time.Hour, true)
+	_, err = other.Get(requestWith(m, "12345"))
+	assert.ErrorIs(t, err, session.ErrInvalidSession)
+
+	// changing who you are breaks the signature
+	r := requestWith(m, "12345")
+	cookie, _ := r.Cookie(session.CookieName)
+	forged := httptest.NewRequest("GET", "/activities", nil)
+	forged.AddCookie(&http.Cookie{Name: session.CookieName, Value: strings.Replace(cookie.Value, "12345", "54321", 1)})
+	_, err = m.Get(forged)
+	assert.ErrorIs(t, err, session.ErrInvalidSession)
+
+	// and so does garbage
+	garbage := httptest.NewRequest("GET", "/activities", nil)
+	garbage.AddCookie(&http.Cookie{Name: session.CookieName, Value: "12345"})
+	_, err = m.Get(garbage)
+	assert.ErrorIs(t, err, session.ErrInvalidSession)
+}
+
+func TestSessionExpires(t *testing.T) {
+	m := session.NewManager([]byte("sekrit"), -time.Hour, true)
+	assert.NotNil(t, m)
+
+	// a negative max age means the default, so this one is fine
+	_, err := m.Get(requestWith(m, "12345"))
+	assert.NoError(t, err)
+
+	// expiry is kept to the second, so a nanosecond session is already over
+	m = session.NewManager([]byte("sekrit"), time.Nanosecond, true)
+	_, err = m.Get(requestWith(m, "12345"))
+	assert.ErrorIs(t, err, session.ErrInvalidSession)
+}
+
+func TestSessionClear(t *testing.T) {
+	m := session.NewManager([]byte("sekrit"), time.Hour, true)
+
+	w := httptest.NewRecorder()
+	m.Clear(w)
+
+	cookies := w.Result().Cookies()
+	assert.Len(t, cookies, 1)
+	assert.Equal(t, session.CookieName, cookies[0].Name)
+	assert.True(t, cookies[0].MaxAge < 0)
+}
+
+func TestSessionSecure(t *testing.T) {
+	// over https the cookie is only ever sent back over https
+	w := httptest.NewRecorder()
+	session.NewManager([]byte("sekrit"), time.Hour, true).Set(w, "12345")
+	assert.True(t, w.Result().Cookies()[0].Secure)
+
+	// but over plain http a secure cookie would never come back, and neither would a cleared one
+	m := session.NewManager([]byte("sekrit"), time.Hour, false)
+	w = httptest.NewRecorder()
+	m.Set(w, "12345")
+	assert.False(t, w.Result().Cookies()[0].Secure)
+
+	athleteID, err := m.Get(requestWith(m, "12345"))
+	assert.NoError(t, err)
+	assert.Equal(t, "12345", athleteID)
+
+	w = httptest.NewRecorder()
+	m.Clear(w)
+	assert.False(t, w.Result().Cookies()[0].Secure)
+}
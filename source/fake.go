@@ -0,0 +1,158 @@
+package source
+
+import (
+	"atc/models"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fake is an ActivitySource that serves whatever it's given, for tests.
+type Fake struct {
+	lock       sync.Mutex
+	athletes   map[string]*models.Athlete
+	activities map[string][]models.StravaActivity
+}
+
+// NewFake creates an empty Fake.
+func NewFake() *Fake {
+	return &Fake{
+		athletes:   make(map[string]*models.Athlete),
+		activities: make(map[string][]models.StravaActivity),
+	}
+}
+
+// AddAthlete connects an athlete to the source.
+func (f *Fake) AddAthlete(athlete *models.Athlete) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.athletes[athlete.Id] = athlete
+}
+
+// Disconnect makes the source refuse to talk about the athlete any more, like strava does
+// when somebody revokes access.
+func (f *Fake) Disconnect(athleteID string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	delete(f.athletes, athleteID)
+}
+
+// AddActivity gives the athlete an activity. Its Streams, if it has any, are served by Streams.
+func (f *Fake) AddActivity(athleteID string, sa models.StravaActivity) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.activities[athleteID] = append(f.activities[athleteID], sa)
+}
+
+// RemoveActivity deletes one of the athlete's activities, like somebody doing it on strava.
+func (f *Fake) RemoveActivity(athleteID string, id int64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	var activities []models.StravaActivity
+	for _, sa := range f.activities[athleteID] {
+		if sa.Id != id {
+			activities = append(activities, sa)
+		}
+	}
+	f.activities[athleteID] = activities
+}
+
+// Name returns "fake".
+func (f *Fake) Name() string {
+	return "fake"
+}
+
+// Athlete returns the athlete.
+func (f *Fake) Athlete(ctx context.Context, athleteID string) (*models.Athlete, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	athlete, ok := f.athletes[athleteID]
+	if !ok {
+		return nil, ErrNotConnected
+	}
+
+	copied := *athlete
+	return &copied, nil
+}
+
+// Activities returns the athlete's activities in the window.
+func (f *Fake) Activities(ctx context.Context, athleteID string, after time.Time, before time.Time) ([]models.StravaActivity, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, ok := f.athletes[athleteID]; !ok {
+		return nil, ErrNotConnected
+	}
+
+	var activities []models.StravaActivity
+	for _, sa := range f.activities[athleteID] {
+		if !after.IsZero() && !sa.StartDate.After(after) {
+			continue
+		}
+		if !before.IsZero() && !sa.StartDate.Before(before) {
+			continue
+		}
+		activities = append(activities, f.strip(sa))
+	}
+
+	sort.SliceStable(activities, func(i, j int) bool {
+		return activities[i].StartDate.Before(activities[j].StartDate)
+	})
+
+	return activities, nil
+}
+
+// Activity returns one of the athlete's activities.
+func (f *Fake) Activity(ctx context.Context, athleteID string, id int64) (*models.StravaActivity, error) {
+	sa, err := f.find(athleteID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	stripped := f.strip(*sa)
+	return &stripped, nil
+}
+
+// Streams returns an activity's streams.
+func (f *Fake) Streams(ctx context.Context, athleteID string, id int64) (*models.Streams, error) {
+	sa, err := f.find(athleteID, id)
+	if err != nil {
+		return nil, err
+	}
+	if sa.Streams == nil {
+		return nil, fmt.Errorf("activity %d has no streams", id)
+	}
+
+	return sa.Streams, nil
+}
+
+func (f *Fake) find(athleteID string, id int64) (*models.StravaActivity, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, ok := f.athletes[athleteID]; !ok {
+		return nil, ErrNotConnected
+	}
+
+	for _, sa := range f.activities[athleteID] {
+		if sa.Id == id {
+			return &sa, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %d", ErrNotFound, id)
+}
+
+// strip returns the activity the way a real source lists it: labelled, and without streams.
+func (f *Fake) strip(sa models.StravaActivity) models.StravaActivity {
+	sa.Source = f.Name()
+	sa.Streams = nil
+	return sa
+}
@@ -0,0 +1,39 @@
+package source
+
+import (
+	"atc/models"
+	"context"
+	"errors"
+	"time"
+)
+
+// package source is where activities come from. strava is the first (and for now the only
+// live) source, but nothing past this package should know that: the service syncs from an
+// ActivitySource, and whatever it hands back goes into the store the same way.
+
+// ErrNotConnected is returned when the athlete hasn't connected the source, or the source
+// won't talk to us on their behalf any more. For strava that means sending them to /auth.
+var ErrNotConnected = errors.New("athlete is not connected to this source")
+
+// ErrNotFound is returned when the source doesn't have the activity (any more).
+var ErrNotFound = errors.New("no such activity")
+
+// ActivitySource is somewhere we can get an athlete's activities from. Everything is keyed by
+// athlete id; how the source authenticates as that athlete is its own business.
+type ActivitySource interface {
+	// Name identifies the source, and is recorded on every activity it returns.
+	Name() string
+
+	// Athlete returns the athlete's profile.
+	Athlete(ctx context.Context, athleteID string) (*models.Athlete, error)
+
+	// Activities returns the triathlon activities that started in the window, oldest first,
+	// without streams. A zero time leaves that side of the window open.
+	Activities(ctx context.Context, athleteID string, after time.Time, before time.Time) ([]models.StravaActivity, error)
+
+	// Activity returns a single activity, without streams.
+	Activity(ctx context.Context, athleteID string, id int64) (*models.StravaActivity, error)
+
+	// Streams returns an activity's per-sample data.
+	Streams(ctx context.Context, athleteID string, id int64) (*models.Streams, error)
+}
@@ -0,0 +1,107 @@
+package source
+
+import (
+	"atc/models"
+	"atc/transport"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// TokenStore is where the strava source finds athletes' tokens. The store package's stores
+// are TokenStores.
+type TokenStore interface {
+	GetToken(athleteID string) (*transport.Token, error)
+}
+
+// Strava is the strava api as an ActivitySource.
+type Strava struct {
+	transport *transport.Transport
+	tokens    TokenStore
+}
+
+// NewStrava creates a strava source that talks to strava through t, as whichever athlete's
+// token it finds in tokens. Refreshed tokens are saved by t's OnTokenRefresh hook.
+func NewStrava(t *transport.Transport, tokens TokenStore) *Strava {
+	return &Strava{transport: t, tokens: tokens}
+}
+
+// Name returns "strava".
+func (s *Strava) Name() string {
+	return "strava"
+}
+
+// Athlete returns the athlete's strava profile.
+func (s *Strava) Athlete(ctx context.Context, athleteID string) (*models.Athlete, error) {
+	token, err := s.token(athleteID)
+	if err != nil {
+		return nil, err
+	}
+
+	athlete, err := s.transport.GetAthleteProfile(ctx, token)
+	return athlete, sourceError(err)
+}
+
+// Activities returns the athlete's strava activities in the window.
+func (s *Strava) Activities(ctx context.Context, athleteID string, after time.Time, before time.Time) ([]models.StravaActivity, error) {
+	token, err := s.token(athleteID)
+	if err != nil {
+		return nil, err
+	}
+
+	activities, err := s.transport.FetchActivities(ctx, token, after, before)
+	for i := range activities {
+		activities[i].Source = s.Name()
+	}
+
+	return activities, sourceError(err)
+}
+
+// Activity returns one of the athlete's strava activities.
+func (s *Strava) Activity(ctx context.Context, athleteID string, id int64) (*models.StravaActivity, error) {
+	token, err := s.token(athleteID)
+	if err != nil {
+		return nil, err
+	}
+
+	activity, err := s.transport.FetchActivity(ctx, token, id)
+	if err != nil {
+		return nil, sourceError(err)
+	}
+	activity.Source = s.Name()
+
+	return activity, nil
+}
+
+// Streams returns a strava activity's streams.
+func (s *Strava) Streams(ctx context.Context, athleteID string, id int64) (*models.Streams, error) {
+	token, err := s.token(athleteID)
+	if err != nil {
+		return nil, err
+	}
+
+	streams, err := s.transport.FetchStreams(ctx, token, id)
+	return streams, sourceError(err)
+}
+
+// token finds the athlete's token.
+func (s *Strava) token(athleteID string) (*transport.Token, error) {
+	token, err := s.tokens.GetToken(athleteID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: no strava token for athlete %s: %v", ErrNotConnected, athleteID, err)
+	}
+	return token, nil
+}
+
+// sourceError turns the transport's "log in again" errors into ErrNotConnected, and its 404s
+// into ErrNotFound.
+func sourceError(err error) error {
+	switch {
+	case errors.Is(err, transport.ErrReauthRequired) || errors.Is(err, transport.ErrNotAuthenticated):
+		return fmt.Errorf("%w: %v", ErrNotConnected, err)
+	case errors.Is(err, transport.ErrNotFound):
+		return fmt.Errorf("%w: %v", ErrNotFound, err)
+	}
+	return err
+}
@@ -0,0 +1,93 @@
+package source_test
+
+import (
+	"atc/source"
+	"atc/transport"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// tokens is a TokenStore that's just a map
+type tokens map[string]*transport.Token
+
+func (t tokens) GetToken(athleteID string) (*transport.Token, error) {
+	token, ok := t[athleteID]
+	if !ok {
+		return nil, fmt.Errorf("no token")
+	}
+	return token, nil
+}
+
+func TestStrava(t *testing.T) {
+	root := os.Getenv("ATC_ROOT")
+
+	strava := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer abc" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/api/v3/athlete":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 123, "firstname": "Jane"})
+		case "/api/v3/athlete/activities":
+			if r.URL.Query().Get("page") != "1" {
+				_, _ = w.Write([]byte("[]"))
+				return
+			}
+			_ = json.NewEncoder(w).Encode([]map[string]interface{}{{"id": 7, "type": "Run", "start_date": time.Now().Format(time.RFC3339)}})
+		case "/api/v3/activities/7":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"id": 7, "type": "Run"})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer strava.Close()
+
+	c, err := transport.LoadConfig(filepath.Join(root, "config/config.yml"), filepath.Join(root, "config/version.yml"))
+	assert.Nil(t, err)
+	c.Strava.Url = strava.URL
+
+	backend, err := transport.NewTransport(c, filepath.Join(root, "config/secrets.yml"))
+	assert.Nil(t, err)
+
+	s := source.NewStrava(backend, tokens{
+		"123": {AthleteID: "123", AccessToken: "abc", ExpiresAt: time.Now().Add(time.Hour)},
+		// strava won't take this one and there's no refresh token to get another
+		"456": {AthleteID: "456", AccessToken: "old", ExpiresAt: time.Now().Add(time.Hour)},
+	})
+	ctx := context.Background()
+
+	athlete, err := s.Athlete(ctx, "123")
+	assert.Nil(t, err)
+	assert.Equal(t, "Jane", athlete.FirstName)
+
+	// everything that comes out is labelled with where it came from
+	activities, err := s.Activities(ctx, "123", time.Time{}, time.Time{})
+	assert.Nil(t, err)
+	assert.Len(t, activities, 1)
+	assert.Equal(t, "strava", activities[0].Source)
+
+	activity, err := s.Activity(ctx, "123", 7)
+	assert.Nil(t, err)
+	assert.Equal(t, "strava", activity.Source)
+
+	// one that's been deleted is a 404
+	_, err = s.Activity(ctx, "123", 8)
+	assert.ErrorIs(t, err, source.ErrNotFound)
+
+	// no token, or a token strava won't take, both mean the athlete needs to connect again
+	_, err = s.Activities(ctx, "789", time.Time{}, time.Time{})
+	assert.ErrorIs(t, err, source.ErrNotConnected)
+	_, err = s.Activities(ctx, "456", time.Time{}, time.Time{})
+	assert.ErrorIs(t, err, source.ErrNotConnected)
+}
@@ -0,0 +1,451 @@
+package store
+
+import (
+	"atc/models"
+	"atc/planning"
+	"atc/transport"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DiskStore is a Store that keeps one json file per record in a directory tree, so there's
+// no database to run. the layout is:
+//
+//	<root>/athletes/<athlete id>/athlete.json
+//	<root>/athletes/<athlete id>/token.json
+//	<root>/athletes/<athlete id>/goals.json
+//	<root>/athletes/<athlete id>/strava/<activity id>.json
+//	<root>/athletes/<athlete id>/streams/<activity id>.json
+//	<root>/athletes/<athlete id>/activities/<activity id>.json
+//
+// a busy athlete does maybe 500 activities a year, so reading a directory's worth of small
+// files is fine. if that stops being true, this is the thing to replace.
+type DiskStore struct {
+	root string
+	lock sync.RWMutex
+}
+
+const (
+	athleteFile   = "athlete.json"
+	tokenFile     = "token.json"
+	goalsFile     = "goals.json"
+	proposalsFile = "proposals.json"
+	stravaDir     = "strava"
+	streamsDir    = "streams"
+	activitiesDir = "activities"
+)
+
+// NewDiskStore creates (if need be) and opens a DiskStore rooted at root.
+func NewDiskStore(root string) (*DiskStore, error) {
+	if err := os.MkdirAll(filepath.Join(root, "athletes"), 0o755); err != nil {
+		return nil, err
+	}
+
+	logrus.Infof("Opened disk store at %s", root)
+
+	return &DiskStore{root: root}, nil
+}
+
+//
+// athletes
+//
+
+// SaveAthlete writes the athlete record. Activities are stored separately and are not
+// written with the athlete.
+func (d *DiskStore) SaveAthlete(athlete *models.Athlete) error {
+	if athlete == nil || athlete.Id == "" {
+		return fmt.Errorf("athlete has no id")
+	}
+
+	record := *athlete
+	record.Activities = nil
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.write(filepath.Join(d.athleteDir(athlete.Id), athleteFile), record)
+}
+
+// GetAthlete reads the athlete record.
+func (d *DiskStore) GetAthlete(athleteID string) (*models.Athlete, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	var athlete models.Athlete
+	if err := d.read(filepath.Join(d.athleteDir(athleteID), athleteFile), &athlete); err != nil {
+		return nil, err
+	}
+
+	return &athlete, nil
+}
+
+//
+// tokens
+//
+
+// SaveToken writes the athlete's strava token. Only we get to read it.
+func (d *DiskStore) SaveToken(token *transport.Token) error {
+	if token == nil || token.AthleteID == "" {
+		return fmt.Errorf("token has no athlete id")
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.writeFile(filepath.Join(d.athleteDir(token.AthleteID), tokenFile), token, 0o600)
+}
+
+// GetToken reads the athlete's strava token.
+func (d *DiskStore) GetToken(athleteID string) (*transport.Token, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	var token transport.Token
+	if err := d.read(filepath.Join(d.athleteDir(athleteID), tokenFile), &token); err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// DeleteToken forgets the athlete's strava token, e.g. when they've revoked our access.
+// Deleting a token that isn't there is not an error.
+func (d *DiskStore) DeleteToken(athleteID string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	err := os.Remove(filepath.Join(d.athleteDir(athleteID), tokenFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+//
+// raw activities
+//
+
+// SaveStravaActivity writes the raw activity, and its streams if it has any.
+func (d *DiskStore) SaveStravaActivity(athleteID string, sa models.StravaActivity) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if err := d.write(d.recordPath(athleteID, stravaDir, sa.Id), sa); err != nil {
+		return err
+	}
+
+	if sa.Streams != nil {
+		return d.write(d.recordPath(athleteID, streamsDir, sa.Id), sa.Streams)
+	}
+
+	return nil
+}
+
+// GetStravaActivity reads a raw activity and attaches its streams if we have them.
+func (d *DiskStore) GetStravaActivity(athleteID string, activityID int64) (*models.StravaActivity, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	var sa models.StravaActivity
+	if err := d.read(d.recordPath(athleteID, stravaDir, activityID), &sa); err != nil {
+		return nil, err
+	}
+
+	streams, err := d.readStreams(athleteID, activityID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	sa.Streams = streams
+
+	return &sa, nil
+}
+
+// ListStravaActivities returns the raw activities that started in the window, oldest first,
+// with their streams attached where we have them.
+func (d *DiskStore) ListStravaActivities(athleteID string, after time.Time, before time.Time) ([]models.StravaActivity, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	ids, err := d.list(athleteID, stravaDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var activities []models.StravaActivity
+	for _, id := range ids {
+		var sa models.StravaActivity
+		if err := d.read(d.recordPath(athleteID, stravaDir, id), &sa); err != nil {
+			return nil, err
+		}
+		if !inWindow(sa.StartDate, after, before) {
+			continue
+		}
+
+		streams, err := d.readStreams(athleteID, id)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		sa.Streams = streams
+
+		activities = append(activities, sa)
+	}
+
+	sort.SliceStable(activities, func(i, j int) bool {
+		return activities[i].StartDate.Before(activities[j].StartDate)
+	})
+
+	return activities, nil
+}
+
+// LatestStartDate returns the start date of the newest raw activity from source, or zero if
+// there are none. Activities stored before we recorded sources count for any source.
+func (d *DiskStore) LatestStartDate(athleteID string, source string) (time.Time, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	ids, err := d.list(athleteID, stravaDir)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var latest time.Time
+	for _, id := range ids {
+		var sa models.StravaActivity
+		if err := d.read(d.recordPath(athleteID, stravaDir, id), &sa); err != nil {
+			return time.Time{}, err
+		}
+		if sa.Source != "" && sa.Source != source {
+			continue
+		}
+		if sa.StartDate.After(latest) {
+			latest = sa.StartDate
+		}
+	}
+
+	return latest, nil
+}
+
+//
+// streams
+//
+
+// SaveStreams writes the streams for an activity.
+func (d *DiskStore) SaveStreams(athleteID string, activityID int64, streams *models.Streams) error {
+	if streams == nil {
+		return nil
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.write(d.recordPath(athleteID, streamsDir, activityID), streams)
+}
+
+// GetStreams reads the streams for an activity.
+func (d *DiskStore) GetStreams(athleteID string, activityID int64) (*models.Streams, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	return d.readStreams(athleteID, activityID)
+}
+
+//
+// scored activities
+//
+
+// SaveActivity writes a scored activity.
+func (d *DiskStore) SaveActivity(athleteID string, activity models.Activity) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.write(d.recordPath(athleteID, activitiesDir, activity.Id), activity)
+}
+
+// ListActivities returns the scored activities that started in the window, oldest first.
+func (d *DiskStore) ListActivities(athleteID string, after time.Time, before time.Time) ([]models.Activity, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	ids, err := d.list(athleteID, activitiesDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var activities []models.Activity
+	for _, id := range ids {
+		var activity models.Activity
+		if err := d.read(d.recordPath(athleteID, activitiesDir, id), &activity); err != nil {
+			return nil, err
+		}
+		if inWindow(activity.StartDate, after, before) {
+			activities = append(activities, activity)
+		}
+	}
+
+	sort.SliceStable(activities, func(i, j int) bool {
+		return activities[i].StartDate.Before(activities[j].StartDate)
+	})
+
+	return activities, nil
+}
+
+// DeleteActivity removes the raw activity, its streams, and its score. Deleting something
+// that isn't there is not an error.
+func (d *DiskStore) DeleteActivity(athleteID string, activityID int64) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for _, dir := range []string{stravaDir, streamsDir, activitiesDir} {
+		err := os.Remove(d.recordPath(athleteID, dir, activityID))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//
+// goals
+//
+
+// SaveGoals replaces the athlete's goals.
+func (d *DiskStore) SaveGoals(athleteID string, goals []planning.Goal) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.write(filepath.Join(d.athleteDir(athleteID), goalsFile), goals)
+}
+
+// ListGoals reads the athlete's goals. An athlete who hasn't set any has none, which is not
+// an error.
+func (d *DiskStore) ListGoals(athleteID string) ([]planning.Goal, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	var goals []planning.Goal
+	err := d.read(filepath.Join(d.athleteDir(athleteID), goalsFile), &goals)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+
+	return goals, err
+}
+
+// SaveProposals replaces the athlete's threshold proposals.
+func (d *DiskStore) SaveProposals(athleteID string, proposals []models.ThresholdProposal) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.write(filepath.Join(d.athleteDir(athleteID), proposalsFile), proposals)
+}
+
+// ListProposals reads the athlete's threshold proposals. Having none is not an error.
+func (d *DiskStore) ListProposals(athleteID string) ([]models.ThresholdProposal, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	var proposals []models.ThresholdProposal
+	err := d.read(filepath.Join(d.athleteDir(athleteID), proposalsFile), &proposals)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+
+	return proposals, err
+}
+
+//
+// helpers. none of these take the lock; the callers already have it.
+//
+
+func (d *DiskStore) athleteDir(athleteID string) string {
+	// athlete ids come from strava (or a cookie), so don't let one walk out of the tree
+	return filepath.Join(d.root, "athletes", filepath.Base(filepath.Clean("/"+athleteID)))
+}
+
+func (d *DiskStore) recordPath(athleteID string, dir string, id int64) string {
+	return filepath.Join(d.athleteDir(athleteID), dir, strconv.FormatInt(id, 10)+".json")
+}
+
+func (d *DiskStore) readStreams(athleteID string, activityID int64) (*models.Streams, error) {
+	var streams models.Streams
+	if err := d.read(d.recordPath(athleteID, streamsDir, activityID), &streams); err != nil {
+		return nil, err
+	}
+	return &streams, nil
+}
+
+// list returns the ids of the records in one of an athlete's directories.
+func (d *DiskStore) list(athleteID string, dir string) ([]int64, error) {
+	entries, err := os.ReadDir(filepath.Join(d.athleteDir(athleteID), dir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSuffix(name, ".json"), 10, 64)
+		if err != nil {
+			logrus.Warnf("Ignoring stray file %s in store", filepath.Join(dir, name))
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// read decodes the json file at path into v.
+func (d *DiskStore) read(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// write encodes v as json to path. it writes to a temporary file and renames it into place
+// so that a crash halfway through doesn't leave half a record behind.
+func (d *DiskStore) write(path string, v interface{}) error {
+	return d.writeFile(path, v, 0o644)
+}
+
+// writeFile is write with a choice of permissions.
+func (d *DiskStore) writeFile(path string, v interface{}, perm os.FileMode) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,186 @@
+package store_test
+
+import (
+	"atc/models"
+	"atc/planning"
+	"atc/store"
+	"atc/transport"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskStoreAthlete(t *testing.T) {
+	d, err := store.NewDiskStore(t.TempDir())
+	assert.NoError(t, err)
+
+	_, err = d.GetAthlete("123")
+	assert.ErrorIs(t, err, store.ErrNotFound)
+
+	athlete := &models.Athlete{Id: "123", FirstName: "Jane", Activities: []models.Activity{{Id: 1}}}
+	assert.NoError(t, d.SaveAthlete(athlete))
+
+	got, err := d.GetAthlete("123")
+	assert.NoError(t, err)
+	assert.Equal(t, "Jane", got.FirstName)
+	// activities live in their own files
+	assert.Empty(t, got.Activities)
+
+	// no walking out of the store
+	assert.NoError(t, d.SaveAthlete(&models.Athlete{Id: "../../evil"}))
+	_, err = d.GetAthlete("evil")
+	assert.NoError(t, err)
+}
+
+func TestDiskStoreToken(t *testing.T) {
+	root := t.TempDir()
+	d, err := store.NewDiskStore(root)
+	assert.NoError(t, err)
+
+	_, err = d.GetToken("123")
+	assert.ErrorIs(t, err, store.ErrNotFound)
+
+	// tokens are per athlete, so one without an athlete is no good to anybody
+	assert.Error(t, d.SaveToken(&transport.Token{AccessToken: "abc"}))
+
+	expires := time.Date(2024, 8, 1, 7, 0, 0, 0, time.UTC)
+	assert.NoError(t, d.SaveToken(&transport.Token{AthleteID: "123", AccessToken: "abc", RefreshToken: "def", ExpiresAt: expires}))
+	assert.NoError(t, d.SaveToken(&transport.Token{AthleteID: "456", AccessToken: "ghi"}))
+
+	token, err := d.GetToken("123")
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", token.AccessToken)
+	assert.Equal(t, "def", token.RefreshToken)
+	assert.True(t, token.ExpiresAt.Equal(expires))
+
+	// nobody else gets to read them
+	info, err := os.Stat(filepath.Join(root, "athletes", "123", "token.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	// the athlete cut us off
+	assert.NoError(t, d.DeleteToken("123"))
+	assert.NoError(t, d.DeleteToken("123"))
+	_, err = d.GetToken("123")
+	assert.ErrorIs(t, err, store.ErrNotFound)
+}
+
+func TestDiskStoreActivities(t *testing.T) {
+	d, err := store.NewDiskStore(t.TempDir())
+	assert.NoError(t, err)
+
+	day := time.Date(2024, 8, 1, 7, 0, 0, 0, time.UTC)
+
+	latest, err := d.LatestStartDate("123", "strava")
+	assert.NoError(t, err)
+	assert.True(t, latest.IsZero())
+
+	// saved out of order, listed oldest first
+	for _, i := range []int{2, 0, 1} {
+		sa := models.StravaActivity{Id: int64(i + 1), Type: "Run", StartDate: day.AddDate(0, 0, i)}
+		if i == 1 {
+			sa.Streams = &models.Streams{Time: []int{0, 1, 2}}
+		}
+		assert.NoError(t, d.SaveStravaActivity("123", sa))
+		assert.NoError(t, d.SaveActivity("123", models.Activity{Id: sa.Id, StartDate: sa.StartDate, TSS: 50}))
+	}
+
+	latest, err = d.LatestStartDate("123", "strava")
+	assert.NoError(t, err)
+	assert.True(t, latest.Equal(day.AddDate(0, 0, 2)))
+
+	// an imported file from later on doesn't move the strava sync along
+	assert.NoError(t, d.SaveStravaActivity("123", models.StravaActivity{Id: -1, Type: "Ride", StartDate: day.AddDate(0, 0, 5), Source: "fit"}))
+	latest, err = d.LatestStartDate("123", "strava")
+	assert.NoError(t, err)
+	assert.True(t, latest.Equal(day.AddDate(0, 0, 2)))
+	assert.NoError(t, d.DeleteActivity("123", -1))
+
+	raw, err := d.ListStravaActivities("123", time.Time{}, time.Time{})
+	assert.NoError(t, err)
+	assert.Len(t, raw, 3)
+	assert.Equal(t, int64(1), raw[0].Id)
+	assert.Nil(t, raw[0].Streams)
+	assert.NotNil(t, raw[1].Streams)
+
+	// windows are [after, before)
+	scored, err := d.ListActivities("123", day.AddDate(0, 0, 1), day.AddDate(0, 0, 2))
+	assert.NoError(t, err)
+	assert.Len(t, scored, 1)
+	assert.Equal(t, int64(2), scored[0].Id)
+
+	streams, err := d.GetStreams("123", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 1, 2}, streams.Time)
+
+	// other athletes can't see it
+	scored, err = d.ListActivities("456", time.Time{}, time.Time{})
+	assert.NoError(t, err)
+	assert.Empty(t, scored)
+
+	assert.NoError(t, d.DeleteActivity("123", 2))
+	assert.NoError(t, d.DeleteActivity("123", 2))
+	_, err = d.GetStravaActivity("123", 2)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+	_, err = d.GetStreams("123", 2)
+	assert.ErrorIs(t, err, store.ErrNotFound)
+}
+
+func TestDiskStoreGoals(t *testing.T) {
+	d, err := store.NewDiskStore(t.TempDir())
+	assert.NoError(t, err)
+
+	goals, err := d.ListGoals("123")
+	assert.NoError(t, err)
+	assert.Empty(t, goals)
+
+	event := time.Date(2025, 5, 4, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, d.SaveGoals("123", []planning.Goal{
+		{Id: "1", Name: "10k", EventDate: event, Discipline: models.DisciplineRun, Distance: 10000, Duration: 2700},
+		{Id: "2", Name: "century", EventDate: event, Discipline: models.DisciplineBike, TargetCTL: 80},
+	}))
+
+	goals, err = d.ListGoals("123")
+	assert.NoError(t, err)
+	assert.Len(t, goals, 2)
+	assert.Equal(t, "10k", goals[0].Name)
+	assert.True(t, goals[0].EventDate.Equal(event))
+	assert.Equal(t, models.DisciplineBike, goals[1].Discipline)
+	assert.Equal(t, 80.0, goals[1].TargetCTL)
+
+	// other athletes have their own
+	goals, err = d.ListGoals("456")
+	assert.NoError(t, err)
+	assert.Empty(t, goals)
+}
+
+func TestDiskStoreProposals(t *testing.T) {
+	root := t.TempDir()
+	d, err := store.NewDiskStore(root)
+	assert.NoError(t, err)
+
+	proposals, err := d.ListProposals("123")
+	assert.NoError(t, err)
+	assert.Empty(t, proposals)
+
+	assert.NoError(t, d.SaveProposals("123", []models.ThresholdProposal{
+		{Id: "bike-power", Sport: "bike", Metric: "power", Current: 230, Proposed: 245, ActivityId: 7},
+	}))
+
+	// they're still there after a restart
+	d, err = store.NewDiskStore(root)
+	assert.NoError(t, err)
+	proposals, err = d.ListProposals("123")
+	assert.NoError(t, err)
+	if assert.Len(t, proposals, 1) {
+		assert.Equal(t, 245.0, proposals[0].Proposed)
+		assert.Equal(t, int64(7), proposals[0].ActivityId)
+	}
+
+	proposals, err = d.ListProposals("456")
+	assert.NoError(t, err)
+	assert.Empty(t, proposals)
+}
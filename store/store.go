@@ -0,0 +1,70 @@
+package store
+
+import (
+	"atc/models"
+	"atc/planning"
+	"atc/transport"
+	"errors"
+	"time"
+)
+
+// package store keeps everything we've pulled from strava (and everything we've worked out
+// from it) so that a page load doesn't have to go back to strava for six months of history.
+// strava gives us 100 requests every 15 minutes, and a single athlete with streams can chew
+// through that in one visit.
+
+// ErrNotFound is returned when the thing asked for isn't in the store.
+var ErrNotFound = errors.New("not found")
+
+// Store is the storage interface. Everything is keyed by athlete so that one deployment can
+// serve a whole team. Windows are [after, before); a zero time leaves that side open.
+type Store interface {
+	// athletes
+	SaveAthlete(athlete *models.Athlete) error
+	GetAthlete(athleteID string) (*models.Athlete, error)
+
+	// strava tokens, one per athlete
+	SaveToken(token *transport.Token) error
+	GetToken(athleteID string) (*transport.Token, error)
+	DeleteToken(athleteID string) error
+
+	// raw activities, exactly as strava gave them to us
+	SaveStravaActivity(athleteID string, sa models.StravaActivity) error
+	GetStravaActivity(athleteID string, activityID int64) (*models.StravaActivity, error)
+	ListStravaActivities(athleteID string, after time.Time, before time.Time) ([]models.StravaActivity, error)
+
+	// LatestStartDate is the start date of the newest raw activity we have from source, or
+	// zero if we don't have any. incremental syncs start from here (so an imported file
+	// doesn't make a sync skip whatever came before it).
+	LatestStartDate(athleteID string, source string) (time.Time, error)
+
+	// per-sample streams, which are big, so they're stored separately from the activity
+	SaveStreams(athleteID string, activityID int64, streams *models.Streams) error
+	GetStreams(athleteID string, activityID int64) (*models.Streams, error)
+
+	// scored activities
+	SaveActivity(athleteID string, activity models.Activity) error
+	ListActivities(athleteID string, after time.Time, before time.Time) ([]models.Activity, error)
+
+	// DeleteActivity removes the raw activity, its streams, and its score.
+	DeleteActivity(athleteID string, activityID int64) error
+
+	// goals. an athlete has a handful, so they're saved (and listed) all at once
+	SaveGoals(athleteID string, goals []planning.Goal) error
+	ListGoals(athleteID string) ([]planning.Goal, error)
+
+	// threshold changes waiting on somebody to confirm them, which are saved all at once too
+	SaveProposals(athleteID string, proposals []models.ThresholdProposal) error
+	ListProposals(athleteID string) ([]models.ThresholdProposal, error)
+}
+
+// inWindow returns true if t falls in [after, before), where zero times are open ends.
+func inWindow(t time.Time, after time.Time, before time.Time) bool {
+	if !after.IsZero() && t.Before(after) {
+		return false
+	}
+	if !before.IsZero() && !t.Before(before) {
+		return false
+	}
+	return true
+}
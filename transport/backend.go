@@ -2,6 +2,7 @@ package transport
 
 import (
 	"atc/models"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/sirupsen/logrus"
@@ -9,6 +10,9 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/yaml.v2"
@@ -18,24 +22,47 @@ type Secrets struct {
 	Strava struct {
 		ClientID     string `yaml:"client_id"`
 		ClientSecret string `yaml:"client_secret"`
+
+		// made up by us, and handed to strava when we subscribe to webhook events
+		WebhookVerifyToken string `yaml:"webhook_verify_token"`
+
+		// what strava answered with when we subscribed. events for any other subscription
+		// aren't from strava, or aren't for us
+		WebhookSubscriptionID int64 `yaml:"webhook_subscription_id"`
 	} `yaml:"strava"`
+	Session struct {
+		Key string `yaml:"key"` // signs session cookies
+	} `yaml:"session"`
 	OpenAI struct {
 		APIKey string `yaml:"api_key"`
 	} `yaml:"openai"`
 }
 
+// Transport talks to strava on behalf of the app. it doesn't hold anybody's credentials:
+// every call that acts for an athlete takes that athlete's Token.
 type Transport struct {
-	clientID      string
-	clientSecret  string
-	redirectURI   string
-	url           string
-	httpClient    *http.Client
-	accessToken   string
-	refreshToken  string
-	expiresAt     time.Time
-	openAIKey     string
-	config        *Config
-	authenticated bool
+	clientID     string
+	clientSecret string
+	redirectURI  string
+	url          string
+	httpClient   *http.Client
+	openAIKey    string
+	config       *Config
+
+	// called with a token after we've refreshed it, so it can be saved, and to load the saved
+	// one before refreshing, in case somebody else just did
+	onTokenRefresh func(token *Token) error
+	loadToken      func(athleteID string) (*Token, error)
+
+	// one lock per athlete, so refreshes of the same token take turns (see refresh)
+	refreshLocks     map[string]*sync.Mutex
+	refreshLocksLock sync.Mutex
+
+	// strava's rate limits, shared by every athlete
+	limiter *rateLimiter
+
+	// the strava api, one method per endpoint
+	strava *StravaClient
 }
 
 // LoadSecrets reads the secrets.yml file and returns a Secrets struct.
@@ -73,177 +100,53 @@ func NewTransport(config *Config, secretsFile string) (*Transport, error) {
 		return nil, err
 	}
 
-	return &Transport{
-		clientID:      secrets.Strava.ClientID,
-		clientSecret:  secrets.Strava.ClientSecret,
-		redirectURI:   config.Server.RedirectURI,
-		url:           config.Strava.Url,
-		httpClient:    &http.Client{},
-		openAIKey:     secrets.OpenAI.APIKey,
-		config:        config,
-		authenticated: false,
-	}, nil
+	t := &Transport{
+		clientID:     secrets.Strava.ClientID,
+		clientSecret: secrets.Strava.ClientSecret,
+		redirectURI:  config.Server.RedirectURI,
+		url:          config.Strava.Url,
+		httpClient:   &http.Client{},
+		openAIKey:    secrets.OpenAI.APIKey,
+		config:       config,
+		limiter:      newRateLimiter(),
+		refreshLocks: make(map[string]*sync.Mutex),
+	}
+	t.strava = NewStravaClient(t, config.Strava.Url)
+
+	return t, nil
+}
+
+// Strava returns the strava api client.
+func (t *Transport) Strava() *StravaClient {
+	return t.strava
 }
 
 // GetAuthURL generates the Strava OAuth URL for authentication.
 func (t *Transport) GetAuthURL() string {
 	return fmt.Sprintf(
-		"%s/oauth/authorize?client_id=%s&redirect_uri=%s&response_type=code&scope=read,activity:read",
+		"%s/oauth/authorize?client_id=%s&redirect_uri=%s&response_type=code&scope=%s",
 		t.url,
 		t.clientID,
 		url.QueryEscape(t.redirectURI),
+		strings.Join(RequiredScopes(), ","),
 	)
 }
 
-// GetAccessToken returns the access token.
-func (t *Transport) GetAccessToken() string {
-	if t.accessToken == "" {
-		logrus.Info("GetAccessToken called with undefined token")
-	}
-	return t.accessToken
-}
-
-// SetAccessToken writes the access token.
-func (t *Transport) SetAccessToken(token string) {
-	if t.accessToken != "" {
-		logrus.Info("SetAccessToken() overwriting existing token")
-	} else {
-		logrus.Info("SetAccessToken() writing new token")
-	}
-	t.accessToken = token
-}
-
-// GetRefreshToken returns the stored refresh token.
-func (t *Transport) GetRefreshToken() string {
-	if t.refreshToken == "" {
-		logrus.Info("GetRefreshToken called with undefined token")
-	}
-	return t.refreshToken
-}
-
-// SetRefreshToken writes the refresh token
-func (t *Transport) SetRefreshToken(token string) {
-	if t.refreshToken != "" {
-		logrus.Info("SetRefreshToke() overwriting existing token")
-	} else {
-		logrus.Info("SetRefreshToken() writing new token")
-	}
-	t.refreshToken = token
-}
-
 // GetConfig returns the internal config used by the backend
 func (t *Transport) GetConfig() *Config {
 	return t.config
 }
 
-// IsTokenExpired checks if the current access token is expired.
-func (t *Transport) IsTokenExpired() bool {
-	return time.Now().After(t.expiresAt)
-}
-
-// ExchangeCodeForToken exchanges the authorization code for an access token and stores the refresh token and expiration time.
-func (t *Transport) ExchangeCodeForToken(code string) error {
-	reqURL := fmt.Sprintf("%s/oauth/token", t.url)
-	data := url.Values{
-		"client_id":     {t.clientID},
-		"client_secret": {t.clientSecret},
-		"code":          {code},
-		"grant_type":    {"authorization_code"},
-		"redirect_uri":  {t.redirectURI},
-	}
-
-	resp, err := t.httpClient.PostForm(reqURL, data)
-	if err != nil {
-		logrus.WithError(err).Error("Failed to post form to exchange code for token")
-		t.AuthBad()
-		return err
-	}
-	defer resp.Body.Close()
-
-	var result map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		logrus.WithError(err).Error("Failed to decode response body")
-		t.AuthBad()
-		return err
-	}
-
-	if token, ok := result["access_token"].(string); ok {
-		t.SetAccessToken(token)
-		t.AuthGood()
-	} else {
-		logrus.Error("Failed to retrieve access token from response body")
-		resultJSON, err := json.Marshal(result)
-		if err != nil {
-			t.AuthBad()
-			logrus.WithError(err).Error("Failed to marshal response body")
-			return fmt.Errorf("failed to retrieve access token")
-		}
-		logrus.WithField("result", string(resultJSON)).Error("unexpected response body")
-		t.AuthBad()
-		return fmt.Errorf("failed to retrieve access token")
-	}
-
-	if refreshToken, ok := result["refresh_token"].(string); ok {
-		t.refreshToken = refreshToken
-	} else {
-		logrus.Error("Failed to retrieve refresh token from response body")
-		t.AuthBad()
-		return fmt.Errorf("failed to retrieve refresh token")
-	}
-
-	if expiresIn, ok := result["expires_in"].(float64); ok {
-		logrus.Infof("Token expiry in %f seconds", expiresIn)
-		t.expiresAt = time.Now().Add(time.Duration(expiresIn) * time.Second)
-	} else {
-		logrus.Info("Strange or missing expiry data in response")
-	}
-
-	return nil
-}
-
-// RefreshAccessToken uses the refresh token to obtain a new access token.
-func (t *Transport) RefreshAccessToken(refreshToken string) (string, error) {
-	reqURL := fmt.Sprintf("%s/oauth/token", t.url)
-	data := url.Values{
-		"client_id":     {t.clientID},
-		"client_secret": {t.clientSecret},
-		"grant_type":    {"refresh_token"},
-		"refresh_token": {refreshToken},
-	}
-
-	resp, err := t.httpClient.PostForm(reqURL, data)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	var result map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", err
-	}
-
-	if newAccessToken, ok := result["access_token"].(string); ok {
-		t.accessToken = newAccessToken
-		if expiresIn, ok := result["expires_in"].(float64); ok {
-			t.expiresAt = time.Now().Add(time.Duration(expiresIn) * time.Second)
-		}
-		return newAccessToken, nil
-	}
-
-	return "", fmt.Errorf("failed to refresh access token")
-}
-
 // ExampleRequest makes an authenticated request to Strava API. This method is not
 // actually used by the backend, but it's preserved for documentation's sake. please
 // don't remove this.
-func (t *Transport) ExampleRequest(endpoint string) ([]byte, error) {
-	req, err := http.NewRequest("GET", t.url+"/api/v3"+endpoint, nil)
+func (t *Transport) ExampleRequest(ctx context.Context, token *Token, endpoint string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", t.strava.baseURL+"/api/v3"+endpoint, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Set("Authorization", "Bearer "+t.accessToken)
-	resp, err := t.httpClient.Do(req)
+	resp, err := t.do(token, req)
 	if err != nil {
 		return nil, err
 	}
@@ -253,192 +156,166 @@ func (t *Transport) ExampleRequest(endpoint string) ([]byte, error) {
 }
 
 // GetAthleteProfile retrieves the athlete's profile from Strava
-func (t *Transport) GetAthleteProfile() (*models.Athlete, error) {
-	if t.Authenticated() == false {
-		logrus.Warn("GetAthleteProfile called but not authenticated")
-		return &models.Athlete{}, fmt.Errorf("not authenticated")
-	}
-	req, err := http.NewRequest("GET", t.url+"/api/v3/athlete", nil)
-	if err != nil {
-		return &models.Athlete{}, err
-	}
-
-	req.Header.Set("Authorization", "Bearer "+t.GetAccessToken())
-	resp, err := t.httpClient.Do(req)
+func (t *Transport) GetAthleteProfile(ctx context.Context, token *Token) (*models.Athlete, error) {
+	profile, err := t.strava.Athlete(ctx, token)
 	if err != nil {
 		logrus.WithError(err).Error("failed to fetch athlete profile")
 		return &models.Athlete{}, err
 	}
 
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			logrus.WithError(err).Error("failed to close response body")
-			return
-		}
-	}(resp.Body)
-
-	placeholder := struct {
-		ID            int64     `json:"id"`
-		Username      *string   `json:"username"`
-		ResourceState int       `json:"resource_state"`
-		Firstname     string    `json:"firstname"`
-		Lastname      string    `json:"lastname"`
-		City          string    `json:"city"`
-		State         string    `json:"state"`
-		Country       string    `json:"country"`
-		Sex           string    `json:"sex"`
-		Premium       bool      `json:"premium""`
-		Summit        bool      `json:"summit"`
-		CreatedAt     time.Time `json:"created_at"`
-		UpdatedAt     time.Time `json:"updated_at"`
-		BadgeTypeID   int       `json:"badge_type_id"`
-		ProfileMedium string    `json:"profile_medium"`
-		Profile       string    `json:"profile"`
-		Friend        *string   `json:"friend"`
-		Follower      *string   `json:"follower"`
-	}{} // this is a placeholder struct to hold the decoded json data
-
-	if err := json.NewDecoder(resp.Body).Decode(&placeholder); err != nil {
-		logrus.WithError(err).Error("failed to decode athlete profile")
-		return &models.Athlete{}, err
-	}
-
-	th := models.Thresholds{}
-	th.Run.ThresholdHR = t.config.Athlete.Run.ThresholdHR
-	th.Swim.ThresholdHR = t.config.Athlete.Swim.ThresholdHR
-	th.Bike.ThresholdHR = t.config.Athlete.Bike.ThresholdHR
+	th := t.config.Athlete.Thresholds
 
 	athlete := models.NewAthlete(
-		fmt.Sprintf("%d", placeholder.ID),
-		placeholder.Firstname,
-		placeholder.Lastname,
-		placeholder.Sex,
+		fmt.Sprintf("%d", profile.ID),
+		profile.Firstname,
+		profile.Lastname,
+		profile.Sex,
 		&th)
 
 	logrus.Infof("Fetched athlete profile for %s", athlete.FullName())
 	return athlete, nil
 }
 
-// FetchActivities retrieves activities from Strava API that are of type Swim, Bike, or Run and occurred in the last six weeks.
-func (t *Transport) FetchActivities() ([]models.StravaActivity, error) {
-	if t.Authenticated() == false {
+// activitiesPerPage is the largest page size strava will give us for athlete/activities
+const activitiesPerPage = 200
+
+// FetchActivities retrieves the athlete's activities that started between after and before. A
+// zero time leaves that side of the window open. Every page is walked until strava returns an
+// empty one, and the result is sorted by start date (oldest first) so nobody downstream has to
+// care what order strava felt like using. Every sport comes back; working out which ones we
+// score is up to the caller.
+func (t *Transport) FetchActivities(ctx context.Context, token *Token, after time.Time, before time.Time) ([]models.StravaActivity, error) {
+	if !token.Valid() {
 		logrus.Warn("FetchActivities called but not authenticated")
-		return []models.StravaActivity{}, fmt.Errorf("not authenticated")
+		return []models.StravaActivity{}, ErrNotAuthenticated
 	}
 
-	token := t.GetAccessToken()
-
-	sixWeeksAgo := time.Now().AddDate(0, 0, -42).Unix()
-
-	sports := []string{"Swim", "Ride", "Run"}
-
 	var allActivities []models.StravaActivity
 
-	// TODO: i feel like these endpoints should be explicitly documented somewhere in code
-	//       so that maintaining them or changing them (should strava change their backend
-	//       for example) is both easy to do, and easy to audit ("where am i using endpoint xyz?")
+	for page := 1; ; page++ {
+		tempActivities, err := t.fetchActivitiesPage(ctx, token, after, before, page)
+		if err != nil {
+			return allActivities, err
+		}
 
-	// TODO: i also feel like this is a janky way to create urls for endpoint access.
-	//       there's probably a more elegant way to do this but let's do that in the future.
+		// strava signals the end of the list with an empty page
+		if len(tempActivities) == 0 {
+			break
+		}
 
-	u, err := url.Parse(fmt.Sprintf("%s/api/v3/athlete/activities", t.url))
-	if err != nil {
-		logrus.WithError(err).Error("failed to parse URL")
-		return []models.StravaActivity{}, err
+		allActivities = append(allActivities, tempActivities...)
 	}
-	// Add query parameters
-	params := url.Values{}
-	params.Add("access_token", token)
-	params.Add("after", fmt.Sprintf("%d", sixWeeksAgo)) // Convert int to string for query params
-	params.Add("per_page", "200")
 
-	u.RawQuery = params.Encode()
+	sort.SliceStable(allActivities, func(i, j int) bool {
+		return allActivities[i].StartDate.Before(allActivities[j].StartDate)
+	})
+
+	logrus.Infof("FetchActivities() fetched %d activities between %s and %s", len(allActivities), after, before)
 
-	resp, err := t.httpClient.Get(u.String())
+	return allActivities, nil
+}
+
+// fetchActivitiesPage retrieves a single page of the athlete's activities.
+func (t *Transport) fetchActivitiesPage(ctx context.Context, token *Token, after time.Time, before time.Time, page int) ([]models.StravaActivity, error) {
+	summaries, err := t.strava.AthleteActivities(ctx, token, ActivityListOptions{
+		After:   after,
+		Before:  before,
+		Page:    page,
+		PerPage: activitiesPerPage,
+	})
 	if err != nil {
-		logrus.WithError(err).Error("failed to fetch activities from Strava")
-		return allActivities, err
+		logrus.WithError(err).Errorf("FetchActivities() failed to fetch page %d", page)
+		return nil, err
 	}
 
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			logrus.WithError(err).Error("failed to close response body")
-			return
-		}
-	}(resp.Body)
-
-	// Temporary structure to hold the raw JSON data
-	var tempActivities []struct {
-		Id                 int64     `json:"id"`
-		Name               string    `json:"name"`
-		Distance           float64   `json:"distance"`
-		MovingTime         int       `json:"moving_time"`
-		ElapsedTime        int       `json:"elapsed_time"`
-		TotalElevationGain float64   `json:"total_elevation_gain"`
-		Type               string    `json:"type"`
-		StartDate          time.Time `json:"start_date"`
-		Calories           int       `json:"calories"`
-		AverageHeartRate   float64   `json:"average_heartrate"`
-		MaxHeartRate       float64   `json:"max_heartrate"`
+	activities := make([]models.StravaActivity, 0, len(summaries))
+	for _, sa := range summaries {
+		activities = append(activities, newStravaActivity(sa))
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&tempActivities); err != nil {
-		logrus.WithError(err).Errorf("FetchActivities() failed to decode response body")
-		return allActivities, err
-	}
+	return activities, nil
+}
 
-	// map the decoded json data to StravaActivity objects using the constructor
-	for _, ta := range tempActivities {
-		// this is just a really ugly grep
-		for _, sport := range sports {
-			if ta.Type == sport {
-				// returns a pointer
-				activity := models.NewStravaActivity(
-					ta.Id,
-					ta.Name,
-					ta.Distance,
-					ta.MovingTime,
-					ta.ElapsedTime,
-					ta.TotalElevationGain,
-					ta.Type,
-					ta.StartDate,
-					ta.Calories,
-					ta.AverageHeartRate,
-					ta.MaxHeartRate,
-				)
-				allActivities = append(allActivities, activity)
-			}
-		}
+// FetchActivity retrieves a single activity.
+func (t *Transport) FetchActivity(ctx context.Context, token *Token, id int64) (*models.StravaActivity, error) {
+	detail, err := t.strava.Activity(ctx, token, id)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to fetch activity %d", id)
+		return nil, err
 	}
 
-	return allActivities, nil
+	activity := newStravaActivity(detail.SummaryActivity)
+	return &activity, nil
 }
 
-// AuthGood sets the authenticated flag to true.
-func (t *Transport) AuthGood() {
-	if t.authenticated == true {
-		logrus.Warn("AuthGood called but already authenticated")
-		return
-	}
+// newStravaActivity converts strava's summary into our StravaActivity.
+func newStravaActivity(sa SummaryActivity) models.StravaActivity {
+	activity := models.NewStravaActivity(
+		sa.ID,
+		sa.Name,
+		sa.Distance,
+		sa.MovingTime,
+		sa.ElapsedTime,
+		sa.TotalElevationGain,
+		sa.Type,
+		sa.StartDate,
+		sa.Calories,
+		sa.AverageHeartRate,
+		sa.MaxHeartRate,
+	)
+	activity.DeviceWatts = sa.DeviceWatts
+	activity.WeightedAverageWatts = sa.WeightedAverageWatts
+	activity.Trainer = sa.Trainer
+	activity.StartLatLng = sa.StartLatLng
+	activity.SportType = sa.SportType
+	activity.TimeZone = zoneName(sa.Timezone)
+
+	return activity
+}
 
-	t.authenticated = true
+// zoneName returns the IANA name from strava's time zone, "(GMT-08:00) America/Los_Angeles".
+func zoneName(timezone string) string {
+	if i := strings.LastIndex(timezone, ") "); i >= 0 {
+		return timezone[i+2:]
+	}
+	return timezone
 }
 
-// AuthBad sets the authenticated flag to false.
-func (t *Transport) AuthBad() {
-	// github issue #1, this needs to push out to the reauth flow
+// streamKeys are the streams we ask strava for. not every activity has every stream.
+var streamKeys = []string{"time", "heartrate", "moving", "velocity_smooth", "watts", "cadence", "altitude", "distance", "grade_smooth", "latlng"}
 
-	if t.authenticated == false {
-		logrus.Warn("AuthBad called but already unauthenticated")
-		return
+// FetchStreams retrieves the per-sample data streams for a single activity.
+func (t *Transport) FetchStreams(ctx context.Context, token *Token, id int64) (*models.Streams, error) {
+	raw, err := t.strava.Streams(ctx, token, id, streamKeys)
+	if err != nil {
+		logrus.WithError(err).Errorf("failed to fetch streams for activity %d", id)
+		return nil, err
 	}
 
-	t.authenticated = false
-}
+	streams := &models.Streams{}
+	targets := map[string]interface{}{
+		"time":            &streams.Time,
+		"heartrate":       &streams.HeartRate,
+		"moving":          &streams.Moving,
+		"velocity_smooth": &streams.Velocity,
+		"watts":           &streams.Watts,
+		"cadence":         &streams.Cadence,
+		"altitude":        &streams.Altitude,
+		"distance":        &streams.Distance,
+		"grade_smooth":    &streams.GradeSmooth,
+		"latlng":          &streams.LatLng,
+	}
+
+	for key, target := range targets {
+		stream, ok := raw[key]
+		if !ok {
+			continue
+		}
+		if err := json.Unmarshal(stream.Data, target); err != nil {
+			logrus.WithError(err).Errorf("FetchStreams() failed to decode %s stream", key)
+			return nil, err
+		}
+	}
 
-// Authenticated returns the authenticated flag.
-func (t *Transport) Authenticated() bool {
-	return t.authenticated
+	return streams, nil
 }
@@ -2,9 +2,16 @@ package transport_test
 
 import (
 	"atc/transport"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -109,16 +116,85 @@ func Test_GetConfig(t *testing.T) {
 	assert.NotNil(t, config)
 }
 
-// requires mocking http & strava:
-// func (t *Transport) ExchangeCodeForToken(code string) error {
-// func (t *Transport) GetAccessToken() string {
-// func (t *Transport) GetRefreshToken() string {
-// func (t *Transport) IsTokenExpired() bool {
-// func (t *Transport) RefreshAccessToken(refreshToken string) (string, error) {
-// func (t *Transport) FetchActivities(token string) ([]models.StravaActivity, error) {
+func TestFetchActivities(t *testing.T) {
+	// func (t *Transport) FetchActivities(ctx context.Context, token *Token, after time.Time, before time.Time) ([]models.StravaActivity, error) {
+	root := os.Getenv("ATC_ROOT")
+
+	configFileName := filepath.Join(root, "config/config.yml")
+	versionFileName := filepath.Join(root, "config/version.yml")
+	secretsFileName := filepath.Join(root, "config/secrets.yml")
+
+	after := time.Date(2024, time.June, 1, 0, 0, 0, 0, time.UTC)
+	before := time.Date(2024, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	// three pages of activities (newest first, the way strava likes it), then an empty page
+	pages := 0
+	strava := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v3/athlete/activities", r.URL.Path)
+		assert.Equal(t, strconv.FormatInt(after.Unix(), 10), r.URL.Query().Get("after"))
+		assert.Equal(t, strconv.FormatInt(before.Unix(), 10), r.URL.Query().Get("before"))
+
+		page, err := strconv.Atoi(r.URL.Query().Get("page"))
+		assert.Nil(t, err)
+		pages++
+
+		var activities []map[string]interface{}
+		if page <= 3 {
+			for i := 0; i < 2; i++ {
+				n := (3-page)*2 + (1 - i)
+				activities = append(activities, map[string]interface{}{
+					"id":         n,
+					"name":       fmt.Sprintf("activity %d", n),
+					"type":       []string{"Run", "Ride", "Swim"}[n%3],
+					"start_date": after.AddDate(0, 0, n).Format(time.RFC3339),
+				})
+			}
+			// and one we don't score, which comes back anyway
+			activities = append(activities, map[string]interface{}{
+				"id":         100 + page,
+				"type":       "Yoga",
+				"sport_type": "Yoga",
+				"start_date": after.Add(time.Duration(page) * time.Minute).Format(time.RFC3339),
+				"timezone":   "(GMT-08:00) America/Los_Angeles",
+			})
+		}
+
+		_ = json.NewEncoder(w).Encode(activities)
+	}))
+	defer strava.Close()
+
+	c, err := transport.LoadConfig(configFileName, versionFileName)
+	assert.Nil(t, err)
+	c.Strava.Url = strava.URL
+
+	backend, err := transport.NewTransport(c, secretsFileName)
+	assert.Nil(t, err)
+	token := &transport.Token{AthleteID: "123", AccessToken: "abc"}
+
+	// no token, no activities
+	_, err = backend.FetchActivities(context.Background(), nil, after, before)
+	assert.ErrorIs(t, err, transport.ErrNotAuthenticated)
+	assert.Equal(t, 0, pages)
+
+	activities, err := backend.FetchActivities(context.Background(), token, after, before)
+	assert.Nil(t, err)
+
+	// every page was walked, including the empty one at the end
+	assert.Equal(t, 4, pages)
+
+	// everything is there (the yoga too: what to do with it is up to the caller), oldest first
+	assert.Len(t, activities, 9)
+	var ids []int64
+	for _, activity := range activities {
+		ids = append(ids, activity.Id)
+	}
+	assert.Equal(t, []int64{0, 101, 102, 103, 1, 2, 3, 4, 5}, ids)
+	assert.Equal(t, "Yoga", activities[1].SportType)
+	assert.Equal(t, "America/Los_Angeles", activities[1].TimeZone)
+}
 
 // probably don't need to test this but maybe it makes sense for documentation
-// func (t *Transport) ExampleRequest(endpoint string) ([]byte, error) {
+// func (t *Transport) ExampleRequest(ctx context.Context, token *Token, endpoint string) ([]byte, error) {
 
 // requires mocking http & openai
 // func (t *Transport) OpenAIRequest(prompt string) (string, error) {
@@ -1,11 +1,16 @@
 package transport
 
 import (
+	"atc/models"
+	"atc/planning"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 	"os"
 )
 
+// DefaultHistoryDays is used when strava.history_days is not set in config.yml
+const DefaultHistoryDays = 120
+
 // Config struct to hold the configuration values from config.yml
 type Config struct {
 	Server struct {
@@ -15,18 +20,30 @@ type Config struct {
 
 	Strava struct {
 		Url string `yaml:"url"`
+
+		// how many days of history to pull in order to seed ctl. ctl has a 42 day
+		// time constant so anything under ~90 days will read low.
+		HistoryDays int `yaml:"history_days"`
 	} `yaml:"strava"`
 
+	// which of strava's sport types we score as what. these are added to (and override)
+	// models.DefaultSportMap.
+	Sports models.SportMap `yaml:"sports"`
+
+	// how hard training plans are allowed to push. anything left out is planning's default.
+	Planning planning.Settings `yaml:"planning"`
+
+	Store struct {
+		// where the on-disk store lives. relative paths are relative to $ATC_ROOT.
+		Path string `yaml:"path"`
+	} `yaml:"store"`
+
 	Athlete struct {
-		Run struct {
-			ThresholdHR float64 `yaml:"threshold_hr"`
-		} `yaml:"run"`
-		Swim struct {
-			ThresholdHR float64 `yaml:"threshold_hr"`
-		} `yaml:"swim"`
-		Bike struct {
-			ThresholdHR float64 `yaml:"threshold_hr"`
-		} `yaml:"bike"`
+		// IANA time zone name, e.g. America/Los_Angeles, used to decide which
+		// calendar day an activity belongs to
+		TimeZone string `yaml:"timezone"`
+
+		models.Thresholds `yaml:",inline"`
 	} `yaml:"athlete"`
 
 	Build struct {
@@ -69,6 +86,22 @@ func LoadConfig(configFileName string, versionFileName string) (*Config, error)
 
 	logrus.Info("Successfully loaded configuration")
 
+	if config.Strava.HistoryDays == 0 {
+		config.Strava.HistoryDays = DefaultHistoryDays
+	}
+
+	config.Planning = config.Planning.WithDefaults()
+	if err := config.Planning.Validate(); err != nil {
+		logrus.WithError(err).Fatal("Bad planning settings in config file")
+		return nil, err
+	}
+
+	config.Sports = config.Sports.Merge()
+	if err := config.Sports.Validate(); err != nil {
+		logrus.WithError(err).Fatal("Bad sports in config file")
+		return nil, err
+	}
+
 	// same as above, but for the version file
 	if versionFileName == "" {
 		versionFileName = "/app/config/version.yml"
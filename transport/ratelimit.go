@@ -0,0 +1,273 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// strava limits the whole app (not each athlete: everybody on a deployment shares one
+// budget) to so many requests every 15 minutes and so many a day, and tells us how much of
+// that we've used in the headers of every response. the 15 minute windows start on the
+// quarter hour and the daily one at midnight UTC.
+//
+// people looking at a page come first. background work (backfills, webhooks) leaves a slice
+// of each budget alone and waits for the next window rather than dip into it, while an
+// interactive request only waits if it's a short wait, and otherwise gets ErrRateLimited so
+// the page can be drawn from what we've already stored.
+
+// ErrRateLimited is returned when we're out of strava budget and the request can't wait.
+var ErrRateLimited = errors.New("strava rate limit reached")
+
+const (
+	// shortWindow is strava's short rate limit window.
+	shortWindow = 15 * time.Minute
+
+	// BackgroundReserve is the fraction of each budget that background requests leave for
+	// interactive ones.
+	BackgroundReserve = 0.2
+
+	// MaxInteractiveWait is the longest we'll make somebody looking at a page wait for budget.
+	MaxInteractiveWait = 5 * time.Second
+
+	// maxRateLimitRetries is how many 429s a single request will put up with.
+	maxRateLimitRetries = 3
+)
+
+// Priority says whether a request is for somebody who's waiting on it.
+type Priority int
+
+const (
+	PriorityInteractive Priority = iota
+	PriorityBackground
+)
+
+type priorityKey struct{}
+
+// WithPriority marks the requests made with ctx. Requests are interactive unless marked
+// otherwise.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// priorityOf returns the priority ctx was marked with.
+func priorityOf(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok {
+		return p
+	}
+	return PriorityInteractive
+}
+
+// Budget is where we are with strava's rate limits. Limits of zero mean strava hasn't told
+// us yet.
+type Budget struct {
+	ShortLimit int       `json:"short_limit"` // requests per 15 minutes
+	ShortUsage int       `json:"short_usage"`
+	DailyLimit int       `json:"daily_limit"` // requests per day
+	DailyUsage int       `json:"daily_usage"`
+	Updated    time.Time `json:"updated"`     // when we last heard from strava
+	RetryAfter time.Time `json:"retry_after"` // strava asked us to leave it alone until then
+}
+
+// ShortRemaining returns how many requests are left in this 15 minute window.
+func (b Budget) ShortRemaining() int {
+	return remaining(b.ShortLimit, b.ShortUsage)
+}
+
+// DailyRemaining returns how many requests are left today.
+func (b Budget) DailyRemaining() int {
+	return remaining(b.DailyLimit, b.DailyUsage)
+}
+
+func remaining(limit int, usage int) int {
+	if usage >= limit {
+		return 0
+	}
+	return limit - usage
+}
+
+// rateLimiter keeps track of the budget and makes requests wait their turn.
+type rateLimiter struct {
+	lock   sync.Mutex
+	budget Budget
+	now    func() time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{now: time.Now}
+}
+
+// Budget returns where we are with strava's rate limits right now.
+func (t *Transport) Budget() Budget {
+	return t.limiter.current()
+}
+
+// current returns the budget, with usage from windows that have since ended forgotten.
+func (l *rateLimiter) current() Budget {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.rollover()
+}
+
+// rollover does the work for current. the caller has the lock.
+func (l *rateLimiter) rollover() Budget {
+	now := l.now().UTC()
+
+	if l.budget.Updated.Before(now.Truncate(shortWindow)) {
+		l.budget.ShortUsage = 0
+	}
+	if l.budget.Updated.Before(startOfUTCDay(now)) {
+		l.budget.DailyUsage = 0
+	}
+
+	return l.budget
+}
+
+// delay returns how long a request of priority p has to wait before it can go, or an error
+// if it shouldn't wait at all.
+func (l *rateLimiter) delay(p Priority) (time.Duration, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	b := l.rollover()
+	now := l.now().UTC()
+
+	var wait time.Duration
+	if now.Before(b.RetryAfter) {
+		wait = b.RetryAfter.Sub(now)
+	}
+
+	shortReserve, dailyReserve := 0, 0
+	if p == PriorityBackground {
+		shortReserve = int(math.Ceil(float64(b.ShortLimit) * BackgroundReserve))
+		dailyReserve = int(math.Ceil(float64(b.DailyLimit) * BackgroundReserve))
+	}
+
+	if b.ShortLimit > 0 && b.ShortRemaining() <= shortReserve {
+		wait = maxDuration(wait, now.Truncate(shortWindow).Add(shortWindow).Sub(now))
+	}
+	if b.DailyLimit > 0 && b.DailyRemaining() <= dailyReserve {
+		wait = maxDuration(wait, startOfUTCDay(now).AddDate(0, 0, 1).Sub(now))
+	}
+
+	if p == PriorityInteractive && wait > MaxInteractiveWait {
+		return 0, fmt.Errorf("%w: next request in %s", ErrRateLimited, wait.Round(time.Second))
+	}
+
+	if wait == 0 {
+		// count the request now, so that requests in flight at the same time don't all
+		// think they have the last slot. strava's headers will put us straight.
+		l.budget.ShortUsage++
+		l.budget.DailyUsage++
+		l.budget.Updated = now
+	}
+
+	return wait, nil
+}
+
+// wait blocks until a request with ctx can go.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	p := priorityOf(ctx)
+
+	for {
+		d, err := l.delay(p)
+		if err != nil {
+			return err
+		}
+		if d == 0 {
+			return nil
+		}
+
+		logrus.Infof("Strava budget is low (%+v), waiting %s", l.current(), d.Round(time.Second))
+
+		timer := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// update records the budget strava reported in a response. If strava sends the read
+// limits as well (everything we do is a read), those are the ones that bite first.
+func (l *rateLimiter) update(h http.Header) {
+	limit, usage := h.Get("X-ReadRateLimit-Limit"), h.Get("X-ReadRateLimit-Usage")
+	if limit == "" || usage == "" {
+		limit, usage = h.Get("X-RateLimit-Limit"), h.Get("X-RateLimit-Usage")
+	}
+
+	shortLimit, dailyLimit, ok1 := parsePair(limit)
+	shortUsage, dailyUsage, ok2 := parsePair(usage)
+	if !ok1 || !ok2 {
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.budget.ShortLimit, l.budget.DailyLimit = shortLimit, dailyLimit
+	l.budget.ShortUsage, l.budget.DailyUsage = shortUsage, dailyUsage
+	l.budget.Updated = l.now().UTC()
+}
+
+// backoff records a 429. Strava says how long to back off for in Retry-After; if it
+// doesn't, we wait for the next 15 minute window.
+func (l *rateLimiter) backoff(h http.Header) time.Time {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.now().UTC()
+	until := now.Truncate(shortWindow).Add(shortWindow)
+
+	if after := h.Get("Retry-After"); after != "" {
+		if seconds, err := strconv.Atoi(after); err == nil {
+			until = now.Add(time.Duration(seconds) * time.Second)
+		} else if date, err := http.ParseTime(after); err == nil {
+			until = date
+		}
+	}
+
+	l.budget.RetryAfter = until
+	logrus.Warnf("Strava rate limited us, backing off until %s", until)
+
+	return until
+}
+
+// parsePair parses strava's "<15 minute>,<daily>" header values.
+func parsePair(value string) (int, int, bool) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+
+	short, err1 := strconv.Atoi(strings.TrimSpace(parts[0]))
+	daily, err2 := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err1 != nil || err2 != nil {
+		return 0, 0, false
+	}
+
+	return short, daily, true
+}
+
+func startOfUTCDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func maxDuration(a time.Duration, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
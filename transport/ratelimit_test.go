@@ -0,0 +1,113 @@
+package transport_test
+
+import (
+	"atc/transport"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// limitedBackend points a transport at a strava that answers with whatever handler says
+func limitedBackend(t *testing.T, handler http.HandlerFunc) (*transport.Transport, func()) {
+	root := os.Getenv("ATC_ROOT")
+
+	strava := httptest.NewServer(handler)
+
+	c, err := transport.LoadConfig(filepath.Join(root, "config/config.yml"), filepath.Join(root, "config/version.yml"))
+	assert.Nil(t, err)
+	c.Strava.Url = strava.URL
+
+	backend, err := transport.NewTransport(c, filepath.Join(root, "config/secrets.yml"))
+	assert.Nil(t, err)
+
+	return backend, strava.Close
+}
+
+// a token that's good for a while, so nothing gets refreshed
+func goodToken() *transport.Token {
+	return &transport.Token{AthleteID: "123", AccessToken: "abc", ExpiresAt: time.Now().Add(time.Hour)}
+}
+
+func TestBudget(t *testing.T) {
+	usage := "10,200"
+	backend, done := limitedBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Limit", "200,2000")
+		w.Header().Set("X-RateLimit-Usage", "20,300")
+		w.Header().Set("X-ReadRateLimit-Limit", "100,1000")
+		w.Header().Set("X-ReadRateLimit-Usage", usage)
+		_, _ = w.Write([]byte("{}"))
+	})
+	defer done()
+
+	// nothing until strava tells us
+	assert.Equal(t, 0, backend.Budget().ShortLimit)
+
+	_, err := backend.FetchStreams(context.Background(), goodToken(), 1)
+	assert.Nil(t, err)
+
+	// everything we do is a read, so the read limits are the ones we track
+	budget := backend.Budget()
+	assert.Equal(t, 100, budget.ShortLimit)
+	assert.Equal(t, 10, budget.ShortUsage)
+	assert.Equal(t, 1000, budget.DailyLimit)
+	assert.Equal(t, 200, budget.DailyUsage)
+	assert.Equal(t, 90, budget.ShortRemaining())
+	assert.Equal(t, 800, budget.DailyRemaining())
+
+	// close to the limit, people still get served
+	usage = "85,200"
+	_, err = backend.FetchStreams(context.Background(), goodToken(), 1)
+	assert.Nil(t, err)
+
+	// but background work leaves the rest of the window alone and waits for the next one
+	ctx, cancel := context.WithTimeout(transport.WithPriority(context.Background(), transport.PriorityBackground), 50*time.Millisecond)
+	defer cancel()
+	_, err = backend.FetchStreams(ctx, goodToken(), 1)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// out of requests for the day: nobody is going to wait until midnight for a page
+	usage = "10,1000"
+	_, err = backend.FetchStreams(context.Background(), goodToken(), 1)
+	assert.Nil(t, err)
+	_, err = backend.FetchStreams(context.Background(), goodToken(), 1)
+	assert.ErrorIs(t, err, transport.ErrRateLimited)
+}
+
+func TestRetryAfter(t *testing.T) {
+	requests := 0
+	retryAfter := "0"
+	backend, done := limitedBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", retryAfter)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte("{}"))
+	})
+	defer done()
+
+	// strava says go ahead right away, so we do
+	_, err := backend.FetchStreams(context.Background(), goodToken(), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, requests)
+
+	// strava says come back in an hour, which is too long for somebody waiting on a page
+	requests = 0
+	retryAfter = "3600"
+	_, err = backend.FetchStreams(context.Background(), goodToken(), 1)
+	assert.ErrorIs(t, err, transport.ErrRateLimited)
+	assert.Equal(t, 1, requests)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), backend.Budget().RetryAfter, time.Minute)
+
+	// and we leave it alone until then
+	_, err = backend.FetchStreams(context.Background(), goodToken(), 1)
+	assert.ErrorIs(t, err, transport.ErrRateLimited)
+	assert.Equal(t, 1, requests)
+}
@@ -0,0 +1,311 @@
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// every strava endpoint we use is listed here, with the oauth scope it needs. if you're
+// adding a call to strava, add the endpoint here and a method on StravaClient for it; if
+// strava moves something, this is the only place that has to change. "where do we use xyz?"
+// is a search for the Endpoint's name.
+
+// oauth scopes, see https://developers.strava.com/docs/authentication/
+const (
+	ScopeRead           = "read"             // public profile
+	ScopeProfileReadAll = "profile:read_all" // private profile bits, like heart rate zones
+	ScopeActivityRead   = "activity:read"    // activities the athlete can see
+)
+
+// Endpoint is one strava api endpoint. Path is relative to /api/v3 and may contain {id}.
+type Endpoint struct {
+	Name  string
+	Path  string
+	Scope string
+}
+
+var (
+	EndpointAthlete           = Endpoint{Name: "athlete", Path: "/athlete", Scope: ScopeRead}
+	EndpointAthleteZones      = Endpoint{Name: "athlete zones", Path: "/athlete/zones", Scope: ScopeProfileReadAll}
+	EndpointAthleteActivities = Endpoint{Name: "athlete activities", Path: "/athlete/activities", Scope: ScopeActivityRead}
+	EndpointActivity          = Endpoint{Name: "activity", Path: "/activities/{id}", Scope: ScopeActivityRead}
+	EndpointActivityStreams   = Endpoint{Name: "activity streams", Path: "/activities/{id}/streams", Scope: ScopeActivityRead}
+	EndpointActivityLaps      = Endpoint{Name: "activity laps", Path: "/activities/{id}/laps", Scope: ScopeActivityRead}
+)
+
+// Endpoints is every endpoint we use.
+var Endpoints = []Endpoint{
+	EndpointAthlete,
+	EndpointAthleteZones,
+	EndpointAthleteActivities,
+	EndpointActivity,
+	EndpointActivityStreams,
+	EndpointActivityLaps,
+}
+
+// RequiredScopes returns the scopes we have to ask for when an athlete logs in, which is
+// every scope any endpoint needs.
+func RequiredScopes() []string {
+	seen := make(map[string]bool)
+	var scopes []string
+	for _, e := range Endpoints {
+		if !seen[e.Scope] {
+			seen[e.Scope] = true
+			scopes = append(scopes, e.Scope)
+		}
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+//
+// what strava sends back. only the fields we use are here.
+//
+
+// DetailedAthlete is the athlete endpoint's response.
+type DetailedAthlete struct {
+	ID        int64     `json:"id"`
+	Username  *string   `json:"username"`
+	Firstname string    `json:"firstname"`
+	Lastname  string    `json:"lastname"`
+	City      string    `json:"city"`
+	State     string    `json:"state"`
+	Country   string    `json:"country"`
+	Sex       string    `json:"sex"`
+	Premium   bool      `json:"premium"`
+	Summit    bool      `json:"summit"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Profile   string    `json:"profile"`
+}
+
+// ZoneRange is one zone, in bpm or watts. Max is -1 for the top zone.
+type ZoneRange struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+// Zones is the athlete zones endpoint's response.
+type Zones struct {
+	HeartRate *struct {
+		CustomZones bool        `json:"custom_zones"`
+		Zones       []ZoneRange `json:"zones"`
+	} `json:"heart_rate"`
+	Power *struct {
+		Zones []ZoneRange `json:"zones"`
+	} `json:"power"`
+}
+
+// SummaryActivity is an activity as the athlete activities endpoint lists it.
+type SummaryActivity struct {
+	ID                   int64     `json:"id"`
+	Name                 string    `json:"name"`
+	Distance             float64   `json:"distance"`
+	MovingTime           int       `json:"moving_time"`
+	ElapsedTime          int       `json:"elapsed_time"`
+	TotalElevationGain   float64   `json:"total_elevation_gain"`
+	Type                 string    `json:"type"`
+	SportType            string    `json:"sport_type"`
+	StartDate            time.Time `json:"start_date"`
+	Calories             int       `json:"calories"`
+	AverageHeartRate     float64   `json:"average_heartrate"`
+	MaxHeartRate         float64   `json:"max_heartrate"`
+	DeviceWatts          bool      `json:"device_watts"`
+	WeightedAverageWatts float64   `json:"weighted_average_watts"`
+	Trainer              bool      `json:"trainer"`
+	StartLatLng          []float64 `json:"start_latlng"`
+	Timezone             string    `json:"timezone"` // e.g. "(GMT-08:00) America/Los_Angeles"
+}
+
+// DetailedActivity is the activity endpoint's response.
+type DetailedActivity struct {
+	SummaryActivity
+	Description string `json:"description"`
+	DeviceName  string `json:"device_name"`
+	Laps        []Lap  `json:"laps"`
+}
+
+// Lap is one lap of an activity.
+type Lap struct {
+	ID               int64     `json:"id"`
+	Name             string    `json:"name"`
+	LapIndex         int       `json:"lap_index"`
+	StartDate        time.Time `json:"start_date"`
+	ElapsedTime      int       `json:"elapsed_time"`
+	MovingTime       int       `json:"moving_time"`
+	Distance         float64   `json:"distance"`
+	AverageSpeed     float64   `json:"average_speed"`
+	AverageHeartRate float64   `json:"average_heartrate"`
+	AverageWatts     float64   `json:"average_watts"`
+	StartIndex       int       `json:"start_index"`
+	EndIndex         int       `json:"end_index"`
+}
+
+// StreamSet is the streams endpoint's response, keyed by stream type ("heartrate",
+// "watts", ...). Each stream's data is left for the caller to decode, because the types
+// differ (moving is booleans, latlng is pairs).
+type StreamSet map[string]struct {
+	Data json.RawMessage `json:"data"`
+}
+
+// ActivityListOptions narrows down the athlete activities endpoint. Zero values are left out.
+type ActivityListOptions struct {
+	After   time.Time
+	Before  time.Time
+	Page    int
+	PerPage int
+}
+
+//
+// the client
+//
+
+// StravaClient has one method per strava endpoint we use. Requests all go through the
+// transport's authenticated request path, so they're rate limited and refresh the token
+// as needed.
+type StravaClient struct {
+	baseURL   string
+	transport *Transport
+}
+
+// NewStravaClient creates a client for the strava at baseURL (https://www.strava.com, or
+// a test server).
+func NewStravaClient(t *Transport, baseURL string) *StravaClient {
+	return &StravaClient{baseURL: strings.TrimSuffix(baseURL, "/"), transport: t}
+}
+
+// Athlete returns the logged in athlete.
+func (c *StravaClient) Athlete(ctx context.Context, token *Token) (*DetailedAthlete, error) {
+	var athlete DetailedAthlete
+	if err := c.get(ctx, token, EndpointAthlete, 0, nil, &athlete); err != nil {
+		return nil, err
+	}
+	return &athlete, nil
+}
+
+// AthleteZones returns the logged in athlete's heart rate and power zones.
+func (c *StravaClient) AthleteZones(ctx context.Context, token *Token) (*Zones, error) {
+	var zones Zones
+	if err := c.get(ctx, token, EndpointAthleteZones, 0, nil, &zones); err != nil {
+		return nil, err
+	}
+	return &zones, nil
+}
+
+// AthleteActivities returns one page of the logged in athlete's activities.
+func (c *StravaClient) AthleteActivities(ctx context.Context, token *Token, opts ActivityListOptions) ([]SummaryActivity, error) {
+	query := url.Values{}
+	if !opts.After.IsZero() {
+		query.Set("after", strconv.FormatInt(opts.After.Unix(), 10))
+	}
+	if !opts.Before.IsZero() {
+		query.Set("before", strconv.FormatInt(opts.Before.Unix(), 10))
+	}
+	if opts.Page > 0 {
+		query.Set("page", strconv.Itoa(opts.Page))
+	}
+	if opts.PerPage > 0 {
+		query.Set("per_page", strconv.Itoa(opts.PerPage))
+	}
+
+	var activities []SummaryActivity
+	if err := c.get(ctx, token, EndpointAthleteActivities, 0, query, &activities); err != nil {
+		return nil, err
+	}
+	return activities, nil
+}
+
+// Activity returns a single activity, with its laps.
+func (c *StravaClient) Activity(ctx context.Context, token *Token, id int64) (*DetailedActivity, error) {
+	var activity DetailedActivity
+	if err := c.get(ctx, token, EndpointActivity, id, nil, &activity); err != nil {
+		return nil, err
+	}
+	return &activity, nil
+}
+
+// Streams returns the requested streams for an activity. Streams the activity doesn't have
+// are left out.
+func (c *StravaClient) Streams(ctx context.Context, token *Token, id int64, keys []string) (StreamSet, error) {
+	query := url.Values{}
+	query.Set("keys", strings.Join(keys, ","))
+	query.Set("key_by_type", "true")
+
+	var streams StreamSet
+	if err := c.get(ctx, token, EndpointActivityStreams, id, query, &streams); err != nil {
+		return nil, err
+	}
+	return streams, nil
+}
+
+// Laps returns an activity's laps.
+func (c *StravaClient) Laps(ctx context.Context, token *Token, id int64) ([]Lap, error) {
+	var laps []Lap
+	if err := c.get(ctx, token, EndpointActivityLaps, id, nil, &laps); err != nil {
+		return nil, err
+	}
+	return laps, nil
+}
+
+// endpointURL builds the url for an endpoint. id fills in {id}, if the endpoint has one.
+func (c *StravaClient) endpointURL(e Endpoint, id int64, query url.Values) string {
+	path := strings.ReplaceAll(e.Path, "{id}", strconv.FormatInt(id, 10))
+
+	u := c.baseURL + "/api/v3" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// get is the request builder every endpoint method uses: it GETs the endpoint on behalf of
+// the token's athlete and decodes the json response into v.
+func (c *StravaClient) get(ctx context.Context, token *Token, e Endpoint, id int64, query url.Values, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.endpointURL(e, id, query), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.transport.do(token, req)
+	if err != nil {
+		logrus.WithError(err).Errorf("strava %s request failed", e.Name)
+		return err
+	}
+
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			logrus.WithError(err).Error("failed to close response body")
+			return
+		}
+	}(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusUnauthorized {
+			logrus.Errorf("strava %s returned %s, does the athlete's token have the %s scope?", e.Name, resp.Status, e.Scope)
+		} else {
+			logrus.Errorf("strava %s returned %s", e.Name, resp.Status)
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("%w: strava %s returned %s", ErrNotFound, e.Name, resp.Status)
+		}
+		return fmt.Errorf("strava %s returned %s", e.Name, resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		logrus.WithError(err).Errorf("failed to decode strava %s response", e.Name)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package transport_test
+
+import (
+	"atc/transport"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEndpoints(t *testing.T) {
+	names := make(map[string]bool)
+	for _, e := range transport.Endpoints {
+		assert.NotEmpty(t, e.Name)
+		assert.True(t, strings.HasPrefix(e.Path, "/"), e.Name)
+		assert.NotEmpty(t, e.Scope, e.Name)
+
+		// names are what you search for, so they'd better be unique
+		assert.False(t, names[e.Name], e.Name)
+		names[e.Name] = true
+	}
+
+	// we ask for every scope we need, and nothing else
+	assert.Equal(t, []string{"activity:read", "profile:read_all", "read"}, transport.RequiredScopes())
+
+	backend, done := limitedBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	defer done()
+	assert.Contains(t, backend.GetAuthURL(), "scope=activity:read,profile:read_all,read")
+}
+
+func TestStravaClient(t *testing.T) {
+	var paths []string
+
+	strava := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+
+		// everybody uses the same auth
+		assert.Equal(t, "Bearer abc", r.Header.Get("Authorization"))
+		assert.Empty(t, r.URL.Query().Get("access_token"))
+
+		var response interface{}
+		switch r.URL.Path {
+		case "/api/v3/athlete":
+			response = map[string]interface{}{"id": 123, "firstname": "Jane"}
+		case "/api/v3/athlete/zones":
+			response = map[string]interface{}{"heart_rate": map[string]interface{}{"zones": []map[string]int{{"min": 0, "max": 120}, {"min": 120, "max": -1}}}}
+		case "/api/v3/athlete/activities":
+			assert.Equal(t, "2", r.URL.Query().Get("page"))
+			assert.Equal(t, "50", r.URL.Query().Get("per_page"))
+			assert.NotEmpty(t, r.URL.Query().Get("after"))
+			assert.Empty(t, r.URL.Query().Get("before"))
+			response = []map[string]interface{}{{"id": 7, "type": "Run", "sport_type": "TrailRun"}}
+		case "/api/v3/activities/7":
+			response = map[string]interface{}{"id": 7, "type": "Run", "laps": []map[string]interface{}{{"lap_index": 1}}}
+		case "/api/v3/activities/7/streams":
+			assert.Equal(t, "heartrate,watts", r.URL.Query().Get("keys"))
+			response = map[string]interface{}{"heartrate": map[string]interface{}{"data": []int{150, 151}}}
+		case "/api/v3/activities/7/laps":
+			response = []map[string]interface{}{{"lap_index": 1}, {"lap_index": 2}}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+	defer strava.Close()
+
+	// the transport's own client talks to somewhere else entirely
+	backend, done := limitedBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to %s", r.URL.Path)
+	})
+	defer done()
+
+	client := transport.NewStravaClient(backend, strava.URL+"/")
+	ctx := context.Background()
+	token := goodToken()
+
+	athlete, err := client.Athlete(ctx, token)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(123), athlete.ID)
+	assert.Equal(t, "Jane", athlete.Firstname)
+
+	zones, err := client.AthleteZones(ctx, token)
+	assert.Nil(t, err)
+	assert.Len(t, zones.HeartRate.Zones, 2)
+	assert.Equal(t, -1, zones.HeartRate.Zones[1].Max)
+	assert.Nil(t, zones.Power)
+
+	activities, err := client.AthleteActivities(ctx, token, transport.ActivityListOptions{After: time.Now().AddDate(0, 0, -7), Page: 2, PerPage: 50})
+	assert.Nil(t, err)
+	assert.Len(t, activities, 1)
+	assert.Equal(t, "TrailRun", activities[0].SportType)
+
+	activity, err := client.Activity(ctx, token, 7)
+	assert.Nil(t, err)
+	assert.Equal(t, "Run", activity.Type)
+	assert.Len(t, activity.Laps, 1)
+
+	streams, err := client.Streams(ctx, token, 7, []string{"heartrate", "watts"})
+	assert.Nil(t, err)
+	assert.Contains(t, streams, "heartrate")
+	assert.NotContains(t, streams, "watts")
+
+	laps, err := client.Laps(ctx, token, 7)
+	assert.Nil(t, err)
+	assert.Len(t, laps, 2)
+
+	// strava not knowing about something is an error
+	_, err = client.Activity(ctx, token, 8)
+	assert.NotNil(t, err)
+
+	assert.Equal(t, []string{
+		"/api/v3/athlete",
+		"/api/v3/athlete/zones",
+		"/api/v3/athlete/activities",
+		"/api/v3/activities/7",
+		"/api/v3/activities/7/streams",
+		"/api/v3/activities/7/laps",
+		"/api/v3/activities/8",
+	}, paths)
+}
@@ -0,0 +1,322 @@
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrNotAuthenticated is returned when a call that needs an athlete's token doesn't get one.
+	ErrNotAuthenticated = errors.New("not authenticated")
+
+	// ErrReauthRequired is returned when strava won't take the athlete's refresh token any
+	// more (they revoked access, or we lost the rotated one). The only fix is to send them
+	// back through /auth.
+	ErrReauthRequired = errors.New("strava rejected the token, the athlete needs to log in again")
+
+	// ErrNotFound is returned when strava says 404: the activity was deleted, or never
+	// belonged to the athlete.
+	ErrNotFound = errors.New("strava has no such thing")
+
+	// errTokenRejected is strava's oauth/token endpoint saying no, as opposed to not answering.
+	errTokenRejected = errors.New("token rejected")
+)
+
+// TokenRefreshMargin is how close to expiry a token has to be before we refresh it rather
+// than risk it expiring halfway through a sync.
+const TokenRefreshMargin = 5 * time.Minute
+
+// Token is one athlete's strava credentials. strava hands these out per athlete when they
+// log in, and everybody using the deployment has their own.
+type Token struct {
+	AthleteID    string    `json:"athlete_id"`
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// Valid returns true if there's an access token to use at all. It doesn't check whether
+// it has expired.
+func (tok *Token) Valid() bool {
+	return tok != nil && tok.AccessToken != ""
+}
+
+// Expired returns true if the access token has expired. A token with no expiry never does.
+func (tok *Token) Expired() bool {
+	return tok.ExpiresWithin(0)
+}
+
+// ExpiresWithin returns true if the access token expires in less than d.
+func (tok *Token) ExpiresWithin(d time.Duration) bool {
+	return !tok.ExpiresAt.IsZero() && time.Now().Add(d).After(tok.ExpiresAt)
+}
+
+// OnTokenRefresh sets a function to be called with every token we refresh. Strava rotates
+// refresh tokens, so if the new one isn't saved the athlete has to log in again.
+func (t *Transport) OnTokenRefresh(f func(token *Token) error) {
+	t.onTokenRefresh = f
+}
+
+// LoadTokensWith sets a function that returns the athlete's saved token. It's checked before
+// refreshing, so a token somebody else has already refreshed isn't refreshed again.
+func (t *Transport) LoadTokensWith(f func(athleteID string) (*Token, error)) {
+	t.loadToken = f
+}
+
+// do sends an authenticated request to strava on behalf of the token's athlete. Every call to
+// the api goes through here. the token is refreshed first if it's about to expire, and once
+// more (followed by a retry) if strava says 401 anyway. a refreshed token replaces the one
+// passed in, so the caller carries on with it. if strava won't refresh the token, or still
+// says 401 with a fresh one, you get ErrReauthRequired.
+func (t *Transport) do(token *Token, req *http.Request) (*http.Response, error) {
+	if !token.Valid() {
+		logrus.Warnf("%s called but not authenticated", req.URL.Path)
+		return nil, ErrNotAuthenticated
+	}
+
+	if token.ExpiresWithin(TokenRefreshMargin) {
+		if err := t.refresh(token); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := t.sendLimited(token, req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	logrus.Warnf("%s returned %s for athlete %s, refreshing token and trying again", req.URL.Path, resp.Status, token.AthleteID)
+
+	if err := t.refresh(token); err != nil {
+		return nil, err
+	}
+
+	resp, err = t.sendLimited(token, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		resp.Body.Close()
+		logrus.Errorf("%s still returned %s for athlete %s with a fresh token", req.URL.Path, resp.Status, token.AthleteID)
+		return nil, ErrReauthRequired
+	}
+
+	return resp, nil
+}
+
+// sendLimited sends the request when the rate limits say it can go, and tries again if
+// strava says 429 anyway.
+func (t *Transport) sendLimited(token *Token, req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if err := t.limiter.wait(req.Context()); err != nil {
+			return nil, err
+		}
+
+		resp, err := t.send(token, req)
+		if err != nil {
+			return nil, err
+		}
+
+		t.limiter.update(resp.Header)
+		if resp.StatusCode != http.StatusTooManyRequests {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		t.limiter.backoff(resp.Header)
+		if attempt >= maxRateLimitRetries {
+			return nil, ErrRateLimited
+		}
+	}
+}
+
+// send makes one attempt at the request with the token's access token.
+func (t *Transport) send(token *Token, req *http.Request) (*http.Response, error) {
+	attempt := req.Clone(req.Context())
+	attempt.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+	return t.httpClient.Do(attempt)
+}
+
+// refresh replaces token with a refreshed one and hands it to the OnTokenRefresh hook.
+func (t *Transport) refresh(token *Token) error {
+	// strava rotates the refresh token every time it's used, so when two requests for the same
+	// athlete both need a refresh, the second one has to use what the first one got rather
+	// than the refresh token that was just rotated away. they take turns, and whoever goes
+	// second picks up the saved token instead of refreshing again. other athletes don't wait.
+	lock := t.refreshLockFor(token.AthleteID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if t.loadToken != nil {
+		saved, err := t.loadToken(token.AthleteID)
+		switch {
+		case err != nil:
+			logrus.WithError(err).Warnf("Failed to load saved token for athlete %s, refreshing the one we have", token.AthleteID)
+		case saved.Valid() && saved.AccessToken != token.AccessToken:
+			*token = *saved
+			if !token.ExpiresWithin(TokenRefreshMargin) {
+				logrus.Infof("Token for athlete %s was already refreshed, good until %s", token.AthleteID, token.ExpiresAt)
+				return nil
+			}
+		}
+	}
+
+	refreshed, err := t.RefreshAccessToken(token)
+	if errors.Is(err, errTokenRejected) || errors.Is(err, ErrNotAuthenticated) {
+		return ErrReauthRequired
+	}
+	if err != nil {
+		return err
+	}
+
+	*token = *refreshed
+	logrus.Infof("Refreshed token for athlete %s, good until %s", token.AthleteID, token.ExpiresAt)
+
+	if t.onTokenRefresh != nil {
+		if err := t.onTokenRefresh(token); err != nil {
+			// we can carry on with this request, but the next one will need a new login
+			logrus.WithError(err).Errorf("Failed to save refreshed token for athlete %s", token.AthleteID)
+		}
+	}
+
+	return nil
+}
+
+// refreshLockFor returns the lock for refreshing athleteID's token.
+func (t *Transport) refreshLockFor(athleteID string) *sync.Mutex {
+	t.refreshLocksLock.Lock()
+	defer t.refreshLocksLock.Unlock()
+
+	lock, ok := t.refreshLocks[athleteID]
+	if !ok {
+		lock = &sync.Mutex{}
+		t.refreshLocks[athleteID] = lock
+	}
+	return lock
+}
+
+// tokenResponse is what strava's oauth/token endpoint returns. the athlete is only there
+// when a code is exchanged, not when a token is refreshed.
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresAt    int64  `json:"expires_at"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Athlete      *struct {
+		ID int64 `json:"id"`
+	} `json:"athlete"`
+	Message string `json:"message"`
+}
+
+// ExchangeCodeForToken exchanges the authorization code from the oauth callback for the
+// athlete's token.
+func (t *Transport) ExchangeCodeForToken(code string) (*Token, error) {
+	result, err := t.postToken(url.Values{
+		"client_id":     {t.clientID},
+		"client_secret": {t.clientSecret},
+		"code":          {code},
+		"grant_type":    {"authorization_code"},
+		"redirect_uri":  {t.redirectURI},
+	})
+	if err != nil {
+		logrus.WithError(err).Error("Failed to exchange code for token")
+		return nil, err
+	}
+
+	token := result.token()
+	if result.Athlete != nil {
+		token.AthleteID = fmt.Sprintf("%d", result.Athlete.ID)
+	}
+
+	return token, nil
+}
+
+// RefreshAccessToken uses the refresh token to obtain a new token for the same athlete.
+// Strava may rotate the refresh token too, so the old token shouldn't be used again.
+func (t *Transport) RefreshAccessToken(token *Token) (*Token, error) {
+	if token == nil || token.RefreshToken == "" {
+		return nil, ErrNotAuthenticated
+	}
+
+	result, err := t.postToken(url.Values{
+		"client_id":     {t.clientID},
+		"client_secret": {t.clientSecret},
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {token.RefreshToken},
+	})
+	if err != nil {
+		logrus.WithError(err).Errorf("Failed to refresh token for athlete %s", token.AthleteID)
+		return nil, err
+	}
+
+	refreshed := result.token()
+	refreshed.AthleteID = token.AthleteID
+	if refreshed.RefreshToken == "" {
+		refreshed.RefreshToken = token.RefreshToken
+	}
+
+	return refreshed, nil
+}
+
+// postToken posts to strava's oauth/token endpoint and decodes the answer.
+func (t *Transport) postToken(data url.Values) (*tokenResponse, error) {
+	resp, err := t.httpClient.PostForm(fmt.Sprintf("%s/oauth/token", t.url), data)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// errors come back as json too, but only an ok response has to
+	var result tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil && resp.StatusCode == http.StatusOK {
+		logrus.WithError(err).Error("Failed to decode response body")
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnauthorized:
+		logrus.WithField("message", result.Message).Errorf("oauth/token returned %s", resp.Status)
+		return nil, fmt.Errorf("%w: strava returned %s", errTokenRejected, resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		logrus.WithField("message", result.Message).Errorf("oauth/token returned %s", resp.Status)
+		return nil, fmt.Errorf("strava returned %s", resp.Status)
+	}
+
+	if result.AccessToken == "" {
+		return nil, fmt.Errorf("failed to retrieve access token")
+	}
+
+	if result.RefreshToken == "" {
+		logrus.Warn("No refresh token in response")
+	}
+
+	return &result, nil
+}
+
+// token converts the response into a Token, without the athlete.
+func (r *tokenResponse) token() *Token {
+	token := &Token{
+		AccessToken:  r.AccessToken,
+		RefreshToken: r.RefreshToken,
+	}
+
+	switch {
+	case r.ExpiresAt > 0:
+		token.ExpiresAt = time.Unix(r.ExpiresAt, 0)
+	case r.ExpiresIn > 0:
+		token.ExpiresAt = time.Now().Add(time.Duration(r.ExpiresIn) * time.Second)
+	default:
+		logrus.Info("Strange or missing expiry data in response")
+	}
+
+	return token
+}
@@ -0,0 +1,213 @@
+package transport_test
+
+import (
+	"atc/transport"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExchangeCodeForToken(t *testing.T) {
+	configFileName := "config/config.yml"
+	versionFileName := "config/version.yml"
+	secretsFileName := "config/secrets.yml"
+
+	root := os.Getenv("ATC_ROOT")
+
+	configFileName = filepath.Join(root, configFileName)
+	versionFileName = filepath.Join(root, versionFileName)
+	secretsFileName = filepath.Join(root, secretsFileName)
+
+	expires := time.Now().Add(6 * time.Hour).Truncate(time.Second)
+
+	strava := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/oauth/token", r.URL.Path)
+		assert.Nil(t, r.ParseForm())
+
+		response := map[string]interface{}{
+			"access_token": "access-" + r.Form.Get("grant_type"),
+			"expires_at":   expires.Unix(),
+		}
+
+		switch r.Form.Get("grant_type") {
+		case "authorization_code":
+			if r.Form.Get("code") != "good" {
+				w.WriteHeader(http.StatusBadRequest)
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{"message": "Bad Request"})
+				return
+			}
+			// only the exchange tells us who the athlete is
+			response["refresh_token"] = "refresh-1"
+			response["athlete"] = map[string]interface{}{"id": 12345}
+		case "refresh_token":
+			assert.Equal(t, "refresh-1", r.Form.Get("refresh_token"))
+			response["refresh_token"] = "refresh-2"
+		}
+
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+	defer strava.Close()
+
+	c, err := transport.LoadConfig(configFileName, versionFileName)
+	assert.Nil(t, err)
+	c.Strava.Url = strava.URL
+
+	backend, err := transport.NewTransport(c, secretsFileName)
+	assert.Nil(t, err)
+
+	_, err = backend.ExchangeCodeForToken("bad")
+	assert.NotNil(t, err)
+
+	token, err := backend.ExchangeCodeForToken("good")
+	assert.Nil(t, err)
+	assert.Equal(t, "12345", token.AthleteID)
+	assert.Equal(t, "access-authorization_code", token.AccessToken)
+	assert.Equal(t, "refresh-1", token.RefreshToken)
+	assert.True(t, token.ExpiresAt.Equal(expires))
+	assert.True(t, token.Valid())
+	assert.False(t, token.Expired())
+
+	// the refreshed token belongs to the same athlete and has the rotated refresh token
+	refreshed, err := backend.RefreshAccessToken(token)
+	assert.Nil(t, err)
+	assert.Equal(t, "12345", refreshed.AthleteID)
+	assert.Equal(t, "access-refresh_token", refreshed.AccessToken)
+	assert.Equal(t, "refresh-2", refreshed.RefreshToken)
+}
+
+// fakeOAuth is a strava that hands out numbered access tokens and only accepts the latest one
+type fakeOAuth struct {
+	issued       int
+	refreshes    int
+	rejectTokens bool // refresh tokens are no good any more
+	always401    bool // and neither is anything else
+}
+
+func (f *fakeOAuth) server(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/oauth/token" {
+			f.refreshes++
+			if f.rejectTokens {
+				w.WriteHeader(http.StatusBadRequest)
+				_ = json.NewEncoder(w).Encode(map[string]interface{}{"message": "Bad Request"})
+				return
+			}
+			f.issued++
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token":  "access-" + strconv.Itoa(f.issued),
+				"refresh_token": "refresh-" + strconv.Itoa(f.issued),
+				"expires_at":    time.Now().Add(6 * time.Hour).Unix(),
+			})
+			return
+		}
+
+		if f.always401 || r.Header.Get("Authorization") != "Bearer access-"+strconv.Itoa(f.issued) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"heartrate": map[string]interface{}{"data": []int{150, 151}},
+		})
+	}))
+}
+
+func TestTokenRefresh(t *testing.T) {
+	configFileName := "config/config.yml"
+	versionFileName := "config/version.yml"
+	secretsFileName := "config/secrets.yml"
+
+	root := os.Getenv("ATC_ROOT")
+
+	configFileName = filepath.Join(root, configFileName)
+	versionFileName = filepath.Join(root, versionFileName)
+	secretsFileName = filepath.Join(root, secretsFileName)
+
+	oauth := &fakeOAuth{}
+	strava := oauth.server(t)
+	defer strava.Close()
+
+	c, err := transport.LoadConfig(configFileName, versionFileName)
+	assert.Nil(t, err)
+	c.Strava.Url = strava.URL
+
+	backend, err := transport.NewTransport(c, secretsFileName)
+	assert.Nil(t, err)
+
+	var saved []transport.Token
+	backend.OnTokenRefresh(func(token *transport.Token) error {
+		saved = append(saved, *token)
+		return nil
+	})
+
+	// a good token just works
+	oauth.issued = 1
+	token := &transport.Token{AthleteID: "123", AccessToken: "access-1", RefreshToken: "refresh-1", ExpiresAt: time.Now().Add(time.Hour)}
+	streams, err := backend.FetchStreams(context.Background(), token, 1)
+	assert.Nil(t, err)
+	assert.Len(t, streams.HeartRate, 2)
+	assert.Equal(t, 0, oauth.refreshes)
+
+	// one that's about to expire is refreshed before it's used, and the new one is saved
+	token.ExpiresAt = time.Now().Add(time.Minute)
+	_, err = backend.FetchStreams(context.Background(), token, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, oauth.refreshes)
+	assert.Equal(t, "access-2", token.AccessToken)
+	assert.Equal(t, "refresh-2", token.RefreshToken)
+	assert.Len(t, saved, 1)
+	assert.Equal(t, "123", saved[0].AthleteID)
+	assert.Equal(t, "refresh-2", saved[0].RefreshToken)
+
+	// strava says 401 to a token we thought was fine: refresh and try again
+	oauth.issued = 5
+	_, err = backend.FetchStreams(context.Background(), token, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, oauth.refreshes)
+	assert.Equal(t, "access-6", token.AccessToken)
+
+	// a fresh token that still gets a 401 means the athlete has to come back through /auth
+	oauth.always401 = true
+	_, err = backend.FetchStreams(context.Background(), token, 1)
+	assert.ErrorIs(t, err, transport.ErrReauthRequired)
+	assert.Equal(t, 3, oauth.refreshes)
+
+	// and so does strava refusing to refresh
+	oauth.always401 = false
+	oauth.rejectTokens = true
+	token.ExpiresAt = time.Now()
+	_, err = backend.FetchStreams(context.Background(), token, 1)
+	assert.ErrorIs(t, err, transport.ErrReauthRequired)
+
+	// two requests with the same stale token: the first refreshes it, and the second one picks
+	// up what the first one saved rather than refreshing (with a rotated refresh token) again
+	oauth.rejectTokens = false
+	oauth.issued = 10
+	saved = []transport.Token{{AthleteID: "123", AccessToken: "access-10", RefreshToken: "refresh-10", ExpiresAt: time.Now()}}
+	backend.LoadTokensWith(func(athleteID string) (*transport.Token, error) {
+		latest := saved[len(saved)-1]
+		return &latest, nil
+	})
+
+	refreshes := oauth.refreshes
+	errs := make(chan error)
+	for i := 0; i < 2; i++ {
+		stale := saved[0]
+		go func() {
+			_, err := backend.FetchStreams(context.Background(), &stale, 1)
+			errs <- err
+		}()
+	}
+	assert.Nil(t, <-errs)
+	assert.Nil(t, <-errs)
+	assert.Equal(t, refreshes+1, oauth.refreshes)
+	assert.Len(t, saved, 2)
+}
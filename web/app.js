@@ -3,8 +3,14 @@
     const wasmModule = await WebAssembly.instantiateStreaming(fetch("app.wasm"), go.importObject);
     go.run(wasmModule.instance);
 
-    // Assuming Go will provide the activities via a function called getActivities
-    const activities = getActivities();
+    // the activities come from the json api, which answers 401 if nobody's logged in
+    const response = await fetch("/api/v1/activities");
+    if (response.status === 401) {
+        window.location.href = "/auth";
+        return;
+    }
+
+    const { activities } = await response.json();
 
     const table = document.getElementById("activities-table");
 
@@ -14,8 +20,8 @@
         const durationCell = row.insertCell(1);
         const tssCell = row.insertCell(2);
 
-        typeCell.innerHTML = activity.type;
-        durationCell.innerHTML = Math.round(activity.movingTime / 60);
-        tssCell.innerHTML = activity.tss.toFixed(2);
+        typeCell.textContent = activity.discipline;
+        durationCell.textContent = Math.round(activity.moving_time / 60);
+        tssCell.textContent = activity.tss.toFixed(2);
     });
-})();
\ No newline at end of file
+})();